@@ -2,42 +2,984 @@ package root
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/canonical/cos-tool/pkg/lsp"
+	"github.com/canonical/cos-tool/pkg/project"
+	"github.com/canonical/cos-tool/pkg/proxy"
+	"github.com/canonical/cos-tool/pkg/server"
 	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/canonical/cos-tool/pkg/transformer"
 	cli "github.com/urfave/cli/v2"
+	yaml "gopkg.in/yaml.v3"
 )
 
 // Define a private, unique key type
 type contextKey string
 
-const implKey contextKey = "impl"
+const (
+	implKey    contextKey = "impl"
+	projectKey contextKey = "project"
+)
+
+var (
+	labelMatcherFlag = &cli.StringSliceFlag{
+		Name:  "label-matcher",
+		Usage: "Label matcher to inject into all vector selectors",
+	}
+	topologyFlag = &cli.StringFlag{
+		Name:  "topology",
+		Usage: "Juju topology as JSON, e.g. `{\"model\": ..., \"model_uuid\": ..., \"application\": ..., \"unit\": ...}`",
+	}
+	topologyFromEnvFlag = &cli.BoolFlag{
+		Name:  "topology-from-env",
+		Usage: "Read the Juju topology from JUJU_MODEL_NAME, JUJU_MODEL_UUID and JUJU_UNIT_NAME",
+	}
+	omitUnitFlag = &cli.BoolFlag{
+		Name:  "omit-unit",
+		Usage: "Leave juju_unit out of the topology matchers, for application-level rules",
+	}
+	injectionRulesFlag = &cli.StringFlag{
+		Name:  "injection-rules",
+		Usage: "YAML `file` of rules scoping which selectors get which label matchers",
+	}
+	varFlag = &cli.GenericFlag{
+		Name:  "var",
+		Value: &repeatedValue{},
+		Usage: "Grafana template variable value as `name=value`, repeat a name for multi-value variables",
+	}
+	labelFlag = &cli.StringSliceFlag{
+		Name:  "label",
+		Usage: "Label `name` whose matchers to strip, a trailing * matches a prefix; defaults to juju_*",
+	}
+	mappingFlag = &cli.StringFlag{
+		Name:     "mapping",
+		Required: true,
+		Usage:    "YAML `file` mapping old metric and label names to new ones",
+	}
+	outputFlag = &cli.StringFlag{
+		Name:    "output",
+		Aliases: []string{"o"},
+		Value:   "table",
+		Usage:   "Output format, `table|json`",
+	}
+	validateOutputFlag = &cli.StringFlag{
+		Name:    "output",
+		Aliases: []string{"o"},
+		Value:   "text",
+		Usage:   "Output format, `text|json|sarif|junit`",
+	}
+	checkFlag = &cli.BoolFlag{
+		Name:  "check",
+		Usage: "Print a diff and exit non-zero if the output differs from the input, instead of printing the output",
+	}
+	metricsFlag = &cli.StringFlag{
+		Name:  "metrics",
+		Usage: "Exposition dump or list of metric and label names `file` to check rule selectors against",
+	}
+	targetLabelFlag = &cli.StringSliceFlag{
+		Name:  "target-label",
+		Usage: "Label `name` added at scrape time, a trailing * matches a prefix; defaults to job, instance and juju_*",
+	}
+	policyFlag = &cli.StringFlag{
+		Name:  "policy",
+		Usage: "Policy `file` declaring the labels, annotations, names and functions rules must have or use",
+	}
+	snapshotFlag = &cli.StringSliceFlag{
+		Name:     "metrics",
+		Required: true,
+		Usage:    "Text exposition snapshot `file`, e.g. a curl of /metrics; repeat for snapshots taken --interval apart, oldest first",
+	}
+	timeFlag = &cli.StringFlag{
+		Name:  "time",
+		Usage: "Evaluation `time` as RFC3339 or Unix seconds; defaults to the latest sample timestamp of the snapshots, or now",
+	}
+	intervalFlag = &cli.DurationFlag{
+		Name:  "interval",
+		Value: time.Minute,
+		Usage: "Interval between rule evaluations, unless set by their group, and between snapshots without timestamps",
+	}
+	groupIntervalFlag = &cli.DurationFlag{
+		Name:  "interval",
+		Value: time.Minute,
+		Usage: "Interval between rule evaluations, unless set by their group",
+	}
+	timingFlag = &cli.BoolFlag{
+		Name:  "timing",
+		Usage: "Check the interval, for, ranges, subquery steps and offsets of rules against the --scrape-interval and evaluation --interval",
+	}
+	scrapeIntervalFlag = &cli.DurationFlag{
+		Name:  "scrape-interval",
+		Value: time.Minute,
+		Usage: "Interval between scrapes of the metrics selected by rules, 0 if unknown",
+	}
+	startFlag = &cli.StringFlag{
+		Name:     "start",
+		Required: true,
+		Usage:    "Start `time` as RFC3339 or Unix seconds",
+	}
+	endFlag = &cli.StringFlag{
+		Name:     "end",
+		Required: true,
+		Usage:    "End `time` as RFC3339 or Unix seconds",
+	}
+	sandboxDirRootFlag = &cli.StringFlag{
+		Name:  "sandbox-dir-root",
+		Usage: "`Directory` in which to replay the write-ahead log, removed afterwards; defaults to a temporary directory",
+	}
+	listenAddressFlag = &cli.StringFlag{
+		Name:  "listen-address",
+		Value: "localhost:8080",
+		Usage: "`Address` to listen on",
+	}
+	maxRequestBytesFlag = &cli.Int64Flag{
+		Name:  "max-request-bytes",
+		Value: server.DefaultMaxRequestBytes,
+		Usage: "Maximum size of request bodies",
+	}
+	shutdownTimeoutFlag = &cli.DurationFlag{
+		Name:  "shutdown-timeout",
+		Value: 30 * time.Second,
+		Usage: "Time to wait for in-flight requests on SIGINT or SIGTERM",
+	}
+	upstreamFlag = &cli.StringFlag{
+		Name:     "upstream",
+		Usage:    "`URL` of the Prometheus or Loki server",
+		Required: true,
+	}
+	tenantHeaderFlag = &cli.StringFlag{
+		Name:  "tenant-header",
+		Usage: "`Header` holding comma-separated label=value matchers to enforce on each request",
+	}
+	allValueFlag = &cli.StringFlag{
+		Name:  "all-value",
+		Value: ".*",
+		Usage: "Value substituted for variables set to $__all",
+	}
+)
+
+var app = &cli.App{
+	Name:            "cos-tool",
+	Usage:           "Validates Prometheus and Loki expressions, adds Juju Topology to label matchers",
+	HideHelpCommand: false,
+	HideHelp:        false,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Value:   "promql",
+			Usage:   "Inject expressions into `promql|logql`",
+		},
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "Project configuration `file`; defaults to the closest " + project.FileName + " from the working directory up",
+		},
+		&cli.BoolFlag{
+			Name:  "no-config",
+			Usage: "Ignore the project configuration file",
+		},
+	},
+	Commands: []*cli.Command{
+		{
+			Name:    "transform",
+			Aliases: []string{"t"},
+			Flags: []cli.Flag{
+				labelMatcherFlag,
+				topologyFlag,
+				topologyFromEnvFlag,
+				omitUnitFlag,
+				injectionRulesFlag,
+				varFlag,
+				allValueFlag,
+				checkFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() != 1 {
+					log.Fatal("Expected exactly one argument: the expression.")
+				}
+
+				inj, err := labelMatchers(c)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				vars, err := tool.GetGrafanaVariables(*c.Generic("var").(*repeatedValue), c.String("all-value"))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				t, err := newTransformer(c, transformer.WithLabelMatchers(inj), transformer.WithVariables(vars))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				result, err := t.Transform(c.Context, args.First())
+				if err != nil {
+					return err
+				}
+
+				// The output is checked against the expression as interpolated by --var
+				input, err := vars.Interpolate(args.First())
+				if err != nil {
+					return err
+				}
+				return printOrCheck(c, "expression", input, result.Output)
+			},
+		},
+		{
+			Name:  "transform-rules",
+			Usage: "Inject label matchers into a rule file's expressions, alert labels and group names",
+			Flags: []cli.Flag{
+				labelMatcherFlag,
+				topologyFlag,
+				topologyFromEnvFlag,
+				omitUnitFlag,
+				injectionRulesFlag,
+				&cli.StringFlag{
+					Name:  "group-name-template",
+					Usage: "Go template for group names, using the matchers and .group; defaults to the COS convention when a topology is given",
+				},
+				checkFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() != 1 {
+					log.Fatal("Expected exactly one argument: the rule file.")
+				}
+
+				inj, err := labelMatchers(c)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				groupNameTemplate := c.String("group-name-template")
+				if !c.IsSet("group-name-template") && hasTopology(c) {
+					groupNameTemplate = tool.DefaultGroupNameTemplate
+				}
+
+				data, err := os.ReadFile(args.First())
+				if err != nil {
+					return err
+				}
+
+				t, err := newTransformer(c,
+					transformer.WithFormat(transformerFormat(checkerFor(c, args.First()))),
+					transformer.WithLabelMatchers(inj),
+					transformer.WithGroupNameTemplate(groupNameTemplate),
+				)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				result, err := t.TransformRules(c.Context, args.First(), data)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+
+				return printOrCheck(c, args.First(), string(data), result.Output)
+			},
+		},
+		{
+			Name:  "transform-dashboard",
+			Usage: "Inject label matchers into a dashboard's targets and variable queries",
+			Flags: []cli.Flag{
+				labelMatcherFlag,
+				topologyFlag,
+				topologyFromEnvFlag,
+				omitUnitFlag,
+				injectionRulesFlag,
+				checkFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() != 1 {
+					log.Fatal("Expected exactly one argument: the dashboard file.")
+				}
+
+				inj, err := labelMatchers(c)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				data, err := os.ReadFile(args.First())
+				if err != nil {
+					return err
+				}
+
+				// Targets are PromQL or LogQL depending on their data source, whatever --format says
+				t, err := newTransformer(c, transformer.WithLabelMatchers(inj))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				result, err := t.TransformDashboard(c.Context, args.First(), data)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+
+				return printOrCheck(c, args.First(), string(data), result.Output)
+			},
+		},
+		{
+			Name:  "untransform",
+			Usage: "Strip injected label matchers from an expression",
+			Flags: []cli.Flag{
+				labelFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() != 1 {
+					log.Fatal("Expected exactly one argument: the expression.")
+				}
+
+				checker := c.Context.Value(implKey).(tool.Checker)
+				output, err := tool.Untransform(checker, args.First(), c.StringSlice("label"))
+				if err != nil {
+					return err
+				}
+
+				fmt.Print(output)
+				return nil
+			},
+		},
+		{
+			Name:  "untransform-rules",
+			Usage: "Strip injected label matchers from a rule file's expressions and alert labels",
+			Flags: []cli.Flag{
+				labelFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() != 1 {
+					log.Fatal("Expected exactly one argument: the rule file.")
+				}
+
+				data, err := os.ReadFile(args.First())
+				if err != nil {
+					return err
+				}
+
+				transformer := checkerFor(c, args.First())
+				output, err := tool.UntransformRules(transformer, args.First(), data, c.StringSlice("label"))
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+
+				fmt.Print(string(output))
+				return nil
+			},
+		},
+		{
+			Name:  "untransform-dashboard",
+			Usage: "Strip injected label matchers from a dashboard's targets and variable queries",
+			Flags: []cli.Flag{
+				labelFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() != 1 {
+					log.Fatal("Expected exactly one argument: the dashboard file.")
+				}
+
+				data, err := os.ReadFile(args.First())
+				if err != nil {
+					return err
+				}
+
+				labels := c.StringSlice("label")
+				output, err := tool.RewriteDashboard(args.First(), data, func(expr string, logql bool) (string, error) {
+					if logql {
+						return tool.Untransform(&tool.LogQL{}, expr, labels)
+					}
+					return tool.Untransform(&tool.PromQL{}, expr, labels)
+				})
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+
+				fmt.Print(string(output))
+				return nil
+			},
+		},
+		{
+			Name:  "rename",
+			Usage: "Rename metrics and labels in an expression",
+			Flags: []cli.Flag{
+				mappingFlag,
+				checkFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() != 1 {
+					log.Fatal("Expected exactly one argument: the expression.")
+				}
+
+				renames, err := loadRenames(c)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				checker := c.Context.Value(implKey).(tool.Checker)
+				output, err := tool.Rename(checker, args.First(), renames)
+				if err != nil {
+					return err
+				}
+
+				return printOrCheck(c, "expression", args.First(), output)
+			},
+		},
+		{
+			Name:  "rename-rules",
+			Usage: "Rename metrics and labels in a rule file's expressions, recording rules, labels and annotations",
+			Flags: []cli.Flag{
+				mappingFlag,
+				checkFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() != 1 {
+					log.Fatal("Expected exactly one argument: the rule file.")
+				}
+
+				renames, err := loadRenames(c)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				data, err := os.ReadFile(args.First())
+				if err != nil {
+					return err
+				}
+
+				transformer := checkerFor(c, args.First())
+				output, err := tool.RenameRules(transformer, args.First(), data, renames)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+
+				return printOrCheck(c, args.First(), string(data), string(output))
+			},
+		},
+		{
+			Name:  "rename-dashboard",
+			Usage: "Rename metrics and labels in a dashboard's targets and variable queries",
+			Flags: []cli.Flag{
+				mappingFlag,
+				checkFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() != 1 {
+					log.Fatal("Expected exactly one argument: the dashboard file.")
+				}
+
+				renames, err := loadRenames(c)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				data, err := os.ReadFile(args.First())
+				if err != nil {
+					return err
+				}
+
+				output, err := tool.RewriteDashboard(args.First(), data, func(expr string, logql bool) (string, error) {
+					if logql {
+						return tool.Rename(&tool.LogQL{}, expr, renames)
+					}
+					return tool.Rename(&tool.PromQL{}, expr, renames)
+				})
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+
+				return printOrCheck(c, args.First(), string(data), string(output))
+			},
+		},
+		{
+			Name:  "analyze",
+			Usage: "List the metrics, matchers, functions, ranges, offsets and output labels of an expression",
+			Flags: []cli.Flag{
+				outputFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() != 1 {
+					log.Fatal("Expected exactly one argument: the expression.")
+				}
+
+				checker := c.Context.Value(implKey).(tool.Checker)
+				analysis, err := tool.Analyze(checker, args.First())
+				if err != nil {
+					return err
+				}
+
+				return printAnalyses(c, []*tool.Analysis{analysis})
+			},
+		},
+		{
+			Name:  "graph",
+			Usage: "Print the dependency graph of rule files and report unused recording rules, cycles and duplicates",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Value:   "dot",
+					Usage:   "Output format, `dot|json`",
+				},
+				groupIntervalFlag,
+			},
+			Action: func(c *cli.Context) error {
+				paths, err := projectFiles(c, (*project.Config).RuleFiles)
+				if err != nil {
+					return err
+				}
+
+				if len(paths) < 1 {
+					log.Fatal("Expected at least one rule file.")
+				}
+
+				graph := tool.NewRuleGraph(c.Duration("interval"))
+				for _, f := range paths {
+					data, err := os.ReadFile(f)
+					if err != nil {
+						return err
+					}
+					if err := graph.AddRules(checkerFor(c, f), f, data); err != nil {
+						return cli.Exit(err, 1)
+					}
+				}
+
+				switch c.String("output") {
+				case "dot":
+					err = graph.WriteDOT(os.Stdout)
+				case "json":
+					encoder := json.NewEncoder(os.Stdout)
+					encoder.SetIndent("", "  ")
+					err = encoder.Encode(graph)
+				default:
+					return fmt.Errorf("unsupported output format %q", c.String("output"))
+				}
+				if err != nil {
+					return err
+				}
+
+				// Problems are reported on stderr, to keep the graph on stdout
+				findings := projectConfig(c).ApplyLint(graph.Findings())
+				for _, f := range findings {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", f.Severity, f)
+				}
+				if tool.HasErrors(findings) {
+					return cli.Exit("", 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "inline",
+			Usage: "Substitute the expressions of recording rules for the metrics they record in an expression or alert, to evaluate it without the rules",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "expr",
+					Usage: "Expression to inline",
+				},
+				&cli.StringFlag{
+					Name:  "alert",
+					Usage: "Name of the alert of the rule files whose expression to inline",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if (c.String("expr") == "") == (c.String("alert") == "") {
+					log.Fatal("Expected either --expr or --alert.")
+				}
+
+				paths, err := projectFiles(c, (*project.Config).RuleFiles)
+				if err != nil {
+					return err
+				}
+
+				if len(paths) < 1 {
+					log.Fatal("Expected at least one rule file.")
+				}
+
+				inliner := tool.NewInliner()
+				for _, f := range paths {
+					data, err := os.ReadFile(f)
+					if err != nil {
+						return err
+					}
+					if err := inliner.AddRules(checkerFor(c, f), f, data); err != nil {
+						return cli.Exit(err, 1)
+					}
+				}
+
+				expr := c.String("expr")
+				if name := c.String("alert"); name != "" {
+					var ok bool
+					if expr, ok = inliner.Alert(name); !ok {
+						return cli.Exit(fmt.Sprintf("no alert %q in the rule files", name), 1)
+					}
+				}
+
+				result, err := inliner.Inline(expr)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				fmt.Println(result)
+				return nil
+			},
+		},
+		{
+			Name:  "analyze-rules",
+			Usage: "Analyze every expression of rule files",
+			Flags: []cli.Flag{
+				outputFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() < 1 {
+					log.Fatal("Expected at least one rule file to analyze.")
+				}
+
+				analyses := []*tool.Analysis{}
+				for _, f := range args.Slice() {
+					data, err := os.ReadFile(f)
+					if err != nil {
+						return err
+					}
+
+					a, err := tool.AnalyzeRules(checkerFor(c, f), f, data)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					analyses = append(analyses, a...)
+				}
+
+				return printAnalyses(c, analyses)
+			},
+		},
+		{
+			Name:  "analyze-dashboard",
+			Usage: "Analyze every target and variable query of dashboards",
+			Flags: []cli.Flag{
+				outputFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() < 1 {
+					log.Fatal("Expected at least one dashboard file to analyze.")
+				}
+
+				analyses := []*tool.Analysis{}
+				for _, f := range args.Slice() {
+					data, err := os.ReadFile(f)
+					if err != nil {
+						return err
+					}
+
+					a, err := tool.AnalyzeDashboard(f, data)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					analyses = append(analyses, a...)
+				}
+
+				return printAnalyses(c, analyses)
+			},
+		},
+		{
+			Name:  "eval",
+			Usage: "Evaluate a PromQL expression against exposition snapshots and print the resulting samples",
+			Flags: []cli.Flag{
+				snapshotFlag,
+				timeFlag,
+				intervalFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() != 1 {
+					log.Fatal("Expected exactly one argument: the expression.")
+				}
+				if _, ok := c.Context.Value(implKey).(*tool.PromQL); !ok {
+					return fmt.Errorf("only PromQL expressions can be evaluated")
+				}
+
+				storage, ts, err := loadSnapshots(c)
+				if err != nil {
+					return err
+				}
+
+				value, err := tool.Eval(c.Context, storage, args.First(), ts)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+
+				if s := value.String(); s != "" {
+					fmt.Println(s)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "eval-rules",
+			Usage: "Evaluate PromQL rule files against exposition snapshots and print the pending and firing alerts",
+			Flags: []cli.Flag{
+				snapshotFlag,
+				timeFlag,
+				intervalFlag,
+				outputFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() < 1 {
+					log.Fatal("Expected at least one rule file to evaluate.")
+				}
+				if c.Duration("interval") <= 0 {
+					return fmt.Errorf("--interval must be positive")
+				}
+
+				storage, ts, err := loadSnapshots(c)
+				if err != nil {
+					return err
+				}
+
+				checker := c.Context.Value(implKey).(tool.Checker)
+				evaluator := tool.NewRuleEvaluator(storage)
+				for _, f := range args.Slice() {
+					data, err := os.ReadFile(f)
+					if err != nil {
+						return err
+					}
 
-var app = &cli.App{
-	Name:            "cos-tool",
-	Usage:           "Validates Prometheus and Loki expressions, adds Juju Topology to label matchers",
-	HideHelpCommand: false,
-	HideHelp:        false,
-	Flags: []cli.Flag{
-		&cli.StringFlag{
-			Name:    "format",
-			Aliases: []string{"f"},
-			Value:   "promql",
-			Usage:   "Inject expressions into `promql|logql`",
+					if err := evaluator.AddRules(checker, f, data); err != nil {
+						return cli.Exit(err, 1)
+					}
+				}
+
+				start := storage.MinTime()
+				if start.IsZero() || start.After(ts) {
+					start = ts
+				}
+				if err := evaluator.Run(c.Context, start, ts, c.Duration("interval")); err != nil {
+					return cli.Exit(err, 1)
+				}
+
+				return printAlerts(c, evaluator.Alerts(false))
+			},
 		},
-	},
-	Commands: []*cli.Command{
 		{
-			Name:    "transform",
-			Aliases: []string{"t"},
+			Name:      "backtest",
+			Usage:     "Evaluate PromQL rule files over a Prometheus data directory and print when each alert was pending or firing",
+			ArgsUsage: "DATA_DIR RULE_FILE...",
 			Flags: []cli.Flag{
-				&cli.StringSliceFlag{
-					Name:  "label-matcher",
-					Usage: "Label matcher to inject into all vector selectors",
-				},
+				startFlag,
+				endFlag,
+				intervalFlag,
+				sandboxDirRootFlag,
+				outputFlag,
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args()
+
+				if args.Len() < 2 {
+					log.Fatal("Expected a data directory and at least one rule file to backtest.")
+				}
+
+				start, err := parseTime(c.String("start"))
+				if err != nil {
+					return err
+				}
+				end, err := parseTime(c.String("end"))
+				if err != nil {
+					return err
+				}
+				if end.Before(start) {
+					return fmt.Errorf("--end is before --start")
+				}
+				if c.Duration("interval") <= 0 {
+					return fmt.Errorf("--interval must be positive")
+				}
+
+				checker := c.Context.Value(implKey).(tool.Checker)
+				db, err := tool.OpenTSDB(args.First(), c.String("sandbox-dir-root"))
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				defer db.Close()
+
+				evaluator := tool.NewRuleEvaluator(db)
+				for _, f := range args.Tail() {
+					data, err := os.ReadFile(f)
+					if err != nil {
+						return err
+					}
+
+					if err := evaluator.AddRules(checker, f, data); err != nil {
+						return cli.Exit(err, 1)
+					}
+				}
+
+				if err := evaluator.Run(c.Context, start, end, c.Duration("interval")); err != nil {
+					return cli.Exit(err, 1)
+				}
+
+				intervals := tool.AlertIntervals(evaluator.Alerts(true), end)
+				switch c.String("output") {
+				case "table":
+					return tool.WriteAlertIntervalsTable(os.Stdout, intervals)
+				case "json":
+					encoder := json.NewEncoder(os.Stdout)
+					encoder.SetIndent("", "  ")
+					return encoder.Encode(intervals)
+				default:
+					return fmt.Errorf("unsupported output format %q", c.String("output"))
+				}
+			},
+		},
+		{
+			Name:  "serve",
+			Usage: "Serve transform, validate-rules, validate-config and analyze as a JSON HTTP API",
+			Flags: []cli.Flag{
+				listenAddressFlag,
+				maxRequestBytesFlag,
+				shutdownTimeoutFlag,
+				injectionRulesFlag,
+			},
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() != 0 {
+					log.Fatal("Expected no arguments.")
+				}
+
+				rules, err := loadInjectionRules(c)
+				if err != nil {
+					return err
+				}
+
+				handler, err := server.New(server.Options{
+					DefaultFormat:   format(c),
+					InjectionRules:  rules,
+					MaxRequestBytes: c.Int64("max-request-bytes"),
+				})
+				if err != nil {
+					return err
+				}
+				return listenAndServe(c, handler)
+			},
+		},
+		{
+			Name:  "proxy",
+			Usage: "Proxy the query APIs of Prometheus or Loki, enforcing label matchers on every query",
+			Flags: []cli.Flag{
+				upstreamFlag,
+				listenAddressFlag,
+				labelMatcherFlag,
+				topologyFlag,
+				topologyFromEnvFlag,
+				omitUnitFlag,
+				tenantHeaderFlag,
+				shutdownTimeoutFlag,
+			},
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() != 0 {
+					log.Fatal("Expected no arguments.")
+				}
+
+				inj, err := labelMatchers(c)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				upstream, err := url.Parse(c.String("upstream"))
+				if err != nil {
+					return err
+				}
+				if upstream.Scheme == "" || upstream.Host == "" {
+					return fmt.Errorf("invalid upstream %q: expected an absolute URL", c.String("upstream"))
+				}
+
+				handler, err := proxy.New(proxy.Options{
+					Upstream:      upstream,
+					LabelMatchers: inj,
+					TenantHeader:  c.String("tenant-header"),
+				})
+				if err != nil {
+					return err
+				}
+				return listenAndServe(c, handler)
+			},
+		},
+		{
+			Name:  "lsp",
+			Usage: "Run a language server for rule files, dashboards and expressions over stdin and stdout",
+			Flags: []cli.Flag{
+				labelMatcherFlag,
+				topologyFlag,
+				topologyFromEnvFlag,
+				omitUnitFlag,
+				injectionRulesFlag,
+			},
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() != 0 {
+					log.Fatal("Expected no arguments.")
+				}
+
+				inj, err := labelMatchers(c)
+				if err != nil {
+					log.Fatal(err)
+				}
+				rules, err := loadInjectionRules(c)
+				if err != nil {
+					return err
+				}
+
+				opts := lsp.Options{
+					LogQL:          format(c) == "logql",
+					LabelMatchers:  inj,
+					InjectionRules: rules,
+				}
+				// The rules entries of the project configuration set the language of their files
+				// unless --format is set
+				if !c.IsSet("format") {
+					opts.FormatFor = projectConfig(c).FormatFor
+				}
+				s, err := lsp.New(opts)
+				if err != nil {
+					return err
+				}
+				return s.Serve(c.Context, os.Stdin, os.Stdout)
+			},
+		},
+		{
+			Name:  "render",
+			Usage: "Interpolate Grafana template variables and check the result parses",
+			Flags: []cli.Flag{
+				varFlag,
+				allValueFlag,
 			},
 			Action: func(c *cli.Context) error {
 				args := c.Args()
@@ -46,15 +988,15 @@ var app = &cli.App{
 					log.Fatal("Expected exactly one argument: the expression.")
 				}
 
-				inj, err := tool.GetLabelMatchers(c.StringSlice("label-matcher"))
+				vars, err := tool.GetGrafanaVariables(*c.Generic("var").(*repeatedValue), c.String("all-value"))
 				if err != nil {
 					log.Fatal(err)
 				}
 
-				transformer := c.Context.Value(implKey).(tool.Checker)
-				output, err := transformer.Transform(args.First(), &inj)
+				checker := c.Context.Value(implKey).(tool.Checker)
+				output, err := tool.Render(checker, args.First(), vars)
 				if err != nil {
-					return err
+					return cli.Exit(err, 1)
 				}
 
 				fmt.Print(output)
@@ -64,22 +1006,63 @@ var app = &cli.App{
 		{
 			Name:    "validate-rules",
 			Aliases: []string{"v", "lint", "l", "validate"},
+			Flags: []cli.Flag{
+				metricsFlag,
+				targetLabelFlag,
+				policyFlag,
+				timingFlag,
+				scrapeIntervalFlag,
+				groupIntervalFlag,
+				validateOutputFlag,
+			},
 			Action: func(c *cli.Context) error {
-				args := c.Args()
+				paths, err := projectFiles(c, (*project.Config).RuleFiles)
+				if err != nil {
+					return err
+				}
 
-				if args.Len() < 1 {
+				if len(paths) < 1 {
 					log.Fatal("Expected at least one rule file to validate.")
 				}
 
-				validator := c.Context.Value(implKey).(tool.Checker)
+				return validateRuleFindings(c, paths)
+			},
+		},
+		{
+			Name:  "validate-dashboard",
+			Usage: "Check that dashboard queries only use defined template variables",
+			Flags: []cli.Flag{
+				validateOutputFlag,
+			},
+			Action: func(c *cli.Context) error {
+				paths, err := projectFiles(c, (*project.Config).DashboardFiles)
+				if err != nil {
+					return err
+				}
 
-				for _, f := range args.Slice() {
+				if len(paths) < 1 {
+					log.Fatal("Expected at least one dashboard file to validate.")
+				}
+
+				if reportFindings(c) {
+					var findings []tool.Finding
+					for _, f := range paths {
+						data, err := os.ReadFile(f)
+						if err != nil {
+							return err
+						}
+						findings = append(findings, tool.DashboardFindings(f, data)...)
+					}
+					return printFindings(c, paths, findings)
+				}
+
+				for _, f := range paths {
 					data, err := os.ReadFile(f)
 					if err != nil {
 						return err
 					}
 
-					_, err = validator.ValidateRules(f, data)
+					err = tool.ValidateDashboard(f, data)
 					if err != nil {
 						return cli.Exit(err, 1)
 					}
@@ -90,6 +1073,9 @@ var app = &cli.App{
 		},
 		{
 			Name: "validate-config",
+			Flags: []cli.Flag{
+				validateOutputFlag,
+			},
 			Action: func(c *cli.Context) error {
 				args := c.Args()
 
@@ -99,6 +1085,18 @@ var app = &cli.App{
 
 				validator := c.Context.Value(implKey).(tool.Checker)
 
+				if reportFindings(c) {
+					var findings []tool.Finding
+					for _, f := range args.Slice() {
+						fileFindings, err := tool.ConfigFindings(validator, f)
+						if err != nil {
+							return err
+						}
+						findings = append(findings, fileFindings...)
+					}
+					return printFindings(c, args.Slice(), findings)
+				}
+
 				for _, f := range args.Slice() {
 					err := validator.ValidateConfig(f)
 					if err != nil {
@@ -109,9 +1107,64 @@ var app = &cli.App{
 				return nil
 			},
 		},
+		{
+			Name:  "config",
+			Usage: "Inspect the project configuration",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "show",
+					Usage: "Print the effective configuration: the project configuration with the flags applied, and paths relative to the working directory",
+					Flags: []cli.Flag{
+						labelMatcherFlag,
+						topologyFlag,
+						topologyFromEnvFlag,
+						omitUnitFlag,
+						injectionRulesFlag,
+						policyFlag,
+					},
+					Action: func(c *cli.Context) error {
+						if c.Args().Len() != 0 {
+							log.Fatal("Expected no arguments.")
+						}
+
+						cfg, err := effectiveConfig(c)
+						if err != nil {
+							return err
+						}
+
+						if path := projectConfig(c).Path; path != "" {
+							fmt.Printf("# %s\n", path)
+						} else {
+							fmt.Printf("# No %s found\n", project.FileName)
+						}
+						encoder := yaml.NewEncoder(os.Stdout)
+						encoder.SetIndent(2)
+						if err := encoder.Encode(cfg); err != nil {
+							return err
+						}
+						return encoder.Close()
+					},
+				},
+			},
+		},
 	},
 	Before: func(c *cli.Context) error {
-		me := strings.ToLower(c.String("format"))
+		var cfg *project.Config
+		var err error
+		switch {
+		case c.Bool("no-config"):
+			cfg = &project.Config{}
+		case c.IsSet("config"):
+			cfg, err = project.Load(c.String("config"))
+		default:
+			cfg, err = project.Discover(".")
+		}
+		if err != nil {
+			return err
+		}
+		c.Context = context.WithValue(c.Context, projectKey, cfg)
+
+		me := format(c)
 		switch me {
 		case "promql":
 			c.Context = context.WithValue(c.Context, implKey, &tool.PromQL{})
@@ -125,6 +1178,506 @@ var app = &cli.App{
 	},
 }
 
+// repeatedValue is the value of a repeatable flag which, unlike a cli.StringSliceFlag, does not
+// split values on commas, since variable values may contain them
+type repeatedValue []string
+
+func (r *repeatedValue) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+func (r *repeatedValue) String() string {
+	return strings.Join(*r, ", ")
+}
+
+// labelMatchers builds the label matchers to inject from the topology flags, if any, and the
+// --label-matcher flags, which take precedence for extra or overridden labels. The topology
+// and label matchers of the project configuration are used unless overridden by the flags.
+func labelMatchers(c *cli.Context) (map[string]string, error) {
+	cfg := projectConfig(c)
+	var topology *tool.Topology
+	var err error
+
+	switch {
+	case c.IsSet("topology") && c.Bool("topology-from-env"):
+		return nil, fmt.Errorf("--topology and --topology-from-env are mutually exclusive")
+	case c.IsSet("topology"):
+		topology, err = tool.ParseTopology([]byte(c.String("topology")))
+	case c.Bool("topology-from-env"):
+		topology, err = tool.TopologyFromEnv(os.Getenv)
+	default:
+		topology, err = cfg.ParseTopology()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	omitUnit := c.Bool("omit-unit")
+	if !c.IsSet("omit-unit") {
+		omitUnit = cfg.OmitUnit
+	}
+
+	matchers := map[string]string{}
+	if topology != nil {
+		if err := topology.Validate(); err != nil {
+			return nil, err
+		}
+		matchers = topology.LabelMatchers(!omitUnit)
+	}
+	for k, v := range cfg.LabelMatchers {
+		matchers[k] = v
+	}
+
+	extra, err := tool.GetLabelMatchers(c.StringSlice("label-matcher"))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		matchers[k] = v
+	}
+	return matchers, nil
+}
+
+// hasTopology tells whether the label matchers include a topology, from the flags or the
+// project configuration
+func hasTopology(c *cli.Context) bool {
+	return c.IsSet("topology") || c.Bool("topology-from-env") || projectConfig(c).Topology != nil
+}
+
+// projectConfig returns the project configuration, which is empty if there is none
+func projectConfig(c *cli.Context) *project.Config {
+	if cfg, ok := c.Context.Value(projectKey).(*project.Config); ok {
+		return cfg
+	}
+	return &project.Config{}
+}
+
+// format returns the --format flag, which defaults to the format of the project configuration
+func format(c *cli.Context) string {
+	if f := projectConfig(c).Format; !c.IsSet("format") && f != "" {
+		return f
+	}
+	return strings.ToLower(c.String("format"))
+}
+
+// checkerFor returns the checker of a rule file, in the language the project configuration
+// gives the file unless --format is set
+func checkerFor(c *cli.Context, file string) tool.Checker {
+	if !c.IsSet("format") {
+		switch projectConfig(c).FormatFor(file) {
+		case "promql":
+			return &tool.PromQL{}
+		case "logql":
+			return &tool.LogQL{}
+		}
+	}
+	return c.Context.Value(implKey).(tool.Checker)
+}
+
+// effectiveConfig returns the project configuration with the flags applied
+func effectiveConfig(c *cli.Context) (*project.Config, error) {
+	// Check the matchers the configuration and flags add up to
+	if _, err := labelMatchers(c); err != nil {
+		return nil, err
+	}
+
+	cfg := *projectConfig(c)
+	cfg.Format = format(c)
+
+	switch {
+	case c.IsSet("topology"):
+		if err := json.Unmarshal([]byte(c.String("topology")), &cfg.Topology); err != nil {
+			return nil, err
+		}
+	case c.Bool("topology-from-env"):
+		topology, err := tool.TopologyFromEnv(os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Topology = map[string]string{
+			"model":       topology.Model,
+			"model_uuid":  topology.ModelUUID,
+			"application": topology.Application,
+			"unit":        topology.Unit,
+		}
+	}
+	if c.IsSet("omit-unit") {
+		cfg.OmitUnit = c.Bool("omit-unit")
+	}
+
+	extra, err := tool.GetLabelMatchers(c.StringSlice("label-matcher"))
+	if err != nil {
+		return nil, err
+	}
+	if len(extra) > 0 {
+		matchers := map[string]string{}
+		for k, v := range cfg.LabelMatchers {
+			matchers[k] = v
+		}
+		for k, v := range extra {
+			matchers[k] = v
+		}
+		cfg.LabelMatchers = matchers
+	}
+
+	// Paths are shown relative to the working directory, like those of the flags
+	if c.IsSet("injection-rules") {
+		cfg.InjectionRules = c.String("injection-rules")
+	} else if cfg.InjectionRules != "" {
+		cfg.InjectionRules = cfg.Resolve(cfg.InjectionRules)
+	}
+	if c.IsSet("policy") {
+		cfg.Policy = c.String("policy")
+	} else if cfg.Policy != "" {
+		cfg.Policy = cfg.Resolve(cfg.Policy)
+	}
+	cfg.Rules = nil
+	for _, r := range projectConfig(c).Rules {
+		r.Paths = resolveAll(&cfg, r.Paths)
+		cfg.Rules = append(cfg.Rules, r)
+	}
+	cfg.Dashboards = resolveAll(&cfg, cfg.Dashboards)
+	return &cfg, nil
+}
+
+func resolveAll(cfg *project.Config, paths []string) []string {
+	var resolved []string
+	for _, p := range paths {
+		resolved = append(resolved, cfg.Resolve(p))
+	}
+	return resolved
+}
+
+// projectFiles returns the file arguments, or the files of the project configuration if there
+// are none
+func projectFiles(c *cli.Context, files func(*project.Config) ([]string, error)) ([]string, error) {
+	if c.Args().Len() > 0 {
+		return c.Args().Slice(), nil
+	}
+	return files(projectConfig(c))
+}
+
+// printAnalyses prints analyses in the --output format. A single expression is printed as a
+// JSON object, files as a JSON array.
+func printAnalyses(c *cli.Context, analyses []*tool.Analysis) error {
+	switch c.String("output") {
+	case "table":
+		return tool.WriteAnalysesTable(os.Stdout, analyses)
+	case "json":
+		var v interface{} = analyses
+		if c.Command.Name == "analyze" {
+			v = analyses[0]
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	default:
+		return fmt.Errorf("unsupported output format %q", c.String("output"))
+	}
+}
+
+// validateRuleFindings validates rule files, and their metrics against the --metrics catalogue
+// if set, printing the findings in the --output format
+func validateRuleFindings(c *cli.Context, files []string) error {
+	var findings []tool.Finding
+	var valid []string
+	data := map[string][]byte{}
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		data[f] = content
+
+		fileFindings := tool.RuleFindings(checkerFor(c, f), f, content)
+		if !tool.HasErrors(fileFindings) {
+			valid = append(valid, f)
+		}
+		findings = append(findings, fileFindings...)
+	}
+
+	checks, err := loadRuleChecks(c)
+	if err != nil {
+		return err
+	}
+	for _, check := range checks {
+		for _, f := range valid {
+			fileFindings, err := check.RuleFindings(checkerFor(c, f), f, data[f])
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+			findings = append(findings, fileFindings...)
+		}
+	}
+
+	if c.IsSet("metrics") {
+		catalogue, err := loadMetricCatalogue(c)
+		if err != nil {
+			return err
+		}
+		// Rules may use the metrics recorded by rules of any of the valid files
+		for _, f := range valid {
+			if err := catalogue.AddRecordingRules(checkerFor(c, f), f, data[f]); err != nil {
+				return cli.Exit(err, 1)
+			}
+		}
+		for _, f := range valid {
+			fileFindings, err := catalogue.RuleMetricFindings(checkerFor(c, f), f, data[f])
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+			findings = append(findings, fileFindings...)
+		}
+	}
+
+	return printFindings(c, files, findings)
+}
+
+// reportFindings tells whether dashboard and configuration validation reports findings, rather
+// than the first error, which it does for the --output formats other than text and when the
+// project configures linting
+func reportFindings(c *cli.Context) bool {
+	return c.String("output") != "text" || !projectConfig(c).Lint.IsZero()
+}
+
+// printFindings prints the findings of a validation in the --output format, with the lint
+// settings of the project configuration, and fails if any of them is an error
+func printFindings(c *cli.Context, files []string, findings []tool.Finding) error {
+	findings = projectConfig(c).ApplyLint(findings)
+
+	var err error
+	switch c.String("output") {
+	case "text":
+		printWarnings(findings)
+		if err := tool.FindingsError(findings); err != nil {
+			return cli.Exit(err, 1)
+		}
+		return nil
+	case "json":
+		if findings == nil {
+			findings = []tool.Finding{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(findings)
+	case "sarif":
+		err = tool.WriteSARIF(os.Stdout, findings)
+	case "junit":
+		err = tool.WriteJUnit(os.Stdout, c.Command.Name, files, findings)
+	default:
+		return fmt.Errorf("unsupported output format %q", c.String("output"))
+	}
+	if err != nil {
+		return err
+	}
+
+	if tool.HasErrors(findings) {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
+
+// printWarnings prints the findings which are warnings, such as unused suppressions, to stderr
+func printWarnings(findings []tool.Finding) {
+	for _, f := range findings {
+		if f.Severity == tool.SeverityWarning {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", f.Severity, f)
+		}
+	}
+}
+
+// loadMetricCatalogue loads the --metrics file, with the --target-label names, if any
+func loadMetricCatalogue(c *cli.Context) (*tool.MetricCatalogue, error) {
+	data, err := os.ReadFile(c.String("metrics"))
+	if err != nil {
+		return nil, err
+	}
+	return tool.LoadMetricCatalogue(data, c.StringSlice("target-label"))
+}
+
+// loadSnapshots loads the --metrics snapshots, returning the storage and the evaluation time
+func loadSnapshots(c *cli.Context) (*tool.MemoryStorage, time.Time, error) {
+	var ts time.Time
+	if c.IsSet("time") {
+		var err error
+		if ts, err = parseTime(c.String("time")); err != nil {
+			return nil, ts, err
+		}
+	}
+
+	var snapshots [][]byte
+	for _, f := range c.StringSlice("metrics") {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, ts, err
+		}
+		snapshots = append(snapshots, data)
+	}
+	return tool.LoadSnapshots(snapshots, ts, c.Duration("interval"))
+}
+
+// parseTime parses a time given as RFC3339 or as Unix seconds
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected RFC3339 or Unix seconds", s)
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), nil
+}
+
+// printAlerts prints alerts in the --output format
+func printAlerts(c *cli.Context, alerts []*tool.Alert) error {
+	switch c.String("output") {
+	case "table":
+		return tool.WriteAlertsTable(os.Stdout, alerts)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(alerts)
+	default:
+		return fmt.Errorf("unsupported output format %q", c.String("output"))
+	}
+}
+
+// loadRenames loads the --mapping file
+func loadRenames(c *cli.Context) (*tool.Renames, error) {
+	data, err := os.ReadFile(c.String("mapping"))
+	if err != nil {
+		return nil, err
+	}
+	return tool.LoadRenames(data)
+}
+
+// printOrCheck prints the output of a transform command or, with --check, prints the diff
+// between its input and output and fails if there is one
+func printOrCheck(c *cli.Context, name, input, output string) error {
+	if !c.Bool("check") {
+		fmt.Print(output)
+		return nil
+	}
+
+	diff, err := tool.UnifiedDiff(name, input, output)
+	if err != nil {
+		return err
+	}
+	if diff != "" {
+		fmt.Print(diff)
+		return cli.Exit(fmt.Sprintf("%s is not transformed", name), 1)
+	}
+	return nil
+}
+
+// loadInjectionRules loads the --injection-rules file, which defaults to that of the project
+// configuration, or returns nil if there is none
+func loadInjectionRules(c *cli.Context) (*tool.InjectionRules, error) {
+	path := c.String("injection-rules")
+	if cfg := projectConfig(c); !c.IsSet("injection-rules") && cfg.InjectionRules != "" {
+		path = cfg.Resolve(cfg.InjectionRules)
+	}
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return tool.LoadInjectionRules(data)
+}
+
+// ruleCheck is a check of rule files besides their validation, such as a policy
+type ruleCheck interface {
+	RuleFindings(checker tool.Checker, filename string, data []byte) ([]tool.Finding, error)
+}
+
+// loadRuleChecks returns the checks enabled by the --policy and --timing flags
+func loadRuleChecks(c *cli.Context) ([]ruleCheck, error) {
+	var checks []ruleCheck
+	policy, err := loadPolicy(c)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		checks = append(checks, policy)
+	}
+	if c.Bool("timing") {
+		checks = append(checks, &tool.TimingChecks{ScrapeInterval: c.Duration("scrape-interval"), EvaluationInterval: c.Duration("interval")})
+	}
+	return checks, nil
+}
+
+// loadPolicy loads the --policy file, which defaults to that of the project configuration, or
+// returns nil if there is none
+func loadPolicy(c *cli.Context) (*tool.Policy, error) {
+	path := c.String("policy")
+	if cfg := projectConfig(c); !c.IsSet("policy") && cfg.Policy != "" {
+		path = cfg.Resolve(cfg.Policy)
+	}
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return tool.LoadPolicy(data)
+}
+
+// newTransformer returns a transformer for the --format and --injection-rules flags and opts
+func newTransformer(c *cli.Context, opts ...transformer.Option) (*transformer.Transformer, error) {
+	rules, err := loadInjectionRules(c)
+	if err != nil {
+		return nil, err
+	}
+
+	checker := c.Context.Value(implKey).(tool.Checker)
+	opts = append([]transformer.Option{transformer.WithFormat(transformerFormat(checker)), transformer.WithInjectionRules(rules)}, opts...)
+	return transformer.New(opts...)
+}
+
+// transformerFormat returns the transformer format of a checker
+func transformerFormat(checker tool.Checker) transformer.Format {
+	if _, ok := checker.(*tool.LogQL); ok {
+		return transformer.LogQL
+	}
+	return transformer.PromQL
+}
+
+// listenAndServe serves handler on --listen-address until SIGINT or SIGTERM, then waits up to
+// --shutdown-timeout for in-flight requests
+func listenAndServe(c *cli.Context, handler http.Handler) error {
+	srv := &http.Server{
+		Addr:              c.String("listen-address"),
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s", srv.Addr)
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Print("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), c.Duration("shutdown-timeout"))
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
 func Execute() error {
 	return app.Run(os.Args)
 }
@@ -29,6 +29,21 @@ func (p ParseError) Error() string {
 	return fmt.Sprintf("parse error at line %d, col %d: %s", p.line, p.col, p.msg)
 }
 
+// Line returns the 1-based line of the error in the query, or 0 if unknown.
+func (p ParseError) Line() int {
+	return p.line
+}
+
+// Col returns the 1-based column of the error in the query, or 0 if unknown.
+func (p ParseError) Col() int {
+	return p.col
+}
+
+// Message returns the error message without its position.
+func (p ParseError) Message() string {
+	return p.msg
+}
+
 // Is allows to use errors.Is(err,ErrParse) on this error.
 func (p ParseError) Is(target error) bool {
 	return target == ErrParse
@@ -276,17 +276,19 @@ func (e *LineFilterExpr) String() string {
 			sb.WriteString(" ")
 		}
 	}
-	switch e.Ty {
-	case labels.MatchRegexp:
-		sb.WriteString("|~")
-	case labels.MatchNotRegexp:
-		sb.WriteString("!~")
-	case labels.MatchEqual:
-		sb.WriteString("|=")
-	case labels.MatchNotEqual:
-		sb.WriteString("!=")
+	if !e.IsOr { // OR-ed filters inherit the type of the filter they extend
+		switch e.Ty {
+		case labels.MatchRegexp:
+			sb.WriteString("|~")
+		case labels.MatchNotRegexp:
+			sb.WriteString("!~")
+		case labels.MatchEqual:
+			sb.WriteString("|=")
+		case labels.MatchNotEqual:
+			sb.WriteString("!=")
+		}
+		sb.WriteString(" ")
 	}
-	sb.WriteString(" ")
 	if e.Op == "" {
 		sb.WriteString(strconv.Quote(e.Match))
 		return sb.String()
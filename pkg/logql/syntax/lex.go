@@ -1,6 +1,7 @@
 package syntax
 
 import (
+	"sort"
 	"strings"
 	"text/scanner"
 	"time"
@@ -114,6 +115,39 @@ var functionTokens = map[string]int{
 	OpFilterIP: IP,
 }
 
+// Keywords returns the keywords of LogQL, such as by, json or line_format, sorted.
+func Keywords() []string {
+	var keywords []string
+	for token := range tokens {
+		if isWord(token) {
+			if _, ok := functionTokens[token]; !ok {
+				keywords = append(keywords, token)
+			}
+		}
+	}
+	sort.Strings(keywords)
+	return keywords
+}
+
+// Functions returns the names of the LogQL functions and aggregations, sorted.
+func Functions() []string {
+	functions := make([]string, 0, len(functionTokens))
+	for token := range functionTokens {
+		functions = append(functions, token)
+	}
+	sort.Strings(functions)
+	return functions
+}
+
+func isWord(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && r != '_' {
+			return false
+		}
+	}
+	return s != ""
+}
+
 type lexer struct {
 	scanner.Scanner
 	errs    []logqlmodel.ParseError
@@ -18,14 +18,19 @@ import (
 )
 
 func Load(data []byte) (*rulefmt.RuleGroups, []error) {
-	rgs, errs := parseRules(data)
+	return LoadFunc(data, nil)
+}
+
+// LoadFunc is Load, leaving out the validation errors for which suppressed, if set, is true
+func LoadFunc(data []byte, suppressed func(GroupError) bool) (*rulefmt.RuleGroups, []error) {
+	rgs, errs := parseRules(data, suppressed)
 	for i := range errs {
 		errs[i] = fmt.Errorf("%+v", errs[i])
 	}
 	return rgs, errs
 }
 
-func parseRules(content []byte) (*rulefmt.RuleGroups, []error) {
+func parseRules(content []byte, suppressed func(GroupError) bool) (*rulefmt.RuleGroups, []error) {
 	var (
 		groups rulefmt.RuleGroups
 		errs   []error
@@ -42,29 +47,51 @@ func parseRules(content []byte) (*rulefmt.RuleGroups, []error) {
 		return nil, errs
 	}
 
-	return &groups, ValidateGroups(groups.Groups...)
+	for _, err := range ValidateGroupsByRule(groups.Groups...) {
+		if suppressed == nil || !suppressed(err) {
+			errs = append(errs, err.Err)
+		}
+	}
+	return &groups, errs
 }
 
 func ValidateGroups(grps ...rulefmt.RuleGroup) (errs []error) {
+	for _, err := range ValidateGroupsByRule(grps...) {
+		errs = append(errs, err.Err)
+	}
+	return errs
+}
+
+// GroupError is an error of the group at index Group, in the rule at index Rule or in the
+// group itself if Rule is -1
+type GroupError struct {
+	Group int
+	Rule  int
+	Err   error
+}
+
+// ValidateGroupsByRule validates groups like ValidateGroups, telling which group and rule each
+// error is about
+func ValidateGroupsByRule(grps ...rulefmt.RuleGroup) (errs []GroupError) {
 	set := map[string]struct{}{}
 
 	for i, g := range grps {
 		if g.Name == "" {
-			errs = append(errs, errors.Errorf("group %d: Groupname must not be empty", i))
+			errs = append(errs, GroupError{i, -1, errors.Errorf("group %d: Groupname must not be empty", i)})
 		}
 
 		if _, ok := set[g.Name]; ok {
 			errs = append(
 				errs,
-				errors.Errorf("groupname: \"%s\" is repeated in the same file", g.Name),
+				GroupError{i, -1, errors.Errorf("groupname: \"%s\" is repeated in the same file", g.Name)},
 			)
 		}
 
 		set[g.Name] = struct{}{}
 
-		for _, r := range g.Rules {
+		for j, r := range g.Rules {
 			if err := validateRule(&r, g.Name); err != nil {
-				errs = append(errs, err)
+				errs = append(errs, GroupError{i, j, err})
 			}
 		}
 	}
@@ -0,0 +1,426 @@
+package lsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/canonical/cos-tool/pkg/logql/logqlmodel"
+	logqlparser "github.com/canonical/cos-tool/pkg/logql/syntax"
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/prometheus/prometheus/promql/parser"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// documentKind is what a document holds, which decides where its expressions are
+type documentKind int
+
+const (
+	ruleFile documentKind = iota
+	dashboard
+	expression
+)
+
+type document struct {
+	uri   string
+	kind  documentKind
+	logql bool
+	text  string
+	lines []string
+}
+
+// newDocument returns a document, whose kind is guessed from its language ID and path: .json
+// files are dashboards, .promql and .logql files a single expression and anything else a rule
+// file, in the server's default language.
+func newDocument(item TextDocumentItem, defaultLogQL bool) *document {
+	d := &document{uri: item.URI, logql: defaultLogQL}
+
+	name := item.URI
+	if u, err := url.Parse(item.URI); err == nil && u.Path != "" {
+		name = u.Path
+	}
+	switch {
+	case item.LanguageID == "json" || path.Ext(name) == ".json":
+		d.kind = dashboard
+	case item.LanguageID == "promql" || path.Ext(name) == ".promql":
+		d.kind, d.logql = expression, false
+	case item.LanguageID == "logql" || path.Ext(name) == ".logql":
+		d.kind, d.logql = expression, true
+	default:
+		d.kind = ruleFile
+	}
+
+	d.setText(item.Text)
+	return d
+}
+
+func (d *document) setText(text string) {
+	d.text = text
+	d.lines = strings.Split(text, "\n")
+}
+
+// filename returns the path of the document for error messages
+func (d *document) filename() string {
+	if u, err := url.Parse(d.uri); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return d.uri
+}
+
+// fullRange returns the range of the whole document
+func (d *document) fullRange() Range {
+	last := len(d.lines) - 1
+	return Range{End: Position{Line: last, Character: len(d.lines[last])}}
+}
+
+// lineRange returns the range of a whole line, clamped to the document
+func (d *document) lineRange(line int) Range {
+	line = max(0, min(line, len(d.lines)-1))
+	return Range{Start: Position{Line: line}, End: Position{Line: line, Character: len(d.lines[line])}}
+}
+
+// Positions within the server count the bytes of a line, and those of the protocol its UTF-16
+// code units: they are converted when received and sent.
+
+// utf16Position converts a position counting bytes into one counting UTF-16 code units
+func (d *document) utf16Position(p Position) Position {
+	if p.Line < 0 || p.Line >= len(d.lines) {
+		return p
+	}
+	line := d.lines[p.Line]
+	p.Character = len(utf16.Encode([]rune(line[:max(0, min(p.Character, len(line)))])))
+	return p
+}
+
+// utf16Range converts a range counting bytes into one counting UTF-16 code units
+func (d *document) utf16Range(r Range) Range {
+	return Range{Start: d.utf16Position(r.Start), End: d.utf16Position(r.End)}
+}
+
+// bytePosition converts a position counting UTF-16 code units into one counting bytes
+func (d *document) bytePosition(p Position) Position {
+	if p.Line < 0 || p.Line >= len(d.lines) {
+		return p
+	}
+	units := 0
+	for i, r := range d.lines[p.Line] {
+		if units >= p.Character {
+			p.Character = i
+			return p
+		}
+		units += utf16.RuneLen(r)
+	}
+	p.Character = len(d.lines[p.Line])
+	return p
+}
+
+// exprLocation is an expression of a document with where its text is
+type exprLocation struct {
+	text  string
+	logql bool
+	// segments map the offset in text of the start of each document line the expression spans
+	// to its position in the document
+	segments []segment
+}
+
+type segment struct {
+	offset int
+	pos    Position
+}
+
+// position returns the document position of an offset in the expression
+func (e exprLocation) position(offset int) Position {
+	s := e.segments[0]
+	for _, next := range e.segments[1:] {
+		if next.offset > offset {
+			break
+		}
+		s = next
+	}
+	return Position{Line: s.pos.Line, Character: s.pos.Character + offset - s.offset}
+}
+
+// rangeOf returns the document range of the expression
+func (e exprLocation) rangeOf() Range {
+	return Range{Start: e.position(0), End: e.position(len(e.text))}
+}
+
+// expressions returns the expressions of the document
+func (d *document) expressions() []exprLocation {
+	switch d.kind {
+	case expression:
+		e := exprLocation{text: d.text, logql: d.logql}
+		offset := 0
+		for i, line := range d.lines {
+			e.segments = append(e.segments, segment{offset: offset, pos: Position{Line: i}})
+			offset += len(line) + 1
+		}
+		return []exprLocation{e}
+	case dashboard:
+		return d.dashboardExpressions()
+	default:
+		return d.ruleExpressions()
+	}
+}
+
+// ruleExpressions returns the expressions of a rule file, or none if it is not valid YAML
+func (d *document) ruleExpressions() []exprLocation {
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(d.text), &root); err != nil || len(root.Content) == 0 {
+		return nil
+	}
+
+	var exprs []exprLocation
+	for _, group := range sequence(mappingValue(root.Content[0], "groups")) {
+		for _, rule := range sequence(mappingValue(group, "rules")) {
+			if node := mappingValue(rule, "expr"); node != nil && node.Kind == yaml.ScalarNode {
+				exprs = append(exprs, d.scalarLocation(node))
+			}
+		}
+	}
+	return exprs
+}
+
+// scalarLocation locates the text of a YAML scalar. Escape sequences and folded line breaks
+// are assumed to take one character, which is exact for the usual expressions.
+func (d *document) scalarLocation(node *yaml.Node) exprLocation {
+	e := exprLocation{text: node.Value, logql: d.logql}
+	line, column := node.Line-1, node.Column-1
+
+	switch node.Style {
+	case yaml.LiteralStyle, yaml.FoldedStyle:
+		// The content starts on the line after the | or > indicator
+		indent, offset := -1, 0
+		for i := line + 1; i < len(d.lines); i++ {
+			text := d.lines[i]
+			trimmed := strings.TrimLeft(text, " ")
+			if offset >= len(e.text) && offset > 0 {
+				break
+			}
+			if trimmed != "" {
+				if indent == -1 {
+					indent = len(text) - len(trimmed)
+				} else if len(text)-len(trimmed) < indent {
+					break
+				}
+			}
+			col := min(max(indent, 0), len(text))
+			e.segments = append(e.segments, segment{offset: offset, pos: Position{Line: i, Character: col}})
+			offset += len(text) - col + 1
+		}
+	case yaml.DoubleQuotedStyle, yaml.SingleQuotedStyle:
+		column++
+	}
+	if len(e.segments) == 0 {
+		e.segments = []segment{{pos: Position{Line: line, Character: column}}}
+	}
+	return e
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func sequence(node *yaml.Node) []*yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return node.Content
+}
+
+// dashboardExpressions returns the targets and variable queries of a dashboard, or none if it
+// is not a valid dashboard. They are located by searching for their JSON strings, the nth
+// expression with a given text being taken to be at its nth occurrence.
+func (d *document) dashboardExpressions() []exprLocation {
+	var exprs []exprLocation
+	seen := map[string]int{}
+	_, err := tool.RewriteDashboard(d.uri, []byte(d.text), func(expr string, logql bool) (string, error) {
+		e := exprLocation{text: expr, logql: logql}
+
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(expr)
+		quoted := strings.TrimSpace(buf.String())
+
+		pos := Position{}
+		if offset := nthIndex(d.text, quoted, seen[quoted]); offset != -1 {
+			offset++
+			pos.Line = strings.Count(d.text[:offset], "\n")
+			pos.Character = offset - (strings.LastIndex(d.text[:offset], "\n") + 1)
+		}
+		seen[quoted]++
+		e.segments = []segment{{pos: pos}}
+		exprs = append(exprs, e)
+		return expr, nil
+	})
+	if err != nil {
+		return nil
+	}
+	return exprs
+}
+
+// nthIndex returns the index of the nth occurrence of substr in s, counting from 0, or -1
+func nthIndex(s, substr string, n int) int {
+	offset := 0
+	for {
+		i := strings.Index(s[offset:], substr)
+		if i == -1 {
+			return -1
+		}
+		if n == 0 {
+			return offset + i
+		}
+		n--
+		offset += i + len(substr)
+	}
+}
+
+// errorPositionPattern matches the position of the errors of rulefmt and of YAML decoding
+var errorPositionPattern = regexp.MustCompile(`(?:^|[\[ ])(\d+):(\d+): |yaml: line (\d+):`)
+
+// diagnostics checks the document. Expressions which do not parse are reported where the parser
+// failed. Otherwise the validation of the whole document is reported, at the position its
+// error gives if any.
+func (d *document) diagnostics() []Diagnostic {
+	diagnostics := []Diagnostic{}
+	for _, e := range d.expressions() {
+		if diagnostic, ok := parseDiagnostic(e); ok {
+			diagnostics = append(diagnostics, diagnostic)
+		}
+	}
+	if len(diagnostics) > 0 || d.kind == expression {
+		return diagnostics
+	}
+
+	var err error
+	switch d.kind {
+	case dashboard:
+		err = tool.ValidateDashboard(d.filename(), []byte(d.text))
+	default:
+		var checker tool.Checker = &tool.PromQL{}
+		if d.logql {
+			checker = &tool.LogQL{}
+		}
+		_, err = checker.ValidateRules(d.filename(), []byte(d.text))
+	}
+	if err == nil {
+		return diagnostics
+	}
+
+	r := d.lineRange(0)
+	if m := errorPositionPattern.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1] + m[3])
+		r = d.lineRange(line - 1)
+	}
+	return append(diagnostics, Diagnostic{Range: r, Severity: SeverityError, Source: "cos-tool", Message: err.Error()})
+}
+
+// parseDiagnostic parses an expression, and returns a diagnostic at the position of the parse
+// error if it does not parse. The text of the expression is parsed as is, unless it has Grafana
+// variables, which are replaced by placeholders whose error positions are mapped back.
+func parseDiagnostic(e exprLocation) (Diagnostic, bool) {
+	var checker tool.Checker = &tool.PromQL{}
+	if e.logql {
+		checker = &tool.LogQL{}
+	}
+	// Transform also accepts Grafana variable queries, which the parsers do not
+	_, err := checker.Transform(e.text, &map[string]string{})
+	if err == nil {
+		return Diagnostic{}, false
+	}
+	diagnostic := Diagnostic{Range: e.rangeOf(), Severity: SeverityError, Source: "cos-tool", Message: err.Error()}
+
+	text, toOriginal := e.text, func(offset int) int { return offset }
+	if variablePattern.MatchString(e.text) {
+		if replaced, err := tool.ReplaceVariables(checker, e.text); err == nil {
+			text, toOriginal = replaced, placeholderOffsets(e.text, replaced)
+		}
+	}
+	if e.logql {
+		_, err = logqlparser.ParseExpr(text)
+	} else {
+		_, err = parser.ParseExpr(text)
+	}
+	if err == nil {
+		return diagnostic, true
+	}
+
+	rangeOf := func(start, end int) Range {
+		start, end = toOriginal(start), toOriginal(end)
+		return Range{Start: e.position(start), End: e.position(max(end, start+1))}
+	}
+	var promErrs parser.ParseErrors
+	var promErr *parser.ParseErr
+	var lokiErr logqlmodel.ParseError
+	switch {
+	case errors.As(err, &promErrs) && len(promErrs) > 0:
+		pr := promErrs[0].PositionRange
+		diagnostic.Message = promErrs[0].Err.Error()
+		diagnostic.Range = rangeOf(int(pr.Start), int(pr.End))
+	case errors.As(err, &promErr):
+		pr := promErr.PositionRange
+		diagnostic.Message = promErr.Err.Error()
+		diagnostic.Range = rangeOf(int(pr.Start), int(pr.End))
+	case errors.As(err, &lokiErr) && lokiErr.Line() > 0:
+		offset := 0
+		for i, line := range strings.Split(text, "\n") {
+			if i == lokiErr.Line()-1 {
+				offset += min(max(lokiErr.Col()-1, 0), len(line))
+				break
+			}
+			offset += len(line) + 1
+		}
+		diagnostic.Message = lokiErr.Message()
+		diagnostic.Range = rangeOf(offset, offset+1)
+	}
+	return diagnostic, true
+}
+
+// variablePattern matches the Grafana variables of an expression: $var and ${var}
+var variablePattern = regexp.MustCompile(`\$(?:\w+|\{[^}]+\})`)
+
+// placeholderOffsets maps the offsets of the text of an expression whose variables were replaced
+// by placeholders back to the original text. The text between variables is searched for in order
+// in the replaced text, the offsets in a placeholder mapping to the start of its variable.
+func placeholderOffsets(text, replaced string) func(int) int {
+	type span struct{ from, to, original int }
+	var spans []span
+	cursor, start := 0, 0
+	for _, v := range append(variablePattern.FindAllStringIndex(text, -1), []int{len(text), len(text)}) {
+		between := text[start:v[0]]
+		if i := strings.Index(replaced[cursor:], between); i != -1 {
+			spans = append(spans, span{from: cursor + i, to: cursor + i + len(between), original: start})
+			cursor += i + len(between)
+		}
+		start = v[1]
+	}
+
+	return func(offset int) int {
+		result := 0
+		for _, s := range spans {
+			if offset < s.from {
+				break
+			}
+			if offset < s.to {
+				return s.original + offset - s.from
+			}
+			result = s.original + s.to - s.from
+		}
+		return result
+	}
+}
@@ -0,0 +1,255 @@
+package lsp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	logqlparser "github.com/canonical/cos-tool/pkg/logql/syntax"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// promQLDocs describes the PromQL functions and aggregations shown on hover
+var promQLDocs = map[string]string{
+	"abs":                "Absolute value of every sample.",
+	"absent":             "A 1-element vector if the vector has no elements, empty otherwise. Useful to alert when a series is missing.",
+	"absent_over_time":   "A 1-element vector if the range vector has no elements, empty otherwise.",
+	"avg_over_time":      "Average of all samples in the range, per series.",
+	"ceil":               "Rounds sample values up to the nearest integer.",
+	"changes":            "Number of times the value changed within the range, per series.",
+	"clamp":              "Clamps sample values between a minimum and a maximum.",
+	"clamp_max":          "Clamps sample values to a maximum.",
+	"clamp_min":          "Clamps sample values to a minimum.",
+	"count_over_time":    "Number of samples in the range, per series.",
+	"day_of_month":       "Day of the month (1-31) of the timestamps given as values, in UTC.",
+	"day_of_week":        "Day of the week (0-6, Sunday is 0) of the timestamps given as values, in UTC.",
+	"day_of_year":        "Day of the year (1-366) of the timestamps given as values, in UTC.",
+	"days_in_month":      "Number of days in the month of the timestamps given as values, in UTC.",
+	"delta":              "Difference between the first and last value of each gauge series in the range, extrapolated.",
+	"deriv":              "Per-second derivative of each gauge series in the range, by simple linear regression.",
+	"exp":                "Exponential of every sample.",
+	"floor":              "Rounds sample values down to the nearest integer.",
+	"histogram_avg":      "Arithmetic average of the observed values of native histograms.",
+	"histogram_count":    "Count of observations of native histograms.",
+	"histogram_fraction": "Estimated fraction of observations between two values, for native histograms.",
+	"histogram_quantile": "Estimated φ-quantile (0 ≤ φ ≤ 1) from the buckets of a histogram, grouped by the le label for classic histograms.",
+	"histogram_stddev":   "Estimated standard deviation of the observations of native histograms.",
+	"histogram_stdvar":   "Estimated standard variance of the observations of native histograms.",
+	"histogram_sum":      "Sum of observations of native histograms.",
+	"hour":               "Hour of the day (0-23) of the timestamps given as values, in UTC.",
+	"idelta":             "Difference between the last two samples of each gauge series in the range.",
+	"increase":           "Increase of each counter series in the range, extrapolated and adjusted for counter resets.",
+	"irate":              "Per-second rate of increase of each counter series, from its last two samples in the range.",
+	"label_join":         "Joins the values of source labels with a separator into a destination label.",
+	"label_replace":      "Sets a destination label to a replacement, expanded with the groups of a regex matching a source label.",
+	"last_over_time":     "Most recent sample in the range, per series.",
+	"ln":                 "Natural logarithm of every sample.",
+	"log10":              "Decimal logarithm of every sample.",
+	"log2":               "Binary logarithm of every sample.",
+	"max_over_time":      "Maximum of all samples in the range, per series.",
+	"min_over_time":      "Minimum of all samples in the range, per series.",
+	"minute":             "Minute of the hour (0-59) of the timestamps given as values, in UTC.",
+	"month":              "Month of the year (1-12) of the timestamps given as values, in UTC.",
+	"predict_linear":     "Predicted value of each gauge series a number of seconds from now, by simple linear regression over the range.",
+	"present_over_time":  "1 for every series with any sample in the range.",
+	"quantile_over_time": "φ-quantile (0 ≤ φ ≤ 1) of the samples in the range, per series.",
+	"rate":               "Per-second average rate of increase of each counter series in the range, extrapolated and adjusted for counter resets.",
+	"resets":             "Number of counter resets within the range, per series.",
+	"round":              "Rounds sample values to the nearest integer, or to the nearest multiple of an optional scalar.",
+	"scalar":             "The value of a single-element vector as a scalar, NaN otherwise.",
+	"sgn":                "Sign of every sample: 1, -1 or 0.",
+	"sort":               "Sorts elements by ascending value. Only affects instant queries.",
+	"sort_desc":          "Sorts elements by descending value. Only affects instant queries.",
+	"sqrt":               "Square root of every sample.",
+	"stddev_over_time":   "Population standard deviation of the samples in the range, per series.",
+	"stdvar_over_time":   "Population standard variance of the samples in the range, per series.",
+	"sum_over_time":      "Sum of all samples in the range, per series.",
+	"time":               "Evaluation time in seconds since the Unix epoch.",
+	"timestamp":          "Timestamp of every sample, in seconds since the Unix epoch.",
+	"vector":             "The scalar as a vector without labels.",
+	"year":               "Year of the timestamps given as values, in UTC.",
+
+	"sum":          "Aggregation: sum over dimensions.",
+	"avg":          "Aggregation: average over dimensions.",
+	"min":          "Aggregation: minimum over dimensions.",
+	"max":          "Aggregation: maximum over dimensions.",
+	"count":        "Aggregation: number of elements in the vector.",
+	"group":        "Aggregation: 1 for every group.",
+	"stddev":       "Aggregation: population standard deviation over dimensions.",
+	"stdvar":       "Aggregation: population standard variance over dimensions.",
+	"topk":         "Aggregation: largest k elements by sample value.",
+	"bottomk":      "Aggregation: smallest k elements by sample value.",
+	"count_values": "Aggregation: number of elements with the same value, in a label of the given name.",
+	"quantile":     "Aggregation: φ-quantile (0 ≤ φ ≤ 1) over dimensions.",
+}
+
+// aggregationParams are the parameters PromQL aggregations take before their vector
+var aggregationParams = map[string]string{
+	"topk":         "scalar, ",
+	"bottomk":      "scalar, ",
+	"quantile":     "scalar, ",
+	"count_values": "string, ",
+}
+
+// logQLDocs holds the signature and description of the LogQL functions and aggregations
+var logQLDocs = map[string][2]string{
+	"rate":               {"rate(log-range) instant-vector", "Number of entries per second."},
+	"count_over_time":    {"count_over_time(log-range) instant-vector", "Number of entries for each log stream within the range."},
+	"bytes_rate":         {"bytes_rate(log-range) instant-vector", "Number of bytes per second for each stream."},
+	"bytes_over_time":    {"bytes_over_time(log-range) instant-vector", "Number of bytes used by each log stream within the range."},
+	"absent_over_time":   {"absent_over_time(log-range) instant-vector", "A 1-element vector if the range has no entries, empty otherwise."},
+	"avg_over_time":      {"avg_over_time(unwrapped-range) instant-vector", "Average of the unwrapped values within the range."},
+	"sum_over_time":      {"sum_over_time(unwrapped-range) instant-vector", "Sum of the unwrapped values within the range."},
+	"min_over_time":      {"min_over_time(unwrapped-range) instant-vector", "Minimum of the unwrapped values within the range."},
+	"max_over_time":      {"max_over_time(unwrapped-range) instant-vector", "Maximum of the unwrapped values within the range."},
+	"first_over_time":    {"first_over_time(unwrapped-range) instant-vector", "First unwrapped value within the range."},
+	"last_over_time":     {"last_over_time(unwrapped-range) instant-vector", "Last unwrapped value within the range."},
+	"stdvar_over_time":   {"stdvar_over_time(unwrapped-range) instant-vector", "Population standard variance of the unwrapped values within the range."},
+	"stddev_over_time":   {"stddev_over_time(unwrapped-range) instant-vector", "Population standard deviation of the unwrapped values within the range."},
+	"quantile_over_time": {"quantile_over_time(scalar, unwrapped-range) instant-vector", "φ-quantile (0 ≤ φ ≤ 1) of the unwrapped values within the range."},
+	"sum":                {"sum [by|without (labels)] (instant-vector)", "Aggregation: sum over dimensions."},
+	"avg":                {"avg [by|without (labels)] (instant-vector)", "Aggregation: average over dimensions."},
+	"min":                {"min [by|without (labels)] (instant-vector)", "Aggregation: minimum over dimensions."},
+	"max":                {"max [by|without (labels)] (instant-vector)", "Aggregation: maximum over dimensions."},
+	"count":              {"count [by|without (labels)] (instant-vector)", "Aggregation: number of elements in the vector."},
+	"stddev":             {"stddev [by|without (labels)] (instant-vector)", "Aggregation: population standard deviation over dimensions."},
+	"stdvar":             {"stdvar [by|without (labels)] (instant-vector)", "Aggregation: population standard variance over dimensions."},
+	"topk":               {"topk(scalar, instant-vector)", "Aggregation: largest k elements by sample value."},
+	"bottomk":            {"bottomk(scalar, instant-vector)", "Aggregation: smallest k elements by sample value."},
+	"sort":               {"sort(instant-vector)", "Sorts elements by ascending value."},
+	"sort_desc":          {"sort_desc(instant-vector)", "Sorts elements by descending value."},
+	"label_replace":      {"label_replace(instant-vector, dst, replacement, src, regex)", "Sets a destination label to a replacement, expanded with the groups of a regex matching a source label."},
+	"bytes":              {"unwrap bytes(label)", "Converts a label value such as 1.5MB to bytes when unwrapping."},
+	"duration":           {"unwrap duration(label)", "Converts a label value such as 1m30s to seconds when unwrapping."},
+	"duration_seconds":   {"unwrap duration_seconds(label)", "Converts a label value such as 1m30s to seconds when unwrapping."},
+	"ip":                 {`label = ip("cidr")`, "Filters log lines or labels on IP addresses, ranges or CIDRs."},
+}
+
+// promQLSignature returns the signature of a PromQL function, such as
+// round(instant-vector[, scalar]) instant-vector
+func promQLSignature(f *parser.Function) string {
+	args := make([]string, len(f.ArgTypes))
+	for i, t := range f.ArgTypes {
+		args[i] = valueTypeName(t)
+	}
+
+	var sig strings.Builder
+	sig.WriteString(f.Name + "(")
+	switch {
+	case f.Variadic > 0:
+		required := max(len(args)-f.Variadic, 0)
+		sig.WriteString(strings.Join(args[:required], ", "))
+		for i, arg := range args[required:] {
+			if i > 0 || required > 0 {
+				arg = ", " + arg
+			}
+			sig.WriteString("[" + arg)
+		}
+		sig.WriteString(strings.Repeat("]", len(args)-required))
+	case f.Variadic < 0:
+		sig.WriteString(strings.Join(args, ", ") + ", ...")
+	default:
+		sig.WriteString(strings.Join(args, ", "))
+	}
+	sig.WriteString(") " + valueTypeName(f.ReturnType))
+	return sig.String()
+}
+
+func valueTypeName(t parser.ValueType) string {
+	switch t {
+	case parser.ValueTypeVector:
+		return "instant-vector"
+	case parser.ValueTypeMatrix:
+		return "range-vector"
+	default:
+		return string(t)
+	}
+}
+
+// completionItems returns the functions and keywords of a query language
+func completionItems(logql bool) []CompletionItem {
+	var items []CompletionItem
+	if logql {
+		for _, name := range logqlparser.Functions() {
+			item := CompletionItem{Label: name, Kind: CompletionItemKindFunction}
+			if doc, ok := logQLDocs[name]; ok {
+				item.Detail = doc[0]
+				item.Documentation = &MarkupContent{Kind: "markdown", Value: doc[1]}
+			}
+			items = append(items, item)
+		}
+		for _, keyword := range logqlparser.Keywords() {
+			items = append(items, CompletionItem{Label: keyword, Kind: CompletionItemKindKeyword})
+		}
+		return items
+	}
+
+	for name, f := range parser.Functions {
+		if f.Experimental && !parser.EnableExperimentalFunctions {
+			continue
+		}
+		item := CompletionItem{Label: name, Kind: CompletionItemKindFunction, Detail: promQLSignature(f)}
+		if doc, ok := promQLDocs[name]; ok {
+			item.Documentation = &MarkupContent{Kind: "markdown", Value: doc}
+		}
+		items = append(items, item)
+	}
+	for t, keyword := range parser.ItemTypeStr {
+		if !(t.IsKeyword() || t.IsAggregator() || t.IsOperator()) || t.IsExperimentalAggregator() || !isWord(keyword) {
+			continue
+		}
+		item := CompletionItem{Label: keyword, Kind: CompletionItemKindKeyword}
+		if doc, ok := promQLDocs[keyword]; ok {
+			item.Documentation = &MarkupContent{Kind: "markdown", Value: doc}
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
+
+// hoverText returns the documentation of a function or aggregation of a query language, in
+// Markdown
+func hoverText(name string, logql bool) (string, bool) {
+	if logql {
+		doc, ok := logQLDocs[name]
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("```logql\n%s\n```\n%s", doc[0], doc[1]), true
+	}
+
+	doc, documented := promQLDocs[name]
+	if f, ok := parser.Functions[name]; ok {
+		return strings.TrimSpace(fmt.Sprintf("```promql\n%s\n```\n%s", promQLSignature(f), doc)), true
+	}
+	if documented {
+		return fmt.Sprintf("```promql\n%s [by|without (labels)] (%sinstant-vector)\n```\n%s", name, aggregationParams[name], doc), true
+	}
+	return "", false
+}
+
+// wordAt returns the identifier at a character of a line and its range
+func wordAt(line string, character int) (string, int, int) {
+	isIdent := func(r byte) bool {
+		return r == '_' || r < unicode.MaxASCII && (unicode.IsLetter(rune(r)) || unicode.IsDigit(rune(r)))
+	}
+	start, end := min(character, len(line)), min(character, len(line))
+	for start > 0 && isIdent(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isIdent(line[end]) {
+		end++
+	}
+	return line[start:end], start, end
+}
+
+func isWord(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && r != '_' && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return s != ""
+}
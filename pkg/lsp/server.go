@@ -0,0 +1,311 @@
+// Package lsp is a Language Server Protocol server for the PromQL and LogQL expressions of rule
+// files, Grafana dashboards and .promql and .logql files. It publishes diagnostics, completes
+// and documents functions and keywords, and offers to inject label matchers as a code action.
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/canonical/cos-tool/pkg/transformer"
+)
+
+// Options configure a Server
+type Options struct {
+	// LogQL makes LogQL the language of rule files
+	LogQL bool
+	// FormatFor, if set, returns the language of a rule file given its path, promql or logql,
+	// or an empty string for the default one
+	FormatFor func(path string) string
+	// LabelMatchers, if any, are injected by the code action
+	LabelMatchers map[string]string
+	// InjectionRules, if set, scope the matchers injected by the code action
+	InjectionRules *tool.InjectionRules
+}
+
+// Server serves a single client over a stream, such as the standard input and output of the
+// process started by an editor
+type Server struct {
+	opts         Options
+	transformers map[bool]*transformer.Transformer
+	documents    map[string]*document
+
+	out         io.Writer
+	outMtx      sync.Mutex
+	initialized bool
+	shutdown    bool
+}
+
+// New returns a server
+func New(opts Options) (*Server, error) {
+	s := &Server{opts: opts, documents: map[string]*document{}}
+	if len(opts.LabelMatchers) > 0 {
+		s.transformers = map[bool]*transformer.Transformer{}
+		for logql, format := range map[bool]transformer.Format{false: transformer.PromQL, true: transformer.LogQL} {
+			t, err := transformer.New(
+				transformer.WithFormat(format),
+				transformer.WithLabelMatchers(opts.LabelMatchers),
+				transformer.WithInjectionRules(opts.InjectionRules),
+			)
+			if err != nil {
+				return nil, err
+			}
+			s.transformers[logql] = t
+		}
+	}
+	return s, nil
+}
+
+// errExitWithoutShutdown is returned by Serve when the client exits without shutting the server
+// down first, which the protocol treats as a failure
+var errExitWithoutShutdown = errors.New("exit without shutdown")
+
+// Serve handles the messages of a client until it exits, the stream ends or ctx is done
+func (s *Server) Serve(ctx context.Context, in io.Reader, out io.Writer) error {
+	s.out = out
+	reader := bufio.NewReader(in)
+
+	messages := make(chan []byte)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := readMessage(reader)
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case msg := <-messages:
+			var req request
+			if err := json.Unmarshal(msg, &req); err != nil {
+				s.reply(nil, nil, &responseError{Code: codeInvalidRequest, Message: err.Error()})
+				continue
+			}
+			if req.Method == "exit" {
+				if !s.shutdown {
+					return errExitWithoutShutdown
+				}
+				return nil
+			}
+			s.handle(ctx, req)
+		}
+	}
+}
+
+// handle handles a request or a notification
+func (s *Server) handle(ctx context.Context, req request) {
+	if req.Method != "initialize" && !s.initialized {
+		if req.ID != nil {
+			s.reply(req.ID, nil, &responseError{Code: codeServerNotInitialized, Message: "server not initialized"})
+		}
+		return
+	}
+
+	var result interface{}
+	var err error
+	switch req.Method {
+	case "initialize":
+		s.initialized = true
+		result = InitializeResult{
+			Capabilities: ServerCapabilities{
+				TextDocumentSync:   TextDocumentSyncOptions{OpenClose: true, Change: TextDocumentSyncKindFull},
+				CompletionProvider: CompletionOptions{},
+				HoverProvider:      true,
+				CodeActionProvider: true,
+			},
+			ServerInfo: ServerInfo{Name: "cos-tool"},
+		}
+	case "shutdown":
+		s.shutdown = true
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if err = json.Unmarshal(req.Params, &params); err == nil {
+			d := newDocument(params.TextDocument, s.opts.LogQL)
+			if d.kind == ruleFile && s.opts.FormatFor != nil {
+				switch s.opts.FormatFor(d.filename()) {
+				case "promql":
+					d.logql = false
+				case "logql":
+					d.logql = true
+				}
+			}
+			s.documents[d.uri] = d
+			s.publishDiagnostics(d)
+		}
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if err = json.Unmarshal(req.Params, &params); err == nil {
+			d, ok := s.documents[params.TextDocument.URI]
+			if ok && len(params.ContentChanges) > 0 {
+				d.setText(params.ContentChanges[len(params.ContentChanges)-1].Text)
+				s.publishDiagnostics(d)
+			}
+		}
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if err = json.Unmarshal(req.Params, &params); err == nil {
+			delete(s.documents, params.TextDocument.URI)
+			s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []Diagnostic{}})
+		}
+	case "textDocument/completion":
+		var params TextDocumentPositionParams
+		if err = json.Unmarshal(req.Params, &params); err == nil {
+			result = s.completion(params)
+		}
+	case "textDocument/hover":
+		var params TextDocumentPositionParams
+		if err = json.Unmarshal(req.Params, &params); err == nil {
+			result = s.hover(params)
+		}
+	case "textDocument/codeAction":
+		var params CodeActionParams
+		if err = json.Unmarshal(req.Params, &params); err == nil {
+			result = s.codeActions(ctx, params)
+		}
+	default:
+		if req.ID != nil {
+			s.reply(req.ID, nil, &responseError{Code: codeMethodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)})
+		}
+		return
+	}
+
+	if req.ID == nil {
+		return
+	}
+	if err != nil {
+		s.reply(req.ID, nil, &responseError{Code: codeInvalidParams, Message: err.Error()})
+		return
+	}
+	s.reply(req.ID, result, nil)
+}
+
+// reply responds to a request
+func (s *Server) reply(id json.RawMessage, result interface{}, respErr *responseError) {
+	resp := response{JSONRPC: "2.0", ID: id, Error: respErr}
+	if id == nil {
+		resp.ID = json.RawMessage("null")
+	}
+	if respErr == nil {
+		resp.Result, _ = json.Marshal(result)
+	}
+	s.write(resp)
+}
+
+// notify sends a notification to the client
+func (s *Server) notify(method string, params interface{}) {
+	s.write(notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (s *Server) write(msg interface{}) {
+	s.outMtx.Lock()
+	defer s.outMtx.Unlock()
+	// A client which no longer reads will not send anything more either
+	writeMessage(s.out, msg)
+}
+
+func (s *Server) publishDiagnostics(d *document) {
+	diagnostics := d.diagnostics()
+	for i := range diagnostics {
+		diagnostics[i].Range = d.utf16Range(diagnostics[i].Range)
+	}
+	s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: d.uri, Diagnostics: diagnostics})
+}
+
+// expressionAt returns the expression of a document at a position, which is converted to count
+// bytes
+func (s *Server) expressionAt(params *TextDocumentPositionParams) (*document, exprLocation, bool) {
+	d, ok := s.documents[params.TextDocument.URI]
+	if !ok {
+		return nil, exprLocation{}, false
+	}
+	params.Position = d.bytePosition(params.Position)
+	for _, e := range d.expressions() {
+		if e.rangeOf().contains(params.Position) {
+			return d, e, true
+		}
+	}
+	return d, exprLocation{}, false
+}
+
+// completion completes the functions and keywords of the language of the expression at the
+// position, if any
+func (s *Server) completion(params TextDocumentPositionParams) []CompletionItem {
+	if _, e, ok := s.expressionAt(&params); ok {
+		return completionItems(e.logql)
+	}
+	return []CompletionItem{}
+}
+
+// hover documents the function or aggregation at the position
+func (s *Server) hover(params TextDocumentPositionParams) *Hover {
+	d, e, ok := s.expressionAt(&params)
+	if !ok || params.Position.Line >= len(d.lines) {
+		return nil
+	}
+
+	word, start, end := wordAt(d.lines[params.Position.Line], params.Position.Character)
+	text, ok := hoverText(word, e.logql)
+	if !ok {
+		return nil
+	}
+	return &Hover{
+		Contents: MarkupContent{Kind: "markdown", Value: text},
+		Range: &Range{
+			Start: d.utf16Position(Position{Line: params.Position.Line, Character: start}),
+			End:   d.utf16Position(Position{Line: params.Position.Line, Character: end}),
+		},
+	}
+}
+
+// codeActions offers to inject the label matchers into the whole document, if that changes it
+func (s *Server) codeActions(ctx context.Context, params CodeActionParams) []CodeAction {
+	d, ok := s.documents[params.TextDocument.URI]
+	if !ok || s.transformers == nil {
+		return []CodeAction{}
+	}
+
+	t := s.transformers[d.logql]
+	var result transformer.Result
+	var err error
+	switch d.kind {
+	case dashboard:
+		result, err = t.TransformDashboard(ctx, d.filename(), []byte(d.text))
+	case expression:
+		result, err = t.Transform(ctx, d.text)
+	default:
+		result, err = t.TransformRules(ctx, d.filename(), []byte(d.text))
+	}
+	if err != nil || !result.Changed {
+		return []CodeAction{}
+	}
+
+	return []CodeAction{{
+		Title: "Inject label matchers",
+		Kind:  "source.transform",
+		Edit: &WorkspaceEdit{Changes: map[string][]TextEdit{
+			d.uri: {{Range: d.utf16Range(d.fullRange()), NewText: result.Output}},
+		}},
+	}}
+}
@@ -0,0 +1,389 @@
+package lsp_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/lsp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// client drives a server over pipes, like an editor over the standard streams of the process
+type client struct {
+	t      *testing.T
+	in     *io.PipeWriter
+	out    *bufio.Reader
+	nextID int
+	done   chan error
+	// notifications holds the notifications received while waiting for responses
+	notifications []message
+}
+
+type message struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func newClient(t *testing.T, opts lsp.Options) *client {
+	s, err := lsp.New(opts)
+	require.NoError(t, err)
+
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	c := &client{t: t, in: inWriter, out: bufio.NewReader(outReader), done: make(chan error, 1)}
+	go func() {
+		c.done <- s.Serve(context.Background(), inReader, outWriter)
+		outWriter.Close()
+	}()
+	t.Cleanup(func() { inWriter.Close() })
+	return c
+}
+
+func (c *client) send(msg interface{}) {
+	body, err := json.Marshal(msg)
+	require.NoError(c.t, err)
+	_, err = fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	require.NoError(c.t, err)
+}
+
+func (c *client) receive() message {
+	header, err := textproto.NewReader(c.out).ReadMIMEHeader()
+	require.NoError(c.t, err)
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	require.NoError(c.t, err)
+	body := make([]byte, length)
+	_, err = io.ReadFull(c.out, body)
+	require.NoError(c.t, err)
+
+	var msg message
+	require.NoError(c.t, json.Unmarshal(body, &msg))
+	return msg
+}
+
+// request sends a request and returns its response, decoding its result into result if not nil
+func (c *client) request(method string, params interface{}, result interface{}) message {
+	c.nextID++
+	c.send(map[string]interface{}{"jsonrpc": "2.0", "id": c.nextID, "method": method, "params": params})
+	for {
+		msg := c.receive()
+		if msg.Method != "" {
+			c.notifications = append(c.notifications, msg)
+			continue
+		}
+		require.Equal(c.t, strconv.Itoa(c.nextID), string(msg.ID))
+		if result != nil && msg.Error == nil {
+			require.NoError(c.t, json.Unmarshal(msg.Result, result))
+		}
+		return msg
+	}
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.send(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// diagnostics returns the next diagnostics published for a document
+func (c *client) diagnostics(uri string) []lsp.Diagnostic {
+	for {
+		var msg message
+		if len(c.notifications) > 0 {
+			msg, c.notifications = c.notifications[0], c.notifications[1:]
+		} else {
+			msg = c.receive()
+		}
+		if msg.Method != "textDocument/publishDiagnostics" {
+			continue
+		}
+		var params lsp.PublishDiagnosticsParams
+		require.NoError(c.t, json.Unmarshal(msg.Params, &params))
+		if params.URI == uri {
+			return params.Diagnostics
+		}
+	}
+}
+
+func (c *client) initialize() {
+	var result lsp.InitializeResult
+	msg := c.request("initialize", map[string]interface{}{"capabilities": map[string]interface{}{}}, &result)
+	require.Nil(c.t, msg.Error)
+	c.notify("initialized", map[string]interface{}{})
+}
+
+func (c *client) open(uri, languageID, text string) []lsp.Diagnostic {
+	c.notify("textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: languageID, Version: 1, Text: text},
+	})
+	return c.diagnostics(uri)
+}
+
+func position(line, character int) lsp.Position {
+	return lsp.Position{Line: line, Character: character}
+}
+
+func TestLifecycle(t *testing.T) {
+	c := newClient(t, lsp.Options{})
+
+	msg := c.request("textDocument/hover", lsp.TextDocumentPositionParams{}, nil)
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, -32002, msg.Error.Code)
+
+	var result lsp.InitializeResult
+	msg = c.request("initialize", map[string]interface{}{"capabilities": map[string]interface{}{}}, &result)
+	require.Nil(t, msg.Error)
+	assert.Equal(t, "cos-tool", result.ServerInfo.Name)
+	assert.Equal(t, lsp.TextDocumentSyncKindFull, result.Capabilities.TextDocumentSync.Change)
+	assert.True(t, result.Capabilities.HoverProvider)
+
+	msg = c.request("workspace/symbol", map[string]interface{}{"query": ""}, nil)
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, -32601, msg.Error.Code)
+
+	msg = c.request("shutdown", nil, nil)
+	assert.Nil(t, msg.Error)
+	assert.Equal(t, "null", string(msg.Result))
+	c.notify("exit", nil)
+	assert.NoError(t, <-c.done)
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	c := newClient(t, lsp.Options{})
+	c.initialize()
+	c.notify("exit", nil)
+	assert.Error(t, <-c.done)
+}
+
+const ruleFile = `groups:
+  - name: api
+    rules:
+      - alert: HighErrorRate
+        expr: rate(http_errors_total) > 0
+      - record: job:http_requests:rate5m
+        expr: |
+          sum by (job) (
+            rate(http_requests_total[5m]
+          )
+`
+
+func TestRuleFileDiagnostics(t *testing.T) {
+	c := newClient(t, lsp.Options{})
+	c.initialize()
+
+	uri := "file:///charm/src/prometheus_alert_rules/api.rules"
+	diagnostics := c.open(uri, "yaml", ruleFile)
+	require.Len(t, diagnostics, 2)
+	// Prometheus reports the argument of the call
+	assert.Equal(t, position(4, 19), diagnostics[0].Range.Start)
+	assert.Contains(t, diagnostics[0].Message, `expected type range vector in call to function "rate"`)
+	assert.Equal(t, lsp.SeverityError, diagnostics[0].Severity)
+	assert.Equal(t, 9, diagnostics[1].Range.Start.Line, "errors in block scalars are on their own line")
+	assert.Contains(t, diagnostics[1].Message, "unclosed left parenthesis")
+
+	// Fixing the expressions leaves the errors of the rule file itself
+	fixed := strings.Replace(ruleFile, "rate(http_errors_total)", "rate(http_errors_total[5m])", 1)
+	fixed = strings.Replace(fixed, "[5m]\n", "[5m])\n", 1)
+	fixed = strings.Replace(fixed, "- alert: HighErrorRate", "- alert: HighErrorRate\n        record: errors", 1)
+	c.notify("textDocument/didChange", lsp.DidChangeTextDocumentParams{
+		TextDocument:   lsp.TextDocumentIdentifier{URI: uri},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{Text: fixed}},
+	})
+	diagnostics = c.diagnostics(uri)
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, 4, diagnostics[0].Range.Start.Line)
+	assert.Contains(t, diagnostics[0].Message, "only one of 'record' and 'alert' must be set")
+
+	c.notify("textDocument/didChange", lsp.DidChangeTextDocumentParams{
+		TextDocument:   lsp.TextDocumentIdentifier{URI: uri},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{Text: strings.Replace(fixed, "        record: errors\n", "", 1)}},
+	})
+	assert.Empty(t, c.diagnostics(uri))
+
+	c.notify("textDocument/didClose", lsp.DidCloseTextDocumentParams{TextDocument: lsp.TextDocumentIdentifier{URI: uri}})
+	assert.Empty(t, c.diagnostics(uri))
+}
+
+func TestLogQLRuleFileDiagnostics(t *testing.T) {
+	c := newClient(t, lsp.Options{LogQL: true})
+	c.initialize()
+
+	diagnostics := c.open("file:///charm/src/loki_alert_rules/errors.rules", "yaml", `groups:
+  - name: errors
+    rules:
+      - alert: Errors
+        expr: sum(rate(}{app="api"} |= "error" [5m])) > 0
+`)
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, position(4, 23), diagnostics[0].Range.Start)
+	assert.Contains(t, diagnostics[0].Message, "syntax error: unexpected }")
+}
+
+func TestRuleFileLanguage(t *testing.T) {
+	c := newClient(t, lsp.Options{})
+	c.initialize()
+
+	// The PromQL rules of the Loki charm are not mistaken for LogQL
+	assert.Empty(t, c.open("file:///loki-k8s-operator/src/prometheus_alert_rules/loki.rule", "yaml", `groups:
+  - name: loki
+    rules:
+      - alert: LokiRequestErrors
+        expr: sum(rate(loki_request_duration_seconds_count{status_code=~"5.."}[1m])) > 0
+`))
+
+	// The project configuration may set the language of rule files
+	c = newClient(t, lsp.Options{FormatFor: func(path string) string {
+		if strings.HasPrefix(path, "/charm/src/loki_alert_rules/") {
+			return "logql"
+		}
+		return ""
+	}})
+	c.initialize()
+	assert.Empty(t, c.open("file:///charm/src/loki_alert_rules/errors.rules", "yaml", `groups:
+  - name: errors
+    rules:
+      - alert: Errors
+        expr: sum(rate({app="api"} |= "error" [5m])) > 0
+`))
+}
+
+func TestDashboardDiagnostics(t *testing.T) {
+	data, err := os.ReadFile("../tool/testdata/dashboards/valid.json")
+	require.NoError(t, err)
+
+	c := newClient(t, lsp.Options{})
+	c.initialize()
+
+	assert.Empty(t, c.open("file:///dashboards/valid.json", "json", string(data)))
+
+	broken := strings.Replace(string(data), `|= \"error\"`, `|= error`, 1)
+	diagnostics := c.open("file:///dashboards/broken.json", "json", broken)
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, 21, diagnostics[0].Range.Start.Line)
+}
+
+func TestCompletion(t *testing.T) {
+	c := newClient(t, lsp.Options{})
+	c.initialize()
+
+	uri := "file:///rules/api.yaml"
+	c.open(uri, "yaml", ruleFile)
+
+	var items []lsp.CompletionItem
+	c.request("textDocument/completion", lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+		Position:     position(8, 14),
+	}, &items)
+	labels := map[string]lsp.CompletionItem{}
+	for _, item := range items {
+		labels[item.Label] = item
+	}
+	require.Contains(t, labels, "rate")
+	assert.Equal(t, "rate(range-vector) instant-vector", labels["rate"].Detail)
+	assert.Equal(t, lsp.CompletionItemKindFunction, labels["rate"].Kind)
+	assert.Equal(t, "round(instant-vector[, scalar]) instant-vector", labels["round"].Detail)
+	assert.Equal(t, lsp.CompletionItemKindKeyword, labels["by"].Kind)
+	assert.Contains(t, labels, "sum")
+	assert.NotContains(t, labels, "line_format")
+
+	// Outside of expressions there is nothing to complete
+	c.request("textDocument/completion", lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+		Position:     position(1, 4),
+	}, &items)
+	assert.Empty(t, items)
+
+	logURI := "file:///queries/errors.logql"
+	c.open(logURI, "logql", `{app="api"} | json`)
+	c.request("textDocument/completion", lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: logURI},
+		Position:     position(0, 14),
+	}, &items)
+	labels = map[string]lsp.CompletionItem{}
+	for _, item := range items {
+		labels[item.Label] = item
+	}
+	assert.Contains(t, labels, "count_over_time")
+	assert.Contains(t, labels, "line_format")
+	assert.Equal(t, lsp.CompletionItemKindKeyword, labels["json"].Kind)
+}
+
+func TestHover(t *testing.T) {
+	c := newClient(t, lsp.Options{})
+	c.initialize()
+
+	uri := "file:///rules/api.yaml"
+	c.open(uri, "yaml", ruleFile)
+
+	var hover lsp.Hover
+	c.request("textDocument/hover", lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+		Position:     position(8, 13),
+	}, &hover)
+	assert.Contains(t, hover.Contents.Value, "rate(range-vector) instant-vector")
+	assert.Contains(t, hover.Contents.Value, "Per-second average rate")
+	assert.Equal(t, &lsp.Range{Start: position(8, 12), End: position(8, 16)}, hover.Range)
+
+	c.request("textDocument/hover", lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+		Position:     position(7, 11),
+	}, &hover)
+	assert.Contains(t, hover.Contents.Value, "Aggregation: sum")
+
+	msg := c.request("textDocument/hover", lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+		Position:     position(3, 16),
+	}, nil)
+	assert.Equal(t, "null", string(msg.Result), "alert names are not documented")
+}
+
+func TestCodeAction(t *testing.T) {
+	c := newClient(t, lsp.Options{LabelMatchers: map[string]string{"juju_model": "lma"}})
+	c.initialize()
+
+	uri := "file:///queries/requests.promql"
+	c.open(uri, "promql", `sum(rate(http_requests_total[5m]))`)
+
+	var actions []lsp.CodeAction
+	c.request("textDocument/codeAction", lsp.CodeActionParams{TextDocument: lsp.TextDocumentIdentifier{URI: uri}}, &actions)
+	require.Len(t, actions, 1)
+	assert.Equal(t, "Inject label matchers", actions[0].Title)
+	assert.Equal(t, []lsp.TextEdit{{
+		Range:   lsp.Range{End: position(0, 34)},
+		NewText: `sum(rate(http_requests_total{juju_model="lma"}[5m]))`,
+	}}, actions[0].Edit.Changes[uri])
+
+	// Nothing is offered for documents which are already transformed
+	transformed := "file:///queries/transformed.promql"
+	c.open(transformed, "promql", `up{juju_model="lma"}`)
+	c.request("textDocument/codeAction", lsp.CodeActionParams{TextDocument: lsp.TextDocumentIdentifier{URI: transformed}}, &actions)
+	assert.Empty(t, actions)
+}
+
+func TestExpressionDiagnostics(t *testing.T) {
+	c := newClient(t, lsp.Options{})
+	c.initialize()
+
+	// Errors after variables are reported in the text as written, not in its placeholders
+	diagnostics := c.open("file:///queries/errors.promql", "promql", `rate(x{job="$job"}[$__rate_interval]) + on(`)
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, position(0, 43), diagnostics[0].Range.Start)
+	assert.Equal(t, "unclosed left parenthesis", diagnostics[0].Message)
+
+	// Characters count UTF-16 code units
+	diagnostics = c.open("file:///queries/names.promql", "promql", `up{name="日本𝔸"} + on(`)
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, position(0, 21), diagnostics[0].Range.Start)
+}
@@ -0,0 +1,292 @@
+// Package project loads the .cos-tool.yaml configuration of a project, which sets the defaults
+// of the command line flags: the query language, the label matchers to inject, the rule files
+// and dashboards to validate, and how validation findings are reported.
+package project
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// FileName is the name of the configuration file, looked up in the working directory and its
+// parents
+const FileName = ".cos-tool.yaml"
+
+// Config is a project configuration. Relative paths are relative to the directory of the file.
+type Config struct {
+	// Path is the file the configuration was loaded from, or empty if there is none
+	Path string `yaml:"-"`
+
+	// Format is the default query language, promql or logql
+	Format string `yaml:"format,omitempty"`
+	// Topology is the default Juju topology, with the keys of --topology
+	Topology map[string]string `yaml:"topology,omitempty"`
+	// OmitUnit leaves juju_unit out of the topology matchers
+	OmitUnit bool `yaml:"omit_unit,omitempty"`
+	// LabelMatchers are injected along with the topology matchers, and override them
+	LabelMatchers map[string]string `yaml:"label_matchers,omitempty"`
+	// InjectionRules is the default injection rules file
+	InjectionRules string `yaml:"injection_rules,omitempty"`
+	// Policy is the default policy file rules are validated against
+	Policy string `yaml:"policy,omitempty"`
+
+	// Rules are the rule files of the project, with their query language
+	Rules []RuleFiles `yaml:"rules,omitempty"`
+	// Dashboards are glob patterns of the dashboards of the project
+	Dashboards []string `yaml:"dashboards,omitempty"`
+
+	Lint Lint `yaml:"lint,omitempty"`
+}
+
+// RuleFiles are rule files in a query language
+type RuleFiles struct {
+	// Paths are glob patterns of the files
+	Paths []string `yaml:"paths"`
+	// Format is the query language of the files, defaulting to that of the project
+	Format string `yaml:"format,omitempty"`
+}
+
+// Lint configures the findings of validation
+type Lint struct {
+	// Severities override the severity of the findings of rule IDs
+	Severities map[string]tool.Severity `yaml:"severities,omitempty"`
+	// Disabled are the rule IDs whose findings are dropped
+	Disabled []string `yaml:"disabled,omitempty"`
+}
+
+// IsZero tells whether lint settings are left to their defaults, for YAML encoding
+func (l Lint) IsZero() bool {
+	return len(l.Severities) == 0 && len(l.Disabled) == 0
+}
+
+// Find returns the path of the configuration file in dir or its closest parent holding one, or
+// an empty string if there is none
+func Find(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		path := filepath.Join(dir, FileName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// Discover loads the configuration file found from dir, or returns an empty configuration if
+// there is none
+func Discover(dir string) (*Config, error) {
+	path, err := Find(dir)
+	if err != nil || path == "" {
+		return &Config{}, err
+	}
+	return Load(path)
+}
+
+// Load reads and checks a configuration file
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error loading %s: %w", path, err)
+	}
+	if c.Path, err = filepath.Abs(path); err != nil {
+		return nil, err
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("error loading %s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *Config) validate() error {
+	if !validFormat(c.Format) {
+		return fmt.Errorf("unsupported format %q", c.Format)
+	}
+	for _, r := range c.Rules {
+		if !validFormat(r.Format) {
+			return fmt.Errorf("unsupported format %q for rules %v", r.Format, r.Paths)
+		}
+		if err := checkPatterns(r.Paths); err != nil {
+			return err
+		}
+	}
+	if err := checkPatterns(c.Dashboards); err != nil {
+		return err
+	}
+
+	if c.Topology != nil {
+		if _, err := c.ParseTopology(); err != nil {
+			return err
+		}
+	}
+
+	for id, severity := range c.Lint.Severities {
+		if _, ok := tool.RuleDescriptions[id]; !ok {
+			return fmt.Errorf("unknown lint rule %q", id)
+		}
+		if severity != tool.SeverityError && severity != tool.SeverityWarning {
+			return fmt.Errorf("unsupported severity %q for lint rule %q", severity, id)
+		}
+	}
+	for _, id := range c.Lint.Disabled {
+		if _, ok := tool.RuleDescriptions[id]; !ok {
+			return fmt.Errorf("unknown lint rule %q", id)
+		}
+	}
+	return nil
+}
+
+func validFormat(format string) bool {
+	return format == "" || format == "promql" || format == "logql"
+}
+
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// ParseTopology returns the topology of the project, or nil if it has none
+func (c *Config) ParseTopology() (*tool.Topology, error) {
+	if c.Topology == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(c.Topology)
+	if err != nil {
+		return nil, err
+	}
+	topology, err := tool.ParseTopology(data)
+	if err != nil {
+		return nil, err
+	}
+	return topology, topology.Validate()
+}
+
+// Resolve returns a path of the configuration relative to the working directory
+func (c *Config) Resolve(path string) string {
+	if c.Path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return relative(filepath.Join(filepath.Dir(c.Path), path))
+}
+
+// relative returns a path relative to the working directory, if it can be
+func relative(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(wd, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// glob returns the files matched by patterns, sorted and without duplicates
+func (c *Config) glob(patterns []string) ([]string, error) {
+	seen := map[string]struct{}{}
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(c.Resolve(pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if _, ok := seen[m]; !ok {
+				seen[m] = struct{}{}
+				files = append(files, m)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// RuleFiles returns the rule files of the project
+func (c *Config) RuleFiles() ([]string, error) {
+	var patterns []string
+	for _, r := range c.Rules {
+		patterns = append(patterns, r.Paths...)
+	}
+	return c.glob(patterns)
+}
+
+// DashboardFiles returns the dashboards of the project
+func (c *Config) DashboardFiles() ([]string, error) {
+	return c.glob(c.Dashboards)
+}
+
+// FormatFor returns the query language of a rule file: that of the first rules entry matching
+// it, or else the default of the project, which may be empty
+func (c *Config) FormatFor(file string) string {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return c.Format
+	}
+
+	for _, r := range c.Rules {
+		for _, pattern := range r.Paths {
+			if matched, _ := filepath.Match(absolute(c.Resolve(pattern)), abs); matched {
+				if r.Format != "" {
+					return r.Format
+				}
+				return c.Format
+			}
+		}
+	}
+	return c.Format
+}
+
+func absolute(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// ApplyLint drops the findings of disabled rules and overrides the severity of the others
+func (c *Config) ApplyLint(findings []tool.Finding) []tool.Finding {
+	var result []tool.Finding
+	for _, f := range findings {
+		if slices.Contains(c.Lint.Disabled, f.RuleID) {
+			continue
+		}
+		if severity, ok := c.Lint.Severities[f.RuleID]; ok {
+			f.Severity = severity
+		}
+		result = append(result, f)
+	}
+	return result
+}
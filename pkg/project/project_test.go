@@ -0,0 +1,128 @@
+package project_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/project"
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+const config = `format: promql
+topology:
+  model: lma
+  model_uuid: 00000000-0000-4000-8000-000000000000
+  application: api
+  unit: api/0
+label_matchers:
+  cluster: prod
+injection_rules: injection.yaml
+rules:
+  - paths: ["rules/prometheus/*.yaml"]
+  - paths: ["rules/loki/*.yaml"]
+    format: logql
+dashboards: ["dashboards/*.json"]
+lint:
+  severities:
+    unused-variable: warning
+  disabled: [undefined-variable]
+`
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	return dir
+}
+
+func TestDiscover(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		project.FileName:                  config,
+		"rules/prometheus/api.yaml":       "groups: []\n",
+		"rules/prometheus/db.yaml":        "groups: []\n",
+		"rules/loki/api.yaml":             "groups: []\n",
+		"dashboards/api.json":             "{}\n",
+		"charms/api/src/placeholder.yaml": "",
+	})
+
+	// The file is found from any subdirectory
+	t.Chdir(filepath.Join(dir, "charms/api/src"))
+	c, err := project.Discover(".")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, project.FileName), c.Path)
+	assert.Equal(t, "promql", c.Format)
+
+	files, err := c.RuleFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"../../../rules/loki/api.yaml", "../../../rules/prometheus/api.yaml", "../../../rules/prometheus/db.yaml"}, files)
+
+	files, err = c.DashboardFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"../../../dashboards/api.json"}, files)
+
+	assert.Equal(t, "logql", c.FormatFor("../../../rules/loki/api.yaml"))
+	assert.Equal(t, "promql", c.FormatFor(filepath.Join(dir, "rules/prometheus/db.yaml")))
+	assert.Equal(t, "promql", c.FormatFor("other.yaml"))
+	assert.Equal(t, "../../../injection.yaml", c.Resolve(c.InjectionRules))
+
+	topology, err := c.ParseTopology()
+	assert.NoError(t, err)
+	assert.Equal(t, "api", topology.Application)
+}
+
+func TestDiscoverNone(t *testing.T) {
+	t.Chdir(t.TempDir())
+	c, err := project.Discover(".")
+	assert.NoError(t, err)
+	assert.Equal(t, "", c.Path)
+	assert.Equal(t, "other.yaml", c.Resolve("other.yaml"))
+
+	files, err := c.RuleFiles()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected string
+	}{
+		{"formats: promql\n", "field formats not found"},
+		{"format: metricsql\n", `unsupported format "metricsql"`},
+		{"rules:\n  - paths: [x]\n    format: sql\n", `unsupported format "sql" for rules [x]`},
+		{"dashboards: ['[']\n", `invalid pattern "["`},
+		{"topology:\n  model: lma\n", "invalid topology"},
+		{"lint:\n  disabled: [typo]\n", `unknown lint rule "typo"`},
+		{"lint:\n  severities:\n    invalid-rule: info\n", `unsupported severity "info" for lint rule "invalid-rule"`},
+	}
+
+	for _, tt := range tests {
+		dir := writeFiles(t, map[string]string{project.FileName: tt.config})
+		_, err := project.Load(filepath.Join(dir, project.FileName))
+		if assert.Error(t, err, tt.config) {
+			assert.Contains(t, err.Error(), tt.expected, tt.config)
+		}
+	}
+}
+
+func TestApplyLint(t *testing.T) {
+	dir := writeFiles(t, map[string]string{project.FileName: config})
+	c, err := project.Load(filepath.Join(dir, project.FileName))
+	assert.NoError(t, err)
+
+	findings := c.ApplyLint([]tool.Finding{
+		{File: "a.json", RuleID: "undefined-variable", Severity: tool.SeverityError},
+		{File: "a.json", RuleID: "unused-variable", Severity: tool.SeverityError},
+		{File: "a.json", RuleID: "invalid-expression", Severity: tool.SeverityError},
+	})
+	assert.Equal(t, []tool.Finding{
+		{File: "a.json", RuleID: "unused-variable", Severity: tool.SeverityWarning},
+		{File: "a.json", RuleID: "invalid-expression", Severity: tool.SeverityError},
+	}, findings)
+	assert.False(t, tool.HasErrors(findings[:1]))
+}
@@ -0,0 +1,201 @@
+// Package proxy enforces label matchers on the query APIs of Prometheus and Loki, in the spirit
+// of prom-label-proxy, so that each tenant, such as a Juju model, only sees its own series.
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+)
+
+// Options configure a Proxy
+type Options struct {
+	// Upstream is the URL of the Prometheus or Loki server
+	Upstream *url.URL
+	// LabelMatchers are enforced on every request
+	LabelMatchers map[string]string
+	// TenantHeader, if set, names a request header holding comma-separated label=value matchers
+	// to enforce along with LabelMatchers, which take precedence. Requests without it are
+	// rejected.
+	TenantHeader string
+}
+
+// endpoint is an API endpoint whose parameter holds expressions in a query language
+type endpoint struct {
+	path  string
+	logql bool
+	param string
+	// selector is set for endpoints whose parameter is optional, where a missing parameter
+	// would select every series
+	selector bool
+}
+
+// endpoints are the only paths proxied; any other path would let requests through unchecked
+var endpoints = []endpoint{
+	{path: "/api/v1/query", param: "query"},
+	{path: "/api/v1/query_range", param: "query"},
+	{path: "/api/v1/series", param: "match[]", selector: true},
+	{path: "/api/v1/labels", param: "match[]", selector: true},
+	{path: "/api/v1/label/{name}/values", param: "match[]", selector: true},
+	{path: "/loki/api/v1/query", logql: true, param: "query"},
+	{path: "/loki/api/v1/query_range", logql: true, param: "query"},
+	{path: "/loki/api/v1/series", logql: true, param: "match[]", selector: true},
+	{path: "/loki/api/v1/labels", logql: true, param: "query", selector: true},
+	{path: "/loki/api/v1/label/{name}/values", logql: true, param: "query", selector: true},
+}
+
+// Proxy rewrites query API requests and forwards them upstream. It is safe for concurrent use.
+type Proxy struct {
+	opts  Options
+	mux   *http.ServeMux
+	proxy *httputil.ReverseProxy
+}
+
+// New returns a proxy forwarding the query endpoints of Prometheus and Loki to opts.Upstream.
+// Requests to other paths fail with status 404.
+func New(opts Options) (*Proxy, error) {
+	if opts.Upstream == nil {
+		return nil, errors.New("no upstream")
+	}
+	if len(opts.LabelMatchers) == 0 && opts.TenantHeader == "" {
+		return nil, errors.New("no label matchers to enforce")
+	}
+
+	p := &Proxy{
+		opts: opts,
+		mux:  http.NewServeMux(),
+		proxy: &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(opts.Upstream)
+				r.SetXForwarded()
+			},
+		},
+	}
+	for _, e := range endpoints {
+		p.mux.Handle("GET "+e.path, p.handler(e))
+		p.mux.Handle("POST "+e.path, p.handler(e))
+	}
+	return p, nil
+}
+
+// ServeHTTP implements http.Handler
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+// handler enforces the label matchers on the parameter of an endpoint. The rewritten parameters
+// replace the query string of GET requests and the body of POST requests, which Prometheus and
+// Loki would otherwise merge with the original query string.
+func (p *Proxy) handler(e endpoint) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matchers, err := p.matchers(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		form := r.Form
+		if err := enforce(e, form, matchers); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		encoded := form.Encode()
+		if r.Method == http.MethodPost {
+			r.URL.RawQuery = ""
+			r.Body = io.NopCloser(strings.NewReader(encoded))
+			r.ContentLength = int64(len(encoded))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Content-Length", strconv.Itoa(len(encoded)))
+		} else {
+			r.URL.RawQuery = encoded
+		}
+		p.proxy.ServeHTTP(w, r)
+	})
+}
+
+// matchers returns the label matchers to enforce on a request
+func (p *Proxy) matchers(r *http.Request) (map[string]string, error) {
+	matchers := map[string]string{}
+	if p.opts.TenantHeader != "" {
+		value := r.Header.Get(p.opts.TenantHeader)
+		if value == "" {
+			return nil, fmt.Errorf("missing %s header", p.opts.TenantHeader)
+		}
+		var err error
+		if matchers, err = tool.GetLabelMatchers(strings.Split(value, ",")); err != nil {
+			return nil, fmt.Errorf("invalid %s header: %w", p.opts.TenantHeader, err)
+		}
+		// An empty value would select the series without the label, of any tenant
+		for name, v := range matchers {
+			if v == "" {
+				return nil, fmt.Errorf("invalid %s header: empty value for %s", p.opts.TenantHeader, name)
+			}
+		}
+	}
+	maps.Copy(matchers, p.opts.LabelMatchers)
+	return matchers, nil
+}
+
+// enforce enforces the label matchers on the values of the parameter of an endpoint, adding a
+// selector of the matchers alone if the parameter is optional and missing
+func enforce(e endpoint, form url.Values, matchers map[string]string) error {
+	var checker tool.Checker = &tool.PromQL{}
+	if e.logql {
+		checker = &tool.LogQL{}
+	}
+
+	// An empty parameter is the same as a missing one
+	values := slices.DeleteFunc(form[e.param], func(v string) bool { return v == "" })
+	if len(values) == 0 && e.selector {
+		values = []string{selector(matchers)}
+	}
+	for i, v := range values {
+		expr, err := tool.Enforce(checker, v, matchers)
+		if err != nil {
+			return fmt.Errorf("invalid parameter %s: %w", e.param, err)
+		}
+		values[i] = expr
+	}
+	if len(values) > 0 {
+		form[e.param] = values
+	} else {
+		delete(form, e.param)
+	}
+	return nil
+}
+
+// selector returns a selector of the label matchers alone
+func selector(matchers map[string]string) string {
+	parts := make([]string, 0, len(matchers))
+	for _, name := range slices.Sorted(maps.Keys(matchers)) {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, matchers[name]))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// writeError writes an error in the format of the Prometheus and Loki APIs
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":    "error",
+		"errorType": "bad_data",
+		"error":     err.Error(),
+	})
+}
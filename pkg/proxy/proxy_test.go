@@ -0,0 +1,228 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upstream stands in for Prometheus or Loki, recording the requests it receives
+type upstream struct {
+	mtx      sync.Mutex
+	requests []*http.Request
+	forms    []url.Values
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Like Prometheus and Loki, merge the query string and the form body
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u.mtx.Lock()
+	u.requests = append(u.requests, r)
+	u.forms = append(u.forms, r.Form)
+	u.mtx.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"success","data":[]}`))
+}
+
+func (u *upstream) last(t *testing.T) (*http.Request, url.Values) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	require.NotEmpty(t, u.requests, "no request reached the upstream")
+	return u.requests[len(u.requests)-1], u.forms[len(u.forms)-1]
+}
+
+func newTestProxy(t *testing.T, opts proxy.Options) (*httptest.Server, *upstream) {
+	u := &upstream{}
+	backend := httptest.NewServer(u)
+	t.Cleanup(backend.Close)
+
+	var err error
+	opts.Upstream, err = url.Parse(backend.URL)
+	require.NoError(t, err)
+	p, err := proxy.New(opts)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(p)
+	t.Cleanup(ts.Close)
+	return ts, u
+}
+
+func get(t *testing.T, ts *httptest.Server, path string, params url.Values, header http.Header) int {
+	req, err := http.NewRequest(http.MethodGet, ts.URL+path+"?"+params.Encode(), nil)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+var modelMatchers = map[string]string{"juju_model": "lma"}
+
+func TestNew(t *testing.T) {
+	_, err := proxy.New(proxy.Options{LabelMatchers: modelMatchers})
+	assert.EqualError(t, err, "no upstream")
+
+	_, err = proxy.New(proxy.Options{Upstream: &url.URL{Scheme: "http", Host: "localhost:9090"}})
+	assert.EqualError(t, err, "no label matchers to enforce")
+}
+
+func TestProxyPrometheus(t *testing.T) {
+	ts, u := newTestProxy(t, proxy.Options{LabelMatchers: modelMatchers})
+
+	tests := []struct {
+		name     string
+		path     string
+		params   url.Values
+		param    string
+		expected []string
+	}{
+		{
+			name:     "Instant query",
+			path:     "/api/v1/query",
+			params:   url.Values{"query": {`sum(rate(http_requests_total[5m]))`}, "time": {"1700000000"}},
+			param:    "query",
+			expected: []string{`sum(rate(http_requests_total{juju_model="lma"}[5m]))`},
+		},
+		{
+			name:     "Range query with a conflicting matcher",
+			path:     "/api/v1/query_range",
+			params:   url.Values{"query": {`up{juju_model=~".*"}`}, "start": {"0"}, "end": {"60"}, "step": {"15"}},
+			param:    "query",
+			expected: []string{`up{juju_model="lma"}`},
+		},
+		{
+			name:     "Series",
+			path:     "/api/v1/series",
+			params:   url.Values{"match[]": {`up`, `{job="api",juju_model="other"}`}},
+			param:    "match[]",
+			expected: []string{`up{juju_model="lma"}`, `{job="api",juju_model="lma"}`},
+		},
+		{
+			name:     "Labels without match",
+			path:     "/api/v1/labels",
+			params:   url.Values{},
+			param:    "match[]",
+			expected: []string{`{juju_model="lma"}`},
+		},
+		{
+			name:     "Label values",
+			path:     "/api/v1/label/job/values",
+			params:   url.Values{"match[]": {""}},
+			param:    "match[]",
+			expected: []string{`{juju_model="lma"}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := get(t, ts, tt.path, tt.params, nil)
+			assert.Equal(t, http.StatusOK, code)
+
+			r, form := u.last(t)
+			assert.Equal(t, tt.path, r.URL.Path)
+			assert.Equal(t, tt.expected, form[tt.param])
+			for k, v := range tt.params {
+				if k != tt.param {
+					assert.Equal(t, v, form[k], "other parameters must be kept")
+				}
+			}
+		})
+	}
+}
+
+func TestProxyLoki(t *testing.T) {
+	ts, u := newTestProxy(t, proxy.Options{LabelMatchers: modelMatchers})
+
+	code := get(t, ts, "/loki/api/v1/query_range", url.Values{"query": {`sum(count_over_time({app="api"} |= "error" [5m]))`}}, nil)
+	assert.Equal(t, http.StatusOK, code)
+	_, form := u.last(t)
+	assert.Equal(t, `sum(count_over_time({app="api", juju_model="lma"} |= "error"[5m]))`, form.Get("query"))
+
+	code = get(t, ts, "/loki/api/v1/labels", url.Values{}, nil)
+	assert.Equal(t, http.StatusOK, code)
+	_, form = u.last(t)
+	assert.Equal(t, `{juju_model="lma"}`, form.Get("query"))
+}
+
+func TestProxyVariableSyntax(t *testing.T) {
+	ts, u := newTestProxy(t, proxy.Options{LabelMatchers: modelMatchers})
+
+	// Queries are parsed as they are: what looks like a Grafana variable is part of a label
+	// value and must not hide the rest of the query from the enforcement
+	code := get(t, ts, "/api/v1/query", url.Values{"query": {`up{job="abc${x"} or up{juju_model='other'} #"}`}}, nil)
+	assert.Equal(t, http.StatusOK, code)
+	_, form := u.last(t)
+	assert.Equal(t, `up{job="abc${x",juju_model="lma"} or up{juju_model="lma"}`, form.Get("query"))
+
+	code = get(t, ts, "/loki/api/v1/query", url.Values{"query": {"count_over_time({job=\"a${x\"}[5m]) or count_over_time({juju_model=`other`}[5m]) //\"}[5m])"}}, nil)
+	assert.Equal(t, http.StatusOK, code)
+	_, form = u.last(t)
+	assert.Equal(t, `(count_over_time({job="a${x", juju_model="lma"}[5m]) or count_over_time({juju_model="lma"}[5m]))`, form.Get("query"))
+}
+
+func TestProxyPost(t *testing.T) {
+	ts, u := newTestProxy(t, proxy.Options{LabelMatchers: modelMatchers})
+
+	// A query in the query string must not reach the upstream along with the rewritten body
+	resp, err := http.Post(ts.URL+"/api/v1/query?query=up", "application/x-www-form-urlencoded",
+		strings.NewReader(url.Values{"query": {`up{juju_model="other"}`}}.Encode()))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	r, form := u.last(t)
+	assert.Empty(t, r.URL.RawQuery)
+	assert.Equal(t, []string{`up{juju_model="lma"}`, `up{juju_model="lma"}`}, form["query"])
+}
+
+func TestProxyTenantHeader(t *testing.T) {
+	ts, u := newTestProxy(t, proxy.Options{
+		LabelMatchers: map[string]string{"juju_model": "lma"},
+		TenantHeader:  "X-Tenant",
+	})
+	params := url.Values{"query": {`up`}}
+
+	code := get(t, ts, "/api/v1/query", params, http.Header{"X-Tenant": {"juju_application=api,juju_model=other"}})
+	assert.Equal(t, http.StatusOK, code)
+	_, form := u.last(t)
+	assert.Equal(t, `up{juju_application="api",juju_model="lma"}`, form.Get("query"), "static matchers take precedence")
+
+	for _, header := range []http.Header{nil, {"X-Tenant": {"juju_application"}}, {"X-Tenant": {"juju_application="}}} {
+		code := get(t, ts, "/api/v1/query", params, header)
+		assert.Equal(t, http.StatusBadRequest, code, "header %v", header)
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	ts, u := newTestProxy(t, proxy.Options{LabelMatchers: modelMatchers})
+
+	resp, err := http.Get(ts.URL + "/api/v1/query?query=" + url.QueryEscape("sum(up"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var body map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "error", body["status"])
+	assert.Equal(t, "bad_data", body["errorType"])
+
+	// Paths which cannot be rewritten are not proxied
+	for _, path := range []string{"/federate", "/api/v1/query_exemplars", "/api/v1/read", "/api/v1/admin/tsdb/delete_series"} {
+		code := get(t, ts, path, url.Values{"match[]": {"up"}}, nil)
+		assert.Equal(t, http.StatusNotFound, code, path)
+	}
+	assert.Empty(t, u.requests)
+}
@@ -0,0 +1,295 @@
+// Package server exposes the transform, validation and analysis of cos-tool as a JSON HTTP API,
+// so that charms can query a long-running process instead of running the binary in each hook.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultMaxRequestBytes is the default limit on the size of request bodies
+const DefaultMaxRequestBytes = 1 << 20
+
+// Options configure a Server
+type Options struct {
+	// DefaultFormat is the query language of requests which do not set one, promql or logql
+	DefaultFormat string
+	// InjectionRules, if set, scope the matchers injected by transform requests
+	InjectionRules *tool.InjectionRules
+	// MaxRequestBytes limits the size of request bodies, DefaultMaxRequestBytes if zero
+	MaxRequestBytes int64
+}
+
+// Server serves the API. It is safe for concurrent use: every request gets its own checker.
+type Server struct {
+	opts Options
+	mux  *http.ServeMux
+}
+
+// New returns a server with the API under /api/v1, its own metrics under /metrics and a
+// health check under /-/healthy
+func New(opts Options) (*Server, error) {
+	if opts.DefaultFormat == "" {
+		opts.DefaultFormat = "promql"
+	}
+	if _, err := newChecker(opts.DefaultFormat); err != nil {
+		return nil, err
+	}
+	if opts.MaxRequestBytes == 0 {
+		opts.MaxRequestBytes = DefaultMaxRequestBytes
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cos_tool_http_requests_total",
+		Help: "Number of HTTP requests by handler and status code.",
+	}, []string{"handler", "code"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cos_tool_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by handler.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+	inFlight := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cos_tool_http_requests_in_flight",
+		Help: "Number of HTTP requests being served.",
+	})
+	registry.MustRegister(requests, duration, inFlight)
+
+	s := &Server{opts: opts, mux: http.NewServeMux()}
+	handle := func(pattern, name string, h http.Handler) {
+		h = promhttp.InstrumentHandlerInFlight(inFlight,
+			promhttp.InstrumentHandlerDuration(duration.MustCurryWith(prometheus.Labels{"handler": name}),
+				promhttp.InstrumentHandlerCounter(requests.MustCurryWith(prometheus.Labels{"handler": name}), h)))
+		s.mux.Handle(pattern, h)
+	}
+
+	handle("POST /api/v1/transform", "transform", apiHandler(s, s.transform))
+	handle("POST /api/v1/validate-rules", "validate-rules", apiHandler(s, s.validateRules))
+	handle("POST /api/v1/validate-config", "validate-config", apiHandler(s, s.validateConfig))
+	handle("POST /api/v1/analyze", "analyze", apiHandler(s, s.analyze))
+	handle("GET /-/healthy", "healthy", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}))
+	s.mux.Handle("GET /metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Request is the common part of API requests
+type Request struct {
+	// Format is the query language, promql or logql; the server's default if empty
+	Format string `json:"format,omitempty"`
+}
+
+// TransformRequest asks for label matchers to be injected into an expression
+type TransformRequest struct {
+	Request
+	Expr          string            `json:"expr"`
+	LabelMatchers map[string]string `json:"label_matchers,omitempty"`
+	// Topology is a Juju topology in either of the forms accepted by --topology, whose label
+	// matchers are injected along with LabelMatchers, which take precedence
+	Topology json.RawMessage `json:"topology,omitempty"`
+	OmitUnit bool            `json:"omit_unit,omitempty"`
+}
+
+// ExprResponse holds a transformed expression
+type ExprResponse struct {
+	Expr string `json:"expr"`
+}
+
+// ValidateRequest holds a rule file or a Prometheus configuration file to validate
+type ValidateRequest struct {
+	Request
+	// Filename names the file in error messages
+	Filename string `json:"filename,omitempty"`
+	Content  string `json:"content"`
+}
+
+// ValidateResponse is the result of a validation. An invalid file is not a failed request.
+type ValidateResponse struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// AnalyzeRequest holds an expression to analyze
+type AnalyzeRequest struct {
+	Request
+	Expr string `json:"expr"`
+}
+
+// ErrorResponse is returned by failed requests
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// httpError is an error with the status code to respond with
+type httpError struct {
+	code int
+	err  error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+// unprocessable wraps an error about the content of a well-formed request
+func unprocessable(err error) error {
+	return &httpError{code: http.StatusUnprocessableEntity, err: err}
+}
+
+// apiHandler decodes a JSON request of type T, limited in size, and encodes the response of f
+func apiHandler[T any](s *Server, f func(*T) (interface{}, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := new(T)
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.opts.MaxRequestBytes))
+		decoder.DisallowUnknownFields()
+
+		var resp interface{}
+		err := decoder.Decode(req)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			err = &httpError{code: http.StatusRequestEntityTooLarge, err: fmt.Errorf("request body larger than %d bytes", maxBytesErr.Limit)}
+		case err != nil:
+			err = &httpError{code: http.StatusBadRequest, err: fmt.Errorf("malformed request: %w", err)}
+		default:
+			resp, err = f(req)
+		}
+
+		code := http.StatusOK
+		if err != nil {
+			code = http.StatusInternalServerError
+			var httpErr *httpError
+			if errors.As(err, &httpErr) {
+				code = httpErr.code
+			}
+			resp = ErrorResponse{Error: err.Error()}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// checker returns a new checker for the format of a request
+func (s *Server) checker(req Request) (tool.Checker, error) {
+	format := req.Format
+	if format == "" {
+		format = s.opts.DefaultFormat
+	}
+	return newChecker(format)
+}
+
+func newChecker(format string) (tool.Checker, error) {
+	switch strings.ToLower(format) {
+	case "promql":
+		return &tool.PromQL{}, nil
+	case "logql":
+		return &tool.LogQL{}, nil
+	default:
+		return nil, &httpError{code: http.StatusBadRequest, err: fmt.Errorf("unsupported format %q", format)}
+	}
+}
+
+func (s *Server) transform(req *TransformRequest) (interface{}, error) {
+	checker, err := s.checker(req.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	matchers := map[string]string{}
+	if len(req.Topology) > 0 {
+		topology, err := tool.ParseTopology(req.Topology)
+		if err == nil {
+			err = topology.Validate()
+		}
+		if err != nil {
+			return nil, unprocessable(err)
+		}
+		matchers = topology.LabelMatchers(!req.OmitUnit)
+	}
+	for k, v := range req.LabelMatchers {
+		matchers[k] = v
+	}
+
+	expr, err := tool.TransformWithRules(checker, req.Expr, &matchers, s.opts.InjectionRules)
+	if err != nil {
+		return nil, unprocessable(err)
+	}
+	return ExprResponse{Expr: expr}, nil
+}
+
+func (s *Server) validateRules(req *ValidateRequest) (interface{}, error) {
+	checker, err := s.checker(req.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := checker.ValidateRules(filename(req, "rules.yaml"), []byte(req.Content)); err != nil {
+		return ValidateResponse{Error: err.Error()}, nil
+	}
+	return ValidateResponse{Valid: true}, nil
+}
+
+func (s *Server) validateConfig(req *ValidateRequest) (interface{}, error) {
+	checker, err := s.checker(req.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checkers validate configurations from files
+	f, err := os.CreateTemp("", "cos-tool-config-*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(req.Content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checker.ValidateConfig(f.Name()); err != nil {
+		message := strings.ReplaceAll(err.Error(), f.Name(), filename(req, "prometheus.yml"))
+		return ValidateResponse{Error: message}, nil
+	}
+	return ValidateResponse{Valid: true}, nil
+}
+
+func (s *Server) analyze(req *AnalyzeRequest) (interface{}, error) {
+	checker, err := s.checker(req.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	analysis, err := tool.Analyze(checker, req.Expr)
+	if err != nil {
+		return nil, unprocessable(err)
+	}
+	return analysis, nil
+}
+
+func filename(req *ValidateRequest, fallback string) string {
+	if req.Filename != "" {
+		return req.Filename
+	}
+	return fallback
+}
@@ -0,0 +1,178 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/server"
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, opts server.Options) *httptest.Server {
+	s, err := server.New(opts)
+	require.NoError(t, err)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func post(t *testing.T, ts *httptest.Server, path string, body interface{}, resp interface{}) int {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	r, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(data))
+	require.NoError(t, err)
+	defer r.Body.Close()
+
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	require.NoError(t, json.NewDecoder(r.Body).Decode(resp))
+	return r.StatusCode
+}
+
+func TestTransform(t *testing.T) {
+	ts := newTestServer(t, server.Options{})
+
+	var resp server.ExprResponse
+	code := post(t, ts, "/api/v1/transform", server.TransformRequest{
+		Expr:          `rate(http_requests_total[5m])`,
+		LabelMatchers: map[string]string{"juju_unit": "api/0"},
+		Topology:      json.RawMessage(`{"model": "cos", "model_uuid": "00000000-0000-4000-8000-000000000000", "application": "api", "unit": "api/0"}`),
+		OmitUnit:      true,
+	}, &resp)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `rate(http_requests_total{juju_application="api",juju_model="cos",juju_model_uuid="00000000-0000-4000-8000-000000000000",juju_unit="api/0"}[5m])`, resp.Expr)
+
+	code = post(t, ts, "/api/v1/transform", server.TransformRequest{
+		Request:       server.Request{Format: "logql"},
+		Expr:          `{app="api"} |= "error"`,
+		LabelMatchers: map[string]string{"juju_model": "cos"},
+	}, &resp)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{app="api", juju_model="cos"} |= "error"`, resp.Expr)
+
+	var errResp server.ErrorResponse
+	code = post(t, ts, "/api/v1/transform", server.TransformRequest{Expr: `rate(`}, &errResp)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.NotEmpty(t, errResp.Error)
+
+	code = post(t, ts, "/api/v1/transform", server.TransformRequest{Request: server.Request{Format: "sql"}, Expr: `up`}, &errResp)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, `unsupported format "sql"`, errResp.Error)
+}
+
+func TestTransformInjectionRules(t *testing.T) {
+	rules, err := tool.LoadInjectionRules([]byte("rules:\n  - skip: {job: blackbox}\n"))
+	require.NoError(t, err)
+	ts := newTestServer(t, server.Options{InjectionRules: rules})
+
+	var resp server.ExprResponse
+	post(t, ts, "/api/v1/transform", server.TransformRequest{
+		Expr:          `up{job="blackbox"} + up{job="api"}`,
+		LabelMatchers: map[string]string{"juju_model": "cos"},
+	}, &resp)
+	assert.Equal(t, `up{job="blackbox"} + up{job="api",juju_model="cos"}`, resp.Expr)
+}
+
+func TestValidate(t *testing.T) {
+	ts := newTestServer(t, server.Options{})
+
+	var resp server.ValidateResponse
+	code := post(t, ts, "/api/v1/validate-rules", server.ValidateRequest{
+		Content: "groups:\n  - name: test\n    rules:\n      - alert: Up\n        expr: up == 1\n",
+	}, &resp)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, resp.Valid)
+
+	code = post(t, ts, "/api/v1/validate-rules", server.ValidateRequest{
+		Filename: "api.rules",
+		Content:  "groups:\n  - name: test\n    rules:\n      - alert: Up\n        expr: up{\n",
+	}, &resp)
+	assert.Equal(t, http.StatusOK, code, "an invalid file is not a failed request")
+	assert.False(t, resp.Valid)
+	assert.Contains(t, resp.Error, "error validating api.rules")
+
+	code = post(t, ts, "/api/v1/validate-config", server.ValidateRequest{
+		Content: "scrape_configs:\n  - job_name: api\n    static_configs:\n      - targets: [localhost:8080]\n",
+	}, &resp)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, resp.Valid)
+
+	post(t, ts, "/api/v1/validate-config", server.ValidateRequest{Content: "scrape_configs: 1\n"}, &resp)
+	assert.False(t, resp.Valid)
+	assert.Contains(t, resp.Error, "prometheus.yml")
+}
+
+func TestAnalyze(t *testing.T) {
+	ts := newTestServer(t, server.Options{})
+
+	var resp tool.Analysis
+	code := post(t, ts, "/api/v1/analyze", server.AnalyzeRequest{Expr: `sum by (job) (rate(up[5m]))`}, &resp)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"sum", "rate"}, resp.Functions)
+	assert.Equal(t, "job", resp.OutputLabels.String())
+}
+
+func TestRequestLimits(t *testing.T) {
+	ts := newTestServer(t, server.Options{MaxRequestBytes: 64})
+
+	var errResp server.ErrorResponse
+	code := post(t, ts, "/api/v1/analyze", server.AnalyzeRequest{Expr: "up" + strings.Repeat(" + up", 20)}, &errResp)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	assert.Equal(t, "request body larger than 64 bytes", errResp.Error)
+
+	code = post(t, ts, "/api/v1/analyze", map[string]string{"query": "up"}, &errResp)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, errResp.Error, "malformed request")
+
+	r, err := http.Get(ts.URL + "/api/v1/analyze")
+	require.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, r.StatusCode)
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	ts := newTestServer(t, server.Options{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			unit := []string{"a/0", "b/1"}[i%2]
+			var resp server.ExprResponse
+			post(t, ts, "/api/v1/transform", server.TransformRequest{
+				Expr:          `sum(rate(http_requests_total[5m])) / sum(up)`,
+				LabelMatchers: map[string]string{"juju_unit": unit},
+			}, &resp)
+			assert.Equal(t, `sum(rate(http_requests_total{juju_unit="`+unit+`"}[5m])) / sum(up{juju_unit="`+unit+`"})`, resp.Expr)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t, server.Options{})
+
+	var resp server.ExprResponse
+	post(t, ts, "/api/v1/transform", server.TransformRequest{Expr: `up`}, &resp)
+
+	r, err := http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `cos_tool_http_requests_total{code="200",handler="transform"} 1`)
+
+	r, err = http.Get(ts.URL + "/-/healthy")
+	require.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+}
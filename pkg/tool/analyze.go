@@ -0,0 +1,553 @@
+package tool
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	logqlparser "github.com/canonical/cos-tool/pkg/logql/syntax"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Analysis lists what an expression depends on and what it returns
+type Analysis struct {
+	// Source locates the expression in a rule file or dashboard, empty for a single expression
+	Source    string             `json:"source,omitempty"`
+	Expr      string             `json:"expr"`
+	Selectors []SelectorAnalysis `json:"selectors"`
+	// Functions holds the functions and aggregation operators used
+	Functions    []string     `json:"functions"`
+	Ranges       []string     `json:"ranges"`
+	Offsets      []string     `json:"offsets"`
+	OutputLabels OutputLabels `json:"output_labels"`
+}
+
+// SelectorAnalysis is a vector or stream selector used by an expression
+type SelectorAnalysis struct {
+	// Metric is the metric name of a PromQL selector, empty for LogQL stream selectors and
+	// selectors matching on __name__
+	Metric   string   `json:"metric,omitempty"`
+	Matchers []string `json:"matchers"`
+}
+
+// OutputLabels describes the labels of the series returned by an expression, as far as they
+// can be told from the expression alone: either exactly Labels, or, if All is set, all the
+// labels of the selected series except Without, plus Labels.
+type OutputLabels struct {
+	All     bool     `json:"all"`
+	Labels  []string `json:"labels"`
+	Without []string `json:"without,omitempty"`
+}
+
+// String formats the output labels, e.g. "job, instance" or "* without (le)"
+func (o OutputLabels) String() string {
+	if !o.All {
+		if len(o.Labels) == 0 {
+			return "none"
+		}
+		return strings.Join(o.Labels, ", ")
+	}
+
+	s := "*"
+	if len(o.Without) > 0 {
+		s += " without (" + strings.Join(o.Without, ", ") + ")"
+	}
+	if len(o.Labels) > 0 {
+		s += " + (" + strings.Join(o.Labels, ", ") + ")"
+	}
+	return s
+}
+
+func allLabels() OutputLabels {
+	return OutputLabels{All: true, Labels: []string{}}
+}
+
+func exactLabels(names ...string) OutputLabels {
+	return OutputLabels{Labels: appendUnique([]string{}, names...)}
+}
+
+// with adds labels to the output, e.g. the destination label of label_replace
+func (o OutputLabels) with(names ...string) OutputLabels {
+	o.Without = slices.DeleteFunc(slices.Clone(o.Without), func(n string) bool { return slices.Contains(names, n) })
+	o.Labels = appendUnique(slices.Clone(o.Labels), names...)
+	return o
+}
+
+// without removes labels from the output, e.g. those of a without clause
+func (o OutputLabels) without(names ...string) OutputLabels {
+	o.Labels = slices.DeleteFunc(slices.Clone(o.Labels), func(n string) bool { return slices.Contains(names, n) })
+	if o.All {
+		o.Without = appendUnique(slices.Clone(o.Without), names...)
+	}
+	return o
+}
+
+// keep restricts the output to the given labels, e.g. those of an on clause
+func (o OutputLabels) keep(names ...string) OutputLabels {
+	var kept []string
+	for _, n := range names {
+		if slices.Contains(o.Labels, n) || (o.All && !slices.Contains(o.Without, n)) {
+			kept = append(kept, n)
+		}
+	}
+	return exactLabels(kept...)
+}
+
+// union returns the labels of either output, e.g. for the or operator
+func (o OutputLabels) union(other OutputLabels) OutputLabels {
+	result := OutputLabels{All: o.All || other.All, Labels: appendUnique(slices.Clone(o.Labels), other.Labels...)}
+	for _, n := range o.Without {
+		if (!other.All || slices.Contains(other.Without, n)) && !slices.Contains(result.Labels, n) {
+			result.Without = append(result.Without, n)
+		}
+	}
+	for _, n := range other.Without {
+		if !o.All && !slices.Contains(result.Labels, n) && !slices.Contains(result.Without, n) {
+			result.Without = append(result.Without, n)
+		}
+	}
+	return result
+}
+
+// appendUnique appends the values that are not in list yet, keeping the order of first use
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		if !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// formatOffset formats an offset duration, which unlike ranges may be negative
+func formatOffset(d time.Duration) string {
+	if d < 0 {
+		return "-" + model.Duration(-d).String()
+	}
+	return model.Duration(d).String()
+}
+
+func newAnalysis(expr string) *Analysis {
+	return &Analysis{
+		Expr:         expr,
+		Selectors:    []SelectorAnalysis{},
+		Functions:    []string{},
+		Ranges:       []string{},
+		Offsets:      []string{},
+		OutputLabels: exactLabels(),
+	}
+}
+
+// analyzeVariableQuery analyzes the expression embedded in a Grafana variable query
+func analyzeVariableQuery(arg string, q grafanaVariableQuery, analyze func(string) (*Analysis, error)) (*Analysis, error) {
+	if q.expr == "" || q.function == "metrics" {
+		return newAnalysis(arg), nil
+	}
+
+	a, err := analyze(q.expr)
+	if err != nil {
+		return nil, err
+	}
+	a.Expr = arg
+	if q.function == "label_values" {
+		a.OutputLabels = exactLabels(q.label)
+	}
+	return a, nil
+}
+
+// Analyze lists what a PromQL or LogQL expression, depending on checker, uses and the labels of
+// the series it returns
+func Analyze(checker Checker, arg string) (*Analysis, error) {
+	switch c := checker.(type) {
+	case *PromQL:
+		return c.analyze(arg)
+	case *LogQL:
+		return c.analyze(arg)
+	}
+	return nil, fmt.Errorf("analysis is not supported by %T", checker)
+}
+
+// analyze lists the selectors, functions, ranges and offsets used by an expression, and the
+// labels of the series it returns
+func (p *PromQL) analyze(arg string) (*Analysis, error) {
+	if q, ok := parseGrafanaVariableQuery(arg); ok {
+		return analyzeVariableQuery(arg, q, p.analyze)
+	}
+
+	exp, restore, err := p.parse(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	a := newAnalysis(arg)
+	parser.Inspect(exp, func(node parser.Node, _ []parser.Node) error {
+		switch e := node.(type) {
+		case *parser.VectorSelector:
+			s := SelectorAnalysis{Metric: restore(e.Name), Matchers: []string{}}
+			for _, m := range e.LabelMatchers {
+				if m.Name == labels.MetricName && m.Type == labels.MatchEqual && m.Value == e.Name {
+					continue
+				}
+				s.Matchers = append(s.Matchers, restore(m.String()))
+			}
+			a.Selectors = append(a.Selectors, s)
+			if e.OriginalOffset != 0 {
+				a.Offsets = appendUnique(a.Offsets, restore(formatOffset(e.OriginalOffset)))
+			}
+		case *parser.MatrixSelector:
+			a.Ranges = appendUnique(a.Ranges, restore(model.Duration(e.Range).String()))
+		case *parser.SubqueryExpr:
+			subquery := model.Duration(e.Range).String()
+			if e.Step != 0 {
+				subquery += ":" + model.Duration(e.Step).String()
+			}
+			a.Ranges = appendUnique(a.Ranges, restore(subquery))
+			if e.OriginalOffset != 0 {
+				a.Offsets = appendUnique(a.Offsets, restore(formatOffset(e.OriginalOffset)))
+			}
+		case *parser.Call:
+			a.Functions = appendUnique(a.Functions, strings.TrimSuffix(restore(e.Func.Name+"("), "("))
+		case *parser.AggregateExpr:
+			a.Functions = appendUnique(a.Functions, e.Op.String())
+		}
+		return nil
+	})
+
+	a.OutputLabels = promQLOutputLabels(exp)
+	for i, name := range a.OutputLabels.Labels {
+		a.OutputLabels.Labels[i] = restore(name)
+	}
+	for i, name := range a.OutputLabels.Without {
+		a.OutputLabels.Without[i] = restore(name)
+	}
+	return a, nil
+}
+
+// promQLOutputLabels works out the labels of the series returned by a PromQL expression,
+// following how the engine builds result labels
+func promQLOutputLabels(exp parser.Expr) OutputLabels {
+	switch e := exp.(type) {
+	case *parser.VectorSelector, *parser.MatrixSelector:
+		return allLabels()
+	case *parser.ParenExpr:
+		return promQLOutputLabels(e.Expr)
+	case *parser.StepInvariantExpr:
+		return promQLOutputLabels(e.Expr)
+	case *parser.SubqueryExpr:
+		return promQLOutputLabels(e.Expr)
+	case *parser.UnaryExpr:
+		return promQLOutputLabels(e.Expr)
+	case *parser.Call:
+		return promQLCallOutputLabels(e)
+	case *parser.AggregateExpr:
+		switch e.Op {
+		case parser.TOPK, parser.BOTTOMK, parser.LIMITK, parser.LIMIT_RATIO:
+			return promQLOutputLabels(e.Expr)
+		}
+		var result OutputLabels
+		if e.Without {
+			result = promQLOutputLabels(e.Expr).without(e.Grouping...)
+		} else {
+			result = exactLabels(e.Grouping...)
+		}
+		if s, ok := e.Param.(*parser.StringLiteral); ok && e.Op == parser.COUNT_VALUES {
+			result = result.with(s.Val)
+		}
+		return result
+	case *parser.BinaryExpr:
+		lhs, rhs := promQLOutputLabels(e.LHS), promQLOutputLabels(e.RHS)
+		switch {
+		case e.LHS.Type() == parser.ValueTypeScalar:
+			return rhs
+		case e.RHS.Type() == parser.ValueTypeScalar:
+			return lhs
+		case e.Op == parser.LOR:
+			return lhs.union(rhs)
+		case e.Op == parser.LAND || e.Op == parser.LUNLESS:
+			return lhs
+		}
+
+		vm := e.VectorMatching
+		if vm == nil {
+			return lhs
+		}
+		switch vm.Card {
+		case parser.CardManyToOne:
+			return lhs.with(vm.Include...)
+		case parser.CardOneToMany:
+			return rhs.with(vm.Include...)
+		}
+		if vm.On {
+			return lhs.keep(vm.MatchingLabels...)
+		}
+		return lhs.without(vm.MatchingLabels...)
+	}
+	return exactLabels()
+}
+
+func promQLCallOutputLabels(e *parser.Call) OutputLabels {
+	if e.Type() != parser.ValueTypeVector && e.Type() != parser.ValueTypeMatrix {
+		return exactLabels()
+	}
+
+	stringArg := func(i int) string {
+		if i < len(e.Args) {
+			if s, ok := e.Args[i].(*parser.StringLiteral); ok {
+				return s.Val
+			}
+		}
+		return ""
+	}
+
+	switch e.Func.Name {
+	case "absent", "absent_over_time":
+		// The labels of the equality matchers of the selector, if any
+		var names []string
+		parser.Inspect(e, func(node parser.Node, _ []parser.Node) error {
+			if vs, ok := node.(*parser.VectorSelector); ok {
+				for _, m := range vs.LabelMatchers {
+					if m.Type == labels.MatchEqual && m.Name != labels.MetricName {
+						names = append(names, m.Name)
+					}
+				}
+			}
+			return nil
+		})
+		return exactLabels(names...)
+	case "label_replace", "label_join":
+		if len(e.Args) > 0 {
+			return promQLOutputLabels(e.Args[0]).with(stringArg(1))
+		}
+	case "histogram_quantile", "histogram_fraction":
+		if len(e.Args) > 0 {
+			return promQLOutputLabels(e.Args[len(e.Args)-1]).without("le")
+		}
+	}
+
+	for _, arg := range e.Args {
+		if t := arg.Type(); t == parser.ValueTypeVector || t == parser.ValueTypeMatrix {
+			return promQLOutputLabels(arg)
+		}
+	}
+	return exactLabels()
+}
+
+// analyze lists the stream selectors, range and vector aggregations, ranges and offsets used
+// by an expression, and the labels of the series it returns
+func (p *LogQL) analyze(arg string) (*Analysis, error) {
+	if q, ok := parseGrafanaVariableQuery(arg); ok {
+		return analyzeVariableQuery(arg, q, p.analyze)
+	}
+
+	exp, restore, err := p.parse(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	a := newAnalysis(arg)
+	exp.Walk(func(node interface{}) {
+		switch e := node.(type) {
+		case *logqlparser.MatchersExpr:
+			s := SelectorAnalysis{Matchers: []string{}}
+			for _, m := range e.Matchers() {
+				s.Matchers = append(s.Matchers, restore(m.String()))
+			}
+			a.Selectors = append(a.Selectors, s)
+		case *logqlparser.LogRange:
+			a.Ranges = appendUnique(a.Ranges, restore(model.Duration(e.Interval).String()))
+			if e.Offset != 0 {
+				a.Offsets = appendUnique(a.Offsets, restore(formatOffset(e.Offset)))
+			}
+		case *logqlparser.RangeAggregationExpr:
+			a.Functions = appendUnique(a.Functions, e.Operation)
+		case *logqlparser.VectorAggregationExpr:
+			a.Functions = appendUnique(a.Functions, e.Operation)
+		case *logqlparser.LabelReplaceExpr:
+			a.Functions = appendUnique(a.Functions, logqlparser.OpLabelReplace)
+		}
+	})
+
+	if sample, ok := exp.(logqlparser.SampleExpr); ok {
+		a.OutputLabels = logQLOutputLabels(sample)
+	} else {
+		// Log queries return streams with all their labels
+		a.OutputLabels = allLabels()
+	}
+	return a, nil
+}
+
+// logQLOutputLabels works out the labels of the series returned by a LogQL metric query
+func logQLOutputLabels(exp logqlparser.SampleExpr) OutputLabels {
+	grouped := func(g *logqlparser.Grouping, inner OutputLabels) OutputLabels {
+		switch {
+		case g == nil:
+			return inner
+		case g.Without:
+			return inner.without(g.Groups...)
+		default:
+			return exactLabels(g.Groups...)
+		}
+	}
+
+	switch e := exp.(type) {
+	case *logqlparser.RangeAggregationExpr:
+		return grouped(e.Grouping, allLabels())
+	case *logqlparser.VectorAggregationExpr:
+		inner := logQLOutputLabels(e.Left)
+		switch e.Operation {
+		case logqlparser.OpTypeTopK, logqlparser.OpTypeBottomK, logqlparser.OpTypeSort, logqlparser.OpTypeSortDesc:
+			return inner
+		}
+		if e.Grouping == nil || (!e.Grouping.Without && len(e.Grouping.Groups) == 0) {
+			return exactLabels()
+		}
+		return grouped(e.Grouping, inner)
+	case *logqlparser.LabelReplaceExpr:
+		return logQLOutputLabels(e.Left).with(e.Dst)
+	case *logqlparser.BinOpExpr:
+		lhs, rhs := logQLOutputLabels(e.SampleExpr), logQLOutputLabels(e.RHS)
+		_, lhsLiteral := e.SampleExpr.(*logqlparser.LiteralExpr)
+		_, rhsLiteral := e.RHS.(*logqlparser.LiteralExpr)
+		switch {
+		case lhsLiteral:
+			return rhs
+		case rhsLiteral:
+			return lhs
+		case e.Op == logqlparser.OpTypeOr:
+			return lhs.union(rhs)
+		}
+		if e.Opts == nil || e.Opts.VectorMatching == nil {
+			return lhs
+		}
+		vm := e.Opts.VectorMatching
+		switch vm.Card {
+		case logqlparser.CardManyToOne:
+			return lhs.with(vm.Include...)
+		case logqlparser.CardOneToMany:
+			return rhs.with(vm.Include...)
+		}
+		if vm.On {
+			return lhs.keep(vm.MatchingLabels...)
+		}
+		return lhs.without(vm.MatchingLabels...)
+	}
+	return exactLabels()
+}
+
+// AnalyzeRules analyzes every expression of a rule file
+func AnalyzeRules(checker Checker, filename string, data []byte) ([]*Analysis, error) {
+	if _, err := checker.ValidateRules(filename, data); err != nil {
+		return nil, err
+	}
+
+	rf := AlertRuleFile{Filepath: filename}
+	if err := yaml.Unmarshal(data, &rf); err != nil {
+		return nil, fmt.Errorf("error analyzing %s: %w", filename, err)
+	}
+
+	var analyses []*Analysis
+	for _, group := range rf.Groups {
+		for j, rule := range group.Rules {
+			name := rule.Alert
+			if name == "" {
+				name = rule.Record
+			}
+			source := fmt.Sprintf("%s: group %q, rule %q", filename, group.Name, name)
+
+			a, err := Analyze(checker, rule.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("error analyzing %s: group %q, rule %d: %w", filename, group.Name, j+1, err)
+			}
+			a.Source = source
+			analyses = append(analyses, a)
+		}
+	}
+	return analyses, nil
+}
+
+// AnalyzeDashboard analyzes every target and query variable of a dashboard
+func AnalyzeDashboard(filename string, data []byte) ([]*Analysis, error) {
+	d, err := ParseDashboard(data)
+	if err != nil {
+		return nil, fmt.Errorf("error analyzing %s: %w", filename, err)
+	}
+
+	analyze := func(source, expr string, logql bool) (*Analysis, error) {
+		var checker Checker = &PromQL{}
+		if logql {
+			checker = &LogQL{}
+		}
+		a, err := Analyze(checker, expr)
+		if err != nil {
+			return nil, fmt.Errorf("error analyzing %s: %s: %w", filename, source, err)
+		}
+		a.Source = fmt.Sprintf("%s: %s", filename, source)
+		return a, nil
+	}
+
+	var analyses []*Analysis
+	for _, t := range d.Targets {
+		a, err := analyze(fmt.Sprintf("panel %q, target %q", t.Panel, t.RefID), t.Expr, t.LogQL)
+		if err != nil {
+			return nil, err
+		}
+		analyses = append(analyses, a)
+	}
+	for _, v := range d.Variables {
+		query := v.QueryString()
+		if v.Type != "query" || query == "" {
+			continue
+		}
+		logql := strings.Contains(d.datasourceType(unmarshalDatasource(v.Datasource)), "loki")
+		a, err := analyze(fmt.Sprintf("variable $%s", v.Name), query, logql)
+		if err != nil {
+			return nil, err
+		}
+		analyses = append(analyses, a)
+	}
+	return analyses, nil
+}
+
+// WriteAnalysesTable writes analyses as a table, with one row per expression
+func WriteAnalysesTable(w io.Writer, analyses []*Analysis) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	withSource := slices.ContainsFunc(analyses, func(a *Analysis) bool { return a.Source != "" })
+
+	header := "SELECTORS\tFUNCTIONS\tRANGES\tOFFSETS\tOUTPUT LABELS"
+	if withSource {
+		header = "SOURCE\t" + header
+	}
+	fmt.Fprintln(tw, header)
+
+	orNone := func(values []string) string {
+		if len(values) == 0 {
+			return "-"
+		}
+		return strings.Join(values, ", ")
+	}
+
+	for _, a := range analyses {
+		var selectors []string
+		for _, s := range a.Selectors {
+			selector := s.Metric
+			if len(s.Matchers) > 0 || selector == "" {
+				selector += "{" + strings.Join(s.Matchers, ",") + "}"
+			}
+			selectors = append(selectors, selector)
+		}
+		row := strings.Join([]string{
+			orNone(selectors), orNone(a.Functions), orNone(a.Ranges), orNone(a.Offsets), a.OutputLabels.String(),
+		}, "\t")
+		if withSource {
+			row = a.Source + "\t" + row
+		}
+		fmt.Fprintln(tw, row)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,99 @@
+package tool_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromQLAnalyze(t *testing.T) {
+	a, err := tool.Analyze(&tool.PromQL{}, `sum by (job) (rate(http_requests_total{job=~"$job",code!="200"}[$__rate_interval] offset 1h)) / on (job) group_left (team) max by (job, team) (team_info)`)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []tool.SelectorAnalysis{
+		{Metric: "http_requests_total", Matchers: []string{`job=~"$job"`, `code!="200"`}},
+		{Metric: "team_info", Matchers: []string{}},
+	}, a.Selectors)
+	assert.Equal(t, []string{"sum", "rate", "max"}, a.Functions)
+	assert.Equal(t, []string{"$__rate_interval"}, a.Ranges)
+	assert.Equal(t, []string{"1h"}, a.Offsets)
+	assert.Equal(t, "job, team", a.OutputLabels.String())
+}
+
+func TestPromQLAnalyzeOutputLabels(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{`up`, `*`},
+		{`sum(up)`, `none`},
+		{`rate(up[5m]) > 0`, `*`},
+		{`sum without (instance) (up)`, `* without (instance)`},
+		{`histogram_quantile(0.9, sum by (le, job) (rate(x_bucket[5m])))`, `job`},
+		{`label_replace(sum by (job) (up), "team", "$1", "job", "(.*)")`, `job, team`},
+		{`a * on (job, instance) b`, `job, instance`},
+		{`a * ignoring (instance) b`, `* without (instance)`},
+		{`a * on (job) group_left (team) b`, `* + (team)`},
+		{`count_values("version", build_info)`, `version`},
+		{`topk(5, sum by (job) (up))`, `job`},
+		{`absent(up{job="x",instance=~".+"})`, `job`},
+		{`vector(1)`, `none`},
+		{`label_values(up, instance)`, `instance`},
+	}
+
+	for _, tt := range tests {
+		a, err := tool.Analyze(&tool.PromQL{}, tt.expr)
+		assert.NoError(t, err, tt.expr)
+		assert.Equal(t, tt.expected, a.OutputLabels.String(), tt.expr)
+	}
+}
+
+func TestLogQLAnalyze(t *testing.T) {
+	a, err := tool.Analyze(&tool.LogQL{}, `sum by (app) (count_over_time({app="$app", env="prod"} |= "error" [$__interval] offset 5m))`)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []tool.SelectorAnalysis{{Matchers: []string{`app="$app"`, `env="prod"`}}}, a.Selectors)
+	assert.Equal(t, []string{"sum", "count_over_time"}, a.Functions)
+	assert.Equal(t, []string{"$__interval"}, a.Ranges)
+	assert.Equal(t, []string{"5m"}, a.Offsets)
+	assert.Equal(t, "app", a.OutputLabels.String())
+
+	a, err = tool.Analyze(&tool.LogQL{}, `{app="x"} | json`)
+	assert.NoError(t, err)
+	assert.Equal(t, "*", a.OutputLabels.String(), "log queries return streams")
+}
+
+func TestAnalyzeRules(t *testing.T) {
+	fp := filepath.Join("testdata/prom_alerts", "rename.yaml")
+	analyses, err := tool.AnalyzeRules(&tool.PromQL{}, fp, readFile(fp))
+	assert.NoError(t, err)
+
+	assert.Len(t, analyses, 2)
+	assert.Equal(t, fp+`: group "http", rule "HighErrorRate"`, analyses[1].Source)
+	assert.Equal(t, "http_requests_total", analyses[1].Selectors[0].Metric)
+}
+
+func TestAnalyzeDashboard(t *testing.T) {
+	fp := filepath.Join("testdata/dashboards", "valid.json")
+	analyses, err := tool.AnalyzeDashboard(fp, readFile(fp))
+	assert.NoError(t, err)
+
+	var sources []string
+	for _, a := range analyses {
+		sources = append(sources, a.Source)
+	}
+	assert.Equal(t, []string{
+		fp + `: panel "Requests", target "A"`,
+		fp + `: panel "Errors", target "A"`,
+		fp + `: variable $job`,
+		fp + `: variable $app`,
+	}, sources)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tool.WriteAnalysesTable(&buf, analyses))
+	assert.Contains(t, buf.String(), "SOURCE")
+	assert.Contains(t, buf.String(), `http_requests_total{job=~"$job"}`)
+}
@@ -0,0 +1,140 @@
+package tool
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// TSDB is a Prometheus data directory opened read-only
+type TSDB struct {
+	db      *tsdb.DBReadOnly
+	querier storage.Querier
+	// tempDir is the sandbox root created by OpenTSDB, if any
+	tempDir string
+}
+
+// OpenTSDB opens a Prometheus data directory, such as a copy or a snapshot of a server's, without
+// modifying it. Replaying its write-ahead log may need to write chunks, which go to a temporary
+// directory created in sandboxDirRoot, or in the system temporary directory if it is empty, and
+// removed on Close.
+func OpenTSDB(dir, sandboxDirRoot string) (*TSDB, error) {
+	tempDir := ""
+	if sandboxDirRoot == "" {
+		var err error
+		if tempDir, err = os.MkdirTemp("", "cos-tool-backtest"); err != nil {
+			return nil, fmt.Errorf("error opening %s: %w", dir, err)
+		}
+		sandboxDirRoot = tempDir
+	}
+
+	db, err := tsdb.OpenDBReadOnly(dir, sandboxDirRoot, nil)
+	if err != nil {
+		removeTempDir(tempDir)
+		return nil, fmt.Errorf("error opening %s: %w", dir, err)
+	}
+
+	// Each querier of a read-only database loads its blocks and replays its write-ahead log,
+	// so a single one is shared by all queries
+	querier, err := db.Querier(math.MinInt64, math.MaxInt64)
+	if err != nil {
+		db.Close()
+		removeTempDir(tempDir)
+		return nil, fmt.Errorf("error opening %s: %w", dir, err)
+	}
+	return &TSDB{db: db, querier: querier, tempDir: tempDir}, nil
+}
+
+// removeTempDir removes a temporary directory, if any
+func removeTempDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
+
+// Querier implements storage.Queryable. Queriers are not closed separately, the database is.
+func (t *TSDB) Querier(_, _ int64) (storage.Querier, error) {
+	return sharedQuerier{t.querier}, nil
+}
+
+// Close closes the database and removes its sandbox directory
+func (t *TSDB) Close() error {
+	t.querier.Close()
+	err := t.db.Close()
+	if rmErr := removeTempDir(t.tempDir); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+type sharedQuerier struct {
+	storage.Querier
+}
+
+func (sharedQuerier) Close() error {
+	return nil
+}
+
+// AlertInterval is a period during which an alert was pending or firing
+type AlertInterval struct {
+	Group  string            `json:"group"`
+	Rule   string            `json:"rule"`
+	Labels map[string]string `json:"labels"`
+	State  AlertState        `json:"state"`
+	From   time.Time         `json:"from"`
+	// To is the first evaluation at which the alert was no longer in State, or the end of the
+	// backtest if Ongoing is set
+	To      time.Time `json:"to"`
+	Ongoing bool      `json:"ongoing,omitempty"`
+}
+
+// AlertIntervals splits alerts, such as those of RuleEvaluator.Alerts, into their pending and
+// firing intervals up to end
+func AlertIntervals(alerts []*Alert, end time.Time) []AlertInterval {
+	intervals := []AlertInterval{}
+	for _, a := range alerts {
+		interval := func(state AlertState, from, to time.Time) {
+			i := AlertInterval{Group: a.Group, Rule: a.Rule, Labels: a.Labels, State: state, From: from, To: to}
+			if to.IsZero() {
+				i.To, i.Ongoing = end, true
+			}
+			intervals = append(intervals, i)
+		}
+
+		if a.FiredAt.IsZero() {
+			interval(AlertPending, a.ActiveAt, a.ResolvedAt)
+			continue
+		}
+		// Alerts without a for duration fire as soon as they are active
+		if a.FiredAt.After(a.ActiveAt) {
+			interval(AlertPending, a.ActiveAt, a.FiredAt)
+		}
+		interval(AlertFiring, a.FiredAt, a.ResolvedAt)
+	}
+	return intervals
+}
+
+// WriteAlertIntervalsTable writes alert intervals as a table, one interval per row
+func WriteAlertIntervalsTable(w io.Writer, intervals []AlertInterval) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ALERT\tSTATE\tFROM\tTO\tDURATION\tLABELS")
+	for _, i := range intervals {
+		to := i.To.UTC().Format(time.RFC3339)
+		if i.Ongoing {
+			to += " (ongoing)"
+		}
+		lb := labels.NewBuilder(labels.FromMap(i.Labels))
+		lb.Del(labels.AlertName)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			i.Rule, i.State, i.From.UTC().Format(time.RFC3339), to, i.To.Sub(i.From), lb.Labels())
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,103 @@
+package tool_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestTSDB writes a data directory where up{instance="a"} is 0 from 12:10 to 12:20, and 1
+// otherwise, scraped every minute from 12:00 to 13:00
+func writeTestTSDB(t *testing.T) string {
+	dir := t.TempDir()
+	db, err := tsdb.Open(dir, nil, nil, tsdb.DefaultOptions(), nil)
+	require.NoError(t, err)
+
+	app := db.Appender(context.Background())
+	lset := labels.FromStrings("__name__", "up", "instance", "a")
+	for m := 0; m <= 60; m++ {
+		v := 1.0
+		if m >= 10 && m <= 20 {
+			v = 0
+		}
+		_, err := app.Append(0, lset, timestamp.FromTime(evalTime.Add(time.Duration(m)*time.Minute)), v)
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+	require.NoError(t, db.Close())
+	return dir
+}
+
+func TestOpenTSDBDefaultSandbox(t *testing.T) {
+	dir := writeTestTSDB(t)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	before, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	db, err := tool.OpenTSDB(dir, "")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// Neither the data directory nor the temporary directory keep a sandbox
+	after, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, len(before), len(after))
+	leftover, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	assert.Empty(t, leftover)
+}
+
+func TestBacktest(t *testing.T) {
+	db, err := tool.OpenTSDB(writeTestTSDB(t), t.TempDir())
+	require.NoError(t, err)
+	defer db.Close()
+
+	rules := []byte(`groups:
+  - name: test
+    rules:
+      - record: instance:up
+        expr: max by (instance) (up)
+      - alert: Down
+        expr: instance:up == 0
+        for: 5m
+      - alert: Flapping
+        expr: changes(up[5m]) > 0
+        keep_firing_for: 10m
+`)
+	// Flapping keeps firing between the two changes, and until 10m after the second leaves the
+	// left-open 5m range
+	evaluator := tool.NewRuleEvaluator(db)
+	require.NoError(t, evaluator.AddRules(&tool.PromQL{}, "rules.yaml", rules))
+	end := evalTime.Add(time.Hour)
+	require.NoError(t, evaluator.Run(context.Background(), evalTime, end, time.Minute))
+
+	at := func(m int) time.Time { return evalTime.Add(time.Duration(m) * time.Minute) }
+	labels := func(name string) map[string]string { return map[string]string{"alertname": name, "instance": "a"} }
+	assert.Equal(t, []tool.AlertInterval{
+		{Group: "test", Rule: "Down", Labels: labels("Down"), State: tool.AlertPending, From: at(10), To: at(15)},
+		{Group: "test", Rule: "Down", Labels: labels("Down"), State: tool.AlertFiring, From: at(15), To: at(21)},
+		{Group: "test", Rule: "Flapping", Labels: labels("Flapping"), State: tool.AlertFiring, From: at(10), To: at(35)},
+	}, tool.AlertIntervals(evaluator.Alerts(true), end))
+}
+
+func TestAlertIntervalsOngoing(t *testing.T) {
+	end := evalTime.Add(time.Hour)
+	intervals := tool.AlertIntervals([]*tool.Alert{
+		{Rule: "A", State: tool.AlertPending, ActiveAt: evalTime},
+		{Rule: "B", State: tool.AlertFiring, ActiveAt: evalTime, FiredAt: evalTime.Add(time.Minute)},
+	}, end)
+
+	assert.Len(t, intervals, 3)
+	assert.Equal(t, tool.AlertInterval{Rule: "A", State: tool.AlertPending, From: evalTime, To: end, Ongoing: true}, intervals[0])
+	assert.Equal(t, tool.AlertInterval{Rule: "B", State: tool.AlertPending, From: evalTime, To: evalTime.Add(time.Minute)}, intervals[1])
+	assert.Equal(t, tool.AlertInterval{Rule: "B", State: tool.AlertFiring, From: evalTime.Add(time.Minute), To: end, Ongoing: true}, intervals[2])
+}
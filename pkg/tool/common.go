@@ -2,9 +2,8 @@ package tool
 
 import (
 	"errors"
-	logqlparser "github.com/canonical/cos-tool/pkg/logql/syntax"
+	"fmt"
 	"github.com/prometheus/prometheus/model/rulefmt"
-	"github.com/prometheus/prometheus/promql/parser"
 	"strings"
 )
 
@@ -14,16 +13,9 @@ type AlertRuleFile struct {
 	Groups   []rulefmt.RuleGroup `yaml:"groups"`
 }
 
-type PromQL struct {
-	expr     parser.Expr
-	matchers *map[string]string
-}
+type PromQL struct{}
 
-type LogQL struct {
-	expr           logqlparser.Expr
-	matchers       *map[string]string
-	sortedMatchers *[]string
-}
+type LogQL struct{}
 
 type Checker interface {
 	Transform(arg string, matchers *map[string]string) (string, error)
@@ -31,6 +23,24 @@ type Checker interface {
 	ValidateConfig(filename string) error
 }
 
+// ReplaceVariables replaces the Grafana variables of a PromQL or LogQL expression, depending on
+// checker, by the placeholders parsed in their stead by Transform
+func ReplaceVariables(checker Checker, arg string) (string, error) {
+	switch checker.(type) {
+	case *PromQL:
+		processed, _, err := replaceVariablesInFunctionNames(arg)
+		if err != nil {
+			return arg, err
+		}
+		processed, _ = replaceGrafanaVariablesPromQL(processed)
+		return processed, nil
+	case *LogQL:
+		processed, _ := replaceGrafanaVariables(arg)
+		return processed, nil
+	}
+	return arg, fmt.Errorf("variables are not supported by %T", checker)
+}
+
 func GetLabelMatchers(flags []string) (map[string]string, error) {
 	inj := map[string]string{}
 	for _, matcher := range flags {
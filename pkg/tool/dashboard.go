@@ -0,0 +1,449 @@
+package tool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DashboardVariable is a Grafana templating variable, as found in a dashboard's templating.list
+type DashboardVariable struct {
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	Datasource json.RawMessage `json:"datasource"`
+	// Query is either a plain string or an object holding the query in its "query" field
+	Query json.RawMessage `json:"query"`
+}
+
+// DashboardTarget is a query found in a dashboard panel
+type DashboardTarget struct {
+	Panel string
+	RefID string
+	Expr  string
+	LogQL bool
+}
+
+var (
+	// logQLSyntaxPattern detects LogQL pipelines (e.g. {app="x"} |= "y") when the data source
+	// of a target cannot be resolved, mirroring the integration test heuristic
+	logQLSyntaxPattern = regexp.MustCompile(`\}\s*\|`)
+
+	// nameKeyPattern matches the "name" key preceding a variable name, to locate its definition
+	nameKeyPattern = regexp.MustCompile(`"name"\s*:\s*$`)
+)
+
+// QueryString returns the variable's query, whichever of the two forms it is stored in
+func (v DashboardVariable) QueryString() string {
+	var query string
+	if err := json.Unmarshal(v.Query, &query); err == nil {
+		return query
+	}
+
+	var object struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(v.Query, &object); err == nil {
+		return object.Query
+	}
+	return ""
+}
+
+// Dashboard is a parsed Grafana dashboard
+type Dashboard struct {
+	Variables []DashboardVariable
+	Targets   []DashboardTarget
+	// References holds the names of the variables used by targets, i.e. in their expressions,
+	// their data sources and the repeats of their panels, and by variable queries
+	References map[string]struct{}
+	// datasources maps datasource variable names to their plugin type, e.g. "loki"
+	datasources map[string]string
+}
+
+// ParseDashboard extracts the templating variables and PromQL/LogQL targets of a dashboard
+func ParseDashboard(data []byte) (*Dashboard, error) {
+	d, root, err := parseDashboard(data)
+	if err != nil {
+		return nil, err
+	}
+
+	d.visitTargets(root, func(_ *jsonObject, _ string, t DashboardTarget) {
+		d.Targets = append(d.Targets, t)
+		d.reference(t.Expr)
+	})
+	for _, v := range d.Variables {
+		if v.Type == "query" {
+			d.reference(v.QueryString())
+			d.referenceDatasource(unmarshalDatasource(v.Datasource))
+		}
+	}
+	return d, nil
+}
+
+// parseDashboard decodes a dashboard and collects its variables
+func parseDashboard(data []byte) (*Dashboard, *jsonObject, error) {
+	decoded, err := decodeJSON(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, ok := decoded.(*jsonObject)
+	if !ok {
+		return nil, nil, fmt.Errorf("dashboard must be a JSON object")
+	}
+
+	var templating struct {
+		Templating struct {
+			List []DashboardVariable `json:"list"`
+		} `json:"templating"`
+	}
+	if err := json.Unmarshal(data, &templating); err != nil {
+		return nil, nil, err
+	}
+
+	d := &Dashboard{
+		Variables:   templating.Templating.List,
+		References:  map[string]struct{}{},
+		datasources: map[string]string{},
+	}
+	for _, v := range d.Variables {
+		if v.Type == "datasource" {
+			d.datasources[v.Name] = strings.ToLower(v.QueryString())
+		}
+	}
+
+	return d, root, nil
+}
+
+// visitTargets calls visit with every target of the dashboard, along with the object and key
+// holding its expression
+func (d *Dashboard) visitTargets(root *jsonObject, visit func(*jsonObject, string, DashboardTarget)) {
+	for _, key := range root.keys {
+		if key != "templating" {
+			d.collectTargets(root.get(key), nil, "", visit)
+		}
+	}
+}
+
+// reference records the variables used in expr
+func (d *Dashboard) reference(expr string) {
+	for _, name := range GrafanaVariableNames(expr) {
+		d.References[name] = struct{}{}
+	}
+}
+
+// referenceDatasource records the variables used in a datasource reference, either
+// {"type": ..., "uid": ...} or a plain name
+func (d *Dashboard) referenceDatasource(datasource interface{}) {
+	switch ds := datasource.(type) {
+	case *jsonObject:
+		uid, _ := ds.get("uid").(string)
+		d.reference(uid)
+	case string:
+		d.reference(ds)
+	}
+}
+
+// collectTargets walks panels and their targets, inheriting the data source of enclosing panels.
+// The variables of the data sources of targets and of panel repeats are recorded as used.
+func (d *Dashboard) collectTargets(node interface{}, datasource interface{}, panel string, visit func(*jsonObject, string, DashboardTarget)) {
+	switch n := node.(type) {
+	case *jsonObject:
+		if ds := n.get("datasource"); ds != nil {
+			datasource = ds
+		}
+		if title, ok := n.get("title").(string); ok {
+			if _, isPanel := n.values["type"]; isPanel {
+				panel = title
+			}
+		}
+
+		isLoki := strings.Contains(d.datasourceType(datasource), "loki")
+		key := "expr"
+		expr, hasExpr := n.get(key).(string)
+		if !hasExpr && isLoki {
+			key = "query"
+			expr, hasExpr = n.get(key).(string)
+		}
+		if hasExpr && expr != "" {
+			d.referenceDatasource(datasource)
+			refID, _ := n.get("refId").(string)
+			visit(n, key, DashboardTarget{
+				Panel: panel,
+				RefID: refID,
+				Expr:  expr,
+				LogQL: isLoki || logQLSyntaxPattern.MatchString(expr),
+			})
+		}
+
+		for _, key := range n.keys {
+			d.collectTargets(n.get(key), datasource, panel, visit)
+		}
+		for _, key := range []string{"repeat", "repeatRow"} {
+			if repeat, ok := n.get(key).(string); ok && repeat != "" {
+				d.References[repeat] = struct{}{}
+			}
+		}
+	case []interface{}:
+		for _, value := range n {
+			d.collectTargets(value, datasource, panel, visit)
+		}
+	}
+}
+
+// datasourceType resolves a datasource reference, either {"type": ..., "uid": ...} or a plain
+// name, to a lowercase plugin type, following datasource variables such as ${lokids}.
+func (d *Dashboard) datasourceType(datasource interface{}) string {
+	ref := ""
+	switch ds := datasource.(type) {
+	case *jsonObject:
+		if t, ok := ds.get("type").(string); ok && t != "" && t != "datasource" {
+			return strings.ToLower(t)
+		}
+		ref, _ = ds.get("uid").(string)
+	case string:
+		ref = ds
+	}
+
+	for _, name := range GrafanaVariableNames(ref) {
+		if t, ok := d.datasources[name]; ok {
+			return t
+		}
+	}
+	return strings.ToLower(ref)
+}
+
+// RewriteDashboard applies rewrite to every PromQL and LogQL target of a dashboard and to the
+// queries of its query variables, and returns the dashboard with everything else unchanged.
+func RewriteDashboard(filename string, data []byte, rewrite func(expr string, logql bool) (string, error)) ([]byte, error) {
+	d, root, err := parseDashboard(data)
+	if err != nil {
+		return nil, fmt.Errorf("error rewriting %s: %w", filename, err)
+	}
+
+	var errs []error
+	d.visitTargets(root, func(target *jsonObject, key string, t DashboardTarget) {
+		expr, err := rewrite(t.Expr, t.LogQL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("panel %q, target %q: %w", t.Panel, t.RefID, err))
+			return
+		}
+		target.set(key, expr)
+	})
+
+	if templating, ok := root.get("templating").(*jsonObject); ok {
+		list, _ := templating.get("list").([]interface{})
+		for _, item := range list {
+			v, ok := item.(*jsonObject)
+			if !ok || v.get("type") != "query" {
+				continue
+			}
+			name, _ := v.get("name").(string)
+			logql := strings.Contains(d.datasourceType(v.get("datasource")), "loki")
+			if err := rewriteVariableQuery(v, logql, rewrite); err != nil {
+				errs = append(errs, fmt.Errorf("variable $%s: %w", name, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("error rewriting %s: %+v", filename, errs)
+	}
+
+	output, err := encodeJSON(root)
+	if err != nil {
+		return nil, fmt.Errorf("error rewriting %s: %w", filename, err)
+	}
+	return output, nil
+}
+
+// rewriteVariableQuery rewrites the query of a query variable, stored either as a string or in
+// the "query" field of an object, and its "definition" when it mirrors the query
+func rewriteVariableQuery(v *jsonObject, logql bool, rewrite func(string, bool) (string, error)) error {
+	holder, key := v, "query"
+	if object, ok := v.get("query").(*jsonObject); ok {
+		holder = object
+	}
+	query, ok := holder.get(key).(string)
+	if !ok || query == "" {
+		return nil
+	}
+
+	rewritten, err := rewrite(query, logql)
+	if err != nil {
+		return err
+	}
+	holder.set(key, rewritten)
+	if definition, ok := v.get("definition").(string); ok && definition == query {
+		v.set("definition", rewritten)
+	}
+	return nil
+}
+
+// isBuiltinVariable reports whether name is one of Grafana's built-in $__* variables
+func isBuiltinVariable(name string) bool {
+	return strings.HasPrefix(name, "__")
+}
+
+// GrafanaVariableNames returns the names of the Grafana template variables used in expr,
+// in order of first use. Regex capture group references such as $1 are not included.
+func GrafanaVariableNames(expr string) []string {
+	var names []string
+	seen := map[string]struct{}{}
+	for _, m := range interpolationPattern.FindAllStringSubmatch(expr, -1) {
+		name := m[1] + m[2] + m[4]
+		if name[0] >= '0' && name[0] <= '9' {
+			continue
+		}
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ValidateDashboard checks that every variable used in the dashboard's targets and variable
+// queries is defined in its templating list or is a Grafana built-in, that every defined
+// variable is used, and that targets and variable queries are valid PromQL/LogQL.
+func ValidateDashboard(filename string, data []byte) error {
+	d, err := ParseDashboard(data)
+	if err != nil {
+		return fmt.Errorf("error validating %s: %w", filename, err)
+	}
+
+	var errs []error
+	for _, f := range dashboardFindings(filename, data, d) {
+		errs = append(errs, errors.New(f.Message))
+	}
+
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+		return fmt.Errorf("error validating %s: %+v", filename, errs)
+	}
+	return nil
+}
+
+// DashboardFindings validates a dashboard like ValidateDashboard, returning a finding for each
+// problem, located at the expression or the name of the variable it is about
+func DashboardFindings(filename string, data []byte) []Finding {
+	d, err := ParseDashboard(data)
+	if err != nil {
+		return []Finding{{File: filename, RuleID: "invalid-dashboard", Severity: SeverityError, Message: err.Error()}}
+	}
+	return sortFindings(dashboardFindings(filename, data, d))
+}
+
+func dashboardFindings(filename string, data []byte, d *Dashboard) []Finding {
+	text := string(data)
+	var findings []Finding
+	report := func(ruleID string, offset int, message string) {
+		f := Finding{File: filename, RuleID: ruleID, Severity: SeverityError, Message: message}
+		if offset != -1 {
+			f.Line = strings.Count(text[:offset], "\n") + 1
+			f.Column = offset - strings.LastIndex(text[:offset], "\n")
+		}
+		findings = append(findings, f)
+	}
+
+	defined := map[string]struct{}{}
+	for _, v := range d.Variables {
+		defined[v.Name] = struct{}{}
+	}
+
+	checkUndefined := func(where, expr string, offset int) {
+		for _, name := range GrafanaVariableNames(expr) {
+			if _, ok := defined[name]; !ok && !isBuiltinVariable(name) {
+				report("undefined-variable", offset, fmt.Sprintf("%s: undefined variable $%s", where, name))
+			}
+		}
+	}
+
+	// Targets are located at the nth occurrence of the nth target with a given expression
+	seen := map[string]int{}
+	for _, t := range d.Targets {
+		offset := -1
+		if quoted, err := marshalJSON(t.Expr); err == nil {
+			offset = nthIndex(text, string(quoted), seen[string(quoted)])
+			seen[string(quoted)]++
+		}
+
+		where := fmt.Sprintf("panel %q, target %q", t.Panel, t.RefID)
+		checkUndefined(where, t.Expr, offset)
+
+		var checker Checker = &PromQL{}
+		if t.LogQL {
+			checker = &LogQL{}
+		}
+		if err := parses(checker, t.Expr); err != nil {
+			report("invalid-expression", offset, fmt.Sprintf("%s: invalid expression: %v", where, err))
+		}
+	}
+
+	for _, v := range d.Variables {
+		offset := -1
+		if quoted, err := marshalJSON(v.Name); err == nil {
+			offset = nameOffset(text, string(quoted))
+		}
+
+		where := fmt.Sprintf("variable $%s", v.Name)
+
+		if _, ok := d.References[v.Name]; !ok && v.Type != "adhoc" {
+			report("unused-variable", offset, fmt.Sprintf("%s: defined but never used", where))
+		}
+
+		if v.Type != "query" {
+			continue
+		}
+		query := v.QueryString()
+		checkUndefined(where, query, offset)
+
+		var checker Checker = &PromQL{}
+		if strings.Contains(d.datasourceType(unmarshalDatasource(v.Datasource)), "loki") {
+			checker = &LogQL{}
+		}
+		if query != "" {
+			if err := validateGrafanaVariableQuery(checker, query); err != nil {
+				report("invalid-expression", offset, fmt.Sprintf("%s: invalid query: %v", where, err))
+			}
+		}
+	}
+	return findings
+}
+
+// nameOffset returns the index of the "name" key whose value is quoted, or -1
+func nameOffset(text, quoted string) int {
+	offset := 0
+	for {
+		i := strings.Index(text[offset:], quoted)
+		if i == -1 {
+			return -1
+		}
+		if loc := nameKeyPattern.FindStringIndex(text[:offset+i]); loc != nil {
+			return loc[0]
+		}
+		offset += i + len(quoted)
+	}
+}
+
+// nthIndex returns the index of the nth occurrence of substr in s, counting from 0, or -1
+func nthIndex(s, substr string, n int) int {
+	offset := 0
+	for {
+		i := strings.Index(s[offset:], substr)
+		if i == -1 {
+			return -1
+		}
+		if n == 0 {
+			return offset + i
+		}
+		n--
+		offset += i + len(substr)
+	}
+}
+
+func unmarshalDatasource(raw json.RawMessage) interface{} {
+	ds, _ := decodeJSON(raw)
+	return ds
+}
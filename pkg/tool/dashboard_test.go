@@ -0,0 +1,81 @@
+package tool_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrafanaVariableNames(t *testing.T) {
+	names := tool.GrafanaVariableNames(`label_replace(rate(x{job="$job",i=~"${instance:regex}"}[$__rate_interval]), "h", "$1", "i", "[[job]]")`)
+	assert.Equal(t, []string{"job", "instance", "__rate_interval"}, names)
+}
+
+func TestParseDashboard(t *testing.T) {
+	fp := filepath.Join("testdata/dashboards", "valid.json")
+	d, err := tool.ParseDashboard(readFile(fp))
+	assert.NoError(t, err)
+
+	assert.Len(t, d.Variables, 6)
+	assert.Equal(t, "label_values(up, job)", d.Variables[2].QueryString())
+	assert.Equal(t, `label_values({job=~"$job"}, app)`, d.Variables[3].QueryString())
+
+	assert.Len(t, d.Targets, 2)
+	for _, target := range d.Targets {
+		switch target.Panel {
+		case "Requests":
+			assert.False(t, target.LogQL)
+		case "Errors":
+			assert.True(t, target.LogQL, "data source should be inherited from the panel")
+		default:
+			t.Errorf("unexpected panel %q", target.Panel)
+		}
+	}
+}
+
+func TestValidateDashboardSuccess(t *testing.T) {
+	fp := filepath.Join("testdata/dashboards", "valid.json")
+	err := tool.ValidateDashboard(fp, readFile(fp))
+	assert.NoError(t, err)
+}
+
+func TestValidateDashboardFailure(t *testing.T) {
+	fp := filepath.Join("testdata/dashboards", "bad_variables.json")
+	err := tool.ValidateDashboard(fp, readFile(fp))
+	assert.Error(t, err)
+
+	for _, msg := range []string{
+		`panel "Requests", target "A": undefined variable $cluster`,
+		// Only referenced in a panel description
+		`variable $unused: defined but never used`,
+		`variable $job: invalid query`,
+	} {
+		assert.Contains(t, err.Error(), msg)
+	}
+	assert.NotContains(t, err.Error(), "$__rate_interval", "built-in variables are always defined")
+}
+
+func TestTransformDashboard(t *testing.T) {
+	fp := filepath.Join("testdata/dashboards", "valid.json")
+	transform := func(expr string, logql bool) (string, error) {
+		if logql {
+			return (&tool.LogQL{}).Transform(expr, &testTopologyMatchers)
+		}
+		return (&tool.PromQL{}).Transform(expr, &testTopologyMatchers)
+	}
+
+	out, err := tool.RewriteDashboard(fp, readFile(fp), transform)
+	assert.NoError(t, err)
+
+	d, err := tool.ParseDashboard(out)
+	assert.NoError(t, err)
+	assert.Contains(t, d.Targets[0].Expr, `juju_application="proxy"`)
+	assert.Contains(t, d.Targets[1].Expr, `juju_application="proxy"`)
+	assert.Contains(t, d.Variables[2].QueryString(), `juju_application="proxy"`)
+
+	again, err := tool.RewriteDashboard(fp, out, transform)
+	assert.NoError(t, err)
+	assert.Equal(t, string(out), string(again), "transforming a transformed dashboard must be a no-op")
+}
@@ -0,0 +1,37 @@
+package tool
+
+import (
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// UnifiedDiff returns a unified diff of a file's contents before and after transforming it,
+// or an empty string if they are the same up to a final newline
+func UnifiedDiff(filename, before, after string) (string, error) {
+	if before == after {
+		return "", nil
+	}
+
+	// Inputs without a final newline, such as expressions, would otherwise run into the next line
+	if !strings.HasSuffix(before, "\n") {
+		before += "\n"
+	}
+	if !strings.HasSuffix(after, "\n") {
+		after += "\n"
+	}
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(before),
+		B:        splitLines(after),
+		FromFile: filename,
+		ToFile:   filename + " (transformed)",
+		Context:  3,
+	})
+}
+
+// splitLines splits newline-terminated text into lines, keeping their newlines
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	return lines[:len(lines)-1]
+}
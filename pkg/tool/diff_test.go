@@ -0,0 +1,26 @@
+package tool_test
+
+import (
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	diff, err := tool.UnifiedDiff("rules.yaml", "a\nb\nc\n", "a\nb2\nc\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "--- rules.yaml\n+++ rules.yaml (transformed)\n@@ -1,3 +1,3 @@\n a\n-b\n+b2\n c\n", diff)
+}
+
+func TestUnifiedDiffWithoutFinalNewline(t *testing.T) {
+	diff, err := tool.UnifiedDiff("expression", "up", `up{a="b"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "--- expression\n+++ expression (transformed)\n@@ -1 +1 @@\n-up\n+up{a=\"b\"}\n", diff)
+}
+
+func TestUnifiedDiffSame(t *testing.T) {
+	diff, err := tool.UnifiedDiff("expression", "up", "up")
+	assert.NoError(t, err)
+	assert.Empty(t, diff)
+}
@@ -0,0 +1,84 @@
+package tool
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	logqlparser "github.com/canonical/cos-tool/pkg/logql/syntax"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// enforceMatchers replaces the matchers on enforced labels with equality matchers on their
+// enforced value, keeping a single matcher per label, and adds those missing in label order
+func enforceMatchers(matchers []*labels.Matcher, enforced map[string]string) []*labels.Matcher {
+	seen := map[string]bool{}
+	result := make([]*labels.Matcher, 0, len(matchers)+len(enforced))
+	for _, m := range matchers {
+		value, ok := enforced[m.Name]
+		if !ok {
+			result = append(result, m)
+			continue
+		}
+		if !seen[m.Name] {
+			seen[m.Name] = true
+			result = append(result, labels.MustNewMatcher(labels.MatchEqual, m.Name, value))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(enforced)) {
+		if !seen[name] {
+			result = append(result, labels.MustNewMatcher(labels.MatchEqual, name, enforced[name]))
+		}
+	}
+	return result
+}
+
+// Enforce injects label matchers into every selector of a PromQL or LogQL expression, depending
+// on checker, replacing the matchers the expression already has on their labels
+func Enforce(checker Checker, arg string, matchers map[string]string) (string, error) {
+	switch c := checker.(type) {
+	case *PromQL:
+		return c.enforce(arg, matchers)
+	case *LogQL:
+		return c.enforce(arg, matchers)
+	}
+	return arg, fmt.Errorf("enforcing label matchers is not supported by %T", checker)
+}
+
+// enforce injects label matchers into every vector selector like Transform, but replaces the
+// matchers the expression already has on their labels instead of keeping them, so that the
+// expression cannot select series with other values. Injection rules do not apply, as they
+// would let some selectors through. Unlike Transform, the expression is parsed as it is, without
+// Grafana variables: rewriting them would let a crafted label value hide selectors from the
+// parser.
+func (p *PromQL) enforce(arg string, matchers map[string]string) (string, error) {
+	exp, err := parser.ParseExpr(arg)
+	if err != nil {
+		return arg, err
+	}
+	parser.Inspect(exp, func(node parser.Node, _ []parser.Node) error {
+		if e, ok := node.(*parser.VectorSelector); ok {
+			e.LabelMatchers = enforceMatchers(e.LabelMatchers, matchers)
+		}
+		return nil
+	})
+	return exp.String(), nil
+}
+
+// enforce injects label matchers into every stream selector like Transform, but replaces the
+// matchers the expression already has on their labels instead of keeping them, so that the
+// expression cannot select streams with other values. Injection rules do not apply, as they
+// would let some selectors through. Like for PromQL, the expression is parsed as it is.
+func (p *LogQL) enforce(arg string, matchers map[string]string) (string, error) {
+	exp, err := logqlparser.ParseExpr(arg)
+	if err != nil {
+		return arg, err
+	}
+	exp.Walk(func(e interface{}) {
+		if e, ok := e.(*logqlparser.MatchersExpr); ok {
+			e.Mts = enforceMatchers(e.Mts, matchers)
+		}
+	})
+	return exp.String(), nil
+}
@@ -0,0 +1,90 @@
+package tool_test
+
+import (
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+var enforcedMatchers = map[string]string{"juju_model": "lma", "juju_application": "api"}
+
+func TestPromQLEnforce(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "Missing matchers are injected",
+			expr:     `rate(http_requests_total[5m])`,
+			expected: `rate(http_requests_total{juju_application="api",juju_model="lma"}[5m])`,
+		},
+		{
+			name:     "Conflicting matchers are replaced",
+			expr:     `up{juju_model="other"} or up{juju_model=~".*",juju_model!="lma"}`,
+			expected: `up{juju_application="api",juju_model="lma"} or up{juju_application="api",juju_model="lma"}`,
+		},
+		{
+			name:     "Selectors on enforced labels only",
+			expr:     `{juju_application=~".+"}`,
+			expected: `{juju_application="api",juju_model="lma"}`,
+		},
+		{
+			name:     "Grouping is kept",
+			expr:     `sum by (juju_model) (up) / on (juju_model) count by (juju_model) (up)`,
+			expected: `sum by (juju_model) (up{juju_application="api",juju_model="lma"}) / on (juju_model) count by (juju_model) (up{juju_application="api",juju_model="lma"})`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := tool.Enforce(&tool.PromQL{}, tt.expr, enforcedMatchers)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+}
+
+func TestPromQLEnforceWithinAbsent(t *testing.T) {
+	out, err := tool.Enforce(&tool.PromQL{}, `absent(up{job="blackbox"})`, enforcedMatchers)
+	assert.NoError(t, err)
+	assert.Equal(t, `absent(up{job="blackbox",juju_application="api",juju_model="lma"})`, out)
+}
+
+func TestLogQLEnforce(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "Missing matchers are injected",
+			expr:     `{app="x"} |= "error"`,
+			expected: `{app="x", juju_application="api", juju_model="lma"} |= "error"`,
+		},
+		{
+			name:     "Conflicting matchers are replaced",
+			expr:     `sum(count_over_time({app="x", juju_model=~".+", juju_model!="lma"}[5m]))`,
+			expected: `sum(count_over_time({app="x", juju_model="lma", juju_application="api"}[5m]))`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := tool.Enforce(&tool.LogQL{}, tt.expr, enforcedMatchers)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+}
+
+func TestEnforceParsesVariablesAsText(t *testing.T) {
+	// A Grafana variable syntax in a label value must not hide the rest of the expression
+	out, err := tool.Enforce(&tool.PromQL{}, `up{job="abc${x"} or up{juju_model='other'} #"}`, enforcedMatchers)
+	assert.NoError(t, err)
+	assert.Equal(t, `up{job="abc${x",juju_application="api",juju_model="lma"} or up{juju_application="api",juju_model="lma"}`, out)
+
+	_, err = tool.Enforce(&tool.PromQL{}, `rate(up[$__interval])`, enforcedMatchers)
+	assert.Error(t, err)
+}
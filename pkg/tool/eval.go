@@ -0,0 +1,393 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/template"
+)
+
+// newEngine returns a PromQL engine with the defaults of a Prometheus server
+func newEngine() *promql.Engine {
+	return promql.NewEngine(promql.EngineOpts{
+		MaxSamples:           50000000,
+		Timeout:              2 * time.Minute,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+	})
+}
+
+// Eval evaluates a PromQL expression at ts against queryable
+func Eval(ctx context.Context, queryable storage.Queryable, expr string, ts time.Time) (parser.Value, error) {
+	return instantQuery(ctx, newEngine(), queryable, expr, ts)
+}
+
+func instantQuery(ctx context.Context, engine *promql.Engine, queryable storage.Queryable, expr string, ts time.Time) (parser.Value, error) {
+	q, err := engine.NewInstantQuery(ctx, queryable, nil, expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	res := q.Exec(ctx)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return res.Value, nil
+}
+
+// AlertState is the state of an alert, as in Prometheus
+type AlertState int
+
+const (
+	AlertInactive AlertState = iota
+	AlertPending
+	AlertFiring
+)
+
+func (s AlertState) String() string {
+	switch s {
+	case AlertPending:
+		return "pending"
+	case AlertFiring:
+		return "firing"
+	default:
+		return "inactive"
+	}
+}
+
+// MarshalJSON encodes the state as its name
+func (s AlertState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Alert is an instance of an alerting rule
+type Alert struct {
+	Group       string            `json:"group"`
+	Rule        string            `json:"rule"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	State       AlertState        `json:"state"`
+	Value       float64           `json:"value"`
+	ActiveAt    time.Time         `json:"active_at"`
+	FiredAt     time.Time         `json:"fired_at,omitzero"`
+	// ResolvedAt is when a firing alert resolved, or a pending alert ended without firing
+	ResolvedAt time.Time `json:"resolved_at,omitzero"`
+
+	keepFiringSince time.Time
+}
+
+// RuleEvaluator evaluates the rules of rule files the way a Prometheus server does, keeping
+// the state of alerts across evaluations and the samples of recording rules. It does not send
+// alerts nor write ALERTS series.
+type RuleEvaluator struct {
+	engine    *promql.Engine
+	queryable storage.Queryable
+	recorded  *MemoryStorage
+	groups    []*evalGroup
+	// resolved holds the alerts which have since resolved, or ended without firing
+	resolved []*Alert
+}
+
+type evalGroup struct {
+	rulefmt.RuleGroup
+	// active maps each alerting rule to its pending and firing alerts, by label hash
+	active []map[uint64]*Alert
+	// recorded maps each recording rule to the series it recorded at its last evaluation
+	recorded []map[uint64]labels.Labels
+}
+
+// NewRuleEvaluator returns a rule evaluator reading samples from queryable
+func NewRuleEvaluator(queryable storage.Queryable) *RuleEvaluator {
+	recorded := NewMemoryStorage()
+	return &RuleEvaluator{
+		engine: newEngine(),
+		queryable: storage.QueryableFunc(func(mint, maxt int64) (storage.Querier, error) {
+			primary, err := queryable.Querier(mint, maxt)
+			if err != nil {
+				return nil, err
+			}
+			secondary, _ := recorded.Querier(mint, maxt)
+			return storage.NewMergeQuerier([]storage.Querier{primary, secondary}, nil, storage.ChainedSeriesMerge), nil
+		}),
+		recorded: recorded,
+	}
+}
+
+// AddRules adds the rule groups of a PromQL rule file
+func (e *RuleEvaluator) AddRules(checker Checker, filename string, data []byte) error {
+	if _, ok := checker.(*PromQL); !ok {
+		return fmt.Errorf("error evaluating %s: only PromQL rules can be evaluated", filename)
+	}
+
+	rgs, err := checker.ValidateRules(filename, data)
+	if err != nil {
+		return err
+	}
+	for _, g := range rgs.Groups {
+		e.groups = append(e.groups, &evalGroup{
+			RuleGroup: g,
+			active:    make([]map[uint64]*Alert, len(g.Rules)),
+			recorded:  make([]map[uint64]labels.Labels, len(g.Rules)),
+		})
+	}
+	return nil
+}
+
+// Run evaluates each rule group between start and end, at the group's interval or else at
+// interval, in time order. Evaluations are aligned on end, which is always evaluated.
+func (e *RuleEvaluator) Run(ctx context.Context, start, end time.Time, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid evaluation interval %s: must be positive", interval)
+	}
+
+	type evaluation struct {
+		ts    time.Time
+		group int
+	}
+
+	var evaluations []evaluation
+	for i, g := range e.groups {
+		step := interval
+		if g.Interval > 0 {
+			step = time.Duration(g.Interval)
+		}
+		first := end.Add(-end.Sub(start) / step * step)
+		for ts := first; !ts.After(end); ts = ts.Add(step) {
+			evaluations = append(evaluations, evaluation{ts: ts, group: i})
+		}
+	}
+	sort.SliceStable(evaluations, func(i, j int) bool { return evaluations[i].ts.Before(evaluations[j].ts) })
+
+	for _, ev := range evaluations {
+		if err := e.evalGroup(ctx, e.groups[ev.group], ev.ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evalGroup evaluates the rules of a group in order, so that each rule sees the samples
+// recorded by the rules before it
+func (e *RuleEvaluator) evalGroup(ctx context.Context, g *evalGroup, ts time.Time) error {
+	queryTime := ts
+	if g.QueryOffset != nil {
+		queryTime = ts.Add(-time.Duration(*g.QueryOffset))
+	}
+
+	for i, rule := range g.Rules {
+		// Group labels apply to every rule, which may override them
+		if len(g.Labels) > 0 {
+			merged := maps.Clone(g.Labels)
+			maps.Copy(merged, rule.Labels)
+			rule.Labels = merged
+		}
+
+		res, err := instantQuery(ctx, e.engine, e.queryable, rule.Expr, queryTime)
+		if err != nil {
+			return fmt.Errorf("error evaluating group %q, rule %d at %s: %w", g.Name, i+1, ts.UTC().Format(time.RFC3339), err)
+		}
+
+		var vector promql.Vector
+		switch v := res.(type) {
+		case promql.Vector:
+			vector = v
+		case promql.Scalar:
+			vector = promql.Vector{{T: v.T, F: v.V, Metric: labels.EmptyLabels()}}
+		default:
+			return fmt.Errorf("error evaluating group %q, rule %d: unexpected result type %s", g.Name, i+1, res.Type())
+		}
+
+		if rule.Record != "" {
+			current := map[uint64]labels.Labels{}
+			for _, smpl := range vector {
+				lb := labels.NewBuilder(smpl.Metric)
+				lb.Set(labels.MetricName, rule.Record)
+				for name, value := range rule.Labels {
+					lb.Set(name, value)
+				}
+				lset := lb.Labels()
+				e.recorded.Add(lset, queryTime, smpl.F)
+				current[lset.Hash()] = lset
+			}
+			// Like Prometheus, mark the series which are no longer recorded as stale
+			for h, lset := range g.recorded[i] {
+				if _, ok := current[h]; !ok {
+					e.recorded.Add(lset, queryTime, math.Float64frombits(value.StaleNaN))
+				}
+			}
+			g.recorded[i] = current
+			continue
+		}
+
+		if g.active[i] == nil {
+			g.active[i] = map[uint64]*Alert{}
+		}
+		if err := e.evalAlert(ctx, g.Name, rule, g.active[i], vector, ts); err != nil {
+			return fmt.Errorf("error evaluating group %q, rule %d: %w", g.Name, i+1, err)
+		}
+	}
+	return nil
+}
+
+// evalAlert updates the alerts of an alerting rule from the result of its expression, as
+// Prometheus does: new alerts are pending until they have been active for the rule's for
+// duration, and firing alerts keep firing for keep_firing_for once their series is gone.
+func (e *RuleEvaluator) evalAlert(ctx context.Context, group string, rule rulefmt.Rule, active map[uint64]*Alert, vector promql.Vector, ts time.Time) error {
+	current := map[uint64]*Alert{}
+	for _, smpl := range vector {
+		expand := e.templateExpander(ctx, rule.Alert, smpl, ts)
+
+		lb := labels.NewBuilder(smpl.Metric)
+		lb.Del(labels.MetricName)
+		for name, value := range rule.Labels {
+			lb.Set(name, expand(value))
+		}
+		lb.Set(labels.AlertName, rule.Alert)
+		lset := lb.Labels()
+
+		annotations := map[string]string{}
+		for name, value := range rule.Annotations {
+			annotations[name] = expand(value)
+		}
+
+		h := lset.Hash()
+		if _, ok := current[h]; ok {
+			return fmt.Errorf("vector contains metrics with the same labelset after applying alert labels")
+		}
+		current[h] = &Alert{
+			Group:       group,
+			Rule:        rule.Alert,
+			Labels:      lset.Map(),
+			Annotations: annotations,
+			State:       AlertPending,
+			Value:       smpl.F,
+			ActiveAt:    ts,
+		}
+	}
+
+	for h, a := range current {
+		if alert, ok := active[h]; ok {
+			alert.Value = a.Value
+			alert.Annotations = a.Annotations
+			continue
+		}
+		active[h] = a
+	}
+
+	for h, a := range active {
+		if _, ok := current[h]; !ok {
+			if a.State == AlertFiring && rule.KeepFiringFor > 0 {
+				if a.keepFiringSince.IsZero() {
+					a.keepFiringSince = ts
+				}
+				if ts.Sub(a.keepFiringSince) < time.Duration(rule.KeepFiringFor) {
+					continue
+				}
+			}
+
+			delete(active, h)
+			a.State = AlertInactive
+			a.ResolvedAt = ts
+			e.resolved = append(e.resolved, a)
+			continue
+		}
+
+		a.keepFiringSince = time.Time{}
+		if a.State == AlertPending && ts.Sub(a.ActiveAt) >= time.Duration(rule.For) {
+			a.State = AlertFiring
+			a.FiredAt = ts
+		}
+	}
+	return nil
+}
+
+// templateExpander returns a function expanding the templates of an alert's labels and
+// annotations, with the $labels, $value and query helpers of Prometheus
+func (e *RuleEvaluator) templateExpander(ctx context.Context, name string, smpl promql.Sample, ts time.Time) func(string) string {
+	data := template.AlertTemplateData(smpl.Metric.Map(), nil, "", smpl)
+	defs := "{{$labels := .Labels}}{{$externalLabels := .ExternalLabels}}{{$externalURL := .ExternalURL}}{{$value := .Value}}"
+	query := func(ctx context.Context, q string, ts time.Time) (promql.Vector, error) {
+		res, err := instantQuery(ctx, e.engine, e.queryable, q, ts)
+		if err != nil {
+			return nil, err
+		}
+		vector, ok := res.(promql.Vector)
+		if !ok {
+			return nil, fmt.Errorf("query %q does not return a vector", q)
+		}
+		return vector, nil
+	}
+
+	return func(text string) string {
+		expander := template.NewTemplateExpander(ctx, defs+text, "__alert_"+name, data,
+			model.Time(timestamp.FromTime(ts)), query, &url.URL{}, nil)
+		result, err := expander.Expand()
+		if err != nil {
+			return fmt.Sprintf("<error expanding template: %s>", err)
+		}
+		return result
+	}
+}
+
+// Alerts returns the pending and firing alerts, and, if resolved is set, the alerts which have
+// since resolved or ended without firing, sorted by rule, labels and time
+func (e *RuleEvaluator) Alerts(resolved bool) []*Alert {
+	alerts := []*Alert{}
+	if resolved {
+		alerts = append(alerts, e.resolved...)
+	}
+	for _, g := range e.groups {
+		for _, active := range g.active {
+			for _, a := range active {
+				alerts = append(alerts, a)
+			}
+		}
+	}
+
+	sort.SliceStable(alerts, func(i, j int) bool {
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		if c := labels.Compare(labels.FromMap(alerts[i].Labels), labels.FromMap(alerts[j].Labels)); c != 0 {
+			return c < 0
+		}
+		return alerts[i].ActiveAt.Before(alerts[j].ActiveAt)
+	})
+	return alerts
+}
+
+// WriteAlertsTable writes alerts as a table, one alert per row
+func WriteAlertsTable(w io.Writer, alerts []*Alert) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ALERT\tSTATE\tACTIVE SINCE\tVALUE\tLABELS")
+	for _, a := range alerts {
+		lset := labels.FromMap(a.Labels)
+		lb := labels.NewBuilder(lset)
+		lb.Del(labels.AlertName)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			a.Rule, a.State, a.ActiveAt.UTC().Format(time.RFC3339), formatValue(a.Value), lb.Labels())
+	}
+	return tw.Flush()
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
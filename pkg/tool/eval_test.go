@@ -0,0 +1,131 @@
+package tool_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/assert"
+)
+
+var evalTime = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func loadTestSnapshots(t *testing.T, names ...string) *tool.MemoryStorage {
+	var snapshots [][]byte
+	for _, name := range names {
+		snapshots = append(snapshots, readFile(filepath.Join("testdata/snapshots", name)))
+	}
+	storage, ts, err := tool.LoadSnapshots(snapshots, evalTime, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, evalTime, ts)
+	return storage
+}
+
+func TestEval(t *testing.T) {
+	storage := loadTestSnapshots(t, "api-1.prom", "api-2.prom")
+	assert.Equal(t, evalTime.Add(-time.Minute), storage.MinTime())
+
+	value, err := tool.Eval(context.Background(), storage, `sum by (instance) (increase(http_requests_total[2m]))`, evalTime)
+	assert.NoError(t, err)
+	vector := value.(promql.Vector)
+	assert.Len(t, vector, 2)
+	assert.Equal(t, labels.FromStrings("instance", "api-0"), vector[0].Metric)
+
+	value, err = tool.Eval(context.Background(), storage, `up == 0`, evalTime)
+	assert.NoError(t, err)
+	assert.Equal(t, `{__name__="up", instance="api-1"} => 0 @[1792324800000]`, value.String())
+
+	_, err = tool.Eval(context.Background(), storage, `up{`, evalTime)
+	assert.Error(t, err)
+}
+
+func TestLoadSnapshotsStaleness(t *testing.T) {
+	snapshots := [][]byte{
+		[]byte("up{instance=\"a\"} 1\nup{instance=\"b\"} 1\n"),
+		[]byte("up{instance=\"a\"} 1\n"),
+	}
+	storage, _, err := tool.LoadSnapshots(snapshots, evalTime, time.Minute)
+	assert.NoError(t, err)
+
+	value, err := tool.Eval(context.Background(), storage, `count(up)`, evalTime)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, value.(promql.Vector)[0].F, "series missing from the last scrape are stale")
+
+	// Samples with a timestamp keep it, and set the evaluation time
+	storage, ts, err := tool.LoadSnapshots([][]byte{[]byte("up 1 1792324800000\n")}, time.Time{}, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, evalTime, ts.UTC())
+	assert.Equal(t, evalTime, storage.MinTime().UTC())
+}
+
+func TestEvalRules(t *testing.T) {
+	storage := loadTestSnapshots(t, "api-1.prom", "api-2.prom")
+
+	fp := filepath.Join("testdata/prom_alerts", "eval.yaml")
+	evaluator := tool.NewRuleEvaluator(storage)
+	assert.NoError(t, evaluator.AddRules(&tool.PromQL{}, fp, readFile(fp)))
+	assert.NoError(t, evaluator.Run(context.Background(), storage.MinTime(), evalTime, time.Minute))
+
+	alerts := evaluator.Alerts(false)
+	assert.Len(t, alerts, 2)
+
+	assert.Equal(t, "HighErrorRate", alerts[0].Rule)
+	assert.Equal(t, tool.AlertFiring, alerts[0].State)
+	assert.Equal(t, map[string]string{"alertname": "HighErrorRate", "instance": "api-0", "severity": "critical", "team": "api"}, alerts[0].Labels)
+	assert.Regexp(t, `^api-0 returns 2\.08\d* errors per second$`, alerts[0].Annotations["summary"])
+
+	assert.Equal(t, "TargetDown", alerts[1].Rule)
+	assert.Equal(t, tool.AlertPending, alerts[1].State, "up == 0 has not lasted for 5m")
+
+	assert.Error(t, evaluator.AddRules(&tool.LogQL{}, fp, readFile(fp)))
+
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		assert.EqualError(t, evaluator.Run(context.Background(), storage.MinTime(), evalTime, interval),
+			"invalid evaluation interval "+interval.String()+": must be positive", interval.String())
+	}
+}
+
+func TestEvalRulesAlertState(t *testing.T) {
+	// The series is up == 0 from 12:00 to 12:10, and then missing
+	storage := tool.NewMemoryStorage()
+	for m := 0; m <= 10; m++ {
+		storage.Add(labels.FromStrings("__name__", "up", "instance", "a"), evalTime.Add(time.Duration(m)*time.Minute), 0)
+	}
+
+	rules := []byte(`groups:
+  - name: test
+    rules:
+      - alert: Down
+        expr: up == 0
+        for: 3m
+        keep_firing_for: 10m
+`)
+	tests := []struct {
+		end      time.Duration
+		state    tool.AlertState
+		resolved bool
+	}{
+		{2 * time.Minute, tool.AlertPending, false},
+		{3 * time.Minute, tool.AlertFiring, false},
+		// The series goes stale 5m after its last sample, and the alert keeps firing 10m more
+		{24 * time.Minute, tool.AlertFiring, false},
+		{26 * time.Minute, tool.AlertInactive, true},
+	}
+
+	for _, tt := range tests {
+		evaluator := tool.NewRuleEvaluator(storage)
+		assert.NoError(t, evaluator.AddRules(&tool.PromQL{}, "rules.yaml", rules))
+		assert.NoError(t, evaluator.Run(context.Background(), evalTime, evalTime.Add(tt.end), time.Minute))
+
+		alerts := evaluator.Alerts(true)
+		if assert.Len(t, alerts, 1, tt.end) {
+			assert.Equal(t, tt.state, alerts[0].State, tt.end)
+			assert.Equal(t, evalTime, alerts[0].ActiveAt, tt.end)
+			assert.Equal(t, tt.resolved, !alerts[0].ResolvedAt.IsZero(), tt.end)
+		}
+	}
+}
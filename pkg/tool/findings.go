@@ -0,0 +1,483 @@
+package tool
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/rulefmt"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Severity is how serious a finding is
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Finding is a problem found in a file by validation
+type Finding struct {
+	File string `json:"file"`
+	// Line and Column are 1-based, and 0 when the problem cannot be located
+	Line     int      `json:"line"`
+	Column   int      `json:"column"`
+	RuleID   string   `json:"rule_id"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// String formats a finding as file:line:column: message (rule ID)
+func (f Finding) String() string {
+	where := f.File
+	if position := f.position(); position != "" {
+		where += ":" + position
+	}
+	return fmt.Sprintf("%s: %s (%s)", where, f.Message, f.RuleID)
+}
+
+// position formats the position of a finding as line:column, line or nothing, depending on
+// what is known
+func (f Finding) position() string {
+	switch {
+	case f.Line > 0 && f.Column > 0:
+		return fmt.Sprintf("%d:%d", f.Line, f.Column)
+	case f.Line > 0:
+		return strconv.Itoa(f.Line)
+	default:
+		return ""
+	}
+}
+
+// RuleDescriptions describe the rule IDs of findings
+var RuleDescriptions = map[string]string{
+	"invalid-yaml":          "The file is not valid YAML, or has unknown fields",
+	"invalid-group":         "A rule group is invalid",
+	"invalid-rule":          "A rule is invalid",
+	"invalid-expression":    "An expression does not parse",
+	"unknown-metric":        "A selector matches no metric of the metric catalogue",
+	"unknown-label":         "A selector requires a label which no metric it matches has",
+	"invalid-dashboard":     "The file is not a valid Grafana dashboard",
+	"undefined-variable":    "A dashboard query uses an undefined template variable",
+	"unused-variable":       "A dashboard template variable is never used",
+	"invalid-config":        "The Prometheus configuration is invalid",
+	"unused-suppression":    "A suppression comment or annotation suppresses no finding",
+	"policy-name":           "A rule name does not follow the naming convention of the policy",
+	"policy-label":          "A rule lacks a label the policy requires, or has a value it does not allow",
+	"policy-annotation":     "An alerting rule lacks an annotation the policy requires, or has a value it does not allow",
+	"policy-for":            "An alerting rule is pending for longer than the policy allows",
+	"policy-function":       "An expression uses a function the policy forbids",
+	"unused-recording-rule": "No rule uses the metric a recording rule records",
+	"slower-dependency":     "An alert uses a metric recorded less often than the alert is evaluated",
+	"rule-cycle":            "Recording rules depend on each other",
+	"duplicate-record":      "A metric is recorded by rules of several files",
+	"timing-interval":       "A group is evaluated more often than its metrics are scraped",
+	"timing-for":            "A for or keep_firing_for duration is shorter than the evaluation interval",
+	"timing-range":          "A range is too short for the scrape or evaluation interval",
+	"timing-subquery":       "A subquery step is shorter than the scrape interval, or longer than the subquery range",
+	"timing-offset":         "An offset is shorter than the scrape interval",
+}
+
+// HasErrors tells whether any of the findings is an error
+func HasErrors(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// errorPositionPattern matches the line:column prefixes of rulefmt errors
+	errorPositionPattern = regexp.MustCompile(`^(?:\d+:\d+: )+`)
+	// yamlLinePattern matches the line of YAML syntax and type errors
+	yamlLinePattern = regexp.MustCompile(`^(?:yaml: )?line (\d+): `)
+	// configLinePattern matches the first line mentioned by a configuration loading error
+	configLinePattern = regexp.MustCompile(`\bline (\d+):`)
+)
+
+// RuleFindings validates a rule file like the ValidateRules of checker, returning a finding for
+// each error which is not suppressed, and a warning for each unused suppression
+func RuleFindings(checker Checker, filename string, data []byte) []Finding {
+	switch c := checker.(type) {
+	case *PromQL:
+		_, findings := c.ruleFindings(filename, data)
+		return findings
+	case *LogQL:
+		_, findings := c.ruleFindings(filename, data)
+		return findings
+	}
+	if _, err := checker.ValidateRules(filename, data); err != nil {
+		return []Finding{errorFinding(filename, "invalid-rule", err)}
+	}
+	return nil
+}
+
+// FindingsError returns an error with a line for each file with findings which are errors, in
+// the format of the errors of ValidateRules, or nil if none of the findings is an error
+func FindingsError(findings []Finding) error {
+	var files []string
+	byFile := map[string][]Finding{}
+	for _, f := range findings {
+		if f.Severity != SeverityError {
+			continue
+		}
+		if _, ok := byFile[f.File]; !ok {
+			files = append(files, f.File)
+		}
+		byFile[f.File] = append(byFile[f.File], f)
+	}
+
+	var errs []string
+	for _, file := range files {
+		errs = append(errs, findingsError(file, byFile[file]).Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// findingsError returns an error listing the messages of the findings which are errors, if any,
+// prefixed with their position when known
+func findingsError(filename string, findings []Finding) error {
+	var errs []error
+	for _, f := range findings {
+		if f.Severity != SeverityError {
+			continue
+		}
+		if position := f.position(); position != "" {
+			errs = append(errs, fmt.Errorf("%s: %s", position, f.Message))
+		} else {
+			errs = append(errs, errors.New(f.Message))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error validating %s: %+v", filename, errs)
+	}
+	return nil
+}
+
+// errorFinding returns a finding for an error, located at the position or the line the error
+// message starts with if any, which is removed from the message
+func errorFinding(filename, ruleID string, err error) Finding {
+	f := Finding{File: filename, RuleID: ruleID, Severity: SeverityError, Message: err.Error()}
+	if prefix := errorPositionPattern.FindString(f.Message); prefix != "" {
+		// The first of the positions rulefmt may give is the most specific
+		fmt.Sscanf(prefix, "%d:%d:", &f.Line, &f.Column)
+		f.Message = f.Message[len(prefix):]
+	} else if m := yamlLinePattern.FindStringSubmatch(f.Message); m != nil {
+		f.Line, _ = strconv.Atoi(m[1])
+		f.Message = f.Message[len(m[0]):]
+	}
+	return f
+}
+
+// yamlFindings returns a finding for each error of a YAML decoding error
+func yamlFindings(filename string, err error) []Finding {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return []Finding{errorFinding(filename, "invalid-yaml", err)}
+	}
+
+	var findings []Finding
+	for _, e := range typeErr.Errors {
+		findings = append(findings, errorFinding(filename, "invalid-yaml", errors.New(e)))
+	}
+	return findings
+}
+
+// nodeFinding returns a finding located at a YAML node, if any
+func nodeFinding(filename, ruleID, message string, node *yaml.Node) Finding {
+	f := Finding{File: filename, RuleID: ruleID, Severity: SeverityError, Message: message}
+	if node != nil {
+		f.Line, f.Column = node.Line, node.Column
+	}
+	return f
+}
+
+// ruleFinding returns a finding about a rule of a group, located at node, whose message names
+// the group and the alert or record
+func ruleFinding(filename, ruleID string, severity Severity, group string, rule rulefmt.Rule, node *yaml.Node, format string, args ...any) Finding {
+	name := rule.Alert
+	if name == "" {
+		name = rule.Record
+	}
+	message := fmt.Sprintf("group %q, rule %q: %s", group, name, fmt.Sprintf(format, args...))
+	f := nodeFinding(filename, ruleID, message, node)
+	f.Severity = severity
+	return f
+}
+
+// ruleFileNodes returns the nodes of the rules of each group of a rule file
+func ruleFileNodes(data []byte) [][]*yaml.Node {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil || len(root.Content) == 0 {
+		return nil
+	}
+
+	var groups [][]*yaml.Node
+	for _, group := range sequenceContent(mappingValue(root.Content[0], "groups")) {
+		groups = append(groups, append([]*yaml.Node{group}, sequenceContent(mappingValue(group, "rules"))...))
+	}
+	return groups
+}
+
+// ruleFileNode returns the node of a group of a rule file if rule is -1, and the node of one
+// of its rules otherwise, or nil
+func ruleFileNode(nodes [][]*yaml.Node, group, rule int) *yaml.Node {
+	if group >= len(nodes) || rule+1 >= len(nodes[group]) {
+		return nil
+	}
+	return nodes[group][rule+1]
+}
+
+// nthGroupNode returns the node of the nth group of a rule file with a given name, counting
+// from 0, or nil
+func nthGroupNode(data []byte, name string, n int) *yaml.Node {
+	for _, nodes := range ruleFileNodes(data) {
+		if scalarValue(nodes[0], "name") == name {
+			if n == 0 {
+				return nodes[0]
+			}
+			n--
+		}
+	}
+	return nil
+}
+
+// exprNode returns the expression node of a rule node, or the rule node if it has none
+func exprNode(rule *yaml.Node) *yaml.Node {
+	if expr := mappingValue(rule, "expr"); expr != nil {
+		return expr
+	}
+	return rule
+}
+
+// sortFindings sorts findings by file and position, and removes duplicates
+func sortFindings(findings []Finding) []Finding {
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+
+	var unique []Finding
+	for i, f := range findings {
+		if i == 0 || f != findings[i-1] {
+			unique = append(unique, f)
+		}
+	}
+	return unique
+}
+
+// ConfigFindings validates a Prometheus configuration file like ValidateConfig, returning its
+// error as a finding, located at the first line the error mentions if any
+func ConfigFindings(checker Checker, filename string) ([]Finding, error) {
+	if _, ok := checker.(*PromQL); !ok {
+		return nil, checker.ValidateConfig(filename)
+	}
+	err := checker.ValidateConfig(filename)
+	if err == nil {
+		return nil, nil
+	}
+
+	f := Finding{File: filename, RuleID: "invalid-config", Severity: SeverityError, Message: err.Error()}
+	if m := configLinePattern.FindStringSubmatch(f.Message); m != nil {
+		f.Line, _ = strconv.Atoi(m[1])
+	}
+	return []Finding{f}, nil
+}
+
+// sarifLog is a SARIF 2.1.0 log, with the fields code scanning uses
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// WriteSARIF writes findings as a SARIF 2.1.0 log, as uploaded to GitHub code scanning
+func WriteSARIF(w io.Writer, findings []Finding) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "cos-tool",
+			InformationURI: "https://github.com/canonical/cos-tool",
+			Rules:          []sarifRule{},
+		}},
+		Results: []sarifResult{},
+	}
+
+	seen := map[string]struct{}{}
+	for _, f := range findings {
+		if _, ok := seen[f.RuleID]; !ok {
+			seen[f.RuleID] = struct{}{}
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+				ID:               f.RuleID,
+				ShortDescription: sarifMessage{Text: RuleDescriptions[f.RuleID]},
+			})
+		}
+
+		location := sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(f.File)}}
+		if f.Line > 0 {
+			location.Region = &sarifRegion{StartLine: f.Line, StartColumn: f.Column}
+		}
+		run.Results = append(run.Results, sarifResult{
+			RuleID:    f.RuleID,
+			Level:     string(f.Severity),
+			Message:   sarifMessage{Text: f.Message},
+			Locations: []sarifLocation{{PhysicalLocation: location}},
+		})
+	}
+	sort.Slice(run.Tool.Driver.Rules, func(i, j int) bool {
+		return run.Tool.Driver.Rules[i].ID < run.Tool.Driver.Rules[j].ID
+	})
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes findings as a JUnit XML report named after the validation, with a test
+// suite for each file holding a failed test case for each of its findings, or a passed one if
+// it has none
+func WriteJUnit(w io.Writer, name string, files []string, findings []Finding) error {
+	byFile := map[string][]Finding{}
+	for _, f := range findings {
+		if _, ok := byFile[f.File]; !ok && !slices.Contains(files, f.File) {
+			files = append(files, f.File)
+		}
+		byFile[f.File] = append(byFile[f.File], f)
+	}
+
+	report := junitTestSuites{Name: name}
+	for _, file := range files {
+		suite := junitTestSuite{Name: file}
+		for _, f := range byFile[file] {
+			suite.Cases = append(suite.Cases, junitTestCase{
+				Name:      strings.TrimSuffix(f.RuleID+" at "+f.position(), " at "),
+				ClassName: file,
+				Failure: &junitFailure{
+					Message: f.Message,
+					Type:    string(f.Severity),
+					Text:    f.String(),
+				},
+			})
+		}
+		if len(suite.Cases) == 0 {
+			suite.Cases = []junitTestCase{{Name: name, ClassName: file}}
+		}
+		suite.Tests = len(suite.Cases)
+		suite.Failures = len(byFile[file])
+
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Suites = append(report.Suites, suite)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,205 @@
+package tool_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+const invalidRules = `groups:
+  - name: api
+    rules:
+      - record: job:up
+        alert: Down
+        expr: up
+      - alert: Broken
+        expr: rate(up[5m)
+  - name: api
+    rules:
+      - alert: Fine
+        expr: up == 0
+`
+
+func TestPromQLRuleFindings(t *testing.T) {
+	findings := tool.RuleFindings(&tool.PromQL{}, "rules.yaml", []byte(invalidRules))
+	assert.Equal(t, []tool.Finding{
+		{File: "rules.yaml", Line: 4, Column: 17, RuleID: "invalid-rule", Severity: tool.SeverityError,
+			Message: `group "api", rule 1, "Down": only one of 'record' and 'alert' must be set`},
+		{File: "rules.yaml", Line: 8, Column: 15, RuleID: "invalid-expression", Severity: tool.SeverityError,
+			Message: `group "api", rule 2, "Broken": could not parse expression: 1:11: parse error: unexpected ")" in subquery or range, expected ":" or "]"`},
+		{File: "rules.yaml", Line: 9, Column: 5, RuleID: "invalid-group", Severity: tool.SeverityError,
+			Message: `groupname: "api" is repeated in the same file`},
+	}, findings)
+
+	assert.Empty(t, tool.RuleFindings(&tool.PromQL{}, "rules.yaml", []byte("groups:\n  - name: ok\n    rules:\n      - alert: Fine\n        expr: up == 0\n")))
+}
+
+func TestLogQLRuleFindings(t *testing.T) {
+	findings := tool.RuleFindings(&tool.LogQL{}, "rules.yaml", []byte(invalidRules))
+	if assert.Len(t, findings, 4) {
+		assert.Equal(t, []int{4, 8, 9, 12}, []int{findings[0].Line, findings[1].Line, findings[2].Line, findings[3].Line})
+		assert.Equal(t, "invalid-rule", findings[0].RuleID)
+		assert.Equal(t, `group "api", rule 1, "Down": only one of 'record' and 'alert' must be set`, findings[0].Message)
+		assert.Equal(t, "invalid-expression", findings[1].RuleID)
+		assert.Equal(t, 15, findings[1].Column)
+		assert.Equal(t, "invalid-group", findings[2].RuleID)
+		assert.NotContains(t, findings[1].Message, ".go:", "no stack trace")
+	}
+
+	assert.Empty(t, tool.RuleFindings(&tool.LogQL{}, "rules.yaml", []byte("groups:\n  - name: ok\n    rules:\n      - alert: Fine\n        expr: 'count_over_time({app=\"x\"}[5m]) > 0'\n")))
+}
+
+func TestRuleFindingsYAML(t *testing.T) {
+	for _, checker := range []tool.Checker{&tool.PromQL{}, &tool.LogQL{}} {
+		findings := tool.RuleFindings(checker, "rules.yaml", []byte("groups:\n  - name: x\n    rulez: []\n"))
+		assert.Equal(t, []tool.Finding{{
+			File: "rules.yaml", Line: 3, RuleID: "invalid-yaml", Severity: tool.SeverityError,
+			Message: "field rulez not found in type rulefmt.RuleGroup",
+		}}, findings)
+	}
+}
+
+func TestRuleMetricFindings(t *testing.T) {
+	c, err := tool.LoadMetricCatalogue([]byte("up{job}\n"), nil)
+	assert.NoError(t, err)
+
+	rules := []byte("groups:\n  - name: test\n    rules:\n      - alert: Test\n        expr: 'up{path=\"a\"} or exporter_up'\n")
+	findings, err := c.RuleMetricFindings(&tool.PromQL{}, "rules.yaml", rules)
+	assert.NoError(t, err)
+	assert.Equal(t, []tool.Finding{
+		{File: "rules.yaml", Line: 5, Column: 15, RuleID: "unknown-label", Severity: tool.SeverityError,
+			Message: `group "test", rule "Test": unknown label "path" for metric "up"`},
+		{File: "rules.yaml", Line: 5, Column: 15, RuleID: "unknown-metric", Severity: tool.SeverityError,
+			Message: `group "test", rule "Test": unknown metric "exporter_up"`},
+	}, findings)
+}
+
+func TestDashboardFindings(t *testing.T) {
+	dashboard := []byte(`{
+  "panels": [
+    {"title": "A", "targets": [{"refId": "A", "expr": "up{job=\"$job\"}"}]},
+    {"title": "B", "targets": [{"refId": "B", "expr": "up{instance=\"$instance\"}"}]}
+  ],
+  "templating": {"list": [
+    {"name": "job", "type": "query", "query": "label_values(up, job)"},
+    {"name": "unused", "type": "custom", "query": "a,b"}
+  ]}
+}`)
+
+	findings := tool.DashboardFindings("dashboard.json", dashboard)
+	if assert.Len(t, findings, 2) {
+		assert.Equal(t, tool.Finding{File: "dashboard.json", Line: 4, Column: 55, RuleID: "undefined-variable", Severity: tool.SeverityError,
+			Message: `panel "", target "B": undefined variable $instance`}, findings[0])
+		assert.Equal(t, tool.Finding{File: "dashboard.json", Line: 8, Column: 6, RuleID: "unused-variable", Severity: tool.SeverityError,
+			Message: `variable $unused: defined but never used`}, findings[1])
+	}
+
+	findings = tool.DashboardFindings("dashboard.json", []byte("{"))
+	if assert.Len(t, findings, 1) {
+		assert.Equal(t, "invalid-dashboard", findings[0].RuleID)
+	}
+}
+
+func TestConfigFindings(t *testing.T) {
+	findings, err := tool.ConfigFindings(&tool.PromQL{}, "testdata/prom_configs/good_config.yml")
+	assert.NoError(t, err)
+	assert.Empty(t, findings)
+
+	for file, line := range map[string]int{"bad_key.yml": 27, "bad_yaml.yml": 28} {
+		findings, err := tool.ConfigFindings(&tool.PromQL{}, "testdata/prom_configs/"+file)
+		assert.NoError(t, err, file)
+		if assert.Len(t, findings, 1, file) {
+			assert.Equal(t, "invalid-config", findings[0].RuleID, file)
+			assert.Equal(t, line, findings[0].Line, file)
+		}
+	}
+
+	_, err = tool.ConfigFindings(&tool.LogQL{}, "testdata/prom_configs/good_config.yml")
+	assert.Error(t, err)
+}
+
+func TestWriteSARIF(t *testing.T) {
+	findings := tool.RuleFindings(&tool.PromQL{}, "rules/api.yaml", []byte(invalidRules))
+
+	var buf bytes.Buffer
+	assert.NoError(t, tool.WriteSARIF(&buf, findings))
+
+	var log struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Name  string `json:"name"`
+					Rules []struct {
+						ID string `json:"id"`
+					} `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results []struct {
+				RuleID    string `json:"ruleId"`
+				Level     string `json:"level"`
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct {
+							URI string `json:"uri"`
+						} `json:"artifactLocation"`
+						Region struct {
+							StartLine   int `json:"startLine"`
+							StartColumn int `json:"startColumn"`
+						} `json:"region"`
+					} `json:"physicalLocation"`
+				} `json:"locations"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &log))
+	assert.Equal(t, "2.1.0", log.Version)
+	if assert.Len(t, log.Runs, 1) && assert.Len(t, log.Runs[0].Results, 3) {
+		run := log.Runs[0]
+		assert.Equal(t, "cos-tool", run.Tool.Driver.Name)
+		assert.Len(t, run.Tool.Driver.Rules, 3)
+
+		result := run.Results[1]
+		assert.Equal(t, "invalid-expression", result.RuleID)
+		assert.Equal(t, "error", result.Level)
+		assert.Equal(t, "rules/api.yaml", result.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+		assert.Equal(t, 8, result.Locations[0].PhysicalLocation.Region.StartLine)
+		assert.Equal(t, 15, result.Locations[0].PhysicalLocation.Region.StartColumn)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	findings := tool.RuleFindings(&tool.PromQL{}, "bad.yaml", []byte(invalidRules))
+
+	var buf bytes.Buffer
+	assert.NoError(t, tool.WriteJUnit(&buf, "validate-rules", []string{"good.yaml", "bad.yaml"}, findings))
+
+	var report struct {
+		Tests    int `xml:"tests,attr"`
+		Failures int `xml:"failures,attr"`
+		Suites   []struct {
+			Name     string `xml:"name,attr"`
+			Failures int    `xml:"failures,attr"`
+			Cases    []struct {
+				Name    string `xml:"name,attr"`
+				Failure *struct {
+					Message string `xml:"message,attr"`
+				} `xml:"failure"`
+			} `xml:"testcase"`
+		} `xml:"testsuite"`
+	}
+	assert.NoError(t, xml.Unmarshal(buf.Bytes(), &report))
+	assert.Equal(t, 4, report.Tests)
+	assert.Equal(t, 3, report.Failures)
+	if assert.Len(t, report.Suites, 2) {
+		assert.Equal(t, "good.yaml", report.Suites[0].Name)
+		assert.Nil(t, report.Suites[0].Cases[0].Failure)
+		assert.Equal(t, "bad.yaml", report.Suites[1].Name)
+		assert.Equal(t, 3, report.Suites[1].Failures)
+		assert.Equal(t, "invalid-rule at 4:17", report.Suites[1].Cases[0].Name)
+	}
+}
@@ -0,0 +1,129 @@
+package tool
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// grafanaVariableQuery is a Grafana templating variable query, such as
+// label_values(up{job="x"}, instance), which is not itself PromQL or LogQL.
+type grafanaVariableQuery struct {
+	function string // label_names, label_values, metrics or query_result
+	expr     string // series selector or expression argument, empty if absent
+	label    string // label argument of label_values
+	regex    string // metric name regex argument of metrics
+}
+
+// Grafana variable query functions, as matched by the Prometheus and Loki data sources
+var (
+	labelNamesQueryPattern  = regexp.MustCompile(`^\s*label_names\(\s*(.*?)\s*\)\s*$`)
+	labelValuesQueryPattern = regexp.MustCompile(`^\s*label_values\(\s*(?:(.+?)\s*,\s*)?([a-zA-Z_$][\w${}]*)\s*\)\s*$`)
+	metricsQueryPattern     = regexp.MustCompile(`^\s*metrics\(\s*(.+?)\s*\)\s*$`)
+	queryResultQueryPattern = regexp.MustCompile(`^\s*query_result\(\s*(.+?)\s*\)\s*$`)
+)
+
+// parseGrafanaVariableQuery recognises the Grafana variable query functions.
+// Returns false if query is not a variable query function call.
+func parseGrafanaVariableQuery(query string) (grafanaVariableQuery, bool) {
+	if m := labelNamesQueryPattern.FindStringSubmatch(query); m != nil {
+		return grafanaVariableQuery{function: "label_names", expr: m[1]}, true
+	}
+	if m := labelValuesQueryPattern.FindStringSubmatch(query); m != nil {
+		return grafanaVariableQuery{function: "label_values", expr: m[1], label: m[2]}, true
+	}
+	if m := metricsQueryPattern.FindStringSubmatch(query); m != nil {
+		return grafanaVariableQuery{function: "metrics", regex: m[1]}, true
+	}
+	if m := queryResultQueryPattern.FindStringSubmatch(query); m != nil {
+		return grafanaVariableQuery{function: "query_result", expr: m[1]}, true
+	}
+	return grafanaVariableQuery{}, false
+}
+
+// String formats the variable query back into Grafana syntax
+func (q grafanaVariableQuery) String() string {
+	switch q.function {
+	case "label_values":
+		if q.expr == "" {
+			return fmt.Sprintf("label_values(%s)", q.label)
+		}
+		return fmt.Sprintf("label_values(%s, %s)", q.expr, q.label)
+	case "metrics":
+		return fmt.Sprintf("metrics(%s)", q.regex)
+	default:
+		return fmt.Sprintf("%s(%s)", q.function, q.expr)
+	}
+}
+
+// metricNames rewrites a metrics query, which has no selector to inject into, as the
+// label_values of __name__ over a selector of its regex, which lists the same metric names.
+// Grafana does not anchor the regex of metrics, unlike =~, so it may match anywhere in a name.
+func (q grafanaVariableQuery) metricNames() grafanaVariableQuery {
+	return grafanaVariableQuery{
+		function: "label_values",
+		expr:     fmt.Sprintf("{__name__=~%q}", ".*(?:"+strings.Trim(q.regex, `"`)+").*"),
+		label:    "__name__",
+	}
+}
+
+// transform injects matchers into the expression of a variable query using the given
+// expression transform. label_names and label_values without an expression get a series
+// selector built from the matchers, so that their values are scoped as well. metrics queries
+// are left as they are.
+func (q grafanaVariableQuery) transform(matchers map[string]string, transform func(string, *map[string]string) (string, error), selector func(map[string]string) string) (string, error) {
+	switch {
+	case q.function == "metrics":
+	case q.expr != "":
+		expr, err := transform(q.expr, &matchers)
+		if err != nil {
+			return "", err
+		}
+		q.expr = expr
+	case len(matchers) > 0:
+		q.expr = selector(matchers)
+	}
+	return q.String(), nil
+}
+
+// sortedMatcherStrings formats matchers as name="value" pairs, sorted by label name
+func sortedMatcherStrings(matchers map[string]string) []string {
+	names := make([]string, 0, len(matchers))
+	for name := range matchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, matchers[name]))
+	}
+	return pairs
+}
+
+// validateGrafanaVariableQuery checks that a variable query is either a valid variable query
+// function with a valid embedded expression, or a valid expression on its own.
+func validateGrafanaVariableQuery(checker Checker, query string) error {
+	q, ok := parseGrafanaVariableQuery(query)
+	if !ok {
+		return parses(checker, query)
+	}
+
+	if q.function == "metrics" {
+		// Variables in the regex are interpolated at render time
+		regex := generalVariablePattern.ReplaceAllString(q.regex, "x")
+		if _, err := regexp.Compile(strings.Trim(regex, `"`)); err != nil {
+			return fmt.Errorf("invalid regex in %s: %w", q.function, err)
+		}
+		return nil
+	}
+
+	if q.expr == "" {
+		return nil
+	}
+	if err := parses(checker, q.expr); err != nil {
+		return fmt.Errorf("invalid expression in %s: %w", q.function, err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package tool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// GrafanaAllValue is the value Grafana uses when "All" is selected for a variable.
+const GrafanaAllValue = "$__all"
+
+// GrafanaVariables holds concrete values for Grafana template variables, used to interpolate
+// dashboard expressions the way Grafana does before they are sent to Prometheus or Loki.
+type GrafanaVariables struct {
+	// Values maps variable names (without $) to their values. More than one value
+	// makes the variable a multi-value variable.
+	Values map[string][]string
+	// AllValue is substituted for variables set to $__all (Grafana's custom "all value").
+	AllValue string
+}
+
+// VariableError reports a variable value that makes an interpolated expression unparseable.
+type VariableError struct {
+	Variable string
+	Value    string
+	Err      error
+}
+
+func (e *VariableError) Error() string {
+	return fmt.Sprintf("value %q of variable $%s breaks parsing: %v", e.Value, e.Variable, e.Err)
+}
+
+func (e *VariableError) Unwrap() error {
+	return e.Err
+}
+
+// Default values for Grafana built-in variables, used by Render when they are not set explicitly
+var grafanaBuiltinDefaults = map[string]string{
+	"__interval":      "1m",
+	"__interval_ms":   "60000",
+	"__rate_interval": "4m",
+	"__range":         "1h",
+	"__range_s":       "3600",
+	"__range_ms":      "3600000",
+	"__auto":          "1m",
+}
+
+var (
+	// Interpolation pattern for all Grafana variable syntaxes:
+	// $var, ${var}, ${var:format} and the deprecated [[var]], [[var:format]]
+	interpolationPattern = regexp.MustCompile(`\$(\w+)|\$\{(\w+)(?::(\w+))?\}|\[\[(\w+)(?::(\w+))?\]\]`)
+
+	// Operators whose right-hand side is a regular expression, in PromQL and LogQL
+	regexOperatorPattern = regexp.MustCompile(`(?:=~|!~|\|~)\s*$`)
+)
+
+// GetGrafanaVariables parses name=value flags into GrafanaVariables.
+// Repeating a name adds values to a multi-value variable.
+func GetGrafanaVariables(flags []string, allValue string) (GrafanaVariables, error) {
+	vars := GrafanaVariables{Values: map[string][]string{}, AllValue: allValue}
+	for _, flag := range flags {
+		name, value, ok := strings.Cut(flag, "=")
+		name = strings.TrimPrefix(name, "$")
+		if !ok || name == "" {
+			return vars, errors.New("malformed variable, expected name=value")
+		}
+		vars.Values[name] = append(vars.Values[name], value)
+	}
+	return vars, nil
+}
+
+// Interpolate substitutes every variable that has a value in expr, following Grafana's
+// formatting rules for Prometheus and Loki data sources. Variables without a value are kept.
+func (v GrafanaVariables) Interpolate(expr string) (string, error) {
+	return v.interpolate(expr, func(string) bool { return true })
+}
+
+func (v GrafanaVariables) interpolate(expr string, include func(string) bool) (string, error) {
+	// Byte ranges of string literals, used to find the matcher operator a variable belongs to
+	literals := append(doubleQuotedStringPattern.FindAllStringIndex(expr, -1), backtickStringPattern.FindAllStringIndex(expr, -1)...)
+
+	var b strings.Builder
+	last := 0
+	for _, m := range interpolationPattern.FindAllStringSubmatchIndex(expr, -1) {
+		name, format := submatch(expr, m, 1), ""
+		if name == "" {
+			name, format = submatch(expr, m, 2), submatch(expr, m, 3)
+		}
+		if name == "" {
+			name, format = submatch(expr, m, 4), submatch(expr, m, 5)
+		}
+
+		values, ok := v.Values[name]
+		if !ok || !include(name) {
+			continue
+		}
+
+		inRegex, quote := false, byte(0)
+		for _, lit := range literals {
+			if lit[0] < m[0] && m[1] < lit[1] {
+				quote = expr[lit[0]]
+				inRegex = regexOperatorPattern.MatchString(expr[:lit[0]])
+				break
+			}
+		}
+
+		formatted, err := v.format(name, values, format, inRegex, quote)
+		if err != nil {
+			return expr, err
+		}
+		b.WriteString(expr[last:m[0]])
+		b.WriteString(formatted)
+		last = m[1]
+	}
+	b.WriteString(expr[last:])
+
+	return b.String(), nil
+}
+
+// format renders the values of a variable using a Grafana variable format.
+// Without an explicit format, multi-value variables and variables used in regex
+// matchers are regex-escaped and joined, as Grafana does for Prometheus and Loki.
+func (v GrafanaVariables) format(name string, values []string, format string, inRegex bool, quote byte) (string, error) {
+	if len(values) == 1 && values[0] == GrafanaAllValue {
+		return v.AllValue, nil
+	}
+
+	switch format {
+	case "":
+		if inRegex || len(values) > 1 {
+			return formatRegex(values, quote), nil
+		}
+		return values[0], nil
+	case "raw", "text", "value":
+		return strings.Join(values, ","), nil
+	case "regex":
+		return formatRegex(values, quote), nil
+	case "pipe":
+		return strings.Join(values, "|"), nil
+	case "csv":
+		return strings.Join(values, ","), nil
+	case "glob":
+		if len(values) == 1 {
+			return values[0], nil
+		}
+		return "{" + strings.Join(values, ",") + "}", nil
+	case "json":
+		var out []byte
+		if len(values) == 1 {
+			out, _ = json.Marshal(values[0])
+		} else {
+			out, _ = json.Marshal(values)
+		}
+		return string(out), nil
+	default:
+		return "", fmt.Errorf("unsupported format %q for variable $%s", format, name)
+	}
+}
+
+// formatRegex escapes each value for use in a regular expression and joins multiple values
+// into an alternation. Backslashes are doubled inside double-quoted string literals.
+func formatRegex(values []string, quote byte) string {
+	escaped := make([]string, 0, len(values))
+	for _, value := range values {
+		e := regexp.QuoteMeta(value)
+		if quote == '"' {
+			e = strings.ReplaceAll(e, `\`, `\\`)
+		}
+		escaped = append(escaped, e)
+	}
+	if len(escaped) == 1 {
+		return escaped[0]
+	}
+	return "(" + strings.Join(escaped, "|") + ")"
+}
+
+func submatch(s string, m []int, group int) string {
+	if m[2*group] < 0 {
+		return ""
+	}
+	return s[m[2*group]:m[2*group+1]]
+}
+
+// Render interpolates all variables in expr and checks that the result parses with the given
+// checker. Grafana built-in variables default to representative values unless set explicitly.
+// If parsing fails, the returned error is a *VariableError naming the offending variable
+// whenever a single variable can be singled out.
+func Render(checker Checker, expr string, vars GrafanaVariables) (string, error) {
+	withDefaults := GrafanaVariables{Values: map[string][]string{}, AllValue: vars.AllValue}
+	for name, value := range grafanaBuiltinDefaults {
+		withDefaults.Values[name] = []string{value}
+	}
+	for name, values := range vars.Values {
+		withDefaults.Values[name] = values
+	}
+
+	rendered, err := withDefaults.Interpolate(expr)
+	if err != nil {
+		return expr, err
+	}
+
+	for _, m := range interpolationPattern.FindAllString(rendered, -1) {
+		// $1, $2, ... are regex capture group references in label_replace, not variables
+		if name := strings.Trim(m, "${}[]"); name[0] < '0' || name[0] > '9' {
+			return rendered, fmt.Errorf("no value for variable %s", m)
+		}
+	}
+
+	if err := parses(checker, rendered); err != nil {
+		return rendered, withDefaults.findBrokenVariable(checker, expr, err)
+	}
+
+	return rendered, nil
+}
+
+// findBrokenVariable interpolates one variable at a time, leaving the others as template
+// variables, to find the variable whose value makes expr unparseable.
+func (v GrafanaVariables) findBrokenVariable(checker Checker, expr string, err error) error {
+	// The template itself must parse, otherwise no single variable is to blame
+	if parses(checker, expr) != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(v.Values))
+	for name := range v.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		partial, ierr := v.interpolate(expr, func(n string) bool { return n == name })
+		if ierr != nil || partial == expr {
+			continue
+		}
+		if perr := parses(checker, partial); perr != nil {
+			return &VariableError{Variable: name, Value: strings.Join(v.Values[name], ","), Err: perr}
+		}
+	}
+	return err
+}
+
+func parses(checker Checker, expr string) error {
+	_, err := checker.Transform(expr, &map[string]string{})
+	return err
+}
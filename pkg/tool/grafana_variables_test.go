@@ -0,0 +1,160 @@
+package tool_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetGrafanaVariables(t *testing.T) {
+	t.Run("single and repeated variables", func(t *testing.T) {
+		vars, err := tool.GetGrafanaVariables([]string{"job=a", "instance=x", "job=b"}, ".*")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{"job": {"a", "b"}, "instance": {"x"}}, vars.Values)
+		assert.Equal(t, ".*", vars.AllValue)
+	})
+
+	t.Run("values with commas", func(t *testing.T) {
+		vars, err := tool.GetGrafanaVariables([]string{"$job=a,b=c"}, "")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{"job": {"a,b=c"}}, vars.Values)
+	})
+
+	t.Run("malformed variable", func(t *testing.T) {
+		_, err := tool.GetGrafanaVariables([]string{"invalid"}, "")
+		assert.Error(t, err)
+		_, err = tool.GetGrafanaVariables([]string{"job=a", "b"}, "")
+		assert.Error(t, err)
+	})
+}
+
+func TestGrafanaVariablesInterpolate(t *testing.T) {
+	vars := tool.GrafanaVariables{
+		Values: map[string][]string{
+			"job":      {"node.exporter"},
+			"instance": {"a:9100", "b:9100"},
+			"all":      {tool.GrafanaAllValue},
+		},
+		AllValue: ".+",
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Single value in equality matcher is not escaped",
+			input:    `up{job="$job"}`,
+			expected: `up{job="node.exporter"}`,
+		},
+		{
+			name:     "Single value in regex matcher is escaped",
+			input:    `up{job=~"$job"}`,
+			expected: `up{job=~"node\\.exporter"}`,
+		},
+		{
+			name:     "Multi-value variable defaults to regex alternation",
+			input:    `up{instance=~"${instance}"}`,
+			expected: `up{instance=~"(a:9100|b:9100)"}`,
+		},
+		{
+			name:     "Pipe format",
+			input:    `up{instance=~"${instance:pipe}"}`,
+			expected: `up{instance=~"a:9100|b:9100"}`,
+		},
+		{
+			name:     "CSV format",
+			input:    `${instance:csv}`,
+			expected: `a:9100,b:9100`,
+		},
+		{
+			name:     "Regex format",
+			input:    `up{job=~"${job:regex}"}`,
+			expected: `up{job=~"node\\.exporter"}`,
+		},
+		{
+			name:     "JSON format",
+			input:    `${instance:json}`,
+			expected: `["a:9100","b:9100"]`,
+		},
+		{
+			name:     "Deprecated bracket syntax",
+			input:    `up{job="[[job]]"}`,
+			expected: `up{job="node.exporter"}`,
+		},
+		{
+			name:     "All value",
+			input:    `up{job=~"$all"}`,
+			expected: `up{job=~".+"}`,
+		},
+		{
+			name:     "Variables without values are kept",
+			input:    `rate(up{job="$job"}[$__rate_interval])`,
+			expected: `rate(up{job="node.exporter"}[$__rate_interval])`,
+		},
+		{
+			name:     "LogQL regex line filter",
+			input:    `{job="x"} |~ "$job"`,
+			expected: `{job="x"} |~ "node\\.exporter"`,
+		},
+		{
+			name:     "Backtick strings do not double backslashes",
+			input:    "{job=~`$job`}",
+			expected: "{job=~`node\\.exporter`}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := vars.Interpolate(tt.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+
+	t.Run("Unsupported format", func(t *testing.T) {
+		_, err := vars.Interpolate(`${job:percentencode}`)
+		assert.Error(t, err)
+	})
+}
+
+func TestRender(t *testing.T) {
+	t.Run("PromQL with built-in defaults", func(t *testing.T) {
+		vars := tool.GrafanaVariables{Values: map[string][]string{"job": {"a", "b"}}}
+		result, err := tool.Render(&tool.PromQL{}, `rate(up{job=~"$job"}[$__rate_interval])`, vars)
+		assert.NoError(t, err)
+		assert.Equal(t, `rate(up{job=~"(a|b)"}[4m])`, result)
+	})
+
+	t.Run("LogQL", func(t *testing.T) {
+		vars := tool.GrafanaVariables{Values: map[string][]string{"app": {"nginx"}}}
+		result, err := tool.Render(&tool.LogQL{}, `sum(count_over_time({app="$app"}[$__auto]))`, vars)
+		assert.NoError(t, err)
+		assert.Equal(t, `sum(count_over_time({app="nginx"}[1m]))`, result)
+	})
+
+	t.Run("Capture group references are not variables", func(t *testing.T) {
+		vars := tool.GrafanaVariables{Values: map[string][]string{}}
+		_, err := tool.Render(&tool.PromQL{}, `label_replace(up, "host", "$1", "instance", "(.*):.*")`, vars)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Missing variable value", func(t *testing.T) {
+		vars := tool.GrafanaVariables{Values: map[string][]string{}}
+		_, err := tool.Render(&tool.PromQL{}, `up{job="$job"}`, vars)
+		assert.ErrorContains(t, err, "no value for variable $job")
+	})
+
+	t.Run("Reports the variable that breaks parsing", func(t *testing.T) {
+		vars := tool.GrafanaVariables{Values: map[string][]string{"job": {"ok"}, "grouping": {"a b"}}}
+		_, err := tool.Render(&tool.PromQL{}, `sum by ($grouping) (up{job="$job"})`, vars)
+
+		var verr *tool.VariableError
+		assert.True(t, errors.As(err, &verr))
+		assert.Equal(t, "grouping", verr.Variable)
+		assert.Equal(t, "a b", verr.Value)
+	})
+}
@@ -0,0 +1,302 @@
+package tool
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// graphRuleIDs are the rule IDs of the findings of rule graphs
+var graphRuleIDs = []string{"unused-recording-rule", "slower-dependency", "rule-cycle", "duplicate-record"}
+
+// RuleGraph is the dependency graph of the rules of rule files: a rule depends on the recording
+// rules recording the metrics its selectors select by name
+type RuleGraph struct {
+	rules []*GraphRule
+	// defaultInterval is the evaluation interval of groups which do not set one
+	defaultInterval model.Duration
+	// files holds the content of each rule file, for its suppressions
+	files map[string][]byte
+	order []string
+}
+
+// GraphRule is a rule of a rule graph
+type GraphRule struct {
+	ID       int            `json:"id"`
+	File     string         `json:"file"`
+	Line     int            `json:"line"`
+	Column   int            `json:"column"`
+	Group    string         `json:"group"`
+	Interval model.Duration `json:"interval"`
+	Alert    string         `json:"alert,omitempty"`
+	Record   string         `json:"record,omitempty"`
+	// Metrics are the metric names selected by the expression
+	Metrics []string `json:"metrics"`
+}
+
+// Name returns the alert or record name of the rule
+func (r *GraphRule) Name() string {
+	if r.Alert != "" {
+		return r.Alert
+	}
+	return r.Record
+}
+
+// GraphEdge is a dependency of a rule, To, on a recording rule, From
+type GraphEdge struct {
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Metric string `json:"metric"`
+}
+
+// NewRuleGraph returns an empty rule graph, in which groups which do not set an evaluation
+// interval are evaluated every defaultInterval
+func NewRuleGraph(defaultInterval time.Duration) *RuleGraph {
+	return &RuleGraph{defaultInterval: model.Duration(defaultInterval), files: map[string][]byte{}}
+}
+
+// AddRules adds the rules of a rule file to the graph
+func (g *RuleGraph) AddRules(checker Checker, filename string, data []byte) error {
+	rf, err := parseRuleFile(checker, filename, data)
+	if err != nil {
+		return err
+	}
+	if _, ok := g.files[filename]; !ok {
+		g.order = append(g.order, filename)
+	}
+	g.files[filename] = data
+
+	nodes := ruleFileNodes(data)
+	for i, group := range rf.Groups {
+		interval := group.Interval
+		if interval == 0 {
+			interval = g.defaultInterval
+		}
+
+		for j, rule := range group.Rules {
+			r := &GraphRule{
+				ID:       len(g.rules),
+				File:     filename,
+				Group:    group.Name,
+				Interval: interval,
+				Alert:    rule.Alert,
+				Record:   rule.Record,
+				Metrics:  []string{},
+			}
+			if node := ruleFileNode(nodes, i, j); node != nil {
+				r.Line, r.Column = node.Line, node.Column
+			}
+
+			// The file being valid, an invalid expression is suppressed and has no dependency
+			if a, err := Analyze(checker, rule.Expr); err == nil {
+				for _, s := range a.Selectors {
+					if s.Metric != "" {
+						r.Metrics = appendUnique(r.Metrics, s.Metric)
+					}
+				}
+			}
+			g.rules = append(g.rules, r)
+		}
+	}
+	return nil
+}
+
+// Rules returns the rules of the graph, in the order they were added
+func (g *RuleGraph) Rules() []*GraphRule {
+	return g.rules
+}
+
+// Edges returns the dependencies of the rules of the graph on recording rules
+func (g *RuleGraph) Edges() []GraphEdge {
+	recorders := g.recorders()
+	var edges []GraphEdge
+	for _, r := range g.rules {
+		for _, metric := range r.Metrics {
+			for _, from := range recorders[metric] {
+				edges = append(edges, GraphEdge{From: from, To: r.ID, Metric: metric})
+			}
+		}
+	}
+	return edges
+}
+
+// recorders returns the IDs of the rules recording each metric
+func (g *RuleGraph) recorders() map[string][]int {
+	recorders := map[string][]int{}
+	for _, r := range g.rules {
+		if r.Record != "" {
+			recorders[r.Record] = append(recorders[r.Record], r.ID)
+		}
+	}
+	return recorders
+}
+
+// Findings returns the problems of the graph which are not suppressed in the rule files, and
+// a warning for each unused suppression of these problems: recording rules no rule uses, alerts
+// using metrics recorded less often than the alerts are evaluated, recording rules depending on
+// each other, and metrics recorded by rules of several files
+func (g *RuleGraph) Findings() []Finding {
+	edges := g.Edges()
+	var findings []Finding
+	report := func(r *GraphRule, ruleID string, severity Severity, format string, args ...any) {
+		findings = append(findings, Finding{
+			File: r.File, Line: r.Line, Column: r.Column, RuleID: ruleID, Severity: severity,
+			Message: fmt.Sprintf("group %q, rule %q: ", r.Group, r.Name()) + fmt.Sprintf(format, args...),
+		})
+	}
+
+	used := map[int]bool{}
+	for _, e := range edges {
+		used[e.From] = true
+
+		from, to := g.rules[e.From], g.rules[e.To]
+		if to.Alert != "" && from.Interval > to.Interval {
+			report(to, "slower-dependency", SeverityWarning, "uses %s, recorded by group %q every %s, less often than every %s",
+				e.Metric, from.Group, from.Interval, to.Interval)
+		}
+	}
+	for _, r := range g.rules {
+		if r.Record != "" && !used[r.ID] {
+			report(r, "unused-recording-rule", SeverityWarning, "recorded metric is not used by any rule")
+		}
+	}
+
+	for _, cycle := range g.cycles(edges) {
+		var names []string
+		for _, id := range cycle {
+			names = append(names, g.rules[id].Record)
+		}
+		for _, id := range cycle {
+			report(g.rules[id], "rule-cycle", SeverityError, "part of a dependency cycle between %s", strings.Join(names, ", "))
+		}
+	}
+
+	for _, ids := range g.recorders() {
+		var files []string
+		for _, id := range ids {
+			files = appendUnique(files, g.rules[id].File)
+		}
+		if len(files) < 2 {
+			continue
+		}
+		for _, id := range ids {
+			r := g.rules[id]
+			others := slices.DeleteFunc(slices.Clone(files), func(f string) bool { return f == r.File })
+			report(r, "duplicate-record", SeverityError, "also recorded in %s", strings.Join(others, ", "))
+		}
+	}
+
+	var result []Finding
+	for _, filename := range g.order {
+		var fileFindings []Finding
+		for _, f := range findings {
+			if f.File == filename {
+				fileFindings = append(fileFindings, f)
+			}
+		}
+		result = append(result, ParseSuppressions(filename, g.files[filename]).apply(fileFindings, graphRuleIDs...)...)
+	}
+	return sortFindings(result)
+}
+
+// cycles returns the IDs of the rules of each dependency cycle, found as the strongly connected
+// components of the graph with more than one rule or a rule depending on itself
+func (g *RuleGraph) cycles(edges []GraphEdge) [][]int {
+	next := map[int][]int{}
+	for _, e := range edges {
+		next[e.From] = append(next[e.From], e.To)
+	}
+
+	// Tarjan's algorithm
+	index := map[int]int{}
+	low := map[int]int{}
+	onStack := map[int]bool{}
+	var stack []int
+	var cycles [][]int
+
+	var connect func(v int)
+	connect = func(v int) {
+		index[v] = len(index)
+		low[v] = index[v]
+		stack = append(stack, v)
+		onStack[v] = true
+
+		for _, w := range next[v] {
+			if _, ok := index[w]; !ok {
+				connect(w)
+				low[v] = min(low[v], low[w])
+			} else if onStack[w] {
+				low[v] = min(low[v], index[w])
+			}
+		}
+
+		if low[v] != index[v] {
+			return
+		}
+		var component []int
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			component = append(component, w)
+			if w == v {
+				break
+			}
+		}
+		if len(component) > 1 || slices.Contains(next[v], v) {
+			sort.Ints(component)
+			cycles = append(cycles, component)
+		}
+	}
+
+	for _, r := range g.rules {
+		if _, ok := index[r.ID]; !ok {
+			connect(r.ID)
+		}
+	}
+	sort.Slice(cycles, func(i, j int) bool { return cycles[i][0] < cycles[j][0] })
+	return cycles
+}
+
+// MarshalJSON encodes the rules and edges of the graph
+func (g *RuleGraph) MarshalJSON() ([]byte, error) {
+	edges := g.Edges()
+	if edges == nil {
+		edges = []GraphEdge{}
+	}
+	rules := g.rules
+	if rules == nil {
+		rules = []*GraphRule{}
+	}
+	return json.Marshal(struct {
+		Rules []*GraphRule `json:"rules"`
+		Edges []GraphEdge  `json:"edges"`
+	}{rules, edges})
+}
+
+// WriteDOT writes the graph in the Graphviz DOT language, with recording rules as boxes,
+// alerting rules as ellipses, and edges from recording rules to the rules using them
+func (g *RuleGraph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph rules {\n  rankdir=LR;\n")
+	for _, r := range g.rules {
+		shape := "ellipse"
+		if r.Record != "" {
+			shape = "box"
+		}
+		fmt.Fprintf(&b, "  r%d [label=%q, shape=%s, tooltip=%q];\n", r.ID, r.Name()+"\n"+r.Group, shape, fmt.Sprintf("%s:%d", r.File, r.Line))
+	}
+	for _, e := range g.Edges() {
+		fmt.Fprintf(&b, "  r%d -> r%d;\n", e.From, e.To)
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
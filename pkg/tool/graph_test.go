@@ -0,0 +1,103 @@
+package tool_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+const recordingRules = `groups:
+  - name: recording
+    interval: 5m
+    rules:
+      - record: job:requests:rate5m
+        expr: sum by (job) (rate(requests_total[5m]))
+      - record: job:errors:ratio5m
+        expr: job:errors:rate5m / job:requests:rate5m
+      - record: job:errors:rate5m
+        expr: sum by (job) (rate(errors_total[5m])) and job:errors:ratio5m
+      - record: job:unused
+        expr: sum by (job) (up)
+`
+
+const alertRules = `groups:
+  - name: alerts
+    rules:
+      - alert: HighErrorRatio
+        expr: job:errors:ratio5m > 0.1
+      - alert: Down
+        expr: up == 0
+  - name: duplicates
+    rules:
+      # cos-tool:disable=unused-recording-rule
+      - record: job:unused
+        expr: sum by (job) (up)
+`
+
+func TestRuleGraph(t *testing.T) {
+	g := tool.NewRuleGraph(time.Minute)
+	assert.NoError(t, g.AddRules(&tool.PromQL{}, "recording.yaml", []byte(recordingRules)))
+	assert.NoError(t, g.AddRules(&tool.PromQL{}, "alerts.yaml", []byte(alertRules)))
+
+	assert.Equal(t, []tool.GraphEdge{
+		{From: 2, To: 1, Metric: "job:errors:rate5m"},
+		{From: 0, To: 1, Metric: "job:requests:rate5m"},
+		{From: 1, To: 2, Metric: "job:errors:ratio5m"},
+		{From: 1, To: 4, Metric: "job:errors:ratio5m"},
+	}, g.Edges())
+
+	assert.Equal(t, []tool.Finding{
+		{File: "alerts.yaml", Line: 4, Column: 9, RuleID: "slower-dependency", Severity: tool.SeverityWarning,
+			Message: `group "alerts", rule "HighErrorRatio": uses job:errors:ratio5m, recorded by group "recording" every 5m, less often than every 1m`},
+		{File: "alerts.yaml", Line: 11, Column: 9, RuleID: "duplicate-record", Severity: tool.SeverityError,
+			Message: `group "duplicates", rule "job:unused": also recorded in recording.yaml`},
+		{File: "recording.yaml", Line: 7, Column: 9, RuleID: "rule-cycle", Severity: tool.SeverityError,
+			Message: `group "recording", rule "job:errors:ratio5m": part of a dependency cycle between job:errors:ratio5m, job:errors:rate5m`},
+		{File: "recording.yaml", Line: 9, Column: 9, RuleID: "rule-cycle", Severity: tool.SeverityError,
+			Message: `group "recording", rule "job:errors:rate5m": part of a dependency cycle between job:errors:ratio5m, job:errors:rate5m`},
+		{File: "recording.yaml", Line: 11, Column: 9, RuleID: "unused-recording-rule", Severity: tool.SeverityWarning,
+			Message: `group "recording", rule "job:unused": recorded metric is not used by any rule`},
+		{File: "recording.yaml", Line: 11, Column: 9, RuleID: "duplicate-record", Severity: tool.SeverityError,
+			Message: `group "recording", rule "job:unused": also recorded in alerts.yaml`},
+	}, g.Findings())
+}
+
+func TestRuleGraphOutput(t *testing.T) {
+	g := tool.NewRuleGraph(time.Minute)
+	assert.NoError(t, g.AddRules(&tool.PromQL{}, "rules.yaml", []byte(`groups:
+  - name: api
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+      - alert: JobDown
+        expr: job:up:sum == 0
+`)))
+
+	var buf bytes.Buffer
+	assert.NoError(t, g.WriteDOT(&buf))
+	assert.Equal(t, `digraph rules {
+  rankdir=LR;
+  r0 [label="job:up:sum\napi", shape=box, tooltip="rules.yaml:4"];
+  r1 [label="JobDown\napi", shape=ellipse, tooltip="rules.yaml:6"];
+  r0 -> r1;
+}
+`, buf.String())
+
+	var decoded struct {
+		Rules []tool.GraphRule `json:"rules"`
+		Edges []tool.GraphEdge `json:"edges"`
+	}
+	data, err := json.Marshal(g)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	if assert.Len(t, decoded.Rules, 2) {
+		assert.Equal(t, "JobDown", decoded.Rules[1].Alert)
+		assert.Equal(t, []string{"job:up:sum"}, decoded.Rules[1].Metrics)
+	}
+	assert.Equal(t, []tool.GraphEdge{{From: 0, To: 1, Metric: "job:up:sum"}}, decoded.Edges)
+	assert.Empty(t, g.Findings())
+}
@@ -0,0 +1,150 @@
+package tool
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// InjectionRules scope label matcher injection by metric name or stream selector.
+// Rules are evaluated in order against every selector, and the first matching rule wins:
+// a skip rule leaves the selector untouched, a match rule injects its own labels instead
+// of the default matchers. Selectors matched by no rule get the default matchers.
+type InjectionRules struct {
+	Rules []InjectionRule `yaml:"rules"`
+}
+
+// InjectionRule is a single entry of an injection rules file
+type InjectionRule struct {
+	// Match selects the selectors that get Inject instead of the default matchers
+	Match *Selector `yaml:"match,omitempty"`
+	// Skip selects the selectors that get no matchers at all
+	Skip *Selector `yaml:"skip,omitempty"`
+	// Inject holds the labels injected into selectors selected by Match
+	Inject map[string]string `yaml:"inject,omitempty"`
+	// Within restricts the rule to selectors nested in one of these functions or aggregations,
+	// e.g. absent or absent_over_time
+	Within []string `yaml:"within,omitempty"`
+}
+
+// Selector is a set of label matchers, written either as a selector string such as
+// 'up{job="blackbox"}', or as an unquoted YAML flow mapping such as {job="blackbox"}.
+type Selector []*labels.Matcher
+
+// UnmarshalYAML parses a selector from a string or a flow mapping. In a flow mapping, keys
+// with no value are matchers ({__name__=~"node_.*"}) and key-value pairs are equality
+// matchers ({job: blackbox}).
+func (s *Selector) UnmarshalYAML(node *yaml.Node) error {
+	var text string
+	switch node.Kind {
+	case yaml.ScalarNode:
+		text = node.Value
+	case yaml.MappingNode:
+		var parts []string
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if value.Tag == "!!null" {
+				parts = append(parts, key.Value)
+			} else {
+				parts = append(parts, fmt.Sprintf("%s=%q", key.Value, value.Value))
+			}
+		}
+		text = "{" + strings.Join(parts, ",") + "}"
+	default:
+		return fmt.Errorf("line %d: selector must be a string or a mapping", node.Line)
+	}
+
+	*s = Selector{}
+	if text == "{}" || text == "" {
+		return nil
+	}
+	matchers, err := parser.ParseMetricSelector(text)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid selector %q: %w", node.Line, text, err)
+	}
+	*s = matchers
+	return nil
+}
+
+// LoadInjectionRules parses and validates an injection rules file
+func LoadInjectionRules(data []byte) (*InjectionRules, error) {
+	rules := &InjectionRules{}
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(rules); err != nil {
+		return nil, fmt.Errorf("invalid injection rules: %w", err)
+	}
+
+	for i, r := range rules.Rules {
+		switch {
+		case r.Match == nil && r.Skip == nil:
+			return nil, fmt.Errorf("invalid injection rules: rule %d: one of 'match' or 'skip' must be set", i+1)
+		case r.Match != nil && r.Skip != nil:
+			return nil, fmt.Errorf("invalid injection rules: rule %d: only one of 'match' and 'skip' must be set", i+1)
+		case r.Match != nil && len(r.Inject) == 0:
+			return nil, fmt.Errorf("invalid injection rules: rule %d: 'inject' must be set with 'match'", i+1)
+		case r.Skip != nil && len(r.Inject) > 0:
+			return nil, fmt.Errorf("invalid injection rules: rule %d: 'inject' cannot be used with 'skip'", i+1)
+		}
+	}
+	return rules, nil
+}
+
+// TransformWithRules injects matchers into an expression like the Transform method of checker,
+// scoped by the injection rules. Nil rules inject the matchers into every selector.
+func TransformWithRules(checker Checker, arg string, matchers *map[string]string, rules *InjectionRules) (string, error) {
+	switch c := checker.(type) {
+	case *PromQL:
+		return c.transform(arg, matchers, rules)
+	case *LogQL:
+		return c.transform(arg, matchers, rules)
+	}
+	if rules != nil {
+		return arg, fmt.Errorf("injection rules are not supported by %T", checker)
+	}
+	return checker.Transform(arg, matchers)
+}
+
+// matchersFor returns the matchers to inject into a selector, given the selector's own
+// matchers and the functions it is nested in. Returns nil if the selector must be skipped.
+func (r *InjectionRules) matchersFor(selector []*labels.Matcher, within []string, defaults map[string]string) map[string]string {
+	if r == nil {
+		return defaults
+	}
+
+	for _, rule := range r.Rules {
+		if len(rule.Within) > 0 && !slices.ContainsFunc(rule.Within, func(f string) bool { return slices.Contains(within, f) }) {
+			continue
+		}
+		if rule.Skip != nil && rule.Skip.matches(selector) {
+			return nil
+		}
+		if rule.Match != nil && rule.Match.matches(selector) {
+			return rule.Inject
+		}
+	}
+	return defaults
+}
+
+// matches reports whether a selector is selected by s. Each matcher of s is evaluated against
+// the value of the selector's equality matcher for the same label, or the empty string if
+// there is none, following the Prometheus convention for missing labels.
+func (s Selector) matches(selector []*labels.Matcher) bool {
+	for _, m := range s {
+		value := ""
+		for _, existing := range selector {
+			if existing.Name == m.Name && existing.Type == labels.MatchEqual {
+				value = existing.Value
+				break
+			}
+		}
+		if !m.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package tool_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestInjectionRules(t *testing.T) *tool.InjectionRules {
+	rules, err := tool.LoadInjectionRules(readFile(filepath.Join("testdata/injection_rules", "basic.yaml")))
+	assert.NoError(t, err)
+	return rules
+}
+
+func TestLoadInjectionRules(t *testing.T) {
+	rules := loadTestInjectionRules(t)
+	assert.Len(t, rules.Rules, 5)
+	assert.Equal(t, `__name__="ALERTS"`, (*rules.Rules[0].Skip)[0].String())
+	assert.Empty(t, *rules.Rules[2].Skip)
+	assert.Equal(t, []string{"absent", "absent_over_time"}, rules.Rules[2].Within)
+	assert.Equal(t, map[string]string{"juju_application": "node-exporter"}, rules.Rules[3].Inject)
+
+	failures := map[string]string{
+		"missing action":    "rules:\n  - inject: {a: b}\n",
+		"match and skip":    "rules:\n  - match: {a=\"b\"}\n    skip: {a=\"b\"}\n    inject: {a: b}\n",
+		"match, no inject":  "rules:\n  - match: {a=\"b\"}\n",
+		"skip with inject":  "rules:\n  - skip: {a=\"b\"}\n    inject: {a: b}\n",
+		"invalid selector":  "rules:\n  - skip: 'up{'\n",
+		"unknown field":     "rules:\n  - skip: {}\n    unless: {}\n",
+		"selector sequence": "rules:\n  - skip: [a]\n",
+	}
+	for name, data := range failures {
+		t.Run(name, func(t *testing.T) {
+			_, err := tool.LoadInjectionRules([]byte(data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestPromQLTransformWithInjectionRules(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`ALERTS{alertstate="firing"}`, `ALERTS{alertstate="firing"}`},
+		{`probe_success{job="blackbox"} == 0`, `probe_success{job="blackbox"} == 0`},
+		{`absent(up{job="prometheus"})`, `absent(up{job="prometheus"})`},
+		{`absent_over_time(up[5m])`, `absent_over_time(up[5m])`},
+		{`rate(node_cpu_seconds_total[5m])`, `rate(node_cpu_seconds_total{juju_application="node-exporter"}[5m])`},
+		{`sum(up) / count(up{job="blackbox"})`, `sum(up{juju_model="cos"}) / count(up{job="blackbox"})`},
+		{`up`, `up{juju_model="cos"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			matchers := map[string]string{"juju_model": "cos"}
+			result, err := tool.TransformWithRules(&tool.PromQL{}, tt.input, &matchers, loadTestInjectionRules(t))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestLogQLTransformWithInjectionRules(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{job="blackbox"} |= "error"`, `{job="blackbox"} |= "error"`},
+		{`absent_over_time({app="nginx"}[5m])`, `absent_over_time({app="nginx"}[5m])`},
+		{`{app="syslog"}`, `{app="syslog", juju_application="syslog"}`},
+		{`sum(count_over_time({app="nginx"}[5m]))`, `sum(count_over_time({app="nginx", juju_model="cos"}[5m]))`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			matchers := map[string]string{"juju_model": "cos"}
+			result, err := tool.TransformWithRules(&tool.LogQL{}, tt.input, &matchers, loadTestInjectionRules(t))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package tool
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	logqlparser "github.com/canonical/cos-tool/pkg/logql/syntax"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/parser/posrange"
+)
+
+// Inliner substitutes the expressions of recording rules for the selectors of the metrics they
+// record, so that an expression can be evaluated without the recording rules, e.g. in Grafana
+// Explore
+type Inliner struct {
+	// records maps each recorded metric to the rules recording it
+	records map[string][]*inlineRule
+	// alerts maps each alert name to its expression
+	alerts map[string]string
+}
+
+// inlineRule is a recording rule
+type inlineRule struct {
+	expr   string
+	labels map[string]string
+	logql  bool
+}
+
+// NewInliner returns an inliner without recording rules
+func NewInliner() *Inliner {
+	return &Inliner{records: map[string][]*inlineRule{}, alerts: map[string]string{}}
+}
+
+// AddRules adds the recording rules and alerts of a rule file
+func (in *Inliner) AddRules(checker Checker, filename string, data []byte) error {
+	rf, err := parseRuleFile(checker, filename, data)
+	if err != nil {
+		return err
+	}
+
+	_, logql := checker.(*LogQL)
+	for _, group := range rf.Groups {
+		for _, rule := range group.Rules {
+			if rule.Alert != "" {
+				in.alerts[rule.Alert] = rule.Expr
+				continue
+			}
+			in.records[rule.Record] = append(in.records[rule.Record], &inlineRule{expr: rule.Expr, labels: rule.Labels, logql: logql})
+		}
+	}
+	return nil
+}
+
+// Alert returns the expression of an alert of the rule files
+func (in *Inliner) Alert(name string) (string, bool) {
+	expr, ok := in.alerts[name]
+	return expr, ok
+}
+
+// Inline substitutes the expressions of the recording rules for the selectors of the metrics
+// they record in a PromQL expression, recursively. The label matchers of a selector are added to
+// the selectors of the substituted expression, or checked against the labels set by the rule,
+// which are added back with label_replace. A metric recorded by several rules is substituted by
+// their expressions joined with or. Substituting LogQL recording rules gives a LogQL expression,
+// provided the rest of the expression is valid LogQL too.
+func (in *Inliner) Inline(expr string) (string, error) {
+	result, logql, err := in.inline(expr, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if logql {
+		if _, err := logqlparser.ParseExpr(result); err != nil {
+			return "", fmt.Errorf("inlining LogQL recording rules does not give a valid LogQL expression: %w", err)
+		}
+	} else if _, err := parser.ParseExpr(result); err != nil {
+		return "", fmt.Errorf("inlining recording rules does not give a valid expression: %w", err)
+	}
+	return result, nil
+}
+
+// inline inlines a PromQL expression, given the metrics being inlined, returning whether the
+// result is LogQL
+func (in *Inliner) inline(expr string, stack []string) (string, bool, error) {
+	exp, err := parser.ParseExpr(expr)
+	if err != nil {
+		return "", false, err
+	}
+
+	type substitution struct {
+		posRange    posrange.PositionRange
+		replacement string
+		logql       bool
+	}
+	var substitutions []substitution
+	var inlineErr error
+	parser.Inspect(exp, func(node parser.Node, path []parser.Node) error {
+		var vs *parser.VectorSelector
+		var rng time.Duration
+		switch e := node.(type) {
+		case *parser.VectorSelector:
+			// Range selectors are substituted as a whole
+			if len(path) > 0 {
+				if _, ok := path[len(path)-1].(*parser.MatrixSelector); ok {
+					return nil
+				}
+			}
+			vs = e
+		case *parser.MatrixSelector:
+			vs, rng = e.VectorSelector.(*parser.VectorSelector), e.Range
+		default:
+			return nil
+		}
+		if _, ok := in.records[vs.Name]; !ok || inlineErr != nil {
+			return nil
+		}
+
+		replacement, logql, err := in.substitute(vs, stack)
+		if err != nil {
+			inlineErr = err
+			return nil
+		}
+		if rng > 0 {
+			if logql {
+				inlineErr = fmt.Errorf("cannot inline the LogQL recording rules of %s over a range", vs.Name)
+				return nil
+			}
+			replacement = fmt.Sprintf("%s[%s:]", replacement, model.Duration(rng))
+		}
+		substitutions = append(substitutions, substitution{node.PositionRange(), replacement, logql})
+		return nil
+	})
+	if inlineErr != nil {
+		return "", false, inlineErr
+	}
+
+	logql := false
+	for i, s := range substitutions {
+		if i > 0 && s.logql != logql {
+			return "", false, fmt.Errorf("cannot inline both PromQL and LogQL recording rules in %s", expr)
+		}
+		logql = s.logql
+	}
+
+	// Substitute from the end, so that the positions of the other selectors stay valid
+	result := expr
+	for i := len(substitutions) - 1; i >= 0; i-- {
+		s := substitutions[i]
+		result = result[:s.posRange.Start] + s.replacement + result[s.posRange.End:]
+	}
+	return result, logql, nil
+}
+
+// substitute returns the expressions of the rules recording the metric of a selector, filtered
+// by its matchers and shifted by its offset
+func (in *Inliner) substitute(vs *parser.VectorSelector, stack []string) (string, bool, error) {
+	name := vs.Name
+	if slices.Contains(stack, name) {
+		return "", false, fmt.Errorf("cannot inline %s, whose recording rules depend on it: %s", name, strings.Join(append(stack, name), " -> "))
+	}
+	if vs.Timestamp != nil || vs.StartOrEnd != 0 {
+		return "", false, fmt.Errorf("cannot inline %s with an @ modifier", name)
+	}
+
+	var matchers []*labels.Matcher
+	for _, m := range vs.LabelMatchers {
+		if m.Name != labels.MetricName {
+			matchers = append(matchers, m)
+		}
+	}
+
+	var alternatives []string
+	logql := false
+	for _, rule := range in.records[name] {
+		expr, ruleMatchers, ok := rule.filter(matchers)
+		if !ok {
+			continue
+		}
+
+		var err error
+		if rule.logql {
+			logql = true
+			expr, err = inlineLogQL(expr, ruleMatchers, vs.OriginalOffset)
+		} else {
+			var nested bool
+			if expr, nested, err = in.inline(expr, append(slices.Clone(stack), name)); err == nil {
+				if nested {
+					return "", false, fmt.Errorf("cannot inline %s, whose PromQL recording rules use LogQL recording rules", name)
+				}
+				expr, err = inlinePromQL(expr, ruleMatchers, vs.OriginalOffset)
+			}
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("error inlining %s: %w", name, err)
+		}
+
+		keys := make([]string, 0, len(rule.labels))
+		for key := range rule.labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) == 0 {
+			expr = "(" + expr + ")"
+		}
+		for _, key := range keys {
+			expr = fmt.Sprintf("label_replace(%s, %q, %q, \"\", \"\")", expr, key, rule.labels[key])
+		}
+		alternatives = append(alternatives, expr)
+	}
+
+	if len(alternatives) == 0 {
+		return "", false, fmt.Errorf("no recording rule of %s matches %s", name, vs.String())
+	}
+	if len(alternatives) > 1 && logql {
+		return "", false, fmt.Errorf("cannot inline %s, recorded by several LogQL recording rules", name)
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], logql, nil
+	}
+	return "(" + strings.Join(alternatives, " or ") + ")", logql, nil
+}
+
+// filter returns the expression of a rule and the matchers to add to its selectors for the
+// rule to return the series matched by matchers, or false if it returns none of them: the
+// matchers on labels set by the rule are checked against their values, and those on labels
+// the expression does not return against an empty value.
+func (r *inlineRule) filter(matchers []*labels.Matcher) (string, []*labels.Matcher, bool) {
+	var checker Checker = &PromQL{}
+	if r.logql {
+		checker = &LogQL{}
+	}
+	a, err := Analyze(checker, r.expr)
+	if err != nil {
+		return "", nil, false
+	}
+
+	var added []*labels.Matcher
+	for _, m := range matchers {
+		if value, ok := r.labels[m.Name]; ok {
+			if !m.Matches(value) {
+				return "", nil, false
+			}
+			continue
+		}
+
+		output := a.OutputLabels
+		returned := slices.Contains(output.Labels, m.Name) || (output.All && !slices.Contains(output.Without, m.Name))
+		switch {
+		case returned:
+			added = append(added, m)
+		case !m.Matches(""):
+			return "", nil, false
+		}
+	}
+	return r.expr, added, true
+}
+
+// inlinePromQL adds matchers to the selectors of a PromQL expression, and an offset to its
+// outermost selectors and subqueries: those nested in a subquery are shifted with it
+func inlinePromQL(expr string, matchers []*labels.Matcher, offset time.Duration) (string, error) {
+	exp, err := parser.ParseExpr(expr)
+	if err != nil {
+		return "", err
+	}
+	parser.Inspect(exp, func(node parser.Node, path []parser.Node) error {
+		nested := slices.ContainsFunc(path, func(n parser.Node) bool {
+			_, ok := n.(*parser.SubqueryExpr)
+			return ok
+		})
+		switch e := node.(type) {
+		case *parser.VectorSelector:
+			for _, m := range matchers {
+				if !slices.ContainsFunc(e.LabelMatchers, func(existing *labels.Matcher) bool { return existing.String() == m.String() }) {
+					e.LabelMatchers = append(e.LabelMatchers, m)
+				}
+			}
+			if !nested {
+				e.OriginalOffset += offset
+			}
+		case *parser.SubqueryExpr:
+			if !nested {
+				e.OriginalOffset += offset
+			}
+		}
+		return nil
+	})
+	return exp.String(), nil
+}
+
+// inlineLogQL adds matchers to the stream selectors of a LogQL expression, and an offset to its
+// ranges
+func inlineLogQL(expr string, matchers []*labels.Matcher, offset time.Duration) (string, error) {
+	exp, err := logqlparser.ParseExpr(expr)
+	if err != nil {
+		return "", err
+	}
+	exp.Walk(func(node interface{}) {
+		switch e := node.(type) {
+		case *logqlparser.MatchersExpr:
+			var added []*labels.Matcher
+			for _, m := range matchers {
+				if !slices.ContainsFunc(e.Matchers(), func(existing *labels.Matcher) bool { return existing.String() == m.String() }) {
+					added = append(added, m)
+				}
+			}
+			e.AppendMatchers(added)
+		case *logqlparser.LogRange:
+			e.Offset += offset
+		}
+	})
+	return exp.String(), nil
+}
@@ -0,0 +1,86 @@
+package tool_test
+
+import (
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInline(t *testing.T) {
+	in := tool.NewInliner()
+	assert.NoError(t, in.AddRules(&tool.PromQL{}, "rules.yaml", []byte(`groups:
+  - name: api
+    rules:
+      - record: job:requests:rate5m
+        expr: sum by (job) (rate(requests_total[5m]))
+      - record: job:errors:rate5m
+        expr: sum by (job) (rate(errors_total[5m]))
+      - record: job:errors:ratio5m
+        expr: job:errors:rate5m / job:requests:rate5m
+      - record: cluster:up
+        expr: sum(up{cluster="a"})
+        labels:
+          cluster: a
+      - record: cluster:up
+        expr: sum(up{cluster="b"})
+        labels:
+          cluster: b
+      - record: job:errors:max5m
+        expr: max_over_time(errors_total[5m:1m])
+      - record: loop:a
+        expr: loop:b
+      - record: loop:b
+        expr: loop:a
+      - alert: HighErrorRatio
+        expr: job:errors:ratio5m{job="api"} > 0.1
+`)))
+
+	expr, ok := in.Alert("HighErrorRatio")
+	assert.True(t, ok)
+	for _, test := range []struct {
+		expr, result, err string
+	}{
+		{expr: expr, result: `((sum by (job) (rate(errors_total{job="api"}[5m]))) / (sum by (job) (rate(requests_total{job="api"}[5m])))) > 0.1`},
+		{expr: `job:errors:rate5m offset 5m`, result: `(sum by (job) (rate(errors_total[5m] offset 5m)))`},
+		{expr: `job:errors:max5m{job="api"} offset 1h`, result: `(max_over_time(errors_total{job="api"}[5m:1m] offset 1h))`},
+		{expr: `max_over_time(job:errors:rate5m{job="api"}[1h]) > 0`, result: `max_over_time((sum by (job) (rate(errors_total{job="api"}[5m])))[1h:]) > 0`},
+		{expr: `cluster:up`, result: `(label_replace(sum(up{cluster="a"}), "cluster", "a", "", "") or label_replace(sum(up{cluster="b"}), "cluster", "b", "", ""))`},
+		{expr: `cluster:up{cluster=~"b|c"}`, result: `label_replace(sum(up{cluster="b"}), "cluster", "b", "", "")`},
+		{expr: `cluster:up{cluster="c"}`, err: `no recording rule of cluster:up matches cluster:up{cluster="c"}`},
+		{expr: `job:requests:rate5m{instance="a"}`, err: `no recording rule of job:requests:rate5m matches`},
+		{expr: `loop:a`, err: `cannot inline loop:a, whose recording rules depend on it: loop:a -> loop:b -> loop:a`},
+		{expr: `job:errors:rate5m @ 100`, err: `cannot inline job:errors:rate5m with an @ modifier`},
+	} {
+		result, err := in.Inline(test.expr)
+		if test.err != "" {
+			if assert.Error(t, err, test.expr) {
+				assert.Contains(t, err.Error(), test.err)
+			}
+			continue
+		}
+		assert.NoError(t, err, test.expr)
+		assert.Equal(t, test.result, result, test.expr)
+	}
+}
+
+func TestInlineLogQL(t *testing.T) {
+	in := tool.NewInliner()
+	assert.NoError(t, in.AddRules(&tool.LogQL{}, "rules.yaml", []byte(`groups:
+  - name: logs
+    rules:
+      - record: job:log_errors:rate5m
+        expr: sum by (job) (rate({app="api"} |= "error" [5m]))
+        labels:
+          env: prod
+`)))
+
+	result, err := in.Inline(`job:log_errors:rate5m{job="api", env="prod"} > 0`)
+	assert.NoError(t, err)
+	assert.Equal(t, `label_replace(sum by(job)(rate({app="api", job="api"} |= "error"[5m])), "env", "prod", "", "") > 0`, result)
+
+	_, err = in.Inline(`max_over_time(job:log_errors:rate5m[1h])`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cannot inline the LogQL recording rules of job:log_errors:rate5m over a range")
+	}
+}
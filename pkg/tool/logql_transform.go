@@ -1,11 +1,13 @@
 package tool
 
 import (
+	"bytes"
 	"fmt"
 	parser "github.com/canonical/cos-tool/pkg/logql/syntax"
 	"github.com/canonical/cos-tool/pkg/lokiruler"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/rulefmt"
+	yaml "gopkg.in/yaml.v3"
 	"regexp"
 	"slices"
 	"sort"
@@ -13,16 +15,54 @@ import (
 	"time"
 )
 
+// ValidateRules validates a rule file, failing on the findings of RuleFindings which are errors
 func (p *LogQL) ValidateRules(filename string, data []byte) (*rulefmt.RuleGroups, error) {
-	// Expose the backend parser
-	rg, errs := lokiruler.Load(data)
+	rg, findings := p.ruleFindings(filename, data)
+	return rg, findingsError(filename, findings)
+}
 
-	if len(errs) > 0 {
+// ruleFindings parses a rule file like the backend parser, returning its groups and a finding
+// for each error which is not suppressed, located at the group, rule or expression it is about,
+// and a warning for each unused suppression
+func (p *LogQL) ruleFindings(filename string, data []byte) (*rulefmt.RuleGroups, []Finding) {
+	var groups rulefmt.RuleGroups
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&groups); err != nil {
+		return nil, yamlFindings(filename, err)
+	}
 
-		return rg, fmt.Errorf("error validating %s: %+v", filename, errs)
+	nodes := ruleFileNodes(data)
+	var findings []Finding
+	for _, err := range lokiruler.ValidateGroupsByRule(groups.Groups...) {
+		findings = append(findings, logqlRuleErrorFinding(filename, nodes, err))
 	}
 
-	return rg, nil
+	suppressions := ParseSuppressions(filename, data)
+	findings = suppressions.apply(findings, ruleValidationIDs...)
+	findings = append(findings, suppressions.Unknown()...)
+	return &groups, sortFindings(findings)
+}
+
+// logqlRuleErrorFinding returns the finding of a lokiruler error, given the nodes of the
+// groups and rules of the file
+func logqlRuleErrorFinding(filename string, nodes [][]*yaml.Node, err lokiruler.GroupError) Finding {
+	node := ruleFileNode(nodes, err.Group, err.Rule)
+	if err.Rule == -1 {
+		return nodeFinding(filename, "invalid-group", err.Err.Error(), node)
+	}
+
+	name := scalarValue(node, "alert")
+	if name == "" {
+		name = scalarValue(node, "record")
+	}
+	group := scalarValue(ruleFileNode(nodes, err.Group, -1), "name")
+	message := fmt.Sprintf("group %q, rule %d, %q: %v", group, err.Rule+1, name, err.Err)
+
+	if strings.HasPrefix(err.Err.Error(), "could not parse expression") {
+		return nodeFinding(filename, "invalid-expression", message, exprNode(node))
+	}
+	return nodeFinding(filename, "invalid-rule", message, node)
 }
 
 func (p *LogQL) ValidateConfig(filename string) error {
@@ -30,48 +70,112 @@ func (p *LogQL) ValidateConfig(filename string) error {
 }
 
 func (p *LogQL) Transform(arg string, matchers *map[string]string) (string, error) {
-	// Replace Grafana template variables with valid placeholders
-	processed, occurrences := replaceGrafanaVariables(arg)
-	exp, err := parser.ParseExpr(processed)
+	return p.transform(arg, matchers, nil)
+}
 
-	if err != nil {
-		return arg, err
+// transform injects matchers like Transform, scoped by the injection rules if not nil
+func (p *LogQL) transform(arg string, matchers *map[string]string, rules *InjectionRules) (string, error) {
+	// Grafana variable queries (label_values, label_names) embed the stream selector to transform
+	if q, ok := parseGrafanaVariableQuery(arg); ok {
+		transform := func(expr string, m *map[string]string) (string, error) {
+			return p.transform(expr, m, rules)
+		}
+		result, err := q.transform(*matchers, transform, func(m map[string]string) string {
+			return "{" + strings.Join(sortedMatcherStrings(m), ", ") + "}"
+		})
+		if err != nil {
+			return arg, err
+		}
+		return result, nil
 	}
 
-	p.expr = exp
-	p.matchers = matchers
-
 	sm := []string{}
 	for m := range *matchers {
 		sm = append(sm, m)
 	}
 
 	sort.Strings(sm)
-	p.sortedMatchers = &sm
 
-	p.expr.Walk(p.traverse)
-	result := p.expr.String()
+	return p.rewrite(arg, func(exp parser.Expr) {
+		within := map[*parser.MatchersExpr][]string{}
+		exp.Walk(func(e interface{}) {
+			collectWithin(e, within)
+		})
+
+		exp.Walk(func(e interface{}) {
+			if m, ok := e.(*parser.MatchersExpr); ok {
+				p.injectLabelMatcher(m, within[m], *matchers, sm, rules)
+			}
+		})
+	})
+}
+
+// rewrite parses arg with its Grafana variables replaced by placeholders, lets visit modify
+// the parsed expression, and formats it back with the original variables restored
+func (p *LogQL) rewrite(arg string, visit func(parser.Expr)) (string, error) {
+	exp, restore, err := p.parse(arg)
+	if err != nil {
+		return arg, err
+	}
+
+	visit(exp)
+	return restore(exp.String()), nil
+}
+
+// parse parses arg with its Grafana variables replaced by placeholders. Returns the parsed
+// expression and a function restoring the original variables in the formatted expression,
+// or in any part of it.
+func (p *LogQL) parse(arg string) (parser.Expr, func(string) string, error) {
+	// Replace Grafana template variables with valid placeholders
+	processed, occurrences := replaceGrafanaVariables(arg)
+	exp, err := parser.ParseExpr(processed)
 
-	// Restore original Grafana variables
-	result = restoreGrafanaVariables(result, occurrences)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return result, nil
+	return exp, func(result string) string {
+		// Restore original Grafana variables
+		return restoreGrafanaVariables(result, occurrences)
+	}, nil
 }
 
-func (p *LogQL) traverse(e interface{}) {
-	// Even though we cast back, the signature has to be interface{}
-	// or it cannot be satisfied
+// collectWithin records in within, for every stream selector below e, the range and vector
+// aggregations it is nested in, since Walk visits nodes without their ancestors
+func collectWithin(e interface{}, within map[*parser.MatchersExpr][]string) {
+	var operation string
+	var inner parser.Walkable
 	switch e := e.(type) {
-	case *parser.MatchersExpr:
-		p.injectLabelMatcher(e)
+	case *parser.RangeAggregationExpr:
+		operation, inner = e.Operation, e.Left
+	case *parser.VectorAggregationExpr:
+		operation, inner = e.Operation, e.Left
 	default:
-		// Do nothing
+		return
+	}
+	if inner == nil {
+		return
 	}
+	inner.Walk(func(n interface{}) {
+		if m, ok := n.(*parser.MatchersExpr); ok {
+			within[m] = append(within[m], operation)
+		}
+	})
 }
 
-func (p *LogQL) injectLabelMatcher(e *parser.MatchersExpr) {
-	appendMatchers := make([]*labels.Matcher, 0, len(*p.matchers))
-	for _, key := range *(p.sortedMatchers) {
+func (p *LogQL) injectLabelMatcher(e *parser.MatchersExpr, within []string, all map[string]string, sortedKeys []string, rules *InjectionRules) {
+	matchers := rules.matchersFor(e.Matchers(), within, all)
+	keys := sortedKeys
+	if rules != nil {
+		keys = make([]string, 0, len(matchers))
+		for key := range matchers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	appendMatchers := make([]*labels.Matcher, 0, len(matchers))
+	for _, key := range keys {
 		existingMatchers := e.Matchers()
 		var found = false
 		for _, existing := range existingMatchers {
@@ -86,7 +190,7 @@ func (p *LogQL) injectLabelMatcher(e *parser.MatchersExpr) {
 		appendMatchers = append(appendMatchers, &labels.Matcher{
 			Type:  labels.MatchEqual,
 			Name:  key,
-			Value: (*p.matchers)[key],
+			Value: matchers[key],
 		})
 	}
 	e.AppendMatchers(appendMatchers)
@@ -218,8 +322,13 @@ func replaceLogQLVariablesInLabelValues(query string, getPlaceholder func(string
 
 // replaceLogQLVariablesInOtherContexts replaces remaining variables in filters and function arguments
 // Example: |= "$pattern" → |= "99990005"
+// Regex capture group references such as label_replace's "$1" are not variables and are kept
+// as-is: replacing them with a numeric placeholder would restore them without their quotes.
 func replaceLogQLVariablesInOtherContexts(query string, getPlaceholder func(string, string) string) string {
 	return logQLGeneralVariablePattern.ReplaceAllStringFunc(query, func(variable string) string {
+		if variable[1] >= '0' && variable[1] <= '9' {
+			return variable
+		}
 		return getPlaceholder(variable, "%d")
 	})
 }
@@ -143,6 +143,15 @@ func TestLogQLTransformDoesNotDuplicateExistingLabel(t *testing.T) {
 	assert.NotContains(t, result, `env="prod"`, "label already in selector must not be overwritten")
 }
 
+func TestLogQLTransformKeepsCaptureReferences(t *testing.T) {
+	p := &tool.LogQL{}
+	// "$1" in label_replace is a regex capture reference, not a Grafana variable
+	matchers := map[string]string{"env": "prod"}
+	result, err := p.Transform(`label_replace(rate({job="test"}[5m]), "host", "$1", "instance", "(.*):.*")`, &matchers)
+	assert.NoError(t, err)
+	assert.Equal(t, `label_replace(rate({job="test", env="prod"}[5m]),"host","$1","instance","(.*):.*")`, result)
+}
+
 func TestLogQLGroupingVariableReusedAcrossClauses(t *testing.T) {
 	p := &tool.LogQL{}
 	// Same grouping variable in two separate by() clauses — hits the placeholder cache path.
@@ -155,6 +164,24 @@ func TestLogQLGroupingVariableReusedAcrossClauses(t *testing.T) {
 	assert.Contains(t, result, `cluster="prod"`)
 }
 
+func TestLogQLTransformGrafanaVariableQueries(t *testing.T) {
+	p := &tool.LogQL{}
+	matchers := map[string]string{"juju_model": "cos", "juju_application": "loki"}
+
+	result, err := p.Transform(`label_values({app="$app"}, pod)`, &matchers)
+	assert.NoError(t, err)
+	assert.Equal(t, `label_values({app="$app", juju_application="loki", juju_model="cos"}, pod)`, result)
+
+	result, err = p.Transform(`label_values(pod)`, &matchers)
+	assert.NoError(t, err)
+	assert.Equal(t, `label_values({juju_application="loki", juju_model="cos"}, pod)`, result)
+
+	// Loki has neither metric names nor metrics queries
+	result, err = p.Transform(`metrics(node_.*)`, &matchers)
+	assert.NoError(t, err)
+	assert.Equal(t, `metrics(node_.*)`, result)
+}
+
 func TestLogQLTransformWithEmptyMatchers(t *testing.T) {
 	p := &tool.LogQL{}
 
@@ -848,19 +875,19 @@ func TestLogQLLineFilterOr(t *testing.T) {
 			name:     "or between two string values on same filter type",
 			input:    `{app="foo"} |= "level=error" or "panic:"`,
 			matchers: map[string]string{"env": "prod"},
-			expected: `{app="foo", env="prod"} |= "level=error" or |= "panic:"`,
+			expected: `{app="foo", env="prod"} |= "level=error" or "panic:"`,
 		},
 		{
 			name:     "or filter followed by pipeline stage",
 			input:    `{app="foo"} |= "level=error" or "panic:" | logfmt`,
 			matchers: map[string]string{"env": "prod"},
-			expected: `{app="foo", env="prod"} |= "level=error" or |= "panic:" | logfmt`,
+			expected: `{app="foo", env="prod"} |= "level=error" or "panic:" | logfmt`,
 		},
 		{
 			name:     "or filter with negation operator",
 			input:    `{app="foo"} != "debug" or "trace"`,
 			matchers: map[string]string{"env": "prod"},
-			expected: `{app="foo", env="prod"} != "debug" or != "trace"`,
+			expected: `{app="foo", env="prod"} != "debug" or "trace"`,
 		},
 	}
 	for _, c := range cases {
@@ -868,6 +895,10 @@ func TestLogQLLineFilterOr(t *testing.T) {
 			result, err := p.Transform(c.input, &c.matchers)
 			assert.NoError(t, err)
 			assert.Equal(t, c.expected, result)
+
+			again, err := p.Transform(result, &c.matchers)
+			assert.NoError(t, err)
+			assert.Equal(t, result, again, "transforming a transformed expression must be a no-op")
 		})
 	}
 }
@@ -0,0 +1,275 @@
+package tool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// MemoryStorage is an in-memory storage of float samples, queryable by the PromQL engine. It is
+// safe for concurrent use.
+type MemoryStorage struct {
+	mtx    sync.RWMutex
+	series map[uint64]*memorySeries
+}
+
+type memorySeries struct {
+	lset    labels.Labels
+	samples []chunks.Sample
+}
+
+// floatSample implements chunks.Sample for float values
+type floatSample struct {
+	t int64
+	f float64
+}
+
+func (s floatSample) T() int64                      { return s.t }
+func (s floatSample) F() float64                    { return s.f }
+func (s floatSample) H() *histogram.Histogram       { return nil }
+func (s floatSample) FH() *histogram.FloatHistogram { return nil }
+func (s floatSample) Type() chunkenc.ValueType      { return chunkenc.ValFloat }
+func (s floatSample) Copy() chunks.Sample           { return s }
+
+// NewMemoryStorage returns an empty in-memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{series: map[uint64]*memorySeries{}}
+}
+
+// Add adds a sample to a series. Samples may be added in any order; a sample at the same
+// timestamp as an existing one replaces it.
+func (s *MemoryStorage) Add(lset labels.Labels, t time.Time, v float64) {
+	s.add(lset, timestamp.FromTime(t), v)
+}
+
+func (s *MemoryStorage) add(lset labels.Labels, t int64, v float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	h := lset.Hash()
+	series, ok := s.series[h]
+	if !ok {
+		series = &memorySeries{lset: lset.Copy()}
+		s.series[h] = series
+	}
+
+	i := sort.Search(len(series.samples), func(i int) bool { return series.samples[i].T() >= t })
+	if i < len(series.samples) && series.samples[i].T() == t {
+		series.samples[i] = floatSample{t: t, f: v}
+		return
+	}
+	series.samples = append(series.samples, nil)
+	copy(series.samples[i+1:], series.samples[i:])
+	series.samples[i] = floatSample{t: t, f: v}
+}
+
+// LoadSnapshots loads Prometheus text exposition snapshots, such as curls of /metrics. Samples
+// with a timestamp keep it. The others are scraped at ts for the last snapshot, and interval
+// apart for the snapshots before it, in order; like Prometheus, a series missing from a scrape
+// is marked stale. If ts is zero, it is the latest sample timestamp of the snapshots, or now if
+// none has any. LoadSnapshots returns the storage and ts.
+func LoadSnapshots(snapshots [][]byte, ts time.Time, interval time.Duration) (*MemoryStorage, time.Time, error) {
+	type sample struct {
+		lset labels.Labels
+		t    *int64
+		v    float64
+	}
+
+	parsed := make([][]sample, len(snapshots))
+	latest := int64(math.MinInt64)
+	for i, data := range snapshots {
+		p := textparse.NewPromParser(data, labels.NewSymbolTable(), false)
+		for {
+			entry, err := p.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, ts, fmt.Errorf("invalid snapshot %d: %w", i+1, err)
+			}
+			if entry != textparse.EntrySeries {
+				continue
+			}
+
+			_, t, v := p.Series()
+			var lset labels.Labels
+			p.Labels(&lset)
+			if t != nil {
+				t := *t
+				latest = max(latest, t)
+				parsed[i] = append(parsed[i], sample{lset: lset, t: &t, v: v})
+			} else {
+				parsed[i] = append(parsed[i], sample{lset: lset, v: v})
+			}
+		}
+	}
+
+	if ts.IsZero() {
+		ts = time.Now()
+		if latest != math.MinInt64 {
+			ts = timestamp.Time(latest)
+		}
+	}
+
+	s := NewMemoryStorage()
+	var scraped map[uint64]labels.Labels
+	for i, samples := range parsed {
+		scrapeTime := timestamp.FromTime(ts.Add(-time.Duration(len(parsed)-1-i) * interval))
+
+		current := map[uint64]labels.Labels{}
+		for _, smpl := range samples {
+			if smpl.t != nil {
+				s.add(smpl.lset, *smpl.t, smpl.v)
+				continue
+			}
+			s.add(smpl.lset, scrapeTime, smpl.v)
+			current[smpl.lset.Hash()] = smpl.lset
+		}
+		for h, lset := range scraped {
+			if _, ok := current[h]; !ok {
+				s.add(lset, scrapeTime, math.Float64frombits(value.StaleNaN))
+			}
+		}
+		scraped = current
+	}
+	return s, ts, nil
+}
+
+// MinTime returns the timestamp of the earliest sample, or the zero time if there is none
+func (s *MemoryStorage) MinTime() time.Time {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	mint := int64(math.MaxInt64)
+	for _, series := range s.series {
+		if len(series.samples) > 0 {
+			mint = min(mint, series.samples[0].T())
+		}
+	}
+	if mint == math.MaxInt64 {
+		return time.Time{}
+	}
+	return timestamp.Time(mint)
+}
+
+// Querier implements storage.Queryable
+func (s *MemoryStorage) Querier(mint, maxt int64) (storage.Querier, error) {
+	return &memoryQuerier{storage: s, mint: mint, maxt: maxt}, nil
+}
+
+type memoryQuerier struct {
+	storage    *MemoryStorage
+	mint, maxt int64
+}
+
+// Select returns the series matching all matchers, with their samples within the querier's
+// time range, sorted by labels
+func (q *memoryQuerier) Select(_ context.Context, _ bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	mint, maxt := q.mint, q.maxt
+	if hints != nil {
+		mint, maxt = max(mint, hints.Start), min(maxt, hints.End)
+	}
+
+	q.storage.mtx.RLock()
+	defer q.storage.mtx.RUnlock()
+
+	var result []storage.Series
+	for _, series := range q.storage.series {
+		if !matchesAll(series.lset, matchers) {
+			continue
+		}
+		from := sort.Search(len(series.samples), func(i int) bool { return series.samples[i].T() >= mint })
+		to := sort.Search(len(series.samples), func(i int) bool { return series.samples[i].T() > maxt })
+		if from >= to {
+			continue
+		}
+		// Copy the samples, which later Adds may shift while the engine reads them
+		samples := append([]chunks.Sample(nil), series.samples[from:to]...)
+		result = append(result, storage.NewListSeries(series.lset, samples))
+	}
+	sort.Slice(result, func(i, j int) bool { return labels.Compare(result[i].Labels(), result[j].Labels()) < 0 })
+	return &sliceSeriesSet{series: result, i: -1}
+}
+
+// LabelValues returns the sorted values of a label of the series matching all matchers
+func (q *memoryQuerier) LabelValues(_ context.Context, name string, _ *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	values := map[string]struct{}{}
+	q.labels(matchers, func(l labels.Label) {
+		if l.Name == name {
+			values[l.Value] = struct{}{}
+		}
+	})
+	return sortedKeys(values), nil, nil
+}
+
+// LabelNames returns the sorted label names of the series matching all matchers
+func (q *memoryQuerier) LabelNames(_ context.Context, _ *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	names := map[string]struct{}{}
+	q.labels(matchers, func(l labels.Label) {
+		names[l.Name] = struct{}{}
+	})
+	return sortedKeys(names), nil, nil
+}
+
+func (q *memoryQuerier) labels(matchers []*labels.Matcher, f func(labels.Label)) {
+	q.storage.mtx.RLock()
+	defer q.storage.mtx.RUnlock()
+
+	for _, series := range q.storage.series {
+		if matchesAll(series.lset, matchers) {
+			series.lset.Range(f)
+		}
+	}
+}
+
+func (q *memoryQuerier) Close() error {
+	return nil
+}
+
+func matchesAll(lset labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sliceSeriesSet implements storage.SeriesSet over a slice of series
+type sliceSeriesSet struct {
+	series []storage.Series
+	i      int
+}
+
+func (s *sliceSeriesSet) Next() bool {
+	s.i++
+	return s.i < len(s.series)
+}
+
+func (s *sliceSeriesSet) At() storage.Series                { return s.series[s.i] }
+func (s *sliceSeriesSet) Err() error                        { return nil }
+func (s *sliceSeriesSet) Warnings() annotations.Annotations { return nil }
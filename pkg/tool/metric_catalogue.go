@@ -0,0 +1,325 @@
+package tool
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/promql/parser"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DefaultTargetLabels are the labels added to every series at scrape time, which an exporter's
+// exposition does not show
+var DefaultTargetLabels = []string{"job", "instance", "juju_*"}
+
+// catalogueLinePattern matches a line of a plain metric list: a metric name, optionally
+// followed by its label names in braces, e.g. http_requests_total{code, method} or up{}
+var catalogueLinePattern = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)\s*(?:\{([^}]*)\})?$`)
+
+// MetricCatalogue lists the metrics known to exist and the label names of their series
+type MetricCatalogue struct {
+	// metrics maps each metric name to its label names, nil if it may have any labels
+	metrics map[string]map[string]struct{}
+	// targetLabels matches the label names every series has, whatever its metric
+	targetLabels func(string) bool
+}
+
+// LoadMetricCatalogue parses either a Prometheus text exposition dump, e.g. the output of
+// curl http://exporter/metrics, or a plain list with one metric name per line, optionally
+// followed by its label names in braces: a bare name accepts any label, and name{} none. Lines
+// starting with # are comments in both formats.
+// Target labels default to DefaultTargetLabels.
+func LoadMetricCatalogue(data []byte, targetLabels []string) (*MetricCatalogue, error) {
+	if len(targetLabels) == 0 {
+		targetLabels = DefaultTargetLabels
+	}
+	c := &MetricCatalogue{
+		metrics:      map[string]map[string]struct{}{},
+		targetLabels: labelNameFilter(targetLabels),
+	}
+
+	if isMetricList(data) {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			m := catalogueLinePattern.FindStringSubmatch(line)
+			if !strings.Contains(line, "{") {
+				// A bare metric name may have any labels, unlike name{} which has none
+				c.metrics[m[1]] = nil
+				continue
+			}
+			var names []string
+			for _, name := range strings.Split(m[2], ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
+				}
+			}
+			c.add(m[1], names...)
+		}
+		return c, scanner.Err()
+	}
+
+	p := textparse.NewPromParser(data, labels.NewSymbolTable(), false)
+	for {
+		entry, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid metrics: %w", err)
+		}
+		if entry != textparse.EntrySeries {
+			continue
+		}
+
+		var lset labels.Labels
+		p.Labels(&lset)
+		var names []string
+		lset.Range(func(l labels.Label) {
+			if l.Name != labels.MetricName {
+				names = append(names, l.Name)
+			}
+		})
+		c.add(lset.Get(labels.MetricName), names...)
+	}
+	if len(c.metrics) == 0 {
+		return nil, fmt.Errorf("invalid metrics: no metrics found")
+	}
+	return c, nil
+}
+
+// isMetricList tells a plain metric list from an exposition dump, whose samples have values
+func isMetricList(data []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	found := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !catalogueLinePattern.MatchString(line) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// add records a metric with the given label names, in addition to any already recorded
+func (c *MetricCatalogue) add(metric string, names ...string) {
+	set, ok := c.metrics[metric]
+	if ok && set == nil {
+		return
+	}
+	if !ok {
+		set = map[string]struct{}{}
+		c.metrics[metric] = set
+	}
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+}
+
+// AddRecordingRules adds the metrics recorded by the rules of a rule file, so that rules using
+// them are not reported. Their label names are the output labels of the recording expression,
+// plus the labels set by the rule; if those cannot be told, any label is accepted.
+func (c *MetricCatalogue) AddRecordingRules(checker Checker, filename string, data []byte) error {
+	rf, err := parseRuleFile(checker, filename, data)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range rf.Groups {
+		for _, rule := range group.Rules {
+			if rule.Record == "" {
+				continue
+			}
+			a, err := Analyze(checker, rule.Expr)
+			if err != nil {
+				// The file being valid, the invalid expression is suppressed
+				continue
+			}
+			if a.OutputLabels.All {
+				c.metrics[rule.Record] = nil
+				continue
+			}
+			c.add(rule.Record, a.OutputLabels.Labels...)
+			for name := range rule.Labels {
+				c.add(rule.Record, name)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateRuleMetrics checks that every selector of every rule in a rule file could match a
+// series of the catalogue, reporting the unknown metrics and label names of each rule
+func (c *MetricCatalogue) ValidateRuleMetrics(checker Checker, filename string, data []byte) error {
+	findings, err := c.RuleMetricFindings(checker, filename, data)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			errs = append(errs, errors.New(f.Message))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error validating %s: %+v", filename, errs)
+	}
+	return nil
+}
+
+// RuleMetricFindings checks a rule file like ValidateRuleMetrics, returning a finding at the
+// expression of a rule for each of its problems which is not suppressed, and a warning for each
+// unused suppression of these problems
+func (c *MetricCatalogue) RuleMetricFindings(checker Checker, filename string, data []byte) ([]Finding, error) {
+	if _, ok := checker.(*PromQL); !ok {
+		return nil, fmt.Errorf("error validating %s: metrics can only be checked for PromQL rules", filename)
+	}
+
+	rf, err := parseRuleFile(checker, filename, data)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := ruleFileNodes(data)
+	var findings []Finding
+	for i, group := range rf.Groups {
+		for j, rule := range group.Rules {
+			name := rule.Alert
+			if name == "" {
+				name = rule.Record
+			}
+
+			exp, err := parser.ParseExpr(rule.Expr)
+			if err != nil {
+				// The file being valid, the invalid expression is suppressed
+				continue
+			}
+			for _, problem := range c.checkExpr(exp) {
+				ruleID := "unknown-metric"
+				if strings.HasPrefix(problem, "unknown label") {
+					ruleID = "unknown-label"
+				}
+				message := fmt.Sprintf("group %q, rule %q: %s", group.Name, name, problem)
+				findings = append(findings, nodeFinding(filename, ruleID, message, exprNode(ruleFileNode(nodes, i, j))))
+			}
+		}
+	}
+
+	return ParseSuppressions(filename, data).apply(findings, "unknown-metric", "unknown-label"), nil
+}
+
+// parseRuleFile validates a rule file and unmarshals its groups
+func parseRuleFile(checker Checker, filename string, data []byte) (*AlertRuleFile, error) {
+	if _, err := checker.ValidateRules(filename, data); err != nil {
+		return nil, err
+	}
+
+	rf := &AlertRuleFile{Filepath: filename}
+	if err := yaml.Unmarshal(data, rf); err != nil {
+		return nil, fmt.Errorf("error validating %s: %w", filename, err)
+	}
+	return rf, nil
+}
+
+// checkExpr lists the selectors of an expression which cannot match any series of the
+// catalogue, either because no metric matches or because no such metric has a required label
+func (c *MetricCatalogue) checkExpr(exp parser.Expr) []string {
+	var problems []string
+	seen := map[string]struct{}{}
+	report := func(problem string) {
+		if _, ok := seen[problem]; !ok {
+			seen[problem] = struct{}{}
+			problems = append(problems, problem)
+		}
+	}
+
+	parser.Inspect(exp, func(node parser.Node, _ []parser.Node) error {
+		e, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		candidates := c.candidates(e)
+		if len(candidates) == 0 {
+			report(fmt.Sprintf("unknown metric %s", selectorMetric(e)))
+			return nil
+		}
+
+		for _, m := range e.LabelMatchers {
+			// Matchers which also match series without the label do not require it
+			if m.Name == labels.MetricName || m.Matches("") || c.targetLabels(m.Name) {
+				continue
+			}
+			if !hasLabel(candidates, m.Name) {
+				report(fmt.Sprintf("unknown label %q for metric %s", m.Name, selectorMetric(e)))
+			}
+		}
+		return nil
+	})
+	return problems
+}
+
+// candidates returns the label names of the metrics matched by the __name__ matchers of a
+// selector, or of all metrics if it has none
+func (c *MetricCatalogue) candidates(e *parser.VectorSelector) []map[string]struct{} {
+	var candidates []map[string]struct{}
+	for metric, names := range c.metrics {
+		matches := true
+		for _, m := range e.LabelMatchers {
+			if m.Name == labels.MetricName && !m.Matches(metric) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			candidates = append(candidates, names)
+		}
+	}
+	return candidates
+}
+
+// hasLabel tells whether any of the candidate metrics has a label
+func hasLabel(candidates []map[string]struct{}, name string) bool {
+	for _, names := range candidates {
+		if names == nil {
+			return true
+		}
+		if _, ok := names[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selectorMetric names the metric of a selector for reporting, either its name or its
+// __name__ matchers
+func selectorMetric(e *parser.VectorSelector) string {
+	if e.Name != "" {
+		return fmt.Sprintf("%q", e.Name)
+	}
+
+	var matchers []string
+	for _, m := range e.LabelMatchers {
+		if m.Name == labels.MetricName {
+			matchers = append(matchers, m.String())
+		}
+	}
+	sort.Strings(matchers)
+	return "{" + strings.Join(matchers, ", ") + "}"
+}
@@ -0,0 +1,62 @@
+package tool_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRuleMetrics(t *testing.T) {
+	fp := filepath.Join("testdata/prom_alerts", "metrics.yaml")
+	data := readFile(fp)
+
+	for _, catalogue := range []string{"exporter.prom", "exporter.txt"} {
+		c, err := tool.LoadMetricCatalogue(readFile(filepath.Join("testdata/metrics", catalogue)), nil)
+		assert.NoError(t, err, catalogue)
+		assert.NoError(t, c.AddRecordingRules(&tool.PromQL{}, fp, data), catalogue)
+
+		err = c.ValidateRuleMetrics(&tool.PromQL{}, fp, data)
+		assert.EqualError(t, err, `error validating `+fp+`: [`+
+			`group "http", rule "StaleExporter": unknown label "path" for metric "process_start_time_seconds" `+
+			`group "http", rule "StaleExporter": unknown metric "exporter_up" `+
+			`group "http", rule "SlowHandler": unknown label "method" for metric "handler:http_request_duration_seconds:p99" `+
+			`group "http", rule "SlowHandler": unknown label "status" for metric "http_requests_total"]`, catalogue)
+	}
+}
+
+func TestValidateRuleMetricsSelectors(t *testing.T) {
+	c, err := tool.LoadMetricCatalogue([]byte("http_requests_total{code}\nup{}\nprocess_cpu_seconds_total\n"), []string{"job"})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{`rate(http_requests_total{code=~"5..", job="api"}[5m]) > 0`, ``},
+		{`up{code!="200", method=~".*"}`, ``},
+		{`{__name__=~"http_.+", code="500"}`, ``},
+		{`up{instance="a"}`, `unknown label "instance" for metric "up"`},
+		{`process_cpu_seconds_total{instance="a", mode="user"}`, ``},
+		{`{__name__=~"node_.+"}`, `unknown metric {__name__=~"node_.+"}`},
+	}
+
+	for _, tt := range tests {
+		rules := []byte("groups:\n  - name: test\n    rules:\n      - alert: Test\n        expr: '" + tt.expr + "'\n")
+		err := c.ValidateRuleMetrics(&tool.PromQL{}, "rules.yaml", rules)
+		if tt.expected == "" {
+			assert.NoError(t, err, tt.expr)
+		} else {
+			assert.EqualError(t, err, `error validating rules.yaml: [group "test", rule "Test": `+tt.expected+`]`, tt.expr)
+		}
+	}
+}
+
+func TestLoadMetricCatalogueInvalid(t *testing.T) {
+	_, err := tool.LoadMetricCatalogue([]byte("up{job=\"x\"} not-a-value\n"), nil)
+	assert.Error(t, err)
+
+	_, err = tool.LoadMetricCatalogue([]byte("# nothing here\n"), nil)
+	assert.EqualError(t, err, "invalid metrics: no metrics found")
+}
@@ -0,0 +1,204 @@
+package tool
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// policyRuleIDs are the rule IDs of the findings of policy enforcement
+var policyRuleIDs = []string{"policy-name", "policy-label", "policy-annotation", "policy-for", "policy-function"}
+
+// Policy declares the conventions the rules of rule files must follow, in either query
+// language. Regular expressions are anchored at both ends, like those of Prometheus.
+type Policy struct {
+	Alerts         AlertPolicy `yaml:"alerts,omitempty"`
+	RecordingRules RulePolicy  `yaml:"recording_rules,omitempty"`
+	// ForbiddenFunctions are the functions and aggregation operators no expression may use
+	ForbiddenFunctions []string `yaml:"forbidden_functions,omitempty"`
+}
+
+// RulePolicy declares the conventions of recording rules, and those shared by alerting rules
+type RulePolicy struct {
+	// Name is a regular expression the names of the rules must match
+	Name   string                 `yaml:"name,omitempty"`
+	Labels map[string]ValuePolicy `yaml:"labels,omitempty"`
+
+	name *regexp.Regexp
+}
+
+// AlertPolicy declares the conventions of alerting rules
+type AlertPolicy struct {
+	RulePolicy  `yaml:",inline"`
+	Annotations map[string]ValuePolicy `yaml:"annotations,omitempty"`
+	// MaxFor is the longest an alert may be pending before firing, unlimited if zero
+	MaxFor model.Duration `yaml:"max_for,omitempty"`
+}
+
+// ValuePolicy declares the conventions of a label or annotation
+type ValuePolicy struct {
+	// Required rules must set the label or annotation
+	Required bool `yaml:"required,omitempty"`
+	// Values are the values allowed, any if empty
+	Values []string `yaml:"values,omitempty"`
+	// Pattern is a regular expression the value must match
+	Pattern string `yaml:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// LoadPolicy parses and validates a policy file
+func LoadPolicy(data []byte) (*Policy, error) {
+	p := &Policy{}
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+
+	for _, r := range []*RulePolicy{&p.Alerts.RulePolicy, &p.RecordingRules} {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("invalid policy: %w", err)
+		}
+	}
+	if err := compileValues(p.Alerts.Annotations); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	return p, nil
+}
+
+func (r *RulePolicy) compile() error {
+	if r.Name != "" {
+		re, err := regexp.Compile("^(?:" + r.Name + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid name pattern %q: %w", r.Name, err)
+		}
+		r.name = re
+	}
+	return compileValues(r.Labels)
+}
+
+func compileValues(values map[string]ValuePolicy) error {
+	for key, v := range values {
+		if v.Pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + v.Pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q of %s: %w", v.Pattern, key, err)
+		}
+		v.pattern = re
+		values[key] = v
+	}
+	return nil
+}
+
+// ValidateRules checks that every rule of a rule file follows the policy, reporting each
+// violation of each rule
+func (p *Policy) ValidateRules(checker Checker, filename string, data []byte) error {
+	findings, err := p.RuleFindings(checker, filename, data)
+	if err != nil {
+		return err
+	}
+	return findingsError(filename, findings)
+}
+
+// RuleFindings checks a rule file like ValidateRules, returning a finding at the part of a rule
+// violating the policy which is not suppressed, and a warning for each unused suppression of
+// these violations
+func (p *Policy) RuleFindings(checker Checker, filename string, data []byte) ([]Finding, error) {
+	rf, err := parseRuleFile(checker, filename, data)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := ruleFileNodes(data)
+	var findings []Finding
+	for i, group := range rf.Groups {
+		for j, rule := range group.Rules {
+			node := ruleFileNode(nodes, i, j)
+			report := func(ruleID string, node *yaml.Node, format string, args ...any) {
+				findings = append(findings, ruleFinding(filename, ruleID, SeverityError, group.Name, rule, node, format, args...))
+			}
+
+			if rule.Alert != "" {
+				p.Alerts.check(rule.Alert, rule.Labels, "alert", node, report)
+				checkValues(rule.Annotations, p.Alerts.Annotations, "annotation", valueNode(node, "annotations"), report)
+				if p.Alerts.MaxFor > 0 && rule.For > p.Alerts.MaxFor {
+					report("policy-for", valueNode(node, "for"), "for %s exceeds the maximum of %s", rule.For, p.Alerts.MaxFor)
+				}
+			} else {
+				p.RecordingRules.check(rule.Record, rule.Labels, "record", node, report)
+			}
+
+			if len(p.ForbiddenFunctions) == 0 {
+				continue
+			}
+			a, err := Analyze(checker, rule.Expr)
+			if err != nil {
+				// The file being valid, the invalid expression is suppressed
+				continue
+			}
+			for _, function := range a.Functions {
+				if slices.Contains(p.ForbiddenFunctions, function) {
+					report("policy-function", exprNode(node), "forbidden function %s", function)
+				}
+			}
+		}
+	}
+
+	return ParseSuppressions(filename, data).apply(findings, policyRuleIDs...), nil
+}
+
+// policyReport reports a violation of the policy by a rule, located at node
+type policyReport func(ruleID string, node *yaml.Node, format string, args ...any)
+
+// check checks the name and labels of a rule, whose name is set under key
+func (r *RulePolicy) check(name string, labels map[string]string, key string, node *yaml.Node, report policyReport) {
+	if r.name != nil && !r.name.MatchString(name) {
+		report("policy-name", valueNode(node, key), "name does not match %q", r.Name)
+	}
+	checkValues(labels, r.Labels, "label", valueNode(node, "labels"), report)
+}
+
+// checkValues checks the labels or annotations of a rule, located at node
+func checkValues(values map[string]string, policies map[string]ValuePolicy, kind string, node *yaml.Node, report policyReport) {
+	ruleID := "policy-" + kind
+	keys := make([]string, 0, len(policies))
+	for key := range policies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		policy := policies[key]
+		value, ok := values[key]
+		if !ok {
+			if policy.Required {
+				report(ruleID, node, "missing required %s %s", kind, key)
+			}
+			continue
+		}
+
+		if len(policy.Values) > 0 && !slices.Contains(policy.Values, value) {
+			report(ruleID, valueNode(node, key), "%s %s value %q is not one of %s", kind, key, value, strings.Join(policy.Values, ", "))
+		}
+		if policy.pattern != nil && !policy.pattern.MatchString(value) {
+			report(ruleID, valueNode(node, key), "%s %s value %q does not match %q", kind, key, value, policy.Pattern)
+		}
+	}
+}
+
+// valueNode returns the node of the value of a key of a mapping node, or the mapping node
+// itself if it does not have the key
+func valueNode(node *yaml.Node, key string) *yaml.Node {
+	if value := mappingValue(node, key); value != nil {
+		return value
+	}
+	return node
+}
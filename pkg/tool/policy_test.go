@@ -0,0 +1,113 @@
+package tool_test
+
+import (
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+const policy = `alerts:
+  name: '[A-Z][a-zA-Z0-9]*'
+  labels:
+    severity:
+      required: true
+      values: [critical, warning, info]
+  annotations:
+    summary:
+      required: true
+    description:
+      required: true
+  max_for: 1h
+recording_rules:
+  name: '[a-z_]+:[a-zA-Z0-9_]+:[a-z0-9_]+'
+forbidden_functions: [absent_over_time]
+`
+
+func TestPolicyRuleFindings(t *testing.T) {
+	p, err := tool.LoadPolicy([]byte(policy))
+	assert.NoError(t, err)
+
+	rules := []byte(`groups:
+  - name: api
+    rules:
+      - alert: APIDown
+        expr: absent_over_time({job="api"}[5m])
+        for: 2h
+        labels:
+          severity: page
+        annotations:
+          summary: API is down
+      - alert: api_errors
+        expr: count_over_time({job="api"}[5m]) > 0
+        labels:
+          severity: warning
+        annotations:
+          summary: API errors
+          description: The API logs errors
+      - record: job:api_requests:rate5m
+        expr: count_over_time({job="api"}[5m])
+      - record: api_requests
+        expr: count_over_time({job="api"}[5m])
+`)
+	for _, checker := range []tool.Checker{&tool.PromQL{}, &tool.LogQL{}} {
+		findings, err := p.RuleFindings(checker, "rules.yaml", rules)
+		assert.NoError(t, err)
+		assert.Equal(t, []tool.Finding{
+			{File: "rules.yaml", Line: 8, Column: 21, RuleID: "policy-label", Severity: tool.SeverityError,
+				Message: `group "api", rule "APIDown": label severity value "page" is not one of critical, warning, info`},
+			{File: "rules.yaml", Line: 10, Column: 11, RuleID: "policy-annotation", Severity: tool.SeverityError,
+				Message: `group "api", rule "APIDown": missing required annotation description`},
+			{File: "rules.yaml", Line: 6, Column: 14, RuleID: "policy-for", Severity: tool.SeverityError,
+				Message: `group "api", rule "APIDown": for 2h exceeds the maximum of 1h`},
+			{File: "rules.yaml", Line: 5, Column: 15, RuleID: "policy-function", Severity: tool.SeverityError,
+				Message: `group "api", rule "APIDown": forbidden function absent_over_time`},
+			{File: "rules.yaml", Line: 11, Column: 16, RuleID: "policy-name", Severity: tool.SeverityError,
+				Message: `group "api", rule "api_errors": name does not match "[A-Z][a-zA-Z0-9]*"`},
+			{File: "rules.yaml", Line: 20, Column: 17, RuleID: "policy-name", Severity: tool.SeverityError,
+				Message: `group "api", rule "api_requests": name does not match "[a-z_]+:[a-zA-Z0-9_]+:[a-z0-9_]+"`},
+		}, findings)
+
+		err = p.ValidateRules(checker, "rules.yaml", rules)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), `rule "APIDown": missing required annotation description`)
+		}
+	}
+}
+
+func TestPolicySuppressed(t *testing.T) {
+	p, err := tool.LoadPolicy([]byte(policy))
+	assert.NoError(t, err)
+
+	rules := []byte(`groups:
+  - name: api
+    rules:
+      # cos-tool:disable=policy-name,policy-for
+      - record: api_requests
+        expr: sum(rate(http_requests_total[5m]))
+`)
+	findings, err := p.RuleFindings(&tool.PromQL{}, "rules.yaml", rules)
+	assert.NoError(t, err)
+	assert.Equal(t, []tool.Finding{{File: "rules.yaml", Line: 4, Column: 7, RuleID: "unused-suppression",
+		Severity: tool.SeverityWarning, Message: "suppression of policy-for is unused"}}, findings)
+	assert.NoError(t, p.ValidateRules(&tool.PromQL{}, "rules.yaml", rules))
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+	tests := []struct {
+		policy   string
+		expected string
+	}{
+		{"alerts:\n  max_pending: 1h\n", "field max_pending not found"},
+		{"alerts:\n  name: '['\n", `invalid name pattern "["`},
+		{"recording_rules:\n  labels:\n    team:\n      pattern: '('\n", `invalid pattern "(" of team`},
+		{"alerts:\n  max_for: soon\n", "not a valid duration string"},
+	}
+
+	for _, tt := range tests {
+		_, err := tool.LoadPolicy([]byte(tt.policy))
+		if assert.Error(t, err, tt.policy) {
+			assert.Contains(t, err.Error(), tt.expected, tt.policy)
+		}
+	}
+}
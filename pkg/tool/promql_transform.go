@@ -1,6 +1,7 @@
 package tool
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
@@ -17,15 +18,70 @@ import (
 	"github.com/prometheus/prometheus/promql/parser"
 )
 
+// ValidateRules validates a rule file, failing on the findings of RuleFindings which are errors
 func (p *PromQL) ValidateRules(filename string, data []byte) (*rulefmt.RuleGroups, error) {
-	// Expose the backend parser for alert rule validation
+	rg, findings := p.ruleFindings(filename, data)
+	return rg, findingsError(filename, findings)
+}
+
+// repeatedGroupPattern matches the rulefmt error of a group whose name is already used
+var repeatedGroupPattern = regexp.MustCompile(`^groupname: "(.*)" is repeated in the same file$`)
+
+// ruleFindings parses a rule file with the backend parser, returning its groups and a finding
+// for each error which is not suppressed, and a warning for each unused suppression
+func (p *PromQL) ruleFindings(filename string, data []byte) (*rulefmt.RuleGroups, []Finding) {
 	// setting ignoreUnknownFields to false to keep the old behavior
 	rg, errs := rulefmt.Parse(data, false, model.UTF8Validation)
 
-	if len(errs) > 0 {
-		return rg, fmt.Errorf("error validating %s: %+v", filename, errs)
+	var findings []Finding
+	for _, errFindings := range promRuleErrorFindings(filename, data, errs) {
+		findings = append(findings, errFindings...)
+	}
+	suppressions := ParseSuppressions(filename, data)
+	findings = suppressions.apply(findings, ruleValidationIDs...)
+	findings = append(findings, suppressions.Unknown()...)
+	return rg, sortFindings(findings)
+}
+
+// promRuleErrorFindings returns the findings of each rulefmt error
+func promRuleErrorFindings(filename string, data []byte, errs []error) [][]Finding {
+	var findings [][]Finding
+	repeated := map[string]int{}
+	for _, err := range errs {
+		var ruleErr *rulefmt.Error
+		if !errors.As(err, &ruleErr) {
+			if !errorPositionPattern.MatchString(err.Error()) {
+				findings = append(findings, yamlFindings(filename, err))
+				continue
+			}
+
+			f := errorFinding(filename, "invalid-group", err)
+			// rulefmt does not locate repeated group names, which are found at their next use
+			if m := repeatedGroupPattern.FindStringSubmatch(f.Message); m != nil {
+				repeated[m[1]]++
+				f.Line, f.Column = 0, 0
+				if node := nthGroupNode(data, m[1], repeated[m[1]]); node != nil {
+					f.Line, f.Column = node.Line, node.Column
+				}
+			}
+			findings = append(findings, []Finding{f})
+			continue
+		}
+
+		cause := errors.Unwrap(&ruleErr.Err)
+		if cause == nil {
+			findings = append(findings, []Finding{errorFinding(filename, "invalid-rule", err)})
+			continue
+		}
+		ruleID := "invalid-rule"
+		if strings.HasPrefix(cause.Error(), "could not parse expression") {
+			ruleID = "invalid-expression"
+		}
+		f := errorFinding(filename, ruleID, err)
+		f.Message = fmt.Sprintf("group %q, rule %d, %q: %v", ruleErr.Group, ruleErr.Rule, ruleErr.RuleName, cause)
+		findings = append(findings, []Finding{f})
 	}
-	return rg, nil
+	return findings
 }
 
 // This function only checks syntax. If more in depth checking is needed, it must be expanded.
@@ -40,10 +96,56 @@ func (p *PromQL) ValidateConfig(filename string) error {
 }
 
 func (p *PromQL) Transform(arg string, matchers *map[string]string) (string, error) {
+	return p.transform(arg, matchers, nil)
+}
+
+// transform injects matchers like Transform, scoped by the injection rules if not nil
+func (p *PromQL) transform(arg string, matchers *map[string]string, rules *InjectionRules) (string, error) {
+	// Grafana variable queries (label_values, query_result, ...) embed the expression to transform
+	if q, ok := parseGrafanaVariableQuery(arg); ok {
+		if q.function == "metrics" && len(*matchers) > 0 {
+			q = q.metricNames()
+		}
+		transform := func(expr string, m *map[string]string) (string, error) {
+			return p.transform(expr, m, rules)
+		}
+		result, err := q.transform(*matchers, transform, func(m map[string]string) string {
+			return "{" + strings.Join(sortedMatcherStrings(m), ",") + "}"
+		})
+		if err != nil {
+			return arg, err
+		}
+		return result, nil
+	}
+
+	return p.rewrite(arg, func(exp parser.Expr) {
+		if e, ok := exp.(*parser.VectorSelector); ok {
+			p.injectLabelMatcher(e, nil, *matchers, rules)
+		}
+		p.traverseNode(exp, nil, *matchers, rules)
+	})
+}
+
+// rewrite parses arg with its Grafana variables replaced by placeholders, lets visit modify
+// the parsed expression, and formats it back with the original variables restored
+func (p *PromQL) rewrite(arg string, visit func(parser.Expr)) (string, error) {
+	exp, restore, err := p.parse(arg)
+	if err != nil {
+		return arg, err
+	}
+
+	visit(exp)
+	return restore(exp.String()), nil
+}
+
+// parse parses arg with its Grafana variables replaced by placeholders. Returns the parsed
+// expression and a function restoring the original variables in the formatted expression,
+// or in any part of it.
+func (p *PromQL) parse(arg string) (parser.Expr, func(string) string, error) {
 	// Replace function name variables first (before other variable processing)
 	processed, funcReplacements, err := replaceVariablesInFunctionNames(arg)
 	if err != nil {
-		return arg, err
+		return nil, nil, err
 	}
 
 	// Replace Grafana template variables with valid placeholders
@@ -52,40 +154,39 @@ func (p *PromQL) Transform(arg string, matchers *map[string]string) (string, err
 	exp, err := parser.ParseExpr(processed)
 
 	if err != nil {
-		return arg, err
+		return nil, nil, err
 	}
 
-	p.expr = exp
-	p.matchers = matchers
-
-	if e, ok := p.expr.(*parser.VectorSelector); ok {
-		p.injectLabelMatcher(e)
-	}
-
-	p.traverseNode(p.expr)
-	result := p.expr.String()
-
-	// Restore original Grafana variables
-	result = restoreGrafanaVariablesPromQL(result, occurrences)
-
-	// Restore function name variables
-	result = restoreFunctionNameVariables(result, funcReplacements)
+	return exp, func(result string) string {
+		// Restore original Grafana variables
+		result = restoreGrafanaVariablesPromQL(result, occurrences)
 
-	return result, nil
+		// Restore function name variables
+		return restoreFunctionNameVariables(result, funcReplacements)
+	}, nil
 }
 
-func (p *PromQL) traverseNode(exp parser.Node) {
+// traverseNode injects matchers into every vector selector below exp. within holds the
+// names of the functions and aggregations enclosing exp, for evaluating injection rules.
+func (p *PromQL) traverseNode(exp parser.Node, within []string, matchers map[string]string, rules *InjectionRules) {
+	switch e := exp.(type) {
+	case *parser.Call:
+		within = append(slices.Clip(within), e.Func.Name)
+	case *parser.AggregateExpr:
+		within = append(slices.Clip(within), e.Op.String())
+	}
+
 	for _, c := range parser.Children(exp) {
 
 		if e, ok := c.(*parser.VectorSelector); ok {
-			p.injectLabelMatcher(e)
+			p.injectLabelMatcher(e, within, matchers, rules)
 		}
-		p.traverseNode(c)
+		p.traverseNode(c, within, matchers, rules)
 	}
 }
 
-func (p *PromQL) injectLabelMatcher(e *parser.VectorSelector) {
-	for key, val := range *(p.matchers) {
+func (p *PromQL) injectLabelMatcher(e *parser.VectorSelector, within []string, matchers map[string]string, rules *InjectionRules) {
+	for key, val := range rules.matchersFor(e.LabelMatchers, within, matchers) {
 		var found = false
 		for _, existing := range e.LabelMatchers {
 			if existing.Name == key {
@@ -139,16 +240,28 @@ var (
 	backtickStringPattern = regexp.MustCompile("`[^`]*`")
 
 	// Full metric name pattern: detects when entire metric name is a variable
-	// Matches: $var{...} or ${var}{...} where variable is the complete metric name
-	fullMetricNamePattern = regexp.MustCompile(`(?:^|[,\(])\s*(` + varPattern + `)\s*\{`)
+	// Matches: $var{...} or ${var}{...} where variable is the complete metric name,
+	// and $var[5m] where a bare variable selector is followed by a range
+	fullMetricNamePattern = regexp.MustCompile(`(?:^|[,\(])\s*(` + varPattern + `)\s*([\{\[])`)
 
 	// Replacement patterns for variable substitution
 	// These are used during the replace phase to swap variables with placeholders
 
 	// Metric name replacement pattern: captures prefix, variable, and suffix
-	// Matches: prefix + $var + suffix + {
+	// Matches: prefix + $var + suffix + {, where prefix and suffix may be empty, so a lone
+	// $var{ not caught by fullMetricNamePattern is replaced too
 	// Examples: otelcol_receiver + ${suffix_total} + (empty) + {
-	metricNameReplacePattern = regexp.MustCompile(`(\w+)(` + varPattern + `)(\w*)\{`)
+	//           (empty) + ${prefix} + _requests_total + {
+	metricNameReplacePattern = regexp.MustCompile(`([\w:]*)(` + varPattern + `)([\w:]*)\{`)
+
+	// Bare metric name pattern: a metric name made of word characters and variables that
+	// is not followed by a {} selector, e.g. rate(${prefix}_requests_total[5m]).
+	// Captures the preceding character (or start of string) and the whole name token.
+	bareMetricNamePattern = regexp.MustCompile(`(^|[^\w:$}])((?:[\w:]|` + varPattern + `)+)`)
+
+	// Duration context pattern: matches range brackets and offset/@ modifiers, whose
+	// contents look like bare names (e.g. [${n}m], offset ${shift}h) but are durations
+	durationContextPattern = regexp.MustCompile(`\[[^\]]*\]|(?:\boffset|@)\s*-?\s*(?:[\w:]|` + varPattern + `)+`)
 
 	// Range duration replacement pattern: captures variables in duration brackets
 	// Matches: [$var]
@@ -169,12 +282,7 @@ var (
 func replaceVariablesInFunctionNames(query string) (string, map[string]string, error) {
 	// Mask string literals so that variables inside quoted label values
 	// (e.g. {desc="$rate(x)"}) are not treated as function-name variables.
-	var literals []string
-	masked := doubleQuotedStringPattern.ReplaceAllStringFunc(query, func(m string) string {
-		idx := len(literals)
-		literals = append(literals, m)
-		return fmt.Sprintf(`"__LIT%d__"`, idx)
-	})
+	masked, unmask := maskLiterals(query, doubleQuotedStringPattern)
 
 	// Find which functions from the pool are already used in the expression
 	usedFunctions := make(map[string]struct{})
@@ -228,10 +336,7 @@ func replaceVariablesInFunctionNames(query string) (string, map[string]string, e
 	}
 
 	// Restore string literals (still containing original variables, e.g. $rate(x))
-	for i, lit := range literals {
-		result = strings.ReplaceAll(result, fmt.Sprintf(`"__LIT%d__"`, i), lit)
-	}
-	return result, placeholderToVar, nil
+	return unmask(result), placeholderToVar, nil
 }
 
 // restoreFunctionNameVariables restores original Grafana variables in function-call positions
@@ -250,26 +355,16 @@ func restoreFunctionNameVariables(query string, placeholderToVar map[string]stri
 		return len(b) - len(a)
 	})
 
-	result := query
-
 	// Mask string literals to avoid replacing placeholder function names that appear
 	// inside quoted label values (e.g. {desc="rate(x)"}).
-	var literals []string
-	result = doubleQuotedStringPattern.ReplaceAllStringFunc(result, func(m string) string {
-		idx := len(literals)
-		literals = append(literals, m)
-		return fmt.Sprintf(`"__LIT%d__"`, idx)
-	})
+	result, unmask := maskLiterals(query, doubleQuotedStringPattern)
 
 	for _, funcName := range funcNames {
 		result = strings.ReplaceAll(result, funcName+"(", placeholderToVar[funcName]+"(")
 	}
 
 	// Restore original string literals.
-	for i, lit := range literals {
-		result = strings.ReplaceAll(result, fmt.Sprintf(`"__LIT%d__"`, i), lit)
-	}
-	return result
+	return unmask(result)
 }
 
 // replaceGrafanaVariablesPromQL replaces Grafana variables with parseable placeholders
@@ -308,6 +403,7 @@ func replaceGrafanaVariablesPromQL(query string) (string, map[string]string) {
 	result = replaceVariablesInGrouping(result, generalVariablePattern, getPlaceholder)
 	result = replaceFullMetricNameVariables(result, getPlaceholder)
 	result = replaceVariablesInMetricNameComponents(result, getPlaceholder)
+	result = replaceVariablesInBareMetricNames(result, getPlaceholder)
 	result = replaceVariablesInDurations(result, getPlaceholder)
 	result = replaceVariablesInValues(result, getPlaceholder)
 
@@ -321,14 +417,7 @@ func replaceGrafanaVariablesPromQL(query string) (string, map[string]string) {
 func replaceVariablesInGrouping(query string, varPat *regexp.Regexp, getPlaceholder func(string, string) string) string {
 	// Mask both double-quoted and backtick string literals so that by/without patterns
 	// inside strings (e.g. |= "queued by ($q)" or | line_format `by ($q $r)`) are not rewritten.
-	var literals []string
-	mask := func(m string) string {
-		idx := len(literals)
-		literals = append(literals, m)
-		return fmt.Sprintf(`"__LIT%d__"`, idx)
-	}
-	masked := doubleQuotedStringPattern.ReplaceAllStringFunc(query, mask)
-	masked = backtickStringPattern.ReplaceAllStringFunc(masked, mask)
+	masked, unmask := maskLiterals(query, doubleQuotedStringPattern, backtickStringPattern)
 
 	result := groupingContentPattern.ReplaceAllStringFunc(masked, func(match string) string {
 		parts := groupingContentPattern.FindStringSubmatch(match)
@@ -351,10 +440,7 @@ func replaceVariablesInGrouping(query string, varPat *regexp.Regexp, getPlacehol
 	})
 
 	// Restore original string literals
-	for i, lit := range literals {
-		result = strings.ReplaceAll(result, fmt.Sprintf(`"__LIT%d__"`, i), lit)
-	}
-	return result
+	return unmask(result)
 }
 
 // normalizeGroupingContent ensures proper comma separation between labels in grouping clauses.
@@ -370,7 +456,7 @@ func normalizeGroupingContent(content string) string {
 }
 
 // replaceFullMetricNameVariables replaces entire metric names that are variables
-// Examples: $metric{...}, ${metric_name}{...}
+// Examples: $metric{...}, ${metric_name}{...}, rate($metric[5m])
 // This must run before replaceVariablesInMetricNameComponents to avoid conflicts
 func replaceFullMetricNameVariables(query string, getPlaceholder func(string, string) string) string {
 	result := query
@@ -393,9 +479,9 @@ func replaceFullMetricNameVariables(query string, getPlaceholder func(string, st
 		// Get placeholder (uses __v%d__ format for metric names)
 		placeholder := getPlaceholder(variable, "__v%d__")
 
-		// Replace: keep any prefix (like comma/paren), replace variable, keep {
+		// Replace: keep any prefix (like comma/paren), replace variable, keep { or [
 		prefix := result[matchStart:varStart]
-		replacement := prefix + placeholder + "{"
+		replacement := prefix + placeholder + result[matches[4]:matches[5]]
 
 		result = result[:matchStart] + replacement + result[matchEnd:]
 	}
@@ -404,9 +490,10 @@ func replaceFullMetricNameVariables(query string, getPlaceholder func(string, st
 }
 
 // replaceVariablesInMetricNameComponents replaces variables in metric name components
-// Examples: metric${suffix}{...}, otelcol${v1}_process${v2}{...}
+// Examples: metric${suffix}{...}, otelcol${v1}_process${v2}{...}, ${prefix}_requests_total{...}
 func replaceVariablesInMetricNameComponents(query string, getPlaceholder func(string, string) string) string {
-	result := query
+	// Mask string literals so that variables followed by { inside label values are left alone
+	result, unmask := maskLiterals(query, doubleQuotedStringPattern, backtickStringPattern)
 
 	for {
 		matches := metricNameReplacePattern.FindStringIndex(result)
@@ -439,7 +526,64 @@ func replaceVariablesInMetricNameComponents(query string, getPlaceholder func(st
 		result = result[:matchStart] + replacement + result[matchEnd:]
 	}
 
-	return result
+	return unmask(result)
+}
+
+// replaceVariablesInBareMetricNames replaces variables in metric names that are not followed
+// by a {} selector. A name qualifies when the variable is attached to other name characters,
+// so lone variables such as topk($limit, ...) or x / $__range_s keep their value semantics.
+// Examples: ${prefix}_requests_total, rate(node_${collector}_seconds_total[5m])
+func replaceVariablesInBareMetricNames(query string, getPlaceholder func(string, string) string) string {
+	// Durations in range brackets and offset/@ modifiers ([${n}m], offset ${shift}h) are
+	// masked as well, since they are handled as numeric placeholders later on
+	masked, unmask := maskLiterals(query, doubleQuotedStringPattern, backtickStringPattern, durationContextPattern)
+
+	result := bareMetricNamePattern.ReplaceAllStringFunc(masked, func(match string) string {
+		parts := bareMetricNamePattern.FindStringSubmatch(match)
+		if len(parts) < 3 {
+			return match
+		}
+		boundary := parts[1] // preceding character, kept as-is
+		name := parts[2]     // metric name token, e.g. ${prefix}_requests_total
+
+		// Only names mixing variables with other characters are metric names. A lone
+		// variable is a value, and names starting with a digit are numbers or durations.
+		if !generalVariablePattern.MatchString(name) || generalVariablePattern.FindString(name) == name {
+			return match
+		}
+		if name[0] >= '0' && name[0] <= '9' {
+			return match
+		}
+
+		return boundary + generalVariablePattern.ReplaceAllStringFunc(name, func(variable string) string {
+			return getPlaceholder(variable, "__v%d__")
+		})
+	})
+
+	return unmask(result)
+}
+
+// maskLiterals replaces every match of the given patterns with an opaque "__LIT%d__" token,
+// applying the patterns in order. Returns the masked query and a function that restores
+// the original text in a (possibly transformed) masked string.
+func maskLiterals(query string, patterns ...*regexp.Regexp) (string, func(string) string) {
+	var literals []string
+	masked := query
+	for _, pattern := range patterns {
+		masked = pattern.ReplaceAllStringFunc(masked, func(m string) string {
+			idx := len(literals)
+			literals = append(literals, m)
+			return fmt.Sprintf(`"__LIT%d__"`, idx)
+		})
+	}
+
+	return masked, func(s string) string {
+		// Restore in reverse so literals nested in later masks are expanded first
+		for i := len(literals) - 1; i >= 0; i-- {
+			s = strings.ReplaceAll(s, fmt.Sprintf(`"__LIT%d__"`, i), literals[i])
+		}
+		return s
+	}
 }
 
 // replaceVariablesInDurations replaces variables in range duration brackets
@@ -131,8 +131,32 @@ func TestPromQLTransformWithVariables(t *testing.T) {
 			expected: `sum by ($grouping) (rate(up{env="prod"}[5m]))`,
 		},
 		{
-			name:        "Unsupported: variable as prefix in metric name",
-			input:       `${prefix}_metric{job="test"}`,
+			name:     "Metric name prefix variable: ${prefix}",
+			input:    `${prefix}_metric{job="test"}`,
+			matchers: map[string]string{"env": "prod"},
+			expected: `${prefix}_metric{env="prod",job="test"}`,
+		},
+		{
+			name:     "Metric name prefix variable: $prefix",
+			input:    `$prefix:requests:rate5m{job="test"}`,
+			matchers: map[string]string{"env": "prod"},
+			expected: `$prefix:requests:rate5m{env="prod",job="test"}`,
+		},
+		{
+			name:     "Metric name prefix and infix variables",
+			input:    `${ns}_http_${kind}_total{job="test"}`,
+			matchers: map[string]string{"env": "prod"},
+			expected: `${ns}_http_${kind}_total{env="prod",job="test"}`,
+		},
+		{
+			name:     "Metric name variable after binary operator",
+			input:    `up + $metric{job="test"}`,
+			matchers: map[string]string{"env": "prod"},
+			expected: `up{env="prod"} + $metric{env="prod",job="test"}`,
+		},
+		{
+			name:        "Unsupported: variable as label name",
+			input:       `up{${label}="test"}`,
 			matchers:    map[string]string{"env": "prod"},
 			expectError: true,
 			errorMsg:    "", // Parser will reject this as invalid syntax
@@ -157,6 +181,71 @@ func TestPromQLTransformWithVariables(t *testing.T) {
 	}
 }
 
+// TestPromQLTransformWithBareMetricNameVariables tests variables in metric names that are
+// not followed by a {} selector. Variables attached to other name characters are treated as
+// part of the metric name, while lone variables keep their scalar value semantics.
+func TestPromQLTransformWithBareMetricNameVariables(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		matchers map[string]string
+		expected string
+	}{
+		{
+			name:     "Bare prefix variable",
+			input:    `${prefix}_requests_total`,
+			matchers: map[string]string{"env": "prod"},
+			expected: `${prefix}_requests_total{env="prod"}`,
+		},
+		{
+			name:     "Bare suffix variable",
+			input:    `http_requests${suffix}`,
+			matchers: map[string]string{"env": "prod"},
+			expected: `http_requests${suffix}{env="prod"}`,
+		},
+		{
+			name:     "Bare prefix variable in range selector",
+			input:    `rate(${prefix}_requests_total[$__rate_interval])`,
+			matchers: map[string]string{"env": "prod"},
+			expected: `rate(${prefix}_requests_total{env="prod"}[$__rate_interval])`,
+		},
+		{
+			name:     "Bare full variable in range selector",
+			input:    `rate($metric[5m])`,
+			matchers: map[string]string{"env": "prod"},
+			expected: `rate($metric{env="prod"}[5m])`,
+		},
+		{
+			name:     "Same prefix variable in bare and braced selectors",
+			input:    `sum(rate(${ns}_errors_total{code=~"5.."}[5m])) / sum(rate(${ns}_errors_total[5m]))`,
+			matchers: map[string]string{"env": "prod"},
+			expected: `sum(rate(${ns}_errors_total{code=~"5..",env="prod"}[5m])) / sum(rate(${ns}_errors_total{env="prod"}[5m]))`,
+		},
+		{
+			name:     "Lone variables keep scalar semantics",
+			input:    `topk($limit, up) / $__range_s`,
+			matchers: map[string]string{"env": "prod"},
+			expected: `topk($limit, up{env="prod"}) / $__range_s`,
+		},
+		{
+			name:     "Prefix-like variable inside label value is not a metric name",
+			input:    `up{job="${prefix}_exporter"}`,
+			matchers: map[string]string{"env": "prod"},
+			expected: `up{env="prod",job="${prefix}_exporter"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &tool.PromQL{}
+			result, err := p.Transform(tt.input, &tt.matchers)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
 func TestPromQLTransformEdgeCases(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -611,6 +700,91 @@ min(
 	}
 }
 
+// TestPromQLTransformGrafanaVariableQueries tests Grafana templating variable queries, which
+// are not PromQL themselves but embed a series selector or expression to scope.
+func TestPromQLTransformGrafanaVariableQueries(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		matchers map[string]string
+		expected string
+	}{
+		{
+			name:     "label_values with series selector",
+			input:    `label_values(up{job="$job"}, instance)`,
+			matchers: map[string]string{"juju_model": "cos"},
+			expected: `label_values(up{job="$job",juju_model="cos"}, instance)`,
+		},
+		{
+			name:     "label_values without series selector",
+			input:    `label_values(instance)`,
+			matchers: map[string]string{"juju_model": "cos", "juju_application": "proxy"},
+			expected: `label_values({juju_application="proxy",juju_model="cos"}, instance)`,
+		},
+		{
+			name:     "label_names",
+			input:    `label_names()`,
+			matchers: map[string]string{"juju_model": "cos"},
+			expected: `label_names({juju_model="cos"})`,
+		},
+		{
+			name:     "query_result",
+			input:    `query_result(topk(5, sum by (job) (rate(http_requests_total[5m]))))`,
+			matchers: map[string]string{"juju_model": "cos"},
+			expected: `query_result(topk(5, sum by (job) (rate(http_requests_total{juju_model="cos"}[5m]))))`,
+		},
+		{
+			name:     "metrics",
+			input:    `metrics(node_.*)`,
+			matchers: map[string]string{"juju_model": "cos"},
+			expected: `label_values({__name__=~".*(?:node_.*).*",juju_model="cos"}, __name__)`,
+		},
+		{
+			name:     "metrics with a variable",
+			input:    `metrics(${prefix}_\d+)`,
+			matchers: map[string]string{"juju_model": "cos"},
+			expected: `label_values({__name__=~".*(?:${prefix}_\\d+).*",juju_model="cos"}, __name__)`,
+		},
+		{
+			name:     "metrics with an unanchored regex",
+			input:    `metrics(node_)`,
+			matchers: map[string]string{"juju_model": "cos"},
+			expected: `label_values({__name__=~".*(?:node_).*",juju_model="cos"}, __name__)`,
+		},
+		{
+			name:     "metrics with empty matchers",
+			input:    `metrics(node_.*)`,
+			matchers: map[string]string{},
+			expected: `metrics(node_.*)`,
+		},
+		{
+			name:     "label_values with empty matchers",
+			input:    `label_values(job)`,
+			matchers: map[string]string{},
+			expected: `label_values(job)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &tool.PromQL{}
+			result, err := p.Transform(tt.input, &tt.matchers)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+
+	t.Run("invalid embedded expression", func(t *testing.T) {
+		p := &tool.PromQL{}
+		matchers := map[string]string{"juju_model": "cos"}
+		input := `label_values(up{, instance)`
+		result, err := p.Transform(input, &matchers)
+		assert.Error(t, err)
+		assert.Equal(t, input, result)
+	})
+}
+
 func TestPromQLFunctionNameVariablePoolExhausted(t *testing.T) {
 	// When all placeholder functions in the pool are already used by real function calls in the
 	// expression, Transform must return an error instead of silently producing a wrong result.
@@ -0,0 +1,305 @@
+package tool
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	logqlparser "github.com/canonical/cos-tool/pkg/logql/syntax"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Renames maps old metric and label names to new ones, e.g. to follow an exporter moving to
+// the OpenTelemetry semantic conventions
+type Renames struct {
+	Metrics map[string]string `yaml:"metrics,omitempty"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
+}
+
+// Rename renames metrics and labels in a PromQL or LogQL expression, depending on checker
+func Rename(checker Checker, arg string, renames *Renames) (string, error) {
+	switch c := checker.(type) {
+	case *PromQL:
+		return c.rename(arg, renames)
+	case *LogQL:
+		return c.rename(arg, renames)
+	}
+	return arg, fmt.Errorf("renaming is not supported by %T", checker)
+}
+
+// labelReferencePattern matches label references in rule templates: $labels.name and .Labels.name
+var labelReferencePattern = regexp.MustCompile(`(\$labels|\.Labels)\.([a-zA-Z_]\w*)`)
+
+// labelNameArgs lists the arguments of PromQL functions that are label names
+var labelNameArgs = map[string]func(i int) bool{
+	"label_replace": func(i int) bool { return i == 1 || i == 3 },
+	"label_join":    func(i int) bool { return i == 1 || i >= 3 },
+}
+
+// LoadRenames parses and validates a rename mapping file
+func LoadRenames(data []byte) (*Renames, error) {
+	renames := &Renames{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(renames); err != nil {
+		return nil, fmt.Errorf("invalid renames: %w", err)
+	}
+
+	if len(renames.Metrics) == 0 && len(renames.Labels) == 0 {
+		return nil, fmt.Errorf("invalid renames: at least one of 'metrics' or 'labels' must be set")
+	}
+	for from, to := range renames.Metrics {
+		if !model.UTF8Validation.IsValidMetricName(to) {
+			return nil, fmt.Errorf("invalid renames: metric %q: invalid metric name %q", from, to)
+		}
+	}
+	for from, to := range renames.Labels {
+		if from == labels.MetricName || to == labels.MetricName {
+			return nil, fmt.Errorf("invalid renames: label %q: use 'metrics' to rename metrics", from)
+		}
+		if !model.UTF8Validation.IsValidLabelName(to) {
+			return nil, fmt.Errorf("invalid renames: label %q: invalid label name %q", from, to)
+		}
+	}
+	return renames, nil
+}
+
+// renamer applies renames and records whether any name was changed
+type renamer struct {
+	*Renames
+	changed bool
+}
+
+func (r *renamer) metric(name string) string {
+	if to, ok := r.Metrics[name]; ok && to != name {
+		r.changed = true
+		return to
+	}
+	return name
+}
+
+func (r *renamer) label(name string) string {
+	if to, ok := r.Labels[name]; ok && to != name {
+		r.changed = true
+		return to
+	}
+	return name
+}
+
+func (r *renamer) labels(names []string) []string {
+	for i, name := range names {
+		names[i] = r.label(name)
+	}
+	return names
+}
+
+// template renames the label references of an alert template
+func (r *renamer) template(text string) string {
+	return labelReferencePattern.ReplaceAllStringFunc(text, func(ref string) string {
+		m := labelReferencePattern.FindStringSubmatch(ref)
+		return m[1] + "." + r.label(m[2])
+	})
+}
+
+// renameVariableQuery renames the label argument and expression of a Grafana variable query
+func renameVariableQuery(q grafanaVariableQuery, r *renamer, rename func(string) (string, error)) (string, error) {
+	q.label = r.label(q.label)
+	if q.expr != "" {
+		expr, err := rename(q.expr)
+		if err != nil {
+			return "", err
+		}
+		q.expr = expr
+	}
+	return q.String(), nil
+}
+
+// rename renames metrics and labels in selectors, in aggregation and vector matching clauses,
+// and in the label name arguments of functions such as label_replace. Expressions without any
+// renamed name are returned as-is rather than reformatted.
+func (p *PromQL) rename(arg string, renames *Renames) (string, error) {
+	r := &renamer{Renames: renames}
+
+	if q, ok := parseGrafanaVariableQuery(arg); ok {
+		result, err := renameVariableQuery(q, r, func(expr string) (string, error) {
+			return p.rename(expr, renames)
+		})
+		if err != nil {
+			return arg, err
+		}
+		return result, nil
+	}
+
+	result, err := p.rewrite(arg, func(exp parser.Expr) {
+		parser.Inspect(exp, func(node parser.Node, _ []parser.Node) error {
+			switch e := node.(type) {
+			case *parser.VectorSelector:
+				renameSelector(e, r)
+			case *parser.AggregateExpr:
+				e.Grouping = r.labels(e.Grouping)
+				if s, ok := e.Param.(*parser.StringLiteral); ok && e.Op == parser.COUNT_VALUES {
+					s.Val = r.label(s.Val)
+				}
+			case *parser.BinaryExpr:
+				if vm := e.VectorMatching; vm != nil {
+					vm.MatchingLabels = r.labels(vm.MatchingLabels)
+					vm.Include = r.labels(vm.Include)
+				}
+			case *parser.Call:
+				isLabelName, ok := labelNameArgs[e.Func.Name]
+				if !ok {
+					break
+				}
+				for i, arg := range e.Args {
+					if s, ok := arg.(*parser.StringLiteral); ok && isLabelName(i) {
+						s.Val = r.label(s.Val)
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil || !r.changed {
+		return arg, err
+	}
+	return result, nil
+}
+
+// renameSelector renames the metric and label names of a vector selector. Metric names that
+// are not valid identifiers, such as OpenTelemetry dotted names, move into a __name__ matcher.
+func renameSelector(e *parser.VectorSelector, r *renamer) {
+	for _, m := range e.LabelMatchers {
+		if m.Name != labels.MetricName {
+			m.Name = r.label(m.Name)
+		} else if m.Type == labels.MatchEqual {
+			m.Value = r.metric(m.Value)
+		}
+	}
+
+	if e.Name == "" {
+		return
+	}
+	e.Name = r.metric(e.Name)
+	if !model.LegacyValidation.IsValidMetricName(e.Name) {
+		e.Name = ""
+	}
+}
+
+// rename renames labels in stream selectors, in aggregation and vector matching clauses, and
+// in label_replace. LogQL has no metric names, and labels extracted by parsers are not renamed.
+func (p *LogQL) rename(arg string, renames *Renames) (string, error) {
+	r := &renamer{Renames: renames}
+
+	if q, ok := parseGrafanaVariableQuery(arg); ok {
+		result, err := renameVariableQuery(q, r, func(expr string) (string, error) {
+			return p.rename(expr, renames)
+		})
+		if err != nil {
+			return arg, err
+		}
+		return result, nil
+	}
+
+	result, err := p.rewrite(arg, func(exp logqlparser.Expr) {
+		exp.Walk(func(e interface{}) {
+			switch e := e.(type) {
+			case *logqlparser.MatchersExpr:
+				for _, m := range e.Mts {
+					m.Name = r.label(m.Name)
+				}
+			case *logqlparser.RangeAggregationExpr:
+				if e.Grouping != nil {
+					e.Grouping.Groups = r.labels(e.Grouping.Groups)
+				}
+			case *logqlparser.VectorAggregationExpr:
+				if e.Grouping != nil {
+					e.Grouping.Groups = r.labels(e.Grouping.Groups)
+				}
+			case *logqlparser.LabelReplaceExpr:
+				e.Dst = r.label(e.Dst)
+				e.Src = r.label(e.Src)
+			}
+		})
+		walkVectorMatching(exp, func(vm *logqlparser.VectorMatching) {
+			vm.MatchingLabels = r.labels(vm.MatchingLabels)
+			vm.Include = r.labels(vm.Include)
+		})
+	})
+	if err != nil || !r.changed {
+		return arg, err
+	}
+	return result, nil
+}
+
+// RenameRules renames metrics and labels in the expressions of a rule file, in the names of its
+// recording rules, and in the labels and annotations of its alerts, including $labels.name
+// references in their templates.
+func RenameRules(checker Checker, filename string, data []byte, renames *Renames) ([]byte, error) {
+	if _, err := checker.ValidateRules(filename, data); err != nil {
+		return nil, err
+	}
+
+	doc, err := parseRuleFileDocument(data)
+	if err != nil {
+		return nil, fmt.Errorf("error renaming %s: %w", filename, err)
+	}
+
+	r := &renamer{Renames: renames}
+	for _, group := range ruleFileGroups(doc) {
+		for j, rule := range sequenceContent(mappingValue(group, "rules")) {
+			if exprNode := mappingValue(rule, "expr"); exprNode != nil {
+				expr, err := Rename(checker, exprNode.Value, renames)
+				if err != nil {
+					return nil, fmt.Errorf("error renaming %s: group %q, rule %d: %w", filename, scalarValue(group, "name"), j+1, err)
+				}
+				setScalar(exprNode, expr)
+			}
+
+			if record := mappingValue(rule, "record"); record != nil && record.Value != "" {
+				setScalar(record, r.metric(record.Value))
+			}
+			r.templates(mappingValue(rule, "labels"), true)
+			r.templates(mappingValue(rule, "annotations"), false)
+		}
+	}
+
+	out, err := encodeRuleFile(doc)
+	if err != nil {
+		return nil, fmt.Errorf("error renaming %s: %w", filename, err)
+	}
+	return out, nil
+}
+
+// templates renames label references in the values of the mapping node of a rule's labels or
+// annotations, and the keys themselves if they are labels. A key renamed to another key of the
+// mapping replaces it.
+func (r *renamer) templates(node *yaml.Node, renameKeys bool) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		setScalar(value, r.template(value.Value))
+		if !renameKeys {
+			continue
+		}
+		renamed := r.label(key.Value)
+		if renamed == key.Value {
+			continue
+		}
+		for k := 0; k+1 < len(node.Content); k += 2 {
+			if k != i && node.Content[k].Value == renamed {
+				node.Content = append(node.Content[:k], node.Content[k+2:]...)
+				if k < i {
+					i -= 2
+				}
+				break
+			}
+		}
+		setScalar(key, renamed)
+	}
+}
@@ -0,0 +1,130 @@
+package tool_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestRenames(t *testing.T) *tool.Renames {
+	renames, err := tool.LoadRenames(readFile(filepath.Join("testdata/renames", "otel.yaml")))
+	assert.NoError(t, err)
+	return renames
+}
+
+func TestLoadRenamesInvalid(t *testing.T) {
+	for _, data := range []string{
+		``,
+		`metric: {a: b}`,
+		`metrics: {a: ""}`,
+		`labels: {a: __name__}`,
+		`labels: {a: ""}`,
+	} {
+		_, err := tool.LoadRenames([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+func TestPromQLRename(t *testing.T) {
+	renames := loadTestRenames(t)
+	renames.Metrics["node_load1"] = "system.cpu.load_average.1m"
+
+	tests := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "Selector",
+			expr:     `rate(http_requests_total{instance=~"$instance",code!="200"}[$__rate_interval])`,
+			expected: `rate(http_server_requests_total{http_response_status_code!="200",service_instance_id=~"$instance"}[$__rate_interval])`,
+		},
+		{
+			name:     "Grouping and vector matching",
+			expr:     `sum by (instance, code) (a) / on (instance) group_left (code) b`,
+			expected: `sum by (service_instance_id, http_response_status_code) (a) / on (service_instance_id) group_left (http_response_status_code) b`,
+		},
+		{
+			name:     "Function label arguments",
+			expr:     `label_replace(label_join(up, "code", ",", "instance", "job"), "host", "$1", "instance", "(.*):.*")`,
+			expected: `label_replace(label_join(up, "http_response_status_code", ",", "service_instance_id", "job"), "host", "$1", "service_instance_id", "(.*):.*")`,
+		},
+		{
+			name:     "count_values label",
+			expr:     `count_values("code", x)`,
+			expected: `count_values("http_response_status_code", x)`,
+		},
+		{
+			name:     "__name__ matcher",
+			expr:     `{__name__="http_requests_total"}`,
+			expected: `{__name__="http_server_requests_total"}`,
+		},
+		{
+			name:     "Dotted metric name",
+			expr:     `node_load1{instance="a"}`,
+			expected: `{__name__="system.cpu.load_average.1m",service_instance_id="a"}`,
+		},
+		{
+			name:     "Unchanged expression is not reformatted",
+			expr:     `sum(rate(up{job="x", env="y"}[5m]))`,
+			expected: `sum(rate(up{job="x", env="y"}[5m]))`,
+		},
+		{
+			name:     "Variable query",
+			expr:     `label_values(http_requests_total{job="a"}, instance)`,
+			expected: `label_values(http_server_requests_total{job="a"}, service_instance_id)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := tool.Rename(&tool.PromQL{}, tt.expr, renames)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+}
+
+func TestLogQLRename(t *testing.T) {
+	renames := loadTestRenames(t)
+
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{
+			expr:     `sum by (instance) (rate({instance="x"} |= "e" [5m]))`,
+			expected: `sum by(service_instance_id)(rate({service_instance_id="x"} |= "e"[5m]))`,
+		},
+		{
+			expr:     `label_replace(rate({instance="x"}[5m]), "h", "$1", "instance", "(.*)")`,
+			expected: `label_replace(rate({service_instance_id="x"}[5m]),"h","$1","service_instance_id","(.*)")`,
+		},
+	}
+
+	for _, tt := range tests {
+		out, err := tool.Rename(&tool.LogQL{}, tt.expr, renames)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, out)
+	}
+}
+
+func TestRenameRules(t *testing.T) {
+	fp := filepath.Join("testdata/prom_alerts", "rename.yaml")
+
+	out, err := tool.RenameRules(&tool.PromQL{}, fp, readFile(fp), loadTestRenames(t))
+	assert.NoError(t, err)
+
+	rgs := parseRuleGroups(t, out)
+	record, alert := rgs.Groups[0].Rules[0], rgs.Groups[0].Rules[1]
+	assert.Equal(t, "service:http_server_requests:rate5m", record.Record)
+	assert.Equal(t, `sum by (service_instance_id) (rate(http_server_requests_total[5m]))`, record.Expr)
+	assert.Equal(t, map[string]string{
+		"severity":                  "critical",
+		"http_response_status_code": "{{ $labels.http_response_status_code }}",
+	}, alert.Labels)
+	assert.Equal(t, "High error rate on {{ $labels.service_instance_id }}", alert.Annotations["summary"])
+	assert.Equal(t, "{{ .Labels.service_instance_id }} returns {{ $value }} errors per second", alert.Annotations["description"])
+}
@@ -0,0 +1,114 @@
+package tool
+
+import (
+	"bytes"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Rule files are rewritten by editing their YAML node tree in place rather than decoding them
+// into rulefmt types, so that their comments, such as suppressions, and their layout survive.
+
+// parseRuleFileDocument parses a rule file into its YAML document node
+func parseRuleFileDocument(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// ruleFileGroups returns the nodes of the groups of a rule file document
+func ruleFileGroups(doc *yaml.Node) []*yaml.Node {
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	return sequenceContent(mappingValue(doc.Content[0], "groups"))
+}
+
+// encodeRuleFile encodes a rule file document back
+func encodeRuleFile(doc *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setScalar sets the value of a scalar node, keeping its style and, for block scalars, their
+// final line break
+func setScalar(node *yaml.Node, value string) {
+	if node.Value == value {
+		return
+	}
+	if (node.Style == yaml.LiteralStyle || node.Style == yaml.FoldedStyle) && strings.HasSuffix(node.Value, "\n") && !strings.HasSuffix(value, "\n") {
+		value += "\n"
+	}
+	node.Value = value
+}
+
+// setMappingValue sets a key of a mapping node to a string, adding the key last if absent
+func setMappingValue(node *yaml.Node, key, value string) {
+	if v := mappingValue(node, key); v != nil {
+		setScalar(v, value)
+		return
+	}
+	node.Content = append(node.Content, stringNode(key), stringNode(value))
+}
+
+// deleteMappingKey removes a key and its value from a mapping node
+func deleteMappingKey(node *yaml.Node, key string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// mappingNode returns the mapping value of a key of a mapping node, adding an empty one if the
+// key is absent or null
+func mappingNode(node *yaml.Node, key string) *yaml.Node {
+	v := mappingValue(node, key)
+	if v == nil {
+		v = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		node.Content = append(node.Content, stringNode(key), v)
+	} else if v.Kind != yaml.MappingNode {
+		*v = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: v.Line, Column: v.Column}
+	}
+	return v
+}
+
+func stringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// scalarValue returns the value of a key of a mapping node, or an empty string
+func scalarValue(node *yaml.Node, key string) string {
+	if value := mappingValue(node, key); value != nil {
+		return value.Value
+	}
+	return ""
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func sequenceContent(node *yaml.Node) []*yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return node.Content
+}
@@ -0,0 +1,116 @@
+package tool
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// DefaultGroupNameTemplate namespaces rule groups with the Juju topology, following the
+// <model>_<model_uuid>_<application>_<group> convention of the COS charm libraries
+const DefaultGroupNameTemplate = "{{ .juju_model }}_{{ .juju_model_uuid }}_{{ .juju_application }}_{{ .group }}"
+
+// groupNameSentinel stands in for the group name when splitting a rendered group name
+// template into its prefix and suffix
+const groupNameSentinel = "\x00group\x00"
+
+// RuleTransformOptions configures how TransformRules rewrites a rule file
+type RuleTransformOptions struct {
+	// Matchers are injected into every expression and added to the labels of alerting rules
+	Matchers map[string]string
+	// GroupNameTemplate is a text/template for group names, executed with the matchers and
+	// the original group name as .group. An empty template leaves group names unchanged.
+	GroupNameTemplate string
+	// InjectionRules scope which selectors get which matchers, if not nil
+	InjectionRules *InjectionRules
+}
+
+// TransformRules injects the matchers into the expressions of a Prometheus or Loki rule file,
+// adds them to the labels of each alert so that notifications carry their origin, and
+// renames groups following the configured naming convention. Rules that already carry
+// the topology are left unchanged, so transforming a transformed file is a no-op. Comments
+// are kept.
+func TransformRules(checker Checker, filename string, data []byte, opts RuleTransformOptions) ([]byte, error) {
+	if _, err := checker.ValidateRules(filename, data); err != nil {
+		return nil, err
+	}
+
+	doc, err := parseRuleFileDocument(data)
+	if err != nil {
+		return nil, fmt.Errorf("error transforming %s: %w", filename, err)
+	}
+
+	prefix, suffix, err := groupNameAffixes(opts)
+	if err != nil {
+		return nil, fmt.Errorf("error transforming %s: %w", filename, err)
+	}
+
+	names := make([]string, 0, len(opts.Matchers))
+	for name := range opts.Matchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, group := range ruleFileGroups(doc) {
+		groupName := mappingValue(group, "name")
+		if groupName != nil && (!strings.HasPrefix(groupName.Value, prefix) || !strings.HasSuffix(groupName.Value, suffix)) {
+			setScalar(groupName, prefix+groupName.Value+suffix)
+		}
+
+		for j, rule := range sequenceContent(mappingValue(group, "rules")) {
+			if exprNode := mappingValue(rule, "expr"); exprNode != nil {
+				expr, err := TransformWithRules(checker, exprNode.Value, &opts.Matchers, opts.InjectionRules)
+				if err != nil {
+					return nil, fmt.Errorf("error transforming %s: group %q, rule %d: %w", filename, scalarValue(group, "name"), j+1, err)
+				}
+				setScalar(exprNode, expr)
+			}
+
+			if mappingValue(rule, "alert") == nil {
+				continue
+			}
+			for _, name := range names {
+				if mappingValue(mappingValue(rule, "labels"), name) == nil {
+					setMappingValue(mappingNode(rule, "labels"), name, opts.Matchers[name])
+				}
+			}
+		}
+	}
+
+	out, err := encodeRuleFile(doc)
+	if err != nil {
+		return nil, fmt.Errorf("error transforming %s: %w", filename, err)
+	}
+	return out, nil
+}
+
+// groupNameAffixes renders the group name template around a sentinel group name and
+// returns the text that goes before and after the original group name
+func groupNameAffixes(opts RuleTransformOptions) (string, string, error) {
+	if opts.GroupNameTemplate == "" {
+		return "", "", nil
+	}
+
+	tmpl, err := template.New("group").Option("missingkey=error").Parse(opts.GroupNameTemplate)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid group name template: %w", err)
+	}
+
+	data := map[string]string{"group": groupNameSentinel}
+	for name, value := range opts.Matchers {
+		data[name] = value
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", "", fmt.Errorf("invalid group name template: %w", err)
+	}
+
+	prefix, suffix, ok := strings.Cut(buf.String(), groupNameSentinel)
+	if !ok || strings.Contains(suffix, groupNameSentinel) {
+		return "", "", fmt.Errorf("invalid group name template: must use {{ .group }} exactly once")
+	}
+	return prefix, suffix, nil
+}
@@ -0,0 +1,124 @@
+package tool_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v3"
+)
+
+var testTopologyMatchers = map[string]string{
+	"juju_model":       "cos",
+	"juju_model_uuid":  testModelUUID,
+	"juju_application": "proxy",
+}
+
+func parseRuleGroups(t *testing.T, data []byte) rulefmt.RuleGroups {
+	var rgs rulefmt.RuleGroups
+	assert.NoError(t, yaml.Unmarshal(data, &rgs))
+	return rgs
+}
+
+func TestTransformRulesPromQL(t *testing.T) {
+	fp := filepath.Join("testdata/prom_alerts", "basic.yaml")
+	opts := tool.RuleTransformOptions{Matchers: testTopologyMatchers, GroupNameTemplate: tool.DefaultGroupNameTemplate}
+
+	out, err := tool.TransformRules(&tool.PromQL{}, fp, readFile(fp), opts)
+	assert.NoError(t, err)
+
+	rgs := parseRuleGroups(t, out)
+	assert.Equal(t, "cos_"+testModelUUID+"_proxy_test", rgs.Groups[0].Name)
+
+	rule := rgs.Groups[0].Rules[0]
+	assert.Equal(t, `process_cpu_seconds_total{juju_application="proxy",juju_model="cos",juju_model_uuid="`+testModelUUID+`"} > 0.12`, rule.Expr)
+	assert.Equal(t, map[string]string{
+		"severity":         "Low",
+		"juju_model":       "cos",
+		"juju_model_uuid":  testModelUUID,
+		"juju_application": "proxy",
+	}, rule.Labels)
+
+	again, err := tool.TransformRules(&tool.PromQL{}, fp, out, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, string(out), string(again), "transforming a transformed file must be a no-op")
+}
+
+func TestTransformRulesLogQL(t *testing.T) {
+	fp := filepath.Join("testdata/loki_alerts", "basic.yaml")
+	opts := tool.RuleTransformOptions{Matchers: testTopologyMatchers, GroupNameTemplate: "{{ .juju_application }}-{{ .group }}-alerts"}
+
+	out, err := tool.TransformRules(&tool.LogQL{}, fp, readFile(fp), opts)
+	assert.NoError(t, err)
+
+	rgs := parseRuleGroups(t, out)
+	assert.Equal(t, "proxy-testgroup-alerts", rgs.Groups[0].Name)
+	assert.Contains(t, rgs.Groups[0].Rules[0].Expr, `juju_application="proxy"`)
+	assert.Equal(t, "proxy", rgs.Groups[0].Rules[0].Labels["juju_application"])
+}
+
+func TestTransformRulesKeepsExistingLabels(t *testing.T) {
+	data := []byte(`groups:
+  - name: test
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+      - alert: Down
+        expr: up == 0
+        labels:
+          juju_model: other
+`)
+	out, err := tool.TransformRules(&tool.PromQL{}, "rules.yaml", data, tool.RuleTransformOptions{Matchers: testTopologyMatchers})
+	assert.NoError(t, err)
+
+	rgs := parseRuleGroups(t, out)
+	assert.Equal(t, "test", rgs.Groups[0].Name, "group names are unchanged without a template")
+	assert.Empty(t, rgs.Groups[0].Rules[0].Labels, "recording rules do not get topology labels")
+	assert.Equal(t, "other", rgs.Groups[0].Rules[1].Labels["juju_model"])
+	assert.Equal(t, "proxy", rgs.Groups[0].Rules[1].Labels["juju_application"])
+}
+
+func TestTransformRulesFailure(t *testing.T) {
+	fp := filepath.Join("testdata/prom_alerts", "bad_expr.yaml")
+	_, err := tool.TransformRules(&tool.PromQL{}, fp, readFile(fp), tool.RuleTransformOptions{Matchers: testTopologyMatchers})
+	assert.ErrorContains(t, err, "could not parse expression")
+
+	fp = filepath.Join("testdata/prom_alerts", "basic.yaml")
+	for _, tmpl := range []string{"{{ .juju_model }}", "{{ .group }}_{{ .missing }}", "{{ .group"} {
+		_, err = tool.TransformRules(&tool.PromQL{}, fp, readFile(fp), tool.RuleTransformOptions{Matchers: testTopologyMatchers, GroupNameTemplate: tmpl})
+		assert.ErrorContains(t, err, "invalid group name template", tmpl)
+	}
+}
+
+func TestRewritingRulesKeepsComments(t *testing.T) {
+	data := []byte(`# Rules of the API
+groups:
+  - name: api
+    rules:
+      # cos-tool:disable=unknown-metric
+      - alert: HighErrorRate
+        expr: rate(http_errors_total[5m]) > 0 # cos-tool:disable=timing-range
+        labels:
+          severity: page # paged at night
+`)
+	rewrites := map[string]func([]byte) ([]byte, error){
+		"transform": func(data []byte) ([]byte, error) {
+			return tool.TransformRules(&tool.PromQL{}, "rules.yaml", data, tool.RuleTransformOptions{Matchers: testTopologyMatchers})
+		},
+		"untransform": func(data []byte) ([]byte, error) {
+			return tool.UntransformRules(&tool.PromQL{}, "rules.yaml", data, nil)
+		},
+		"rename": func(data []byte) ([]byte, error) {
+			return tool.RenameRules(&tool.PromQL{}, "rules.yaml", data, loadTestRenames(t))
+		},
+	}
+	for name, rewrite := range rewrites {
+		out, err := rewrite(data)
+		assert.NoError(t, err, name)
+		for _, comment := range []string{"# Rules of the API", "# cos-tool:disable=unknown-metric", "# cos-tool:disable=timing-range", "# paged at night"} {
+			assert.Contains(t, string(out), comment, name)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package tool
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// SuppressionAnnotation is the annotation of an alerting rule listing, separated by commas, the
+// rule IDs whose findings are suppressed in the rule
+const SuppressionAnnotation = "cos_tool_ignore"
+
+// suppressionPattern matches the comments suppressing the findings of rule IDs, e.g.
+// # cos-tool:disable=invalid-expression,unknown-metric
+var suppressionPattern = regexp.MustCompile(`#\s*cos-tool:disable=([\w-]+(?:\s*,\s*[\w-]+)*)`)
+
+// ruleValidationIDs are the rule IDs of the findings of rule file validation
+var ruleValidationIDs = []string{"invalid-yaml", "invalid-group", "invalid-rule", "invalid-expression"}
+
+// Suppressions are the findings suppressed in a rule file, by comments applying to the rule or
+// group they are on or above, or to the whole file outside of groups, and by the
+// SuppressionAnnotation of alerting rules
+type Suppressions struct {
+	filename string
+	entries  []*suppression
+}
+
+// suppression suppresses the findings of a rule ID within a range of lines
+type suppression struct {
+	ruleID string
+	// line and column locate the comment or annotation
+	line, column int
+	// first and last are the lines of the group or rule the suppression applies to, last
+	// being 0 for the end of the file
+	first, last int
+	used        bool
+}
+
+// span is the range of lines of a group or rule
+type span struct {
+	first, last int
+}
+
+func (s span) contains(line int) bool {
+	return s.first <= line && (s.last == 0 || line <= s.last)
+}
+
+// ParseSuppressions returns the suppressions of a rule file, which are none if it is not valid
+// YAML
+func ParseSuppressions(filename string, data []byte) *Suppressions {
+	s := &Suppressions{filename: filename}
+	nodes := ruleFileNodes(data)
+	if nodes == nil {
+		return s
+	}
+
+	// Each group spans up to the next one, and each rule up to the next one or the end of
+	// its group
+	var groups []span
+	rules := map[int][]span{}
+	for i, group := range nodes {
+		g := span{first: group[0].Line}
+		if i+1 < len(nodes) {
+			g.last = nodes[i+1][0].Line - 1
+		}
+		groups = append(groups, g)
+
+		for j, rule := range group[1:] {
+			r := span{first: rule.Line, last: g.last}
+			if j+2 < len(group) {
+				r.last = group[j+2].Line - 1
+			}
+			rules[i] = append(rules[i], r)
+
+			if value := mappingValue(mappingValue(rule, "annotations"), SuppressionAnnotation); value != nil {
+				s.add(value.Value, value.Line, value.Column, r)
+			}
+		}
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		loc := suppressionPattern.FindStringSubmatchIndex(line)
+		if loc == nil {
+			continue
+		}
+
+		// A comment on its own line applies to what follows it
+		target := i
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			for target = i + 1; target < len(lines); target++ {
+				next := strings.TrimSpace(lines[target])
+				if next != "" && !strings.HasPrefix(next, "#") {
+					break
+				}
+			}
+		}
+		target++
+
+		scope := span{first: 1}
+		for g, group := range groups {
+			if !group.contains(target) {
+				continue
+			}
+			scope = group
+			for _, rule := range rules[g] {
+				if rule.contains(target) {
+					scope = rule
+				}
+			}
+		}
+		s.add(line[loc[2]:loc[3]], i+1, loc[0]+1, scope)
+	}
+	return s
+}
+
+func (s *Suppressions) add(ruleIDs string, line, column int, scope span) {
+	for _, id := range strings.Split(ruleIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			s.entries = append(s.entries, &suppression{ruleID: id, line: line, column: column, first: scope.first, last: scope.last})
+		}
+	}
+}
+
+// Suppresses tells whether a finding is suppressed, which counts as a use of the suppressions
+// applying to it. Findings which cannot be located are only suppressed for the whole file.
+func (s *Suppressions) Suppresses(f Finding) bool {
+	suppressed := false
+	for _, e := range s.entries {
+		if e.ruleID != f.RuleID {
+			continue
+		}
+		if (f.Line == 0 && e.first == 1 && e.last == 0) || (f.Line > 0 && (span{e.first, e.last}).contains(f.Line)) {
+			e.used = true
+			suppressed = true
+		}
+	}
+	return suppressed
+}
+
+// SuppressesAll tells whether there are findings and all of them are suppressed
+func (s *Suppressions) SuppressesAll(findings []Finding) bool {
+	if len(findings) == 0 {
+		return false
+	}
+	all := true
+	for _, f := range findings {
+		// Every finding is checked, to count every suppression used
+		if !s.Suppresses(f) {
+			all = false
+		}
+	}
+	return all
+}
+
+// Filter returns the findings which are not suppressed
+func (s *Suppressions) Filter(findings []Finding) []Finding {
+	var result []Finding
+	for _, f := range findings {
+		if !s.Suppresses(f) {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// apply returns the findings of the checks of the rule IDs which are not suppressed, followed by
+// a warning for each unused suppression of these rule IDs
+func (s *Suppressions) apply(findings []Finding, ruleIDs ...string) []Finding {
+	return append(s.Filter(findings), s.Unused(ruleIDs...)...)
+}
+
+// Unused returns a warning for each suppression of one of the rule IDs which did not suppress
+// any finding, for the checks of these rule IDs to report once they have run
+func (s *Suppressions) Unused(ruleIDs ...string) []Finding {
+	var findings []Finding
+	for _, e := range s.entries {
+		if !e.used && slices.Contains(ruleIDs, e.ruleID) {
+			findings = append(findings, s.warning(e, fmt.Sprintf("suppression of %s is unused", e.ruleID)))
+		}
+	}
+	return findings
+}
+
+// Unknown returns a warning for each suppression of a rule ID which does not exist
+func (s *Suppressions) Unknown() []Finding {
+	var findings []Finding
+	for _, e := range s.entries {
+		if _, ok := RuleDescriptions[e.ruleID]; !ok {
+			findings = append(findings, s.warning(e, fmt.Sprintf("suppression of unknown rule %s", e.ruleID)))
+		}
+	}
+	return findings
+}
+
+func (s *Suppressions) warning(e *suppression, message string) Finding {
+	return Finding{File: s.filename, Line: e.line, Column: e.column, RuleID: "unused-suppression", Severity: SeverityWarning, Message: message}
+}
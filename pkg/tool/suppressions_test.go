@@ -0,0 +1,83 @@
+package tool_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+const suppressedRules = `groups:
+  - name: api
+    rules:
+      # cos-tool:disable=invalid-expression
+      - alert: Broken
+        expr: rate(up[5m)
+      - alert: AlsoBroken
+        expr: rate(up[5m) # cos-tool:disable=invalid-rule
+      - alert: Annotated
+        expr: count_over_time({job="api"}[5m]) == 0
+        annotations:
+          cos_tool_ignore: unknown-metric, typo
+  # cos-tool:disable=invalid-rule
+  - name: db
+    rules:
+      - record: job:up
+        alert: Down
+        expr: up
+`
+
+func TestRuleFindingsSuppressed(t *testing.T) {
+	for _, checker := range []tool.Checker{&tool.PromQL{}, &tool.LogQL{}} {
+		findings := tool.RuleFindings(checker, "rules.yaml", []byte(suppressedRules))
+		if !assert.Len(t, findings, 3) {
+			continue
+		}
+
+		// The suppression on the wrong line does not apply to the expression
+		assert.Equal(t, "invalid-expression", findings[0].RuleID)
+		assert.Equal(t, 8, findings[0].Line)
+		assert.Equal(t, tool.Finding{File: "rules.yaml", Line: 8, Column: 27, RuleID: "unused-suppression",
+			Severity: tool.SeverityWarning, Message: "suppression of invalid-rule is unused"}, findings[1])
+		assert.Equal(t, tool.Finding{File: "rules.yaml", Line: 12, Column: 28, RuleID: "unused-suppression",
+			Severity: tool.SeverityWarning, Message: "suppression of unknown rule typo"}, findings[2])
+	}
+}
+
+func TestValidateRulesSuppressed(t *testing.T) {
+	for _, checker := range []tool.Checker{&tool.PromQL{}, &tool.LogQL{}} {
+		_, err := checker.ValidateRules("rules.yaml", []byte(suppressedRules))
+		if assert.Error(t, err) {
+			assert.Equal(t, 1, strings.Count(err.Error(), "could not parse expression"))
+			assert.NotContains(t, err.Error(), "only one of 'record' and 'alert' must be set")
+		}
+	}
+
+	rules := "# cos-tool:disable=invalid-rule\ngroups:\n  - name: x\n    rules:\n      - record: a\n        alert: B\n        expr: up\n"
+	for _, checker := range []tool.Checker{&tool.PromQL{}, &tool.LogQL{}} {
+		_, err := checker.ValidateRules("rules.yaml", []byte(rules))
+		assert.NoError(t, err)
+	}
+}
+
+func TestRuleMetricFindingsSuppressed(t *testing.T) {
+	c, err := tool.LoadMetricCatalogue([]byte("up{job}\n"), nil)
+	assert.NoError(t, err)
+
+	rules := []byte(`groups:
+  - name: test
+    rules:
+      - alert: Exporter
+        expr: exporter_up == 0
+        annotations:
+          cos_tool_ignore: unknown-metric
+      - alert: Up # cos-tool:disable=unknown-label
+        expr: up == 0
+`)
+	findings, err := c.RuleMetricFindings(&tool.PromQL{}, "rules.yaml", rules)
+	assert.NoError(t, err)
+	assert.Equal(t, []tool.Finding{{File: "rules.yaml", Line: 8, Column: 19, RuleID: "unused-suppression",
+		Severity: tool.SeverityWarning, Message: "suppression of unknown-label is unused"}}, findings)
+	assert.NoError(t, c.ValidateRuleMetrics(&tool.PromQL{}, "rules.yaml", rules))
+}
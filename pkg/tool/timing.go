@@ -0,0 +1,231 @@
+package tool
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	logqlparser "github.com/canonical/cos-tool/pkg/logql/syntax"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// timingRuleIDs are the rule IDs of the findings of timing checks
+var timingRuleIDs = []string{"timing-interval", "timing-for", "timing-range", "timing-subquery", "timing-offset"}
+
+// rateFunctions are the PromQL functions needing at least two samples in their range
+var rateFunctions = []string{"rate", "irate", "increase", "delta", "idelta", "deriv", "predict_linear", "changes", "resets"}
+
+// TimingChecks compare the durations of rules, i.e. their group interval, for, keep_firing_for,
+// ranges, subquery steps and offsets, with how often the metrics they select are scraped and how
+// often they are evaluated, to catch rules which flap or never fire
+type TimingChecks struct {
+	// ScrapeInterval is how often the metrics are scraped, unknown if zero. It does not apply
+	// to LogQL rules.
+	ScrapeInterval time.Duration
+	// EvaluationInterval is how often the groups without an interval are evaluated, and the step
+	// of the subqueries without one, whatever the interval of their group
+	EvaluationInterval time.Duration
+}
+
+// exprDurations are the durations of an expression
+type exprDurations struct {
+	ranges     []exprRange
+	subqueries []exprSubquery
+	offsets    []time.Duration
+	// logs tells that the expression is a LogQL query, whose ranges are not made of scrapes
+	logs bool
+}
+
+// exprRange is a range selector, with the function it is an argument of and the innermost
+// subquery it is in, if any, which evaluates it instead of the rule
+type exprRange struct {
+	function string
+	rng      time.Duration
+	subquery *exprSubquery
+}
+
+// exprSubquery is a subquery, whose step is 0 if it is the default, the global evaluation
+// interval
+type exprSubquery struct {
+	rng, step time.Duration
+}
+
+// ValidateRules checks the timing of every rule of a rule file, reporting each problem
+func (t *TimingChecks) ValidateRules(checker Checker, filename string, data []byte) error {
+	findings, err := t.RuleFindings(checker, filename, data)
+	if err != nil {
+		return err
+	}
+	return findingsError(filename, findings)
+}
+
+// RuleFindings checks a rule file like ValidateRules, returning a finding for each problem
+// which is not suppressed: an error for ranges too short to hold the samples their function
+// needs and subqueries shorter than their step, and a warning for the durations which are
+// shorter than the scrape or evaluation interval. Unused suppressions of these problems are
+// reported as warnings too.
+func (t *TimingChecks) RuleFindings(checker Checker, filename string, data []byte) ([]Finding, error) {
+	rf, err := parseRuleFile(checker, filename, data)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := ruleFileNodes(data)
+	var findings []Finding
+	for i, group := range rf.Groups {
+		interval := time.Duration(group.Interval)
+		if interval == 0 {
+			interval = t.EvaluationInterval
+		}
+		groupNode := ruleFileNode(nodes, i, -1)
+		if t.ScrapeInterval > 0 && interval < t.ScrapeInterval {
+			f := nodeFinding(filename, "timing-interval", fmt.Sprintf("group %q: interval %s is shorter than the scrape interval %s, so evaluations see the same samples",
+				group.Name, model.Duration(interval), model.Duration(t.ScrapeInterval)), valueNode(groupNode, "interval"))
+			f.Severity = SeverityWarning
+			findings = append(findings, f)
+		}
+
+		for j, rule := range group.Rules {
+			node := ruleFileNode(nodes, i, j)
+			report := func(ruleID string, severity Severity, node *yaml.Node, format string, args ...any) {
+				findings = append(findings, ruleFinding(filename, ruleID, severity, group.Name, rule, node, format, args...))
+			}
+
+			for key, d := range map[string]model.Duration{"for": rule.For, "keep_firing_for": rule.KeepFiringFor} {
+				if d > 0 && time.Duration(d) < interval {
+					report("timing-for", SeverityWarning, valueNode(node, key), "%s %s is shorter than the evaluation interval %s, so it lasts a single evaluation",
+						key, d, model.Duration(interval))
+				}
+			}
+
+			durations, err := parseExprDurations(checker, rule.Expr)
+			if err != nil {
+				// The file being valid, the invalid expression is suppressed
+				continue
+			}
+			t.checkExpr(durations, interval, func(ruleID string, severity Severity, format string, args ...any) {
+				report(ruleID, severity, exprNode(node), format, args...)
+			})
+		}
+	}
+
+	return sortFindings(ParseSuppressions(filename, data).apply(findings, timingRuleIDs...)), nil
+}
+
+// checkExpr checks the durations of an expression evaluated every interval
+func (t *TimingChecks) checkExpr(d *exprDurations, interval time.Duration, report func(ruleID string, severity Severity, format string, args ...any)) {
+	scrape := t.ScrapeInterval
+	if d.logs {
+		scrape = 0
+	}
+
+	// Like Prometheus, subqueries without a step are evaluated at the global evaluation
+	// interval, whatever the interval of their group
+	stepOf := func(s exprSubquery) time.Duration {
+		switch {
+		case s.step > 0:
+			return s.step
+		case t.EvaluationInterval > 0:
+			return t.EvaluationInterval
+		}
+		return interval
+	}
+
+	for _, r := range d.ranges {
+		rate := slices.Contains(rateFunctions, r.function)
+		switch {
+		case scrape > 0 && rate && r.rng < 2*scrape:
+			report("timing-range", SeverityError, "range %s of %s holds fewer than two samples scraped every %s",
+				model.Duration(r.rng), r.function, model.Duration(scrape))
+		case scrape > 0 && r.rng < scrape:
+			report("timing-range", SeverityError, "range %s of %s is shorter than the scrape interval %s, so it may hold no sample",
+				model.Duration(r.rng), r.function, model.Duration(scrape))
+		case r.subquery != nil:
+			// Ranges within a subquery are evaluated at each of its steps
+			if step := stepOf(*r.subquery); r.rng < step {
+				report("timing-range", SeverityWarning, "range %s of %s is shorter than the subquery step %s, so samples between steps are missed",
+					model.Duration(r.rng), r.function, model.Duration(step))
+			}
+		case r.rng < interval:
+			report("timing-range", SeverityWarning, "range %s of %s is shorter than the evaluation interval %s, so samples between evaluations are missed",
+				model.Duration(r.rng), r.function, model.Duration(interval))
+		}
+	}
+
+	for _, s := range d.subqueries {
+		step := stepOf(s)
+		switch {
+		case s.rng < step:
+			report("timing-subquery", SeverityError, "subquery range %s is shorter than its step %s", model.Duration(s.rng), model.Duration(step))
+		case scrape > 0 && step < scrape:
+			report("timing-subquery", SeverityWarning, "subquery step %s is shorter than the scrape interval %s, so steps see the same samples",
+				model.Duration(step), model.Duration(scrape))
+		}
+	}
+
+	for _, offset := range d.offsets {
+		if scrape > 0 && offset > 0 && offset < scrape {
+			report("timing-offset", SeverityWarning, "offset %s is shorter than the scrape interval %s, so it selects mostly the same samples",
+				model.Duration(offset), model.Duration(scrape))
+		}
+	}
+}
+
+// parseExprDurations returns the durations of a PromQL or LogQL expression
+func parseExprDurations(checker Checker, expr string) (*exprDurations, error) {
+	d := &exprDurations{}
+	switch c := checker.(type) {
+	case *PromQL:
+		exp, _, err := c.parse(expr)
+		if err != nil {
+			return nil, err
+		}
+		parser.Inspect(exp, func(node parser.Node, path []parser.Node) error {
+			switch e := node.(type) {
+			case *parser.MatrixSelector:
+				r := exprRange{rng: e.Range}
+				if len(path) > 0 {
+					if call, ok := path[len(path)-1].(*parser.Call); ok {
+						r.function = call.Func.Name
+					}
+				}
+				for _, n := range slices.Backward(path) {
+					if s, ok := n.(*parser.SubqueryExpr); ok {
+						r.subquery = &exprSubquery{rng: s.Range, step: s.Step}
+						break
+					}
+				}
+				d.ranges = append(d.ranges, r)
+			case *parser.SubqueryExpr:
+				d.subqueries = append(d.subqueries, exprSubquery{rng: e.Range, step: e.Step})
+				if e.OriginalOffset > 0 {
+					d.offsets = append(d.offsets, e.OriginalOffset)
+				}
+			case *parser.VectorSelector:
+				if e.OriginalOffset > 0 {
+					d.offsets = append(d.offsets, e.OriginalOffset)
+				}
+			}
+			return nil
+		})
+	case *LogQL:
+		exp, _, err := c.parse(expr)
+		if err != nil {
+			return nil, err
+		}
+		d.logs = true
+		exp.Walk(func(node interface{}) {
+			if e, ok := node.(*logqlparser.RangeAggregationExpr); ok && e.Left != nil {
+				d.ranges = append(d.ranges, exprRange{function: e.Operation, rng: e.Left.Interval})
+				if e.Left.Offset > 0 {
+					d.offsets = append(d.offsets, e.Left.Offset)
+				}
+			}
+		})
+	default:
+		return nil, fmt.Errorf("unsupported checker %T", checker)
+	}
+	return d, nil
+}
@@ -0,0 +1,107 @@
+package tool_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimingRuleFindings(t *testing.T) {
+	checks := &tool.TimingChecks{ScrapeInterval: time.Minute, EvaluationInterval: time.Minute}
+
+	rules := []byte(`groups:
+  - name: slow
+    interval: 2m
+    rules:
+      - alert: Errors
+        expr: rate(errors_total[1m]) > 0
+        for: 30s
+      - alert: Gaps
+        expr: max_over_time(up[90s]) == 0
+      - alert: Missing
+        expr: absent_over_time(up{job="api"}[30s])
+      - record: job:errors:max1h
+        expr: max_over_time(rate(errors_total[5m])[1h:30s] offset 10s)
+  - name: fast
+    interval: 30s
+    rules:
+      - alert: Fine
+        expr: increase(errors_total[5m]) > 0
+        for: 5m
+        keep_firing_for: 10s
+`)
+	findings, err := checks.RuleFindings(&tool.PromQL{}, "rules.yaml", rules)
+	assert.NoError(t, err)
+	assert.Equal(t, []tool.Finding{
+		{File: "rules.yaml", Line: 6, Column: 15, RuleID: "timing-range", Severity: tool.SeverityError,
+			Message: `group "slow", rule "Errors": range 1m of rate holds fewer than two samples scraped every 1m`},
+		{File: "rules.yaml", Line: 7, Column: 14, RuleID: "timing-for", Severity: tool.SeverityWarning,
+			Message: `group "slow", rule "Errors": for 30s is shorter than the evaluation interval 2m, so it lasts a single evaluation`},
+		{File: "rules.yaml", Line: 9, Column: 15, RuleID: "timing-range", Severity: tool.SeverityWarning,
+			Message: `group "slow", rule "Gaps": range 1m30s of max_over_time is shorter than the evaluation interval 2m, so samples between evaluations are missed`},
+		{File: "rules.yaml", Line: 11, Column: 15, RuleID: "timing-range", Severity: tool.SeverityError,
+			Message: `group "slow", rule "Missing": range 30s of absent_over_time is shorter than the scrape interval 1m, so it may hold no sample`},
+		{File: "rules.yaml", Line: 13, Column: 15, RuleID: "timing-subquery", Severity: tool.SeverityWarning,
+			Message: `group "slow", rule "job:errors:max1h": subquery step 30s is shorter than the scrape interval 1m, so steps see the same samples`},
+		{File: "rules.yaml", Line: 13, Column: 15, RuleID: "timing-offset", Severity: tool.SeverityWarning,
+			Message: `group "slow", rule "job:errors:max1h": offset 10s is shorter than the scrape interval 1m, so it selects mostly the same samples`},
+		{File: "rules.yaml", Line: 15, Column: 15, RuleID: "timing-interval", Severity: tool.SeverityWarning,
+			Message: `group "fast": interval 30s is shorter than the scrape interval 1m, so evaluations see the same samples`},
+		{File: "rules.yaml", Line: 20, Column: 26, RuleID: "timing-for", Severity: tool.SeverityWarning,
+			Message: `group "fast", rule "Fine": keep_firing_for 10s is shorter than the evaluation interval 30s, so it lasts a single evaluation`},
+	}, findings)
+
+	err = checks.ValidateRules(&tool.PromQL{}, "rules.yaml", rules)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `rule "Errors": range 1m of rate holds fewer than two samples scraped every 1m`)
+	}
+}
+
+func TestTimingSubqueries(t *testing.T) {
+	checks := &tool.TimingChecks{ScrapeInterval: 15 * time.Second, EvaluationInterval: time.Minute}
+
+	rules := []byte(`groups:
+  - name: hourly
+    interval: 5m
+    rules:
+      - record: job:errors:max1h
+        expr: max_over_time(rate(errors_total[1m])[1h:30s])
+      - record: job:up:min1h
+        expr: min_over_time(min_over_time(up[20s])[1h:30s])
+      - record: job:errors:max1h_default_step
+        expr: max_over_time(rate(errors_total[2m])[1h:])
+      - record: job:up:min1h_default_step
+        expr: min_over_time(min_over_time(up[30s])[1h:])
+`)
+	findings, err := checks.RuleFindings(&tool.PromQL{}, "rules.yaml", rules)
+	assert.NoError(t, err)
+	assert.Equal(t, []tool.Finding{
+		{File: "rules.yaml", Line: 8, Column: 15, RuleID: "timing-range", Severity: tool.SeverityWarning,
+			Message: `group "hourly", rule "job:up:min1h": range 20s of min_over_time is shorter than the subquery step 30s, so samples between steps are missed`},
+		{File: "rules.yaml", Line: 12, Column: 15, RuleID: "timing-range", Severity: tool.SeverityWarning,
+			Message: `group "hourly", rule "job:up:min1h_default_step": range 30s of min_over_time is shorter than the subquery step 1m, so samples between steps are missed`},
+	}, findings)
+}
+
+func TestTimingLogQL(t *testing.T) {
+	checks := &tool.TimingChecks{ScrapeInterval: time.Minute, EvaluationInterval: 5 * time.Minute}
+
+	rules := []byte(`groups:
+  - name: logs
+    rules:
+      - alert: Errors
+        expr: sum(count_over_time({job="api"} |= "error" [1m])) > 0
+      # cos-tool:disable=timing-range
+      - alert: Quiet
+        expr: absent_over_time({job="api"}[2m])
+`)
+	findings, err := checks.RuleFindings(&tool.LogQL{}, "rules.yaml", rules)
+	assert.NoError(t, err)
+	assert.Equal(t, []tool.Finding{
+		{File: "rules.yaml", Line: 5, Column: 15, RuleID: "timing-range", Severity: tool.SeverityWarning,
+			Message: `group "logs", rule "Errors": range 1m of count_over_time is shorter than the evaluation interval 5m, so samples between evaluations are missed`},
+	}, findings)
+	assert.NoError(t, checks.ValidateRules(&tool.LogQL{}, "rules.yaml", rules))
+}
@@ -0,0 +1,120 @@
+package tool
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Topology is the Juju topology of a charm, as passed around by charms: either the plain
+// form ({"model": ..., "model_uuid": ...}) or the label form ({"juju_model": ...}).
+type Topology struct {
+	Model       string `json:"model"`
+	ModelUUID   string `json:"model_uuid"`
+	Application string `json:"application"`
+	Unit        string `json:"unit"`
+	CharmName   string `json:"charm_name"`
+}
+
+// Juju environment variables available to charm hooks and actions
+const (
+	JujuModelNameEnv = "JUJU_MODEL_NAME"
+	JujuModelUUIDEnv = "JUJU_MODEL_UUID"
+	JujuUnitNameEnv  = "JUJU_UNIT_NAME"
+)
+
+var (
+	// Juju model UUIDs are lowercase hexadecimal UUIDs
+	modelUUIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+	// Unit names are the application name followed by a slash and the unit number
+	unitNamePattern = regexp.MustCompile(`^([a-z][a-z0-9-]*)/(\d+)$`)
+)
+
+// ParseTopology reads a topology from JSON. Keys may carry the juju_ label prefix.
+func ParseTopology(data []byte) (*Topology, error) {
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("malformed topology: %w", err)
+	}
+
+	t := &Topology{}
+	for key, value := range raw {
+		switch strings.TrimPrefix(key, "juju_") {
+		case "model":
+			t.Model = value
+		case "model_uuid":
+			t.ModelUUID = value
+		case "application":
+			t.Application = value
+		case "unit":
+			t.Unit = value
+		case "charm_name", "charm":
+			t.CharmName = value
+		default:
+			return nil, fmt.Errorf("malformed topology: unknown key %q", key)
+		}
+	}
+	return t, nil
+}
+
+// TopologyFromEnv builds a topology from the Juju environment of a charm hook.
+// The application name is derived from the unit name.
+func TopologyFromEnv(getenv func(string) string) (*Topology, error) {
+	t := &Topology{
+		Model:     getenv(JujuModelNameEnv),
+		ModelUUID: getenv(JujuModelUUIDEnv),
+		Unit:      getenv(JujuUnitNameEnv),
+	}
+	if t.Unit == "" {
+		return nil, fmt.Errorf("%s is not set", JujuUnitNameEnv)
+	}
+	t.Application, _, _ = strings.Cut(t.Unit, "/")
+	return t, nil
+}
+
+// Validate checks that the required fields are set and have the Juju format
+func (t *Topology) Validate() error {
+	var problems []string
+	if t.Model == "" {
+		problems = append(problems, "model must be set")
+	}
+	if !modelUUIDPattern.MatchString(t.ModelUUID) {
+		problems = append(problems, fmt.Sprintf("invalid model UUID %q", t.ModelUUID))
+	}
+	if t.Application == "" {
+		problems = append(problems, "application must be set")
+	}
+	if t.Unit != "" {
+		m := unitNamePattern.FindStringSubmatch(t.Unit)
+		if m == nil {
+			problems = append(problems, fmt.Sprintf("invalid unit name %q", t.Unit))
+		} else if t.Application != "" && m[1] != t.Application {
+			problems = append(problems, fmt.Sprintf("unit %q does not belong to application %q", t.Unit, t.Application))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid topology: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// LabelMatchers returns the topology as juju_* label matchers. The unit is left out when
+// includeUnit is false, for application-level rules, or when it is not set, and the charm
+// name when it is not set.
+func (t *Topology) LabelMatchers(includeUnit bool) map[string]string {
+	matchers := map[string]string{
+		"juju_model":       t.Model,
+		"juju_model_uuid":  t.ModelUUID,
+		"juju_application": t.Application,
+	}
+	if includeUnit && t.Unit != "" {
+		matchers["juju_unit"] = t.Unit
+	}
+	if t.CharmName != "" {
+		matchers["juju_charm"] = t.CharmName
+	}
+	return matchers
+}
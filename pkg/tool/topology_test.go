@@ -0,0 +1,92 @@
+package tool_test
+
+import (
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+const testModelUUID = "1a2b3c4d-0000-4000-8000-123456789abc"
+
+func TestParseTopology(t *testing.T) {
+	expected := &tool.Topology{Model: "cos", ModelUUID: testModelUUID, Application: "proxy", Unit: "proxy/1", CharmName: "nginx"}
+
+	t.Run("plain keys", func(t *testing.T) {
+		topology, err := tool.ParseTopology([]byte(`{"model": "cos", "model_uuid": "` + testModelUUID + `", "application": "proxy", "unit": "proxy/1", "charm_name": "nginx"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, topology)
+	})
+
+	t.Run("label keys", func(t *testing.T) {
+		topology, err := tool.ParseTopology([]byte(`{"juju_model": "cos", "juju_model_uuid": "` + testModelUUID + `", "juju_application": "proxy", "juju_unit": "proxy/1", "juju_charm": "nginx"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, topology)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := tool.ParseTopology([]byte(`{"model": "cos", "region": "eu"}`))
+		assert.Error(t, err)
+	})
+
+	t.Run("malformed JSON", func(t *testing.T) {
+		_, err := tool.ParseTopology([]byte(`model=cos`))
+		assert.Error(t, err)
+	})
+}
+
+func TestTopologyFromEnv(t *testing.T) {
+	env := map[string]string{
+		tool.JujuModelNameEnv: "cos",
+		tool.JujuModelUUIDEnv: testModelUUID,
+		tool.JujuUnitNameEnv:  "grafana/2",
+	}
+	topology, err := tool.TopologyFromEnv(func(k string) string { return env[k] })
+	assert.NoError(t, err)
+	assert.Equal(t, &tool.Topology{Model: "cos", ModelUUID: testModelUUID, Application: "grafana", Unit: "grafana/2"}, topology)
+
+	_, err = tool.TopologyFromEnv(func(string) string { return "" })
+	assert.Error(t, err)
+}
+
+func TestTopologyValidate(t *testing.T) {
+	valid := tool.Topology{Model: "cos", ModelUUID: testModelUUID, Application: "proxy", Unit: "proxy/1"}
+	assert.NoError(t, valid.Validate())
+
+	tests := []struct {
+		name   string
+		modify func(*tool.Topology)
+		errMsg string
+	}{
+		{"missing model", func(t *tool.Topology) { t.Model = "" }, "model must be set"},
+		{"invalid UUID", func(t *tool.Topology) { t.ModelUUID = "12345" }, `invalid model UUID "12345"`},
+		{"missing application", func(t *tool.Topology) { t.Application = "" }, "application must be set"},
+		{"invalid unit name", func(t *tool.Topology) { t.Unit = "proxy-1" }, `invalid unit name "proxy-1"`},
+		{"unit of another application", func(t *tool.Topology) { t.Unit = "other/0" }, "does not belong to application"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topology := valid
+			tt.modify(&topology)
+			err := topology.Validate()
+			assert.ErrorContains(t, err, tt.errMsg)
+		})
+	}
+}
+
+func TestTopologyLabelMatchers(t *testing.T) {
+	topology := tool.Topology{Model: "cos", ModelUUID: testModelUUID, Application: "proxy", Unit: "proxy/1"}
+
+	assert.Equal(t, map[string]string{
+		"juju_model":       "cos",
+		"juju_model_uuid":  testModelUUID,
+		"juju_application": "proxy",
+		"juju_unit":        "proxy/1",
+	}, topology.LabelMatchers(true))
+
+	assert.NotContains(t, topology.LabelMatchers(false), "juju_unit")
+	assert.NotContains(t, topology.LabelMatchers(true), "juju_charm")
+
+	topology.CharmName = "nginx"
+	assert.Equal(t, "nginx", topology.LabelMatchers(false)["juju_charm"])
+}
@@ -0,0 +1,271 @@
+package tool
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	logqlparser "github.com/canonical/cos-tool/pkg/logql/syntax"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Untransform removes the matchers on the given labels from a PromQL or LogQL expression,
+// depending on checker, along with those labels in aggregation and vector matching clauses
+func Untransform(checker Checker, arg string, labelNames []string) (string, error) {
+	switch c := checker.(type) {
+	case *PromQL:
+		return c.untransform(arg, labelNames)
+	case *LogQL:
+		return c.untransform(arg, labelNames)
+	}
+	return arg, fmt.Errorf("untransforming is not supported by %T", checker)
+}
+
+// DefaultUntransformLabels are the labels stripped by Untransform when no label names are
+// given: the Juju topology labels injected by Transform
+var DefaultUntransformLabels = []string{"juju_*"}
+
+// labelNameFilter returns a predicate matching the given label names, where a name ending in
+// * matches every label with that prefix. The metric name is never matched.
+func labelNameFilter(names []string) func(string) bool {
+	if len(names) == 0 {
+		names = DefaultUntransformLabels
+	}
+	return func(name string) bool {
+		if name == labels.MetricName {
+			return false
+		}
+		for _, n := range names {
+			if prefix, ok := strings.CutSuffix(n, "*"); ok && strings.HasPrefix(name, prefix) {
+				return true
+			}
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// stripMatchers removes the matchers on stripped labels. Selectors that would be left without
+// any matcher are returned unchanged, as they would no longer be valid.
+func stripMatchers(matchers []*labels.Matcher, strip func(string) bool) []*labels.Matcher {
+	kept := slices.DeleteFunc(slices.Clone(matchers), func(m *labels.Matcher) bool { return strip(m.Name) })
+	if len(kept) == 0 {
+		return matchers
+	}
+	return kept
+}
+
+// stripLabelNames removes stripped labels from a by, without, on or ignoring label list
+func stripLabelNames(names []string, strip func(string) bool) []string {
+	return slices.DeleteFunc(names, strip)
+}
+
+// untransformVariableQuery strips matchers from the expression of a Grafana variable query.
+// The series selector of label_names and label_values is dropped altogether when only
+// stripped labels are left in it, undoing the selector added by Transform.
+func untransformVariableQuery(q grafanaVariableQuery, strip func(string) bool, untransform func(string) (string, error)) (string, error) {
+	if q.expr == "" || q.function == "metrics" {
+		return q.String(), nil
+	}
+
+	if q.function != "query_result" {
+		if matchers, err := parser.ParseMetricSelector(q.expr); err == nil && strings.HasPrefix(strings.TrimSpace(q.expr), "{") &&
+			!slices.ContainsFunc(matchers, func(m *labels.Matcher) bool { return !strip(m.Name) }) {
+			q.expr = ""
+			return q.String(), nil
+		}
+	}
+
+	expr, err := untransform(q.expr)
+	if err != nil {
+		return "", err
+	}
+	q.expr = expr
+	return q.String(), nil
+}
+
+// untransform removes the matchers on the given labels from every vector selector, along with
+// those labels in aggregation and vector matching clauses. Grafana variables are preserved.
+func (p *PromQL) untransform(arg string, labelNames []string) (string, error) {
+	strip := labelNameFilter(labelNames)
+
+	if q, ok := parseGrafanaVariableQuery(arg); ok {
+		result, err := untransformVariableQuery(q, strip, func(expr string) (string, error) {
+			return p.untransform(expr, labelNames)
+		})
+		if err != nil {
+			return arg, err
+		}
+		return result, nil
+	}
+
+	// Expressions without any stripped label are returned as-is rather than reformatted
+	changed := false
+	stripped := func(name string) bool {
+		if strip(name) {
+			changed = true
+			return true
+		}
+		return false
+	}
+
+	result, err := p.rewrite(arg, func(exp parser.Expr) {
+		parser.Inspect(exp, func(node parser.Node, _ []parser.Node) error {
+			switch e := node.(type) {
+			case *parser.VectorSelector:
+				e.LabelMatchers = stripMatchers(e.LabelMatchers, stripped)
+			case *parser.AggregateExpr:
+				// An empty by () is the same as no grouping, whereas an empty without () is not
+				e.Grouping = stripLabelNames(e.Grouping, stripped)
+			case *parser.BinaryExpr:
+				if vm := e.VectorMatching; vm != nil {
+					matching := stripLabelNames(slices.Clone(vm.MatchingLabels), stripped)
+					// An empty ignoring () is the same as no clause, but it cannot be printed
+					// with group_left or group_right, so the clause is kept as-is then
+					if len(matching) > 0 || vm.On || vm.Card == parser.CardOneToOne {
+						vm.MatchingLabels = matching
+					}
+					vm.Include = stripLabelNames(vm.Include, stripped)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil || !changed {
+		return arg, err
+	}
+	return result, nil
+}
+
+// untransform removes the matchers on the given labels from every stream selector, along with
+// those labels in aggregation and vector matching clauses. Grafana variables are preserved.
+func (p *LogQL) untransform(arg string, labelNames []string) (string, error) {
+	strip := labelNameFilter(labelNames)
+
+	if q, ok := parseGrafanaVariableQuery(arg); ok {
+		result, err := untransformVariableQuery(q, strip, func(expr string) (string, error) {
+			return p.untransform(expr, labelNames)
+		})
+		if err != nil {
+			return arg, err
+		}
+		return result, nil
+	}
+
+	// Expressions without any stripped label are returned as-is rather than reformatted
+	changed := false
+	stripped := func(name string) bool {
+		if strip(name) {
+			changed = true
+			return true
+		}
+		return false
+	}
+
+	result, err := p.rewrite(arg, func(exp logqlparser.Expr) {
+		exp.Walk(func(e interface{}) {
+			switch e := e.(type) {
+			case *logqlparser.MatchersExpr:
+				e.Mts = stripMatchers(e.Mts, stripped)
+			case *logqlparser.RangeAggregationExpr:
+				stripGrouping(e.Grouping, stripped)
+			case *logqlparser.VectorAggregationExpr:
+				stripGrouping(e.Grouping, stripped)
+			}
+		})
+		stripVectorMatching(exp, stripped)
+	})
+	if err != nil || !changed {
+		return arg, err
+	}
+	return result, nil
+}
+
+// stripGrouping removes stripped labels from a LogQL by or without clause
+func stripGrouping(g *logqlparser.Grouping, strip func(string) bool) {
+	if g != nil {
+		g.Groups = stripLabelNames(g.Groups, strip)
+	}
+}
+
+// stripVectorMatching removes stripped labels from the on, ignoring, group_left and group_right
+// clauses of LogQL binary operations
+func stripVectorMatching(e logqlparser.Expr, strip func(string) bool) {
+	walkVectorMatching(e, func(vm *logqlparser.VectorMatching) {
+		vm.MatchingLabels = stripLabelNames(vm.MatchingLabels, strip)
+		if len(vm.MatchingLabels) == 0 && !vm.On && vm.Card == logqlparser.CardOneToOne {
+			// An empty ignoring () is the same as no clause, whereas an empty on () is not
+			vm.MatchingLabels = nil
+		}
+		if vm.Include != nil {
+			vm.Include = stripLabelNames(vm.Include, strip)
+		}
+	})
+}
+
+// walkVectorMatching calls f with the vector matching clause of every LogQL binary operation,
+// which Walk does not visit
+func walkVectorMatching(e logqlparser.Expr, f func(*logqlparser.VectorMatching)) {
+	switch e := e.(type) {
+	case *logqlparser.BinOpExpr:
+		if e.Opts != nil && e.Opts.VectorMatching != nil {
+			f(e.Opts.VectorMatching)
+		}
+		walkVectorMatching(e.SampleExpr, f)
+		walkVectorMatching(e.RHS, f)
+	case *logqlparser.VectorAggregationExpr:
+		walkVectorMatching(e.Left, f)
+	case *logqlparser.LabelReplaceExpr:
+		walkVectorMatching(e.Left, f)
+	}
+}
+
+// UntransformRules removes the matchers on the given labels from the expressions of a rule file,
+// and those labels from the labels of its alerts. Group names are left unchanged, since the
+// naming convention they follow cannot be recovered from the rule file alone.
+func UntransformRules(checker Checker, filename string, data []byte, labelNames []string) ([]byte, error) {
+	if _, err := checker.ValidateRules(filename, data); err != nil {
+		return nil, err
+	}
+
+	doc, err := parseRuleFileDocument(data)
+	if err != nil {
+		return nil, fmt.Errorf("error untransforming %s: %w", filename, err)
+	}
+
+	strip := labelNameFilter(labelNames)
+	for _, group := range ruleFileGroups(doc) {
+		for j, rule := range sequenceContent(mappingValue(group, "rules")) {
+			if exprNode := mappingValue(rule, "expr"); exprNode != nil {
+				expr, err := Untransform(checker, exprNode.Value, labelNames)
+				if err != nil {
+					return nil, fmt.Errorf("error untransforming %s: group %q, rule %d: %w", filename, scalarValue(group, "name"), j+1, err)
+				}
+				setScalar(exprNode, expr)
+			}
+
+			labels := mappingValue(rule, "labels")
+			if mappingValue(rule, "alert") == nil || labels == nil || labels.Kind != yaml.MappingNode {
+				continue
+			}
+			for i := len(labels.Content) - 2; i >= 0; i -= 2 {
+				if strip(labels.Content[i].Value) {
+					deleteMappingKey(labels, labels.Content[i].Value)
+				}
+			}
+			if len(labels.Content) == 0 {
+				deleteMappingKey(rule, "labels")
+			}
+		}
+	}
+
+	out, err := encodeRuleFile(doc)
+	if err != nil {
+		return nil, fmt.Errorf("error untransforming %s: %w", filename, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,183 @@
+package tool_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromQLUntransform(t *testing.T) {
+	tests := []struct {
+		name       string
+		expr       string
+		labelNames []string
+		expected   string
+	}{
+		{
+			name:     "Topology matchers",
+			expr:     `up{job="x",juju_model="cos",juju_model_uuid="1234",juju_application="proxy"}`,
+			expected: `up{job="x"}`,
+		},
+		{
+			name:     "Grouping and vector matching",
+			expr:     `sum by (juju_unit, job) (a{juju_model="cos"}) / ignoring (juju_unit) sum by (juju_unit, job) (b{juju_model="cos"})`,
+			expected: `sum by (job) (a) / sum by (job) (b)`,
+		},
+		{
+			name:     "Empty without is kept",
+			expr:     `count without (juju_unit) (up{job="x"})`,
+			expected: `count without () (up{job="x"})`,
+		},
+		{
+			name:     "Ignoring is kept with group_left",
+			expr:     `a * ignoring (juju_unit) group_left (juju_application) b`,
+			expected: `a * ignoring (juju_unit) group_left () b`,
+		},
+		{
+			name:     "Selector left empty is unchanged",
+			expr:     `count({juju_model="cos"})`,
+			expected: `count({juju_model="cos"})`,
+		},
+		{
+			name:     "Variables are preserved",
+			expr:     `rate(http_requests_total{job=~"$job",juju_model=~"$juju_model"}[$__rate_interval])`,
+			expected: `rate(http_requests_total{job=~"$job"}[$__rate_interval])`,
+		},
+		{
+			name:     "Expressions without stripped labels are not reformatted",
+			expr:     `sum(rate(up{job="x", instance="y"}[5m]))`,
+			expected: `sum(rate(up{job="x", instance="y"}[5m]))`,
+		},
+		{
+			name:       "Given label names",
+			expr:       `up{job="x",instance="y",juju_model="cos"}`,
+			labelNames: []string{"instance"},
+			expected:   `up{job="x",juju_model="cos"}`,
+		},
+		{
+			name:       "Label name prefix",
+			expr:       `up{job="x",k8s_namespace="a",k8s_pod="b"}`,
+			labelNames: []string{"k8s_*"},
+			expected:   `up{job="x"}`,
+		},
+		{
+			name:     "Variable query selector is dropped",
+			expr:     `label_values({juju_model="cos",juju_application="proxy"}, instance)`,
+			expected: `label_values(instance)`,
+		},
+		{
+			name:     "Variable query expression",
+			expr:     `label_values(up{juju_model="cos"}, instance)`,
+			expected: `label_values(up, instance)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := tool.Untransform(&tool.PromQL{}, tt.expr, tt.labelNames)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+}
+
+func TestPromQLUntransformRoundTrip(t *testing.T) {
+	p := &tool.PromQL{}
+	expr := `sum by (job) (rate(http_requests_total{job=~"$job"}[$__rate_interval]))`
+
+	transformed, err := p.Transform(expr, &testTopologyMatchers)
+	assert.NoError(t, err)
+	assert.Contains(t, transformed, "juju_model")
+
+	untransformed, err := tool.Untransform(p, transformed, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expr, untransformed)
+}
+
+func TestLogQLUntransform(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "Stream selector",
+			expr:     `{app="$app", juju_model="cos", juju_unit="proxy/0"} |= "error"`,
+			expected: `{app="$app"} |= "error"`,
+		},
+		{
+			name:     "Grouping",
+			expr:     `sum by (juju_unit, app) (rate({app="x", juju_model="cos"}[5m]))`,
+			expected: `sum by(app)(rate({app="x"}[5m]))`,
+		},
+		{
+			name:     "Vector matching",
+			expr:     `sum by (app) (rate({app="x"}[5m])) / ignoring (juju_unit) sum by (app) (rate({app="y"}[5m]))`,
+			expected: `(sum by(app)(rate({app="x"}[5m])) / sum by(app)(rate({app="y"}[5m])))`,
+		},
+		{
+			name:     "Variable query selector is dropped",
+			expr:     `label_values({juju_model="cos"}, app)`,
+			expected: `label_values(app)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := tool.Untransform(&tool.LogQL{}, tt.expr, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, out)
+		})
+	}
+}
+
+func TestUntransformRules(t *testing.T) {
+	fp := filepath.Join("testdata/prom_alerts", "basic.yaml")
+	opts := tool.RuleTransformOptions{Matchers: testTopologyMatchers, GroupNameTemplate: tool.DefaultGroupNameTemplate}
+
+	transformed, err := tool.TransformRules(&tool.PromQL{}, fp, readFile(fp), opts)
+	assert.NoError(t, err)
+
+	out, err := tool.UntransformRules(&tool.PromQL{}, fp, transformed, nil)
+	assert.NoError(t, err)
+
+	rgs := parseRuleGroups(t, out)
+	assert.Equal(t, "cos_"+testModelUUID+"_proxy_test", rgs.Groups[0].Name, "group names are left unchanged")
+
+	rule := rgs.Groups[0].Rules[0]
+	assert.Equal(t, `process_cpu_seconds_total > 0.12`, rule.Expr)
+	assert.Equal(t, map[string]string{"severity": "Low"}, rule.Labels)
+}
+
+func TestUntransformDashboard(t *testing.T) {
+	fp := filepath.Join("testdata/dashboards", "topology.json")
+
+	out, err := tool.RewriteDashboard(fp, readFile(fp), func(expr string, logql bool) (string, error) {
+		if logql {
+			return tool.Untransform(&tool.LogQL{}, expr, nil)
+		}
+		return tool.Untransform(&tool.PromQL{}, expr, nil)
+	})
+	assert.NoError(t, err)
+	assert.True(t, json.Valid(out))
+
+	d, err := tool.ParseDashboard(out)
+	assert.NoError(t, err)
+	assert.Equal(t, []tool.DashboardTarget{
+		{Panel: "Requests", RefID: "A", Expr: `sum by (job) (rate(http_requests_total{job=~"$job"}[$__rate_interval])) > 0`},
+		{Panel: "Errors", RefID: "A", Expr: `{app="$app"} |= "error"`, LogQL: true},
+	}, d.Targets)
+
+	queries := map[string]string{}
+	for _, v := range d.Variables {
+		queries[v.Name] = v.QueryString()
+	}
+	assert.Equal(t, "label_values(up, job)", queries["job"])
+	assert.Equal(t, "label_values(juju_unit)", queries["juju_unit"])
+	assert.Equal(t, "label_values(app)", queries["app"])
+	assert.Contains(t, string(out), `"definition": "label_values(up, job)"`)
+	assert.Contains(t, string(out), `> 0`, "HTML characters must not be escaped")
+}
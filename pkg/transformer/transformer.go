@@ -0,0 +1,180 @@
+// Package transformer injects label matchers into PromQL and LogQL expressions, rule files and
+// Grafana dashboards, for programs embedding cos-tool as a library.
+//
+// A Transformer is configured once with options and never modified afterwards, so a single
+// Transformer may be shared by any number of goroutines:
+//
+//	t, err := transformer.New(
+//		transformer.WithLabelMatchers(topology.LabelMatchers(true)),
+//		transformer.WithInjectionRules(rules),
+//	)
+//	...
+//	result, err := t.Transform(ctx, `rate(http_requests_total[5m])`)
+package transformer
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+)
+
+// Format is the query language of expressions and rule files
+type Format string
+
+const (
+	PromQL Format = "promql"
+	LogQL  Format = "logql"
+)
+
+// Transformer injects label matchers. It is immutable and safe for concurrent use.
+type Transformer struct {
+	format            Format
+	matchers          map[string]string
+	injectionRules    *tool.InjectionRules
+	variables         *tool.GrafanaVariables
+	groupNameTemplate string
+}
+
+// Option configures a Transformer
+type Option func(*Transformer)
+
+// WithFormat sets the query language of expressions and rule files, PromQL by default.
+// Dashboard targets are always transformed according to their data source.
+func WithFormat(format Format) Option {
+	return func(t *Transformer) {
+		t.format = format
+	}
+}
+
+// WithLabelMatchers adds equality matchers to inject, such as the matchers of a Juju topology.
+// Later options override the values of earlier ones.
+func WithLabelMatchers(matchers map[string]string) Option {
+	return func(t *Transformer) {
+		maps.Copy(t.matchers, matchers)
+	}
+}
+
+// WithInjectionRules scopes which selectors get which matchers. The rules must not be modified
+// afterwards.
+func WithInjectionRules(rules *tool.InjectionRules) Option {
+	return func(t *Transformer) {
+		t.injectionRules = rules
+	}
+}
+
+// WithVariables makes Transform interpolate the Grafana template variables which have a value
+// before transforming expressions. Without it, and in dashboards, variables are kept as they are.
+func WithVariables(vars tool.GrafanaVariables) Option {
+	return func(t *Transformer) {
+		values := make(map[string][]string, len(vars.Values))
+		for name, v := range vars.Values {
+			values[name] = append([]string(nil), v...)
+		}
+		t.variables = &tool.GrafanaVariables{Values: values, AllValue: vars.AllValue}
+	}
+}
+
+// WithGroupNameTemplate renames the groups of rule files, see tool.RuleTransformOptions
+func WithGroupNameTemplate(template string) Option {
+	return func(t *Transformer) {
+		t.groupNameTemplate = template
+	}
+}
+
+// Result is the output of a transformation
+type Result struct {
+	Output string
+	// Changed is set if Output differs from the input
+	Changed bool
+}
+
+func newResult(input, output string) Result {
+	return Result{Output: output, Changed: output != input}
+}
+
+// New returns a Transformer configured by opts
+func New(opts ...Option) (*Transformer, error) {
+	t := &Transformer{format: PromQL, matchers: map[string]string{}}
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if t.format != PromQL && t.format != LogQL {
+		return nil, fmt.Errorf("unsupported format %q", t.format)
+	}
+	return t, nil
+}
+
+// checker returns a new checker for format, as checkers keep the state of a transformation
+func (t *Transformer) checker(format Format) tool.Checker {
+	if format == LogQL {
+		return &tool.LogQL{}
+	}
+	return &tool.PromQL{}
+}
+
+// transform transforms a single expression with a new checker
+func (t *Transformer) transform(format Format, expr string) (string, error) {
+	matchers := maps.Clone(t.matchers)
+	return tool.TransformWithRules(t.checker(format), expr, &matchers, t.injectionRules)
+}
+
+// Transform injects the label matchers into an expression, or a Grafana variable query such
+// as label_values(up, job)
+func (t *Transformer) Transform(ctx context.Context, expr string) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	input := expr
+	if t.variables != nil {
+		var err error
+		if input, err = t.variables.Interpolate(expr); err != nil {
+			return Result{}, err
+		}
+	}
+
+	output, err := t.transform(t.format, input)
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(expr, output), nil
+}
+
+// TransformRules injects the label matchers into the expressions and alert labels of a rule
+// file, and renames its groups if a group name template is set
+func (t *Transformer) TransformRules(ctx context.Context, filename string, data []byte) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	output, err := tool.TransformRules(t.checker(t.format), filename, data, tool.RuleTransformOptions{
+		Matchers:          maps.Clone(t.matchers),
+		GroupNameTemplate: t.groupNameTemplate,
+		InjectionRules:    t.injectionRules,
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(string(data), string(output)), nil
+}
+
+// TransformDashboard injects the label matchers into the targets and variable queries of a
+// Grafana dashboard, as PromQL or LogQL depending on their data source
+func (t *Transformer) TransformDashboard(ctx context.Context, filename string, data []byte) (Result, error) {
+	output, err := tool.RewriteDashboard(filename, data, func(expr string, isLogQL bool) (string, error) {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if isLogQL {
+			return t.transform(LogQL, expr)
+		}
+		return t.transform(PromQL, expr)
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(string(data), string(output)), nil
+}
@@ -0,0 +1,163 @@
+package transformer_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/canonical/cos-tool/pkg/tool"
+	"github.com/canonical/cos-tool/pkg/transformer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, path string) []byte {
+	data, err := os.ReadFile(filepath.Join("../tool/testdata", path))
+	require.NoError(t, err)
+	return data
+}
+
+func TestNew(t *testing.T) {
+	_, err := transformer.New(transformer.WithFormat("sql"))
+	assert.EqualError(t, err, `unsupported format "sql"`)
+}
+
+func TestTransform(t *testing.T) {
+	ctx := context.Background()
+	tr, err := transformer.New(transformer.WithLabelMatchers(map[string]string{"juju_model": "lma"}))
+	require.NoError(t, err)
+
+	result, err := tr.Transform(ctx, `rate(up[5m])`)
+	assert.NoError(t, err)
+	assert.Equal(t, transformer.Result{Output: `rate(up{juju_model="lma"}[5m])`, Changed: true}, result)
+
+	result, err = tr.Transform(ctx, result.Output)
+	assert.NoError(t, err)
+	assert.False(t, result.Changed, "transforming a transformed expression must be a no-op")
+
+	_, err = tr.Transform(ctx, `rate(up[5m]`)
+	assert.Error(t, err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = tr.Transform(cancelled, `up`)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTransformOptions(t *testing.T) {
+	ctx := context.Background()
+
+	matchers := map[string]string{"juju_model": "lma"}
+	tr, err := transformer.New(
+		transformer.WithFormat(transformer.LogQL),
+		transformer.WithLabelMatchers(matchers),
+		transformer.WithLabelMatchers(map[string]string{"juju_application": "loki"}),
+	)
+	require.NoError(t, err)
+
+	// The transformer must not see later changes to its options
+	matchers["juju_model"] = "cos"
+
+	result, err := tr.Transform(ctx, `{app="x"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, `{app="x", juju_application="loki", juju_model="lma"}`, result.Output)
+}
+
+func TestTransformInjectionRules(t *testing.T) {
+	rules, err := tool.LoadInjectionRules(readFile(t, "injection_rules/basic.yaml"))
+	require.NoError(t, err)
+
+	tr, err := transformer.New(
+		transformer.WithLabelMatchers(map[string]string{"juju_model": "lma"}),
+		transformer.WithInjectionRules(rules),
+	)
+	require.NoError(t, err)
+
+	result, err := tr.Transform(context.Background(), `node_load1 > on() absent(up)`)
+	assert.NoError(t, err)
+	assert.Equal(t, `node_load1{juju_application="node-exporter"} > on () absent(up)`, result.Output)
+}
+
+func TestTransformVariables(t *testing.T) {
+	vars, err := tool.GetGrafanaVariables([]string{"job=api", "threshold=3"}, ".*")
+	require.NoError(t, err)
+
+	tr, err := transformer.New(
+		transformer.WithLabelMatchers(map[string]string{"juju_model": "lma"}),
+		transformer.WithVariables(vars),
+	)
+	require.NoError(t, err)
+
+	// The transformer must not see later changes to its options
+	vars.Values["job"][0] = "web"
+
+	result, err := tr.Transform(context.Background(), `up{job="$job"} > $threshold`)
+	assert.NoError(t, err)
+	assert.Equal(t, `up{job="api",juju_model="lma"} > 3`, result.Output)
+}
+
+func TestTransformRules(t *testing.T) {
+	tr, err := transformer.New(
+		transformer.WithLabelMatchers(map[string]string{"juju_model": "lma"}),
+		transformer.WithGroupNameTemplate(`{{ .juju_model }}_{{ .group }}`),
+	)
+	require.NoError(t, err)
+
+	result, err := tr.TransformRules(context.Background(), "basic.yaml", readFile(t, "prom_alerts/basic.yaml"))
+	assert.NoError(t, err)
+	assert.True(t, result.Changed)
+	assert.Contains(t, result.Output, `name: lma_test`)
+	assert.Contains(t, result.Output, `expr: process_cpu_seconds_total{juju_model="lma"} > 0.12`)
+}
+
+func TestTransformDashboard(t *testing.T) {
+	tr, err := transformer.New(transformer.WithLabelMatchers(map[string]string{"juju_application": "proxy"}))
+	require.NoError(t, err)
+
+	data := readFile(t, "dashboards/valid.json")
+	result, err := tr.TransformDashboard(context.Background(), "valid.json", data)
+	assert.NoError(t, err)
+	assert.True(t, result.Changed)
+
+	d, err := tool.ParseDashboard([]byte(result.Output))
+	assert.NoError(t, err)
+	assert.Contains(t, d.Targets[0].Expr, `juju_application="proxy"`)
+	assert.Contains(t, d.Targets[1].Expr, `juju_application="proxy"`)
+
+	again, err := tr.TransformDashboard(context.Background(), "valid.json", []byte(result.Output))
+	assert.NoError(t, err)
+	assert.False(t, again.Changed, "transforming a transformed dashboard must be a no-op")
+}
+
+func TestTransformConcurrent(t *testing.T) {
+	rules, err := tool.LoadInjectionRules(readFile(t, "injection_rules/basic.yaml"))
+	require.NoError(t, err)
+	tr, err := transformer.New(
+		transformer.WithLabelMatchers(map[string]string{"juju_model": "lma"}),
+		transformer.WithInjectionRules(rules),
+	)
+	require.NoError(t, err)
+
+	dashboard := readFile(t, "dashboards/valid.json")
+	expected, err := tr.TransformDashboard(context.Background(), "valid.json", dashboard)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := tr.Transform(context.Background(), fmt.Sprintf(`sum(rate(requests_%d[5m]))`, i))
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf(`sum(rate(requests_%d{juju_model="lma"}[5m]))`, i), result.Output)
+
+			result, err = tr.TransformDashboard(context.Background(), "valid.json", dashboard)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, result)
+		}()
+	}
+	wg.Wait()
+}